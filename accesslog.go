@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accessLog receives one Combined Log Format line per request, nil when
+// ACCESS_LOG is unset.
+var accessLog *log.Logger
+
+// openAccessLog opens the ACCESS_LOG destination: stdout, stderr or a file
+// that lines are appended to.
+func openAccessLog(dest string) (*log.Logger, error) {
+	var w io.Writer
+	switch dest {
+	case "":
+		return nil, nil
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return log.New(w, "", 0), nil
+}
+
+// withAccessLog writes an access log line for every request once it is
+// answered, in addition to the gateway's own logs.
+func withAccessLog(handler http.Handler) http.Handler {
+	if accessLog == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+		handler.ServeHTTP(rec, r)
+		accessLog.Print(redactLine(combinedLogLine(r, rec.status, rec.bytes, start, time.Since(start))))
+	})
+}
+
+// combinedLogLine formats a request in the Combined Log Format, followed by
+// the time taken in microseconds (Apache's %D):
+//
+//	203.0.113.7 - - [10/Oct/2024:13:55:36 +0000] "POST /v1/messages HTTP/1.1" 200 2326 "-" "curl/8.5.0" 523041
+//
+// The user field stays empty and the path is sanitized since API keys must
+// not reach the logs.
+func combinedLogLine(r *http.Request, status int, bytes int64, start time.Time, d time.Duration) string {
+	if status == 0 {
+		status = http.StatusOK
+		// WebSocket 握手在接管连接后直接写出，记录为 101
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && bytes == 0 {
+			status = http.StatusSwitchingProtocols
+		}
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s %s %s %d",
+		clientIP(r),
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		clfQuote(r.Method+" "+sanitizedRequestURI(r)+" "+r.Proto),
+		status,
+		size,
+		clfQuote(r.Referer()),
+		clfQuote(r.UserAgent()),
+		d.Microseconds(),
+	)
+}
+
+// sanitizedRequestURI returns the request URI with the key segment of the
+// /v1/keys/{id} admin routes replaced by its key ID, unless it already is a
+// key ID or hash. The routes take no plaintext keys, but a client may still
+// send one.
+func sanitizedRequestURI(r *http.Request) string {
+	uri := r.RequestURI
+	before, rest, ok := strings.Cut(uri, "/v1/keys/")
+	if !ok {
+		return uri
+	}
+	end := strings.IndexAny(rest, "/?")
+	if end < 0 {
+		end = len(rest)
+	}
+	key := rest[:end]
+	if unescaped, err := url.PathUnescape(key); err == nil {
+		key = unescaped
+	}
+	if !isKeyID(key) && !isKeyHash(key) {
+		key = keyID(key)
+	}
+	return before + "/v1/keys/" + key + rest[end:]
+}
+
+// clfQuote quotes a field, escaping quotes and control characters so a
+// client can't forge log lines; empty fields become "-".
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// accessRecorder captures the status and body size written by a handler.
+// Flush is passed on directly since the streaming code checks for
+// http.Flusher; Hijack and deadlines go through Unwrap.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *accessRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *accessRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *accessRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *accessRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
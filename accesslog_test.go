@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCombinedLogLine(t *testing.T) {
+	start := time.Date(2024, 10, 10, 13, 55, 36, 0, time.UTC)
+	id := keyID("sk-live-secret")
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header map[string]string
+		status int
+		bytes  int64
+		want   string
+	}{
+		{
+			name:   "messages request",
+			method: http.MethodPost, target: "/v1/messages",
+			header: map[string]string{"User-Agent": "curl/8.5.0", "Referer": "https://app.example/chat"},
+			status: http.StatusOK, bytes: 2326,
+			want: `192.0.2.1 - - [10/Oct/2024:13:55:36 +0000] "POST /v1/messages HTTP/1.1" 200 2326 "https://app.example/chat" "curl/8.5.0" 523041`,
+		},
+		{
+			name:   "empty fields",
+			method: http.MethodGet, target: "/health",
+			want: `192.0.2.1 - - [10/Oct/2024:13:55:36 +0000] "GET /health HTTP/1.1" 200 - "-" "-" 523041`,
+		},
+		{
+			name:   "forged line in the user agent",
+			method: http.MethodGet, target: "/v1/pricing",
+			header: map[string]string{"User-Agent": "x\" 200 1\n10.0.0.1 - - \"GET /"},
+			status: http.StatusNotFound, bytes: 9,
+			want: `192.0.2.1 - - [10/Oct/2024:13:55:36 +0000] "GET /v1/pricing HTTP/1.1" 404 9 "-" "x\" 200 1\n10.0.0.1 - - \"GET /" 523041`,
+		},
+		{
+			name:   "plaintext key in an admin path",
+			method: http.MethodDelete, target: "/v1/keys/sk-live-secret?force=1",
+			status: http.StatusNoContent,
+			want:   `192.0.2.1 - - [10/Oct/2024:13:55:36 +0000] "DELETE /v1/keys/` + id + `?force=1 HTTP/1.1" 204 - "-" "-" 523041`,
+		},
+		{
+			name:   "key ID in an admin path",
+			method: http.MethodGet, target: "/v1/keys/" + id + "/usage",
+			status: http.StatusOK, bytes: 12,
+			want: `192.0.2.1 - - [10/Oct/2024:13:55:36 +0000] "GET /v1/keys/` + id + `/usage HTTP/1.1" 200 12 "-" "-" 523041`,
+		},
+		{
+			name:   "WebSocket upgrade",
+			method: http.MethodGet, target: "/v1/messages/ws",
+			header: map[string]string{"Upgrade": "websocket"},
+			want:   `192.0.2.1 - - [10/Oct/2024:13:55:36 +0000] "GET /v1/messages/ws HTTP/1.1" 101 - "-" "-" 523041`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if got := combinedLogLine(r, tt.status, tt.bytes, start, 523041*time.Microsecond); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	swap(t, &accessLog, log.New(&buf, "", 0))
+	handler := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "hello")
+		io.WriteString(w, " world")
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/v1/keys", strings.NewReader(`{}`))
+	r.Header.Set("User-Agent", "admin-cli/1.0")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	line := regexp.MustCompile(`^192\.0\.2\.1 - - \[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /v1/keys HTTP/1\.1" 201 11 "-" "admin-cli/1\.0" \d+\n$`)
+	if !line.MatchString(buf.String()) {
+		t.Errorf("access log %q is not a Combined Log Format line", buf.String())
+	}
+}
+
+func TestOpenAccessLog(t *testing.T) {
+	if l, err := openAccessLog(""); l != nil || err != nil {
+		t.Errorf("openAccessLog(\"\") = %v, %v, want access logging off", l, err)
+	}
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(path, []byte("earlier line\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := openAccessLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Print("new line")
+	if got, _ := os.ReadFile(path); string(got) != "earlier line\nnew line\n" {
+		t.Errorf("file holds %q, want the line appended", got)
+	}
+	if _, err := openAccessLog(filepath.Join(t.TempDir(), "missing", "access.log")); err == nil {
+		t.Error("unwritable destination accepted")
+	}
+}
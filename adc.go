@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Application Default Credentials, used when no service account key is set
+// through GC_* variables. They are looked up in the order Google's client
+// libraries use: the GOOGLE_APPLICATION_CREDENTIALS file, gcloud's
+// well-known file, then the GCE metadata server (GKE workload identity,
+// Cloud Run).
+
+// credentialsFile is the subset of a Google credentials JSON file the gateway
+// understands.
+type credentialsFile struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// wellKnownCredentialsFile is where `gcloud auth application-default login`
+// stores user credentials.
+func wellKnownCredentialsFile() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return filepath.Join(dir, "application_default_credentials.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+// defaultTokenProvider resolves Application Default Credentials.
+func defaultTokenProvider() (TokenProvider, error) {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return credentialsFromFile(path)
+	}
+	if path := wellKnownCredentialsFile(); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			return credentialsFromFile(path)
+		}
+	}
+	return metadataTokenProvider{}, nil
+}
+
+func credentialsFromFile(path string) (TokenProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading credentials file: %w", err)
+	}
+	var creds credentialsFile
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("parsing credentials file %s: %w", path, err)
+	}
+	switch creds.Type {
+	case "service_account":
+		return &googleTokenProvider{
+			clientEmail:   creds.ClientEmail,
+			privateKeyPEM: creds.PrivateKey,
+			privateKeyID:  creds.PrivateKeyID,
+		}, nil
+	case "authorized_user":
+		return &refreshTokenProvider{
+			clientID:     creds.ClientID,
+			clientSecret: creds.ClientSecret,
+			refreshToken: creds.RefreshToken,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported credentials type %q in %s", creds.Type, path)
+	}
+}
+
+// refreshTokenProvider exchanges a user's OAuth refresh token for access
+// tokens.
+type refreshTokenProvider struct {
+	clientID     string
+	clientSecret string
+	refreshToken string
+}
+
+func (p *refreshTokenProvider) AccessToken(ctx context.Context) (string, time.Time, error) {
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("client_id", p.clientID)
+	data.Set("client_secret", p.clientSecret)
+	data.Set("refresh_token", p.refreshToken)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doTokenRequest(req)
+}
+
+// metadataHost is the GCE metadata server. GCE_METADATA_HOST overrides it,
+// as it does for Google's client libraries.
+func metadataHost() string {
+	if host := os.Getenv("GCE_METADATA_HOST"); host != "" {
+		return host
+	}
+	return "metadata.google.internal"
+}
+
+// metadataTokenProvider gets tokens for the attached service account from the
+// metadata server.
+type metadataTokenProvider struct{}
+
+func (metadataTokenProvider) AccessToken(ctx context.Context) (string, time.Time, error) {
+	u := "http://" + metadataHost() + "/computeMetadata/v1/instance/service-accounts/default/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return doTokenRequest(req)
+}
+
+// doTokenRequest sends a token request and extracts access_token from the
+// JSON response, with the expiry its expires_in gives, zero without one.
+func doTokenRequest(req *http.Request) (string, time.Time, error) {
+	sent := time.Now()
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("token request failed: status=%d, body=%s", resp.StatusCode, body)
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing response: %w", err)
+	}
+	var expiry time.Time
+	// 有效期从发出请求时算起，避免网络延迟使到期时间偏晚
+	if tokenResp.ExpiresIn > 0 {
+		expiry = sent.Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	}
+	return tokenResp.AccessToken, expiry, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearCredentialsEnv unsets every variable the credential lookup reads and
+// points gcloud's configuration at an empty directory.
+func clearCredentialsEnv(t *testing.T) string {
+	t.Helper()
+	for _, name := range []string{"STATIC_ACCESS_TOKEN", "GC_CLIENT_EMAIL", "GC_PRIVATE_KEY", "GC_PRIVATE_KEY_ID", "GOOGLE_APPLICATION_CREDENTIALS"} {
+		t.Setenv(name, "")
+	}
+	dir := t.TempDir()
+	t.Setenv("CLOUDSDK_CONFIG", dir)
+	return dir
+}
+
+func TestNewTokenProvider(t *testing.T) {
+	serviceAccount := `{"type":"service_account","client_email":"sa@test.iam.gserviceaccount.com","private_key":"key","private_key_id":"kid"}`
+	tests := []struct {
+		name      string
+		env       map[string]string
+		adcFile   string // GOOGLE_APPLICATION_CREDENTIALS 的内容
+		wellKnown string // gcloud 默认凭据文件的内容
+		want      string
+		wantErr   bool
+	}{
+		{name: "static token", env: map[string]string{"STATIC_ACCESS_TOKEN": "t", "GC_CLIENT_EMAIL": "sa", "GC_PRIVATE_KEY": "k"}, want: "main.staticTokenProvider"},
+		{name: "GC_* service account", env: map[string]string{"GC_CLIENT_EMAIL": "sa", "GC_PRIVATE_KEY": "k"}, adcFile: serviceAccount, want: "*main.googleTokenProvider"},
+		{name: "GC_* incomplete falls back to ADC", env: map[string]string{"GC_CLIENT_EMAIL": "sa"}, want: "main.metadataTokenProvider"},
+		{name: "credentials file with a service account", adcFile: serviceAccount, want: "*main.googleTokenProvider"},
+		{name: "credentials file with a user", adcFile: `{"type":"authorized_user","client_id":"id","client_secret":"s","refresh_token":"r"}`, want: "*main.refreshTokenProvider"},
+		{name: "unsupported credentials", adcFile: `{"type":"external_account"}`, wantErr: true},
+		{name: "invalid credentials file", adcFile: `{`, wantErr: true},
+		{name: "gcloud credentials", wellKnown: `{"type":"authorized_user","refresh_token":"r"}`, want: "*main.refreshTokenProvider"},
+		{name: "metadata server", want: "main.metadataTokenProvider"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := clearCredentialsEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			if tt.adcFile != "" {
+				path := filepath.Join(t.TempDir(), "credentials.json")
+				os.WriteFile(path, []byte(tt.adcFile), 0o600)
+				t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path)
+			}
+			if tt.wellKnown != "" {
+				os.WriteFile(filepath.Join(dir, "application_default_credentials.json"), []byte(tt.wellKnown), 0o600)
+			}
+			provider, err := newTokenProvider()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got := fmt.Sprintf("%T", provider); !tt.wantErr && got != tt.want {
+				t.Errorf("provider %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataTokenProvider(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantToken string
+		wantErr   bool
+	}{
+		{"token", http.StatusOK, `{"access_token":"ya29.metadata","expires_in":3599,"token_type":"Bearer"}`, "ya29.metadata", false},
+		{"no service account", http.StatusNotFound, "not found", "", true},
+		{"malformed answer", http.StatusOK, `{"access_token":`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Metadata-Flavor") != "Google" {
+					t.Error("request without Metadata-Flavor: Google")
+				}
+				if r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+					t.Errorf("path %s", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+			token, expiry, err := metadataTokenProvider{}.AccessToken(context.Background())
+			if (err != nil) != tt.wantErr || token != tt.wantToken {
+				t.Fatalf("got %q, %v; want %q", token, err, tt.wantToken)
+			}
+			if !tt.wantErr && time.Until(expiry) < 59*time.Minute {
+				t.Errorf("expiry %v, want an hour from now", expiry)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenProvider(t *testing.T) {
+	stubTokenEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "r" || r.PostForm.Get("client_id") != "id" {
+			t.Errorf("unexpected token request %v", r.PostForm)
+		}
+		w.Write([]byte(`{"access_token":"ya29.user","expires_in":3600}`))
+	})
+	p := &refreshTokenProvider{clientID: "id", clientSecret: "s", refreshToken: "r"}
+	if token, _, err := p.AccessToken(context.Background()); err != nil || token != "ya29.user" {
+		t.Errorf("got %q, %v", token, err)
+	}
+}
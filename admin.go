@@ -0,0 +1,24 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin guards operator endpoints with the ADMIN_TOKEN bearer token.
+// Admin endpoints are disabled entirely when no token is configured.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg().AdminToken == "" {
+			respondError(w, r, notFound("Not found"))
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg().AdminToken)) != 1 {
+			respondError(w, r, unauthenticated("Invalid admin token"))
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// priority is the scheduling class a client requests with X-Priority.
+type priority int
+
+const (
+	priorityInteractive priority = iota
+	priorityBatch
+)
+
+func (p priority) String() string {
+	if p == priorityBatch {
+		return "batch"
+	}
+	return "interactive"
+}
+
+// parsePriority reads an X-Priority value; anything but "batch" is
+// interactive.
+func parsePriority(v string) priority {
+	if strings.EqualFold(strings.TrimSpace(v), "batch") {
+		return priorityBatch
+	}
+	return priorityInteractive
+}
+
+// admissionQueue caps the number of requests in flight to the upstream
+// across all keys. When it is full, requests wait in FIFO order per
+// priority and freed slots go to interactive waiters before batch ones.
+type admissionQueue struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiting [2][]chan struct{}
+}
+
+func newAdmissionQueue(limit int) *admissionQueue {
+	return &admissionQueue{limit: limit}
+}
+
+// Acquire waits for a slot until ctx is done. Batch requests never overtake
+// waiting interactive ones.
+func (q *admissionQueue) Acquire(ctx context.Context, p priority) error {
+	q.mu.Lock()
+	if q.active < q.limit && len(q.waiting[priorityInteractive]) == 0 && (p == priorityInteractive || len(q.waiting[priorityBatch]) == 0) {
+		q.active++
+		q.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	q.waiting[p] = append(q.waiting[p], ready)
+	q.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		for i, ch := range q.waiting[p] {
+			if ch == ready {
+				q.waiting[p] = append(q.waiting[p][:i], q.waiting[p][i+1:]...)
+				q.mu.Unlock()
+				return ctx.Err()
+			}
+		}
+		q.mu.Unlock()
+		// 已被分配到名额，归还后再返回
+		q.Release()
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot, handing it directly to the next waiter if any.
+func (q *admissionQueue) Release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for p := range q.waiting {
+		if len(q.waiting[p]) > 0 {
+			ready := q.waiting[p][0]
+			q.waiting[p] = q.waiting[p][1:]
+			close(ready)
+			return
+		}
+	}
+	q.active--
+}
+
+// Waiting returns the number of queued requests per priority.
+func (q *admissionQueue) Waiting() (interactive, batch int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting[priorityInteractive]), len(q.waiting[priorityBatch])
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParsePriority(t *testing.T) {
+	tests := []struct {
+		header string
+		want   priority
+	}{
+		{"", priorityInteractive},
+		{"interactive", priorityInteractive},
+		{"batch", priorityBatch},
+		{" Batch ", priorityBatch},
+		{"urgent", priorityInteractive},
+	}
+	for _, tt := range tests {
+		if got := parsePriority(tt.header); got != tt.want {
+			t.Errorf("parsePriority(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestAdmissionBatchYieldsToInteractive(t *testing.T) {
+	q := newAdmissionQueue(1)
+	if err := q.Acquire(context.Background(), priorityInteractive); err != nil {
+		t.Fatal(err)
+	}
+
+	// 名额被占满时依次排入 batch、batch、interactive
+	admitted := make(chan string, 3)
+	enqueue := func(name string, p priority, wantInteractive, wantBatch int) {
+		go func() {
+			if err := q.Acquire(context.Background(), p); err != nil {
+				t.Error(err)
+			}
+			admitted <- name
+		}()
+		waitFor(t, name+" to queue", func() bool {
+			interactive, batch := q.Waiting()
+			return interactive == wantInteractive && batch == wantBatch
+		})
+	}
+	enqueue("batch 1", priorityBatch, 0, 1)
+	enqueue("batch 2", priorityBatch, 0, 2)
+	enqueue("interactive", priorityInteractive, 1, 2)
+
+	// 新来的 batch 请求也不能越过排队的请求
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Acquire(ctx, priorityBatch); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("batch request admitted past the queue: %v", err)
+	}
+
+	for _, want := range []string{"interactive", "batch 1", "batch 2"} {
+		q.Release()
+		select {
+		case got := <-admitted:
+			if got != want {
+				t.Fatalf("%s admitted, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s never admitted", want)
+		}
+	}
+	q.Release()
+	if q.active != 0 {
+		t.Errorf("%d slots still taken", q.active)
+	}
+}
+
+func TestAdmissionTimeout(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.AdmissionTimeout = 20 * time.Millisecond
+	})
+	q := newAdmissionQueue(1)
+	swap(t, &admission, q)
+	useFakeDB(t, nil)
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+	send := func(prio string) int {
+		r := newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`)
+		r.Header.Set("X-Priority", prio)
+		w := httptest.NewRecorder()
+		handleForwardToEndpoint(w, r)
+		return w.Code
+	}
+
+	q.Acquire(context.Background(), priorityInteractive)
+	if got := send("batch"); got != http.StatusServiceUnavailable {
+		t.Errorf("status %d while at capacity, want 503", got)
+	}
+	if got := auth.remaining("k"); got != 10 {
+		t.Errorf("%d calls left, want the rejected request uncharged", got)
+	}
+	q.Release()
+	if got := send("batch"); got != http.StatusOK {
+		t.Errorf("status %d with a free slot, want 200", got)
+	}
+}
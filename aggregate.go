@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// wantsAggregation reports whether a non-streaming request should be served
+// from the upstream stream: always when AGGREGATE_STREAMS is set, otherwise
+// when the client sends X-Aggregate-Stream: true.
+func wantsAggregation(r *http.Request) bool {
+	if cfg().AggregateStreams {
+		return true
+	}
+	on, _ := strconv.ParseBool(r.Header.Get("X-Aggregate-Stream"))
+	return on
+}
+
+// streamForAggregation turns a non-streaming request body into a streaming
+// one. It reports false, leaving body as is, when the client already asked
+// for a stream.
+func streamForAggregation(body []byte) ([]byte, bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, false, err
+	}
+	var stream bool
+	if raw, ok := fields["stream"]; ok {
+		if err := json.Unmarshal(raw, &stream); err != nil {
+			return nil, false, errors.New("stream must be a boolean")
+		}
+	}
+	if stream {
+		return body, false, nil
+	}
+	fields["stream"] = json.RawMessage("true")
+	body, err := json.Marshal(fields)
+	return body, err == nil, err
+}
+
+// aggregatedMessage is the Messages API response assembled from a stream.
+type aggregatedMessage struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      []map[string]any `json:"content"`
+	StopReason   *string          `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        map[string]any   `json:"usage"`
+}
+
+// messageAggregator rebuilds the final message from the events of a
+// Messages API stream: text and thinking deltas are concatenated, tool input
+// JSON is parsed once its block ends, and usage from message_delta is merged
+// into the usage of message_start.
+type messageAggregator struct {
+	message   aggregatedMessage
+	toolInput map[int]*bytes.Buffer
+	// err is the error event of the stream, if any.
+	err *ErrorResponse
+	// done is set by message_stop.
+	done bool
+}
+
+func newMessageAggregator() *messageAggregator {
+	return &messageAggregator{toolInput: make(map[int]*bytes.Buffer)}
+}
+
+func (a *messageAggregator) Observe(event []byte) error {
+	data, ok := sseEventData(event)
+	if !ok || len(data) == 0 {
+		return nil
+	}
+	var e struct {
+		Type         string          `json:"type"`
+		Index        int             `json:"index"`
+		Message      json.RawMessage `json:"message"`
+		ContentBlock json.RawMessage `json:"content_block"`
+		Delta        struct {
+			Type         string  `json:"type"`
+			Text         string  `json:"text"`
+			Thinking     string  `json:"thinking"`
+			Signature    string  `json:"signature"`
+			PartialJSON  string  `json:"partial_json"`
+			StopReason   *string `json:"stop_reason"`
+			StopSequence *string `json:"stop_sequence"`
+		} `json:"delta"`
+		Usage map[string]any `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+
+	switch e.Type {
+	case "message_start":
+		if err := decodeNumbers(e.Message, &a.message); err != nil {
+			return err
+		}
+		if a.message.Content == nil {
+			a.message.Content = []map[string]any{}
+		}
+	case "content_block_start":
+		var block map[string]any
+		if err := decodeNumbers(e.ContentBlock, &block); err != nil {
+			return err
+		}
+		if e.Index != len(a.message.Content) {
+			return errors.New("content block " + strconv.Itoa(e.Index) + " out of order")
+		}
+		a.message.Content = append(a.message.Content, block)
+	case "content_block_delta":
+		block, err := a.block(e.Index)
+		if err != nil {
+			return err
+		}
+		switch e.Delta.Type {
+		case "text_delta":
+			block["text"] = stringField(block, "text") + e.Delta.Text
+		case "thinking_delta":
+			block["thinking"] = stringField(block, "thinking") + e.Delta.Thinking
+		case "signature_delta":
+			block["signature"] = stringField(block, "signature") + e.Delta.Signature
+		case "input_json_delta":
+			if a.toolInput[e.Index] == nil {
+				a.toolInput[e.Index] = new(bytes.Buffer)
+			}
+			a.toolInput[e.Index].WriteString(e.Delta.PartialJSON)
+		}
+	case "content_block_stop":
+		block, err := a.block(e.Index)
+		if err != nil {
+			return err
+		}
+		// 工具参数以 JSON 片段流式下发，块结束后整体解析；无片段时保留起始事件中的值
+		if buf := a.toolInput[e.Index]; buf != nil && buf.Len() > 0 {
+			var input any
+			if err := decodeNumbers(buf.Bytes(), &input); err != nil {
+				return err
+			}
+			block["input"] = input
+		}
+	case "message_delta":
+		a.message.StopReason = e.Delta.StopReason
+		a.message.StopSequence = e.Delta.StopSequence
+		if a.message.Usage == nil {
+			a.message.Usage = make(map[string]any)
+		}
+		for k, v := range e.Usage {
+			a.message.Usage[k] = v
+		}
+	case "message_stop":
+		a.done = true
+	case "error":
+		var resp ErrorResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return err
+		}
+		a.err = &resp
+	}
+	return nil
+}
+
+func (a *messageAggregator) block(index int) (map[string]any, error) {
+	if index < 0 || index >= len(a.message.Content) {
+		return nil, errors.New("delta for unknown content block " + strconv.Itoa(index))
+	}
+	return a.message.Content[index], nil
+}
+
+func stringField(block map[string]any, name string) string {
+	s, _ := block[name].(string)
+	return s
+}
+
+// decodeNumbers unmarshals data keeping numbers exact.
+func decodeNumbers(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// splitSSEEvents splits the output of a stream transformer, which may hold
+// several events, into single events.
+func splitSSEEvents(data []byte) [][]byte {
+	var events [][]byte
+	for len(data) > 0 {
+		event, rest, found := bytes.Cut(data, []byte("\n\n"))
+		if found {
+			event = data[:len(event)+2]
+		}
+		events = append(events, event)
+		data = rest
+	}
+	return events
+}
+
+// aggregateResponse reads an upstream event stream to its end and answers
+// with the assembled message as a single JSON document, like the
+// non-streaming API would. An error event or a stream cut short is answered
+// with an error instead.
+func aggregateResponse(w http.ResponseWriter, resp *http.Response, apiKey, model string, calls int, capture bool) (usageTracker, []byte) {
+	var usage usageTracker
+	// 组装的消息缓冲在内存中，按读到的字节数执行上限
+	maxBytes := cfg().MaxStreamBytes
+	var upstream io.Reader = resp.Body
+	if maxBytes > 0 {
+		upstream = io.LimitReader(resp.Body, int64(maxBytes)+1)
+	}
+	reader := bufio.NewReader(upstream)
+	transformer := newStreamTransformer()
+	aggregator := newMessageAggregator()
+	var read int
+	for {
+		event, err := readSSEEvent(reader)
+		if read += len(event); maxBytes > 0 && read > maxBytes {
+			respondSizeExceeded(w, resp, maxBytes)
+			return usage, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			// 不完整的事件不参与组装，流按被截断处理
+			err = io.EOF
+		}
+		if err == nil || err == io.EOF {
+			var data []byte
+			if err == nil {
+				usage.observeEvent(event)
+				data = transformer.Transform(event)
+			} else {
+				data = transformer.Flush()
+			}
+			for _, e := range splitSSEEvents(data) {
+				if aerr := aggregator.Observe(e); aerr != nil {
+					respondError(w, resp.Request, upstreamFailure("Upstream stream could not be assembled", aerr))
+					return usage, nil
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			respondError(w, resp.Request, bodyReadFailure(resp.Request, err))
+			return usage, nil
+		}
+	}
+
+	if aggregator.err != nil {
+		// 流中的错误事件按错误类型转换为对应的状态码
+		ge := upstreamFailure(aggregator.err.Error.Message, nil)
+		switch ge.Code = aggregator.err.Error.Type; ge.Code {
+		case codeOverloaded:
+			ge.Status = http.StatusServiceUnavailable
+		case codeRateLimit:
+			ge.Status = http.StatusTooManyRequests
+		}
+		respondError(w, resp.Request, ge)
+		return usage, nil
+	}
+	if !aggregator.done {
+		respondError(w, resp.Request, upstreamFailure("Upstream stream ended unexpectedly", nil))
+		return usage, nil
+	}
+
+	body, err := json.Marshal(aggregator.message)
+	if err != nil {
+		respondError(w, resp.Request, internalError("Failed to encode aggregated message", err))
+		return usage, nil
+	}
+	setCostHeaders(w.Header(), model, calls, usage)
+	if receipt := usageReceiptFor(apiKey, model, calls, usage); receipt != "" {
+		w.Header().Set("X-Usage-Receipt", receipt)
+	}
+	writeBody(w, http.StatusOK, "application/json", body)
+	if !capture {
+		return usage, nil
+	}
+	return usage, body
+}
+
+// bodyReadFailure classifies an error reading the upstream stream.
+func bodyReadFailure(r *http.Request, err error) error {
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return upstreamFailure("Upstream stream was interrupted", err)
+}
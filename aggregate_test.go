@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// toolTranscript is a captured stream with a thinking block and a tool call
+// whose input arrives in fragments.
+const toolTranscript = "event: message_start\n" +
+	`data: {"type":"message_start","message":{"id":"msg_2","type":"message","role":"assistant","model":"claude","content":[],"stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":42,"cache_read_input_tokens":7,"output_tokens":1}}}` + "\n\n" +
+	"event: content_block_start\n" +
+	`data: {"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}` + "\n\n" +
+	"event: content_block_delta\n" +
+	`data: {"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"Need the "}}` + "\n\n" +
+	"event: content_block_delta\n" +
+	`data: {"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"weather."}}` + "\n\n" +
+	"event: content_block_delta\n" +
+	`data: {"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"c2ln"}}` + "\n\n" +
+	"event: content_block_stop\n" +
+	`data: {"type":"content_block_stop","index":0}` + "\n\n" +
+	"event: ping\n" +
+	`data: {"type":"ping"}` + "\n\n" +
+	"event: content_block_start\n" +
+	`data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}` + "\n\n" +
+	"event: content_block_delta\n" +
+	`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\": \"Par"}}` + "\n\n" +
+	"event: content_block_delta\n" +
+	`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"is\", \"days\": 3}"}}` + "\n\n" +
+	"event: content_block_stop\n" +
+	`data: {"type":"content_block_stop","index":1}` + "\n\n" +
+	"event: message_delta\n" +
+	`data: {"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":31}}` + "\n\n" +
+	"event: message_stop\n" +
+	`data: {"type":"message_stop"}` + "\n\n"
+
+func TestMessageAggregator(t *testing.T) {
+	tests := []struct {
+		name       string
+		transcript string
+		want       string
+	}{
+		{
+			name:       "text",
+			transcript: sseTranscript,
+			want:       `{"id":"msg_1","type":"message","role":"assistant","model":"claude","content":[{"text":"Hello world","type":"text"}],"stop_reason":"end_turn","stop_sequence":null,"usage":{"input_tokens":10,"output_tokens":5}}`,
+		},
+		{
+			name:       "thinking and tool use",
+			transcript: toolTranscript,
+			want: `{"id":"msg_2","type":"message","role":"assistant","model":"claude","content":[` +
+				`{"signature":"c2ln","thinking":"Need the weather.","type":"thinking"},` +
+				`{"id":"toolu_1","input":{"city":"Paris","days":3},"name":"get_weather","type":"tool_use"}],` +
+				`"stop_reason":"tool_use","stop_sequence":null,"usage":{"cache_read_input_tokens":7,"input_tokens":42,"output_tokens":31}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newMessageAggregator()
+			reader := bufio.NewReader(strings.NewReader(tt.transcript))
+			for {
+				event, err := readSSEEvent(reader)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := a.Observe(event); err != nil {
+					t.Fatalf("observing %q: %v", event, err)
+				}
+			}
+			if !a.done || a.err != nil {
+				t.Fatalf("done %v, error %v", a.done, a.err)
+			}
+			got, err := json.Marshal(a.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("assembled\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageAggregatorRejectsBrokenStreams(t *testing.T) {
+	start := strings.SplitAfter(sseTranscript, "\n\n")[0]
+	for name, transcript := range map[string]string{
+		"delta before its block": start + `data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"x"}}` + "\n\n",
+		"block out of order":     start + `data: {"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}` + "\n\n",
+		"invalid tool input": start + `data: {"type":"content_block_start","index":0,"content_block":{"type":"tool_use","input":{}}}` + "\n\n" +
+			`data: {"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"city\""}}` + "\n\n" +
+			`data: {"type":"content_block_stop","index":0}` + "\n\n",
+	} {
+		a := newMessageAggregator()
+		var err error
+		for _, event := range splitSSEEvents([]byte(transcript)) {
+			if err = a.Observe(event); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			t.Errorf("%s: assembled without an error", name)
+		}
+	}
+}
+
+func TestStreamForAggregation(t *testing.T) {
+	tests := []struct {
+		body       string
+		wantChange bool
+		wantErr    bool
+	}{
+		{`{"messages":[]}`, true, false},
+		{`{"messages":[],"stream":false}`, true, false},
+		{`{"messages":[],"stream":true}`, false, false},
+		{`{"messages":[],"stream":"yes"}`, false, true},
+		{`not json`, false, true},
+	}
+	for _, tt := range tests {
+		got, changed, err := streamForAggregation([]byte(tt.body))
+		if (err != nil) != tt.wantErr || changed != tt.wantChange {
+			t.Errorf("%s: changed %v, err %v", tt.body, changed, err)
+			continue
+		}
+		if changed && !strings.Contains(string(got), `"stream":true`) {
+			t.Errorf("%s: became %s, want a streaming request", tt.body, got)
+		}
+	}
+}
+
+func TestAggregatedResponse(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.AggregateStreams = false
+	})
+	events := strings.SplitAfter(sseTranscript, "\n\n")
+	delta := "event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"` + strings.Repeat("x", 100) + `"}}` + "\n\n"
+	tests := []struct {
+		name       string
+		limit      int
+		upstream   string
+		wantStatus int
+		wantBody   string
+	}{
+		{"complete stream", 0, sseTranscript, http.StatusOK, `"content":[{"text":"Hello world","type":"text"}]`},
+		{"overloaded mid-stream", 0, events[0] + "event: error\n" + `data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}` + "\n\n", http.StatusServiceUnavailable, `"overloaded_error"`},
+		{"stream cut short", 0, events[0] + events[1] + events[2], http.StatusBadGateway, "Upstream stream ended unexpectedly"},
+		{"within the size limit", len(sseTranscript), sseTranscript, http.StatusOK, `"content":[{"text":"Hello world","type":"text"}]`},
+		{"over the size limit", 1000, events[0] + events[1] + strings.Repeat(delta, 20) + strings.Join(events[2:], ""), http.StatusBadGateway, "Response exceeded the gateway's size limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.MaxStreamBytes = tt.limit })
+			useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+			fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				var body struct{ Stream bool }
+				json.NewDecoder(r.Body).Decode(&body)
+				if !body.Stream {
+					t.Error("upstream asked for a non-streaming response")
+				}
+				streamSSE(w, tt.upstream)
+			})
+			r := newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}]}`)
+			r.Header.Set("X-Aggregate-Stream", "true")
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, r)
+			if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %s, want %d with %s", w.Code, w.Body, tt.wantStatus, tt.wantBody)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type %s, want a single JSON document", ct)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// modelRoute is the target of a model alias: the provider and model serving
+// it and, optionally, the regions to use instead of the model's own.
+type modelRoute struct {
+	Provider string   `json:"provider,omitempty"`
+	Model    string   `json:"model"`
+	Regions  []string `json:"regions,omitempty"`
+}
+
+// provider names the route's provider, by default the one serving Model.
+func (r modelRoute) provider() string {
+	if r.Provider != "" {
+		return r.Provider
+	}
+	return providerOf(r.Model)
+}
+
+// validate checks that the route names a known provider able to serve the
+// model under c. Providers looking models up in their configuration need the
+// model listed there.
+func (r modelRoute) validate(c *Config) error {
+	if r.Model == "" {
+		return fmt.Errorf("model is required")
+	}
+	for _, region := range r.Regions {
+		if strings.TrimSpace(region) == "" {
+			return fmt.Errorf("regions must not be empty")
+		}
+	}
+	var listed bool
+	switch r.Provider {
+	case "", providerVertex, providerGemini, providerOpenAI:
+		return nil
+	case providerBedrock:
+		_, listed = c.BedrockModels[r.Model]
+	case providerAzure:
+		_, listed = c.AzureDeployments[r.Model]
+	case providerOpenAICompatible:
+		_, listed = c.OpenAICompatibleModels[r.Model]
+	case providerAnthropic:
+		_, listed = c.AnthropicModels[r.Model]
+	default:
+		return fmt.Errorf("unknown provider %q", r.Provider)
+	}
+	if !listed {
+		return fmt.Errorf("model %s is not configured for provider %s", r.Model, r.Provider)
+	}
+	return nil
+}
+
+// parseModelAliases parses entries of the form
+// alias=[provider/]model[/region1|region2], e.g.
+// fast=vertex/claude-3-5-haiku@20241022/us-east5|europe-west1.
+func parseModelAliases(entries []string) map[string]modelRoute {
+	aliases := make(map[string]modelRoute)
+	for _, entry := range entries {
+		alias, target, ok := strings.Cut(entry, "=")
+		alias = strings.TrimSpace(alias)
+		parts := strings.Split(strings.TrimSpace(target), "/")
+		if !ok || alias == "" || len(parts) > 3 {
+			log.Printf("Ignoring invalid model alias %q", entry)
+			continue
+		}
+		var route modelRoute
+		// 两段时首段为已知提供方则是 provider/model，否则是 model/regions
+		if len(parts) == 3 || len(parts) == 2 && slices.Contains(providerNames, parts[0]) {
+			route.Provider, parts = parts[0], parts[1:]
+		}
+		route.Model = parts[0]
+		if len(parts) == 2 {
+			route.Regions = strings.Split(parts[1], "|")
+		}
+		aliases[alias] = route
+	}
+	return aliases
+}
+
+// providerNames lists the providers a route may name.
+var providerNames = []string{providerVertex, providerGemini, providerBedrock, providerAzure, providerOpenAI, providerOpenAICompatible, providerAnthropic}
+
+// modelAliasTable holds the model aliases admins set through the API. They
+// are stored in the model_aliases table, which every instance re-reads
+// periodically like the allowed models, and take precedence over
+// MODEL_ALIASES.
+type modelAliasTable struct {
+	mu     sync.RWMutex
+	routes map[string]modelRoute
+}
+
+var modelAliases = &modelAliasTable{}
+
+// Lookup returns the route of alias, from the table or MODEL_ALIASES.
+func (t *modelAliasTable) Lookup(alias string) (modelRoute, bool) {
+	t.mu.RLock()
+	route, ok := t.routes[alias]
+	t.mu.RUnlock()
+	if ok {
+		return route, true
+	}
+	route, ok = cfg().ModelAliases[alias]
+	return route, ok
+}
+
+// Stored returns the aliases set through the API.
+func (t *modelAliasTable) Stored() map[string]modelRoute {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.routes
+}
+
+// Load replaces the aliases with the contents of the model_aliases table.
+func (t *modelAliasTable) Load(db *sql.DB) error {
+	rows, err := db.Query(`SELECT alias, provider, model, regions FROM model_aliases`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	routes := make(map[string]modelRoute)
+	for rows.Next() {
+		var (
+			alias string
+			route modelRoute
+		)
+		if err := rows.Scan(&alias, &route.Provider, &route.Model, pq.Array(&route.Regions)); err != nil {
+			return err
+		}
+		routes[alias] = route
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.routes = routes
+	t.mu.Unlock()
+	return nil
+}
+
+// Run reloads the table on every tick until ctx is cancelled, so changes
+// made on another instance take effect here too. A zero interval disables
+// reloading.
+func (t *modelAliasTable) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !dbReady.Load() {
+				continue
+			}
+			if err := t.Load(db); err != nil {
+				log.Printf("Error loading model aliases: %v", err)
+			}
+		}
+	}
+}
+
+// aliasNames lists every alias, configured or stored, sorted.
+func aliasNames() []string {
+	var names []string
+	for alias := range cfg().ModelAliases {
+		names = append(names, alias)
+	}
+	for alias := range modelAliases.Stored() {
+		if !slices.Contains(names, alias) {
+			names = append(names, alias)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+type modelAliasesResponse struct {
+	// Configured come from MODEL_ALIASES; Stored were set through the API
+	// and win over configured aliases of the same name.
+	Configured map[string]modelRoute `json:"configured"`
+	Stored     map[string]modelRoute `json:"stored"`
+}
+
+// handleListModelAliases returns the model aliases and their routes.
+func handleListModelAliases(w http.ResponseWriter, r *http.Request) {
+	resp := modelAliasesResponse{Configured: map[string]modelRoute{}, Stored: map[string]modelRoute{}}
+	for alias, route := range cfg().ModelAliases {
+		resp.Configured[alias] = route
+	}
+	for alias, route := range modelAliases.Stored() {
+		resp.Stored[alias] = route
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleModelAlias sets the alias with PUT and removes it with DELETE.
+func handleModelAlias(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		handleDeleteModelAlias(w, r)
+		return
+	}
+	handleSetModelAlias(w, r)
+}
+
+// handleSetModelAlias stores the route of an alias, replacing any previous
+// one.
+func handleSetModelAlias(w http.ResponseWriter, r *http.Request) {
+	alias := r.PathValue("alias")
+	if !vertexModelPattern.MatchString(alias) {
+		respondError(w, r, invalidRequest("Invalid alias "+alias))
+		return
+	}
+	var route modelRoute
+	if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+		respondError(w, r, invalidRequest(`body must be {"provider": "...", "model": "...", "regions": [...]}`))
+		return
+	}
+	if err := route.validate(cfg()); err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+	// 别名不能指向另一个别名，避免链式或循环解析
+	if _, ok := modelAliases.Lookup(route.Model); ok {
+		respondError(w, r, invalidRequest(fmt.Sprintf("model %s is an alias itself", route.Model)))
+		return
+	}
+	if route.Regions == nil {
+		route.Regions = []string{}
+	}
+	_, err := db.ExecContext(r.Context(), `
+		INSERT INTO model_aliases (alias, provider, model, regions, updated_at) VALUES ($1, $2, $3, $4, now())
+		ON CONFLICT (alias) DO UPDATE SET provider = EXCLUDED.provider, model = EXCLUDED.model, regions = EXCLUDED.regions, updated_at = EXCLUDED.updated_at`,
+		alias, route.Provider, route.Model, pq.Array(route.Regions))
+	if err != nil {
+		respondError(w, r, internalError("Failed to store model alias", fmt.Errorf("alias %s: %w", alias, err)))
+		return
+	}
+	if err := modelAliases.Load(db); err != nil {
+		log.Printf("Error loading model aliases: %v", err)
+	}
+	log.Printf("Model alias %s routed to %s", alias, route.Model)
+	handleListModelAliases(w, r)
+}
+
+// handleDeleteModelAlias removes a stored alias. Aliases from MODEL_ALIASES
+// can't be removed this way.
+func handleDeleteModelAlias(w http.ResponseWriter, r *http.Request) {
+	alias := r.PathValue("alias")
+	res, err := db.ExecContext(r.Context(), `DELETE FROM model_aliases WHERE alias = $1`, alias)
+	if err != nil {
+		respondError(w, r, internalError("Failed to remove model alias", fmt.Errorf("alias %s: %w", alias, err)))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondError(w, r, notFound("Alias is not stored"))
+		return
+	}
+	if err := modelAliases.Load(db); err != nil {
+		log.Printf("Error loading model aliases: %v", err)
+	}
+	log.Printf("Model alias %s removed", alias)
+	handleListModelAliases(w, r)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseModelAliases(t *testing.T) {
+	got := parseModelAliases([]string{
+		"fast=claude-3-5-haiku@20241022",
+		"eu=claude-sonnet@20250101/europe-west1|europe-west4",
+		"gpt=openai/gpt-4o",
+		"pinned=vertex/claude-3-5-haiku@20241022/us-east5",
+		" spaced = claude-a ",
+		"invalid",
+		"=claude-a",
+		"deep=vertex/claude-a/us-east5/extra",
+	})
+	want := map[string]modelRoute{
+		"fast":   {Model: "claude-3-5-haiku@20241022"},
+		"eu":     {Model: "claude-sonnet@20250101", Regions: []string{"europe-west1", "europe-west4"}},
+		"gpt":    {Provider: providerOpenAI, Model: "gpt-4o"},
+		"pinned": {Provider: providerVertex, Model: "claude-3-5-haiku@20241022", Regions: []string{"us-east5"}},
+		"spaced": {Model: "claude-a"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestModelRouteValidate(t *testing.T) {
+	c := &Config{
+		BedrockModels:          map[string]string{"claude-b": "anthropic.claude-b"},
+		AzureDeployments:       map[string]string{"gpt-azure": "prod-gpt"},
+		OpenAICompatibleModels: map[string]string{"llama3": "http://localhost:11434/v1"},
+		AnthropicModels:        map[string]string{"claude-a": "claude-a-20250101"},
+	}
+	tests := []struct {
+		name    string
+		route   modelRoute
+		wantErr string
+	}{
+		{name: "default provider", route: modelRoute{Model: "claude-a"}},
+		{name: "vertex with regions", route: modelRoute{Provider: providerVertex, Model: "claude-a", Regions: []string{"us-east5"}}},
+		{name: "openai", route: modelRoute{Provider: providerOpenAI, Model: "gpt-4o"}},
+		{name: "bedrock", route: modelRoute{Provider: providerBedrock, Model: "claude-b"}},
+		{name: "azure", route: modelRoute{Provider: providerAzure, Model: "gpt-azure"}},
+		{name: "openai-compatible", route: modelRoute{Provider: providerOpenAICompatible, Model: "llama3"}},
+		{name: "anthropic", route: modelRoute{Provider: providerAnthropic, Model: "claude-a"}},
+		{name: "no model", route: modelRoute{Provider: providerVertex}, wantErr: "model is required"},
+		{name: "empty region", route: modelRoute{Model: "claude-a", Regions: []string{" "}}, wantErr: "regions must not be empty"},
+		{name: "unknown provider", route: modelRoute{Provider: "mistral", Model: "m"}, wantErr: `unknown provider "mistral"`},
+		{name: "model not configured", route: modelRoute{Provider: providerBedrock, Model: "claude-a"}, wantErr: "model claude-a is not configured for provider bedrock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.route.validate(c)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestModelAliasesAPI(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.ModelAliases = map[string]modelRoute{"fast": {Model: "claude-3-5-haiku@20241022"}}
+		c.BedrockModels = nil
+	})
+	swap(t, &modelAliases, &modelAliasTable{})
+	type row struct{ provider, model, regions any }
+	var (
+		mu     sync.Mutex
+		stored = map[string]row{}
+	)
+	useFakeDB(t, func(q fakeQuery) fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(q.SQL), "INSERT INTO model_aliases"):
+			stored[q.Args[0].(string)] = row{q.Args[1], q.Args[2], q.Args[3]}
+		case strings.HasPrefix(q.SQL, "DELETE FROM model_aliases"):
+			if _, ok := stored[q.Args[0].(string)]; !ok {
+				return fakeResult{}
+			}
+			delete(stored, q.Args[0].(string))
+			return fakeResult{Affected: 1}
+		case strings.HasPrefix(q.SQL, "SELECT alias, provider, model, regions FROM model_aliases"):
+			res := fakeResult{Columns: []string{"alias", "provider", "model", "regions"}}
+			for alias, r := range stored {
+				res.Rows = append(res.Rows, []driver.Value{alias, r.provider, r.model, r.regions})
+			}
+			return res
+		}
+		return fakeResult{}
+	})
+
+	haikuEU := modelRoute{Provider: providerVertex, Model: "claude-3-5-haiku@20241022", Regions: []string{"europe-west1"}}
+	tests := []struct {
+		name       string
+		method     string
+		alias      string
+		body       string
+		wantStatus int
+		wantStored map[string]modelRoute
+	}{
+		{"set", http.MethodPut, "eu", `{"provider":"vertex","model":"claude-3-5-haiku@20241022","regions":["europe-west1"]}`, http.StatusOK,
+			map[string]modelRoute{"eu": haikuEU}},
+		// 同名时存储的别名覆盖 MODEL_ALIASES
+		{"override a configured alias", http.MethodPut, "fast", `{"model":"claude-sonnet@20250101"}`, http.StatusOK,
+			map[string]modelRoute{"eu": haikuEU, "fast": {Model: "claude-sonnet@20250101", Regions: []string{}}}},
+		{"invalid alias", http.MethodPut, "my alias", `{"model":"claude-a"}`, http.StatusBadRequest,
+			map[string]modelRoute{"eu": haikuEU, "fast": {Model: "claude-sonnet@20250101", Regions: []string{}}}},
+		{"invalid body", http.MethodPut, "x", `["claude-a"]`, http.StatusBadRequest,
+			map[string]modelRoute{"eu": haikuEU, "fast": {Model: "claude-sonnet@20250101", Regions: []string{}}}},
+		{"invalid route", http.MethodPut, "x", `{"provider":"bedrock","model":"claude-a"}`, http.StatusBadRequest,
+			map[string]modelRoute{"eu": haikuEU, "fast": {Model: "claude-sonnet@20250101", Regions: []string{}}}},
+		{"alias of an alias", http.MethodPut, "x", `{"model":"eu"}`, http.StatusBadRequest,
+			map[string]modelRoute{"eu": haikuEU, "fast": {Model: "claude-sonnet@20250101", Regions: []string{}}}},
+		{"remove", http.MethodDelete, "fast", "", http.StatusOK,
+			map[string]modelRoute{"eu": haikuEU}},
+		{"remove a configured alias", http.MethodDelete, "fast", "", http.StatusNotFound,
+			map[string]modelRoute{"eu": haikuEU}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/model-aliases/"+url.PathEscape(tt.alias), strings.NewReader(tt.body))
+			r.SetPathValue("alias", tt.alias)
+			w := httptest.NewRecorder()
+			handleModelAlias(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := modelAliases.Stored(); !maps.EqualFunc(got, tt.wantStored, func(a, b modelRoute) bool { return reflect.DeepEqual(a, b) }) {
+				t.Errorf("stored %+v, want %+v", got, tt.wantStored)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var resp modelAliasesResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Configured) != 1 || len(resp.Stored) != len(tt.wantStored) {
+				t.Errorf("response %+v", resp)
+			}
+		})
+	}
+
+	if route, _ := modelAliases.Lookup("fast"); route.Model != "claude-3-5-haiku@20241022" {
+		t.Errorf("fast routed to %s after removing the stored alias", route.Model)
+	}
+	if got := aliasNames(); !reflect.DeepEqual(got, []string{"eu", "fast"}) {
+		t.Errorf("alias names %v", got)
+	}
+}
+
+func TestModelAliasRequest(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-default"
+		c.AllowedModels = nil
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.ModelFailover = nil
+		c.AnthropicModels = nil
+		c.VertexAPIVersion = "v1"
+		c.VertexPublisher = "anthropic"
+		c.ModelAliases = map[string]modelRoute{"eu": {Model: "claude-3-5-haiku@20241022", Regions: []string{"europe-west1"}}}
+	})
+	swap(t, &storedModels, &modelAllowlist{})
+	swap(t, &modelAliases, &modelAliasTable{})
+	swap[TokenProvider](t, &tokenProvider, staticTokenProvider("fake-token"))
+	swap(t, &accessToken, "")
+	if err := refreshAccessToken(); err != nil {
+		t.Fatal(err)
+	}
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want := "/v1/projects/test-project/locations/europe-west1/publishers/anthropic/models/claude-3-5-haiku@20241022:streamRawPredict"; r.URL.Path != want {
+			t.Errorf("path %s, want %s", r.URL.Path, want)
+		}
+		if body, _ := io.ReadAll(r.Body); strings.Contains(string(body), `"eu"`) {
+			t.Errorf("body %s still names the alias", body)
+		}
+		streamSSE(w, sseTranscript)
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	swap(t, &vertexClient, &http.Client{Transport: redirectTransport{target}})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"model":"eu","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusOK || w.Body.String() != sseTranscript {
+		t.Fatalf("got %d:\n%s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Served-Region"); got != "europe-west1" {
+		t.Errorf("X-Served-Region = %q", got)
+	}
+}
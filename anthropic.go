@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// anthropicHost is the "region" of the Anthropic API.
+const anthropicHost = "api.anthropic.com"
+
+// anthropicProvider serves Claude through the Anthropic API. Bodies are
+// already in its format apart from the model, which moves into the body, and
+// the API version, which moves into a header.
+type anthropicProvider struct{}
+
+func (anthropicProvider) Ready() bool {
+	return cfg().AnthropicAPIKey != ""
+}
+
+func (anthropicProvider) BuildRequest(ctx context.Context, region, model string, body io.Reader) (*http.Request, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, invalidRequest(fmt.Sprintf("invalid request body: %v", err))
+	}
+	id, ok := cfg().AnthropicModels[model]
+	if !ok {
+		return nil, invalidRequest(fmt.Sprintf("model %s is not served by the Anthropic API", model))
+	}
+	delete(fields, "anthropic_version")
+	fields["model"], _ = json.Marshal(id)
+	if data, err = json.Marshal(fields); err != nil {
+		return nil, invalidRequest(fmt.Sprintf("invalid request body: %v", err))
+	}
+	return http.NewRequestWithContext(ctx, http.MethodPost, "https://"+region+"/v1/messages", bytes.NewReader(data))
+}
+
+func (anthropicProvider) Authenticate(req *http.Request) error {
+	key := cfg().AnthropicAPIKey
+	if key == "" {
+		return errCredentialsUnavailable
+	}
+	req.Header.Set("x-api-key", key)
+	req.Header.Set("anthropic-version", cfg().AnthropicVersion)
+	return nil
+}
+
+func (anthropicProvider) StreamResponse(resp *http.Response) *http.Response {
+	return resp
+}
+
+// anthropicFallbackProvider serves a model on Vertex AI and, once its Vertex
+// regions are exhausted, on the Anthropic API, which regionsForModel lists as
+// the last region.
+type anthropicFallbackProvider struct {
+	vertexProvider
+}
+
+func (a anthropicFallbackProvider) BuildRequest(ctx context.Context, region, model string, body io.Reader) (*http.Request, error) {
+	if region == anthropicHost {
+		return anthropicProvider{}.BuildRequest(ctx, region, model, body)
+	}
+	return a.vertexProvider.BuildRequest(ctx, region, model, body)
+}
+
+func (a anthropicFallbackProvider) Authenticate(req *http.Request) error {
+	if req.URL.Host == anthropicHost {
+		return anthropicProvider{}.Authenticate(req)
+	}
+	return a.vertexProvider.Authenticate(req)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicProviderBuildRequest(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.AnthropicModels = map[string]string{"claude-sonnet@20250101": "claude-sonnet-20250101"}
+	})
+	tests := []struct {
+		name    string
+		model   string
+		body    string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "model moves into the body",
+			model: "claude-sonnet@20250101",
+			body:  `{"anthropic_version":"vertex-2023-10-16","messages":[{"role":"user","content":"hi"}],"max_tokens":10,"stream":true}`,
+			want:  `{"max_tokens":10,"messages":[{"role":"user","content":"hi"}],"model":"claude-sonnet-20250101","stream":true}`,
+		},
+		{
+			name:  "client model replaced",
+			model: "claude-sonnet@20250101",
+			body:  `{"model":"claude-sonnet@20250101","messages":[]}`,
+			want:  `{"messages":[],"model":"claude-sonnet-20250101"}`,
+		},
+		{
+			name:    "model not served",
+			model:   "claude-other",
+			body:    `{"messages":[]}`,
+			wantErr: "model claude-other is not served by the Anthropic API",
+		},
+		{
+			name:    "invalid body",
+			model:   "claude-sonnet@20250101",
+			body:    `{"messages":`,
+			wantErr: "invalid request body",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := anthropicProvider{}.BuildRequest(context.Background(), anthropicHost, tt.model, strings.NewReader(tt.body))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := req.URL.String(); got != "https://api.anthropic.com/v1/messages" {
+				t.Errorf("URL %s", got)
+			}
+			if got, _ := io.ReadAll(req.Body); string(got) != tt.want {
+				t.Errorf("body %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnthropicProviderAuthenticate(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.AnthropicAPIKey = "sk-ant-test"
+		c.AnthropicVersion = "2023-06-01"
+	})
+	p := anthropicProvider{}
+	if !p.Ready() {
+		t.Error("not ready with an API key")
+	}
+	req := httptest.NewRequest(http.MethodPost, "https://api.anthropic.com/v1/messages", nil)
+	if err := p.Authenticate(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("x-api-key") != "sk-ant-test" || req.Header.Get("anthropic-version") != "2023-06-01" || req.Header.Get("Authorization") != "" {
+		t.Errorf("headers %v", req.Header)
+	}
+
+	setConfig(t, func(c *Config) { c.AnthropicAPIKey = "" })
+	if p.Ready() {
+		t.Error("ready without an API key")
+	}
+	if err := p.Authenticate(httptest.NewRequest(http.MethodPost, "https://api.anthropic.com/v1/messages", nil)); err != errCredentialsUnavailable {
+		t.Errorf("Authenticate = %v, want errCredentialsUnavailable", err)
+	}
+}
+
+func TestAnthropicFallback(t *testing.T) {
+	const model = "claude-sonnet@20250101"
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = model
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.ModelAliases = nil
+		c.ModelFailover = nil
+		c.FailoverOnRateLimit = false
+		c.FailoverCooldown = 0
+		c.VertexAPIVersion = "v1"
+		c.VertexPublisher = "anthropic"
+		c.AnthropicModels = map[string]string{model: "claude-sonnet-20250101"}
+		c.AnthropicAPIKey = "sk-ant-test"
+		c.AnthropicFallback = true
+	})
+	swap[TokenProvider](t, &tokenProvider, staticTokenProvider("fake-token"))
+	swap(t, &accessToken, "")
+	if err := refreshAccessToken(); err != nil {
+		t.Fatal(err)
+	}
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+
+	tests := []struct {
+		name         string
+		vertexStatus int
+		wantRegion   string
+	}{
+		{name: "Vertex answers", vertexStatus: http.StatusOK, wantRegion: "us-east5"},
+		// 429 在 Vertex 上不会换区域，但 Anthropic API 的配额是独立的
+		{name: "Vertex rate limited", vertexStatus: http.StatusTooManyRequests, wantRegion: anthropicHost},
+		{name: "Vertex overloaded", vertexStatus: 529, wantRegion: anthropicHost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vertex := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.vertexStatus != http.StatusOK {
+					w.WriteHeader(tt.vertexStatus)
+					io.WriteString(w, `{"type":"error","error":{"type":"overloaded_error","message":"busy"}}`)
+					return
+				}
+				streamSSE(w, sseTranscript)
+			}))
+			defer vertex.Close()
+			anthropic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Host != anthropicHost || r.URL.Path != "/v1/messages" || r.Header.Get("x-api-key") != "sk-ant-test" {
+					t.Errorf("request to %s%s with key %q", r.Host, r.URL.Path, r.Header.Get("x-api-key"))
+				}
+				var body map[string]json.RawMessage
+				json.NewDecoder(r.Body).Decode(&body)
+				if string(body["model"]) != `"claude-sonnet-20250101"` || body["anthropic_version"] != nil {
+					t.Errorf("body %v", body)
+				}
+				streamSSE(w, sseTranscript)
+			}))
+			defer anthropic.Close()
+			vertexTarget, _ := url.Parse(vertex.URL)
+			anthropicTarget, _ := url.Parse(anthropic.URL)
+			swap(t, &vertexClient, &http.Client{Transport: redirectTransport{vertexTarget}})
+			swap(t, &upstreamClient, &http.Client{Transport: redirectTransport{anthropicTarget}})
+
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if w.Code != http.StatusOK || w.Body.String() != sseTranscript {
+				t.Fatalf("got %d:\n%s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("X-Served-Region"); got != tt.wantRegion {
+				t.Errorf("X-Served-Region = %q, want %q", got, tt.wantRegion)
+			}
+		})
+	}
+}
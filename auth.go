@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Authenticator resolves the caller of a request and meters its quota.
+// Authenticate returns errKeyNotFound for unknown credentials and the
+// principal together with errNoRemainingCalls when its quota is used up.
+type Authenticator interface {
+	Authenticate(ctx context.Context, r *http.Request) (*APIKey, error)
+	// Charge deducts cost calls from the principal's quota and returns the
+	// balance left, or errNoRemainingCalls if it can't cover the cost.
+	Charge(ctx context.Context, key *APIKey, cost int) (int, error)
+	// Refund gives back calls charged for a request that was abandoned.
+	Refund(ctx context.Context, key *APIKey, cost int) error
+}
+
+// defaultIntrospectionTimeout bounds a call to the introspection service.
+const defaultIntrospectionTimeout = 5 * time.Second
+
+// authenticator is the backend selected by AUTH_BACKEND.
+var authenticator Authenticator = dbAuthenticator{}
+
+// newAuthenticator builds the backend named by cfg.AuthBackend.
+func newAuthenticator() (Authenticator, error) {
+	switch cfg().AuthBackend {
+	case "", "db":
+		return dbAuthenticator{}, nil
+	case "introspection":
+		if cfg().AuthIntrospectionURL == "" {
+			return nil, errors.New("AUTH_INTROSPECTION_URL is required for the introspection backend")
+		}
+		return &introspectionAuthenticator{
+			url:    cfg().AuthIntrospectionURL,
+			token:  cfg().AuthIntrospectionToken,
+			client: &http.Client{Transport: upstreamClient.Transport, Timeout: cfg().AuthIntrospectionTimeout},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown AUTH_BACKEND %q", cfg().AuthBackend)
+	}
+}
+
+// authFailure classifies an Authenticate error: unknown keys are counted
+// against the client IP and get a 401, while a failing backend is a 503
+// instead of being blamed on the key.
+func authFailure(r *http.Request, apiKey string, err error) error {
+	var ge *GatewayError
+	if errors.As(err, &ge) {
+		return ge
+	}
+	if errors.Is(err, errKeyNotFound) {
+		recordAuthFailure(r)
+		return errInvalidAPIKey
+	}
+	return errAuthUnavailable.withDetail(fmt.Errorf("loading key %s: %w", keyID(apiKey), err))
+}
+
+// errEndpointNotAllowed rejects a key used outside its allowed_endpoints.
+var errEndpointNotAllowed = permissionDenied("API key is not allowed to use this endpoint")
+
+// endpointScope restricts keys with allowed_endpoints to those paths. It
+// wraps the configured backend, so a key is rejected right after it is
+// resolved, before any quota is charged or the upstream is called.
+type endpointScope struct {
+	next Authenticator
+}
+
+func (a endpointScope) Authenticate(ctx context.Context, r *http.Request) (*APIKey, error) {
+	key, err := a.next.Authenticate(ctx, r)
+	if key != nil && !endpointAllowed(key.AllowedEndpoints, strings.TrimPrefix(r.URL.Path, cfg().BasePath)) {
+		return key, errEndpointNotAllowed
+	}
+	return key, err
+}
+
+func (a endpointScope) Charge(ctx context.Context, key *APIKey, cost int) (int, error) {
+	return a.next.Charge(ctx, key, cost)
+}
+
+func (a endpointScope) Refund(ctx context.Context, key *APIKey, cost int) error {
+	return a.next.Refund(ctx, key, cost)
+}
+
+// endpointAllowed reports whether path matches one of allowed, which are
+// exact paths such as /v1/messages or prefixes ending in /*. An empty list
+// allows every endpoint.
+func endpointAllowed(allowed []string, path string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, pattern := range allowed {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if path == prefix || strings.HasPrefix(path, prefix+"/") {
+				return true
+			}
+		} else if path == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// authHeaders are the credential headers that must appear at most once.
+var authHeaders = []string{"x-api-key", "Authorization"}
+
+// rejectDuplicateAuth answers 400 when a credential header is sent more than
+// once. Header.Get would silently use the first value, which can hide a
+// misconfigured client or an injected header. DUPLICATE_AUTH_HEADERS=first
+// restores that behavior.
+func rejectDuplicateAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg().DuplicateAuthHeaders != "first" {
+			for _, name := range authHeaders {
+				if len(r.Header.Values(name)) > 1 {
+					logf(r.Context(), "Rejected request with duplicate %s headers from %s", name, clientIP(r))
+					respondError(w, r, invalidRequest("Multiple "+name+" headers are not allowed"))
+					return
+				}
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// dbAuthenticator validates x-api-key against the api_keys table.
+type dbAuthenticator struct{}
+
+func (dbAuthenticator) Authenticate(ctx context.Context, r *http.Request) (*APIKey, error) {
+	return lookupAPIKey(r.Header.Get("x-api-key"))
+}
+
+func (dbAuthenticator) Charge(ctx context.Context, key *APIKey, cost int) (int, error) {
+	return decrementAPIKey(key.Key, cost)
+}
+
+func (dbAuthenticator) Refund(ctx context.Context, key *APIKey, cost int) error {
+	return refundAPIKey(key.Key, cost)
+}
+
+// introspectionAuthenticator validates x-api-key by POSTing it to an external
+// service, which answers with the key's quota and permissions:
+//
+//	{"active": true, "remaining_calls": 100, "tier": "pro", ...}
+//
+// The service owns the quota, so Charge only checks that the reported
+// balance covers the cost; the service meters usage from the usage events.
+type introspectionAuthenticator struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+type introspectionResponse struct {
+	Active            bool     `json:"active"`
+	RemainingCalls    int      `json:"remaining_calls"`
+	Tier              string   `json:"tier"`
+	CaptureOptOut     bool     `json:"capture_opt_out"`
+	MaxTemperature    *float64 `json:"max_temperature"`
+	ForcedModel       string   `json:"forced_model"`
+	AllowedCIDRs      []string `json:"allowed_cidrs"`
+	AllowedEndpoints  []string `json:"allowed_endpoints"`
+	OutputTokenBudget *int64   `json:"output_token_budget"`
+	DailyLimit        *int     `json:"daily_limit"`
+	SystemPrompt      string   `json:"system_prompt"`
+	BrandName         string   `json:"brand_name"`
+	SupportURL        string   `json:"support_url"`
+	// MaxRequestDuration is in seconds.
+	MaxRequestDuration float64 `json:"max_request_duration"`
+	MaxMessages        *int    `json:"max_messages"`
+	MaxInputTokens     *int    `json:"max_input_tokens"`
+}
+
+func (a *introspectionAuthenticator) Authenticate(ctx context.Context, r *http.Request) (*APIKey, error) {
+	apiKey := r.Header.Get("x-api-key")
+	payload, _ := json.Marshal(map[string]string{"key": apiKey})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspection request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errKeyNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("introspection returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result introspectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding introspection response: %w", err)
+	}
+	if !result.Active {
+		return nil, errKeyNotFound
+	}
+	key := &APIKey{
+		Key:                apiKey,
+		RemainingCalls:     result.RemainingCalls,
+		CaptureOptOut:      result.CaptureOptOut,
+		MaxTemperature:     result.MaxTemperature,
+		ForcedModel:        result.ForcedModel,
+		AllowedCIDRs:       result.AllowedCIDRs,
+		AllowedEndpoints:   result.AllowedEndpoints,
+		Tier:               result.Tier,
+		OutputTokenBudget:  result.OutputTokenBudget,
+		DailyLimit:         result.DailyLimit,
+		SystemPrompt:       result.SystemPrompt,
+		BrandName:          result.BrandName,
+		SupportURL:         result.SupportURL,
+		MaxRequestDuration: time.Duration(result.MaxRequestDuration * float64(time.Second)),
+		MaxMessages:        result.MaxMessages,
+		MaxInputTokens:     result.MaxInputTokens,
+	}
+	if key.Tier == "" {
+		key.Tier = defaultTier
+	}
+	if key.RemainingCalls <= 0 {
+		return key, errNoRemainingCalls
+	}
+	return key, nil
+}
+
+func (a *introspectionAuthenticator) Charge(ctx context.Context, key *APIKey, cost int) (int, error) {
+	if key.RemainingCalls < cost {
+		return 0, errNoRemainingCalls
+	}
+	return key.RemainingCalls - cost, nil
+}
+
+// Refund is a no-op: the introspection service owns the quota.
+func (a *introspectionAuthenticator) Refund(ctx context.Context, key *APIKey, cost int) error {
+	return nil
+}
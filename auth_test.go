@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubIntrospection answers introspection requests from responses, keyed by
+// the API key; unknown keys get a 404.
+func stubIntrospection(t *testing.T, responses map[string]string) *introspectionAuthenticator {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer service-token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		var payload struct{ Key string }
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("introspection payload: %v", err)
+		}
+		resp, ok := responses[payload.Key]
+		switch {
+		case !ok:
+			http.NotFound(w, r)
+		case resp == "500":
+			http.Error(w, "database down", http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(resp))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &introspectionAuthenticator{url: srv.URL, token: "service-token", client: &http.Client{Timeout: time.Second}}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		url     string
+		want    string // 后端类型，空表示出错
+	}{
+		{"default", "", "", "db"},
+		{"database", "db", "", "db"},
+		{"introspection", "introspection", "http://auth.internal/introspect", "introspection"},
+		{"introspection without a URL", "introspection", "", ""},
+		{"unknown backend", "ldap", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.AuthBackend = tt.backend
+				c.AuthIntrospectionURL = tt.url
+			})
+			auth, err := newAuthenticator()
+			var got string
+			switch auth.(type) {
+			case dbAuthenticator:
+				got = "db"
+			case *introspectionAuthenticator:
+				got = "introspection"
+			}
+			if got != tt.want || (err != nil) != (tt.want == "") {
+				t.Errorf("got %T, %v; want %q", auth, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntrospectionAuthenticate(t *testing.T) {
+	auth := stubIntrospection(t, map[string]string{
+		"sk-pro":      `{"active":true,"remaining_calls":100,"tier":"pro","forced_model":"claude-safe","max_temperature":0.5,"max_request_duration":1.5,"allowed_cidrs":["10.0.0.0/8"]}`,
+		"sk-basic":    `{"active":true,"remaining_calls":3}`,
+		"sk-inactive": `{"active":false,"remaining_calls":100}`,
+		"sk-empty":    `{"active":true,"remaining_calls":0}`,
+		"sk-garbled":  `{"active":`,
+		"sk-failing":  "500",
+	})
+	tests := []struct {
+		key       string
+		wantErr   error
+		wantOther bool // 失败但不是密钥本身的问题
+		check     func(t *testing.T, key *APIKey)
+	}{
+		{key: "sk-pro", check: func(t *testing.T, key *APIKey) {
+			if key.Tier != "pro" || key.RemainingCalls != 100 || key.ForcedModel != "claude-safe" || *key.MaxTemperature != 0.5 ||
+				key.MaxRequestDuration != 1500*time.Millisecond || len(key.AllowedCIDRs) != 1 {
+				t.Errorf("key %+v", key)
+			}
+		}},
+		{key: "sk-basic", check: func(t *testing.T, key *APIKey) {
+			if key.Tier != defaultTier || key.RemainingCalls != 3 {
+				t.Errorf("key %+v, want the default tier", key)
+			}
+		}},
+		{key: "sk-unknown", wantErr: errKeyNotFound},
+		{key: "sk-inactive", wantErr: errKeyNotFound},
+		{key: "sk-empty", wantErr: errNoRemainingCalls},
+		{key: "sk-garbled", wantOther: true},
+		{key: "sk-failing", wantOther: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			key, err := auth.Authenticate(context.Background(), newMessagesRequest(tt.key, `{}`))
+			switch {
+			case tt.wantOther:
+				if err == nil || errors.Is(err, errKeyNotFound) || errors.Is(err, errNoRemainingCalls) {
+					t.Errorf("err = %v, want a backend failure", err)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.check != nil && err == nil {
+				tt.check(t, key)
+			}
+		})
+	}
+}
+
+func TestIntrospectionCharge(t *testing.T) {
+	auth := &introspectionAuthenticator{}
+	key := &APIKey{RemainingCalls: 3}
+	if left, err := auth.Charge(context.Background(), key, 3); err != nil || left != 0 {
+		t.Errorf("Charge(3) = %d, %v", left, err)
+	}
+	if _, err := auth.Charge(context.Background(), key, 4); !errors.Is(err, errNoRemainingCalls) {
+		t.Errorf("Charge(4) = %v, want errNoRemainingCalls", err)
+	}
+}
+
+func TestIntrospectionOnForwardedRequest(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	swap[Authenticator](t, &authenticator, stubIntrospection(t, map[string]string{
+		"sk-valid":   `{"active":true,"remaining_calls":5,"forced_model":"claude-safe"}`,
+		"sk-failing": "500",
+	}))
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if model := strings.TrimPrefix(r.URL.Path, "/"+upstreamRegion(r)+"/"); model != "claude-safe" {
+			t.Errorf("request for %s, want the model the service set", model)
+		}
+		streamSSE(w, sseTranscript)
+	})
+
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"sk-valid", http.StatusOK},
+		{"sk-unknown", http.StatusUnauthorized},
+		{"sk-failing", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest(tt.key, `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestRejectDuplicateAuth(t *testing.T) {
+	useFakeDB(t, nil)
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+	tests := []struct {
+		name       string
+		mode       string
+		headers    map[string][]string
+		wantStatus int
+		wantCalls  map[string]int
+	}{
+		{"single key", "reject", map[string][]string{"x-api-key": {"k1"}}, http.StatusOK, map[string]int{"k1": 9, "k2": 10}},
+		{"duplicate x-api-key", "reject", map[string][]string{"x-api-key": {"k1", "k2"}}, http.StatusBadRequest, map[string]int{"k1": 10, "k2": 10}},
+		{"duplicate Authorization", "reject", map[string][]string{"x-api-key": {"k1"}, "Authorization": {"Bearer a", "Bearer b"}}, http.StatusBadRequest, map[string]int{"k1": 10, "k2": 10}},
+		{"first value wins", "first", map[string][]string{"x-api-key": {"k1", "k2"}}, http.StatusOK, map[string]int{"k1": 9, "k2": 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.Regions = []string{"us-east5"}
+				c.ModelRegions = nil
+				c.VertexTargets = nil
+				c.DuplicateAuthHeaders = tt.mode
+			})
+			auth := useKeys(t,
+				&APIKey{Key: "k1", RemainingCalls: 10, Tier: defaultTier},
+				&APIKey{Key: "k2", RemainingCalls: 10, Tier: defaultTier},
+			)
+			req := newMessagesRequest("", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`)
+			for name, values := range tt.headers {
+				for _, v := range values {
+					req.Header.Add(name, v)
+				}
+			}
+			w := httptest.NewRecorder()
+			newRouter().ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusBadRequest && !strings.Contains(w.Body.String(), "invalid_request_error") {
+				t.Errorf("body %s, want an invalid_request_error", w.Body)
+			}
+			for key, want := range tt.wantCalls {
+				if got := auth.remaining(key); got != want {
+					t.Errorf("%s has %d calls left, want %d", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEndpointAllowed(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		path    string
+		want    bool
+	}{
+		{nil, "/v1/chat/completions", true},
+		{[]string{"/v1/messages"}, "/v1/messages", true},
+		{[]string{"/v1/messages"}, "/v1/messages/count_tokens", false},
+		{[]string{"/v1/messages"}, "/v1/messages2", false},
+		{[]string{"/v1/messages/*"}, "/v1/messages", true},
+		{[]string{"/v1/messages/*"}, "/v1/messages/count_tokens", true},
+		{[]string{"/v1/messages/*"}, "/v1/messagesx", false},
+		{[]string{"/v1/messages", "/v1/chat/completions"}, "/v1/chat/completions", true},
+	}
+	for _, tt := range tests {
+		if got := endpointAllowed(tt.allowed, tt.path); got != tt.want {
+			t.Errorf("endpointAllowed(%q, %s) = %v, want %v", tt.allowed, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestEndpointScope(t *testing.T) {
+	useFakeDB(t, nil)
+	setConfig(t, func(c *Config) {
+		c.BasePath = "/api"
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	auth := newMemAuthenticator(
+		&APIKey{Key: "messages-only", RemainingCalls: 10, Tier: defaultTier, AllowedEndpoints: []string{"/v1/messages"}},
+		&APIKey{Key: "unscoped", RemainingCalls: 10, Tier: defaultTier},
+	)
+	swap[Authenticator](t, &authenticator, endpointScope{next: auth})
+	swap(t, &accessToken, "fake-token")
+	var forwarded int
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		streamSSE(w, sseTranscript)
+	})
+	body := `{"model":"` + cfg().DefaultModel + `","messages":[{"role":"user","content":"hi"}],"stream":true}`
+	tests := []struct {
+		name       string
+		key        string
+		path       string
+		wantDenied bool
+	}{
+		{"allowed endpoint", "messages-only", "/api/v1/messages", false},
+		{"token counting", "messages-only", "/api/v1/messages/count_tokens", true},
+		{"OpenAI-compatible endpoint", "messages-only", "/api/v1/chat/completions", true},
+		{"unscoped key", "unscoped", "/api/v1/chat/completions", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded = 0
+			before := auth.remaining(tt.key)
+			r := newMessagesRequest(tt.key, body)
+			r.URL.Path = tt.path
+			w := httptest.NewRecorder()
+			newRouter().ServeHTTP(w, r)
+			if denied := w.Code == http.StatusForbidden; denied != tt.wantDenied {
+				t.Fatalf("status %d, want denied %v: %s", w.Code, tt.wantDenied, w.Body)
+			}
+			if !tt.wantDenied {
+				if forwarded == 0 {
+					t.Errorf("allowed request not forwarded: %d %s", w.Code, w.Body)
+				}
+				return
+			}
+			if !strings.Contains(w.Body.String(), "not allowed to use this endpoint") {
+				t.Errorf("body %s", w.Body)
+			}
+			if forwarded != 0 || auth.remaining(tt.key) != before {
+				t.Error("request to a disallowed endpoint was forwarded or charged")
+			}
+		})
+	}
+}
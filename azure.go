@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseAzureEndpoints accepts Azure OpenAI resource hosts with or without a
+// scheme and returns the hosts, e.g. my-resource.openai.azure.com.
+func parseAzureEndpoints(entries []string) []string {
+	var hosts []string
+	for _, entry := range entries {
+		host := strings.TrimPrefix(strings.TrimPrefix(entry, "https://"), "http://")
+		hosts = append(hosts, strings.TrimRight(host, "/"))
+	}
+	return hosts
+}
+
+// azureProvider serves models deployed on Azure OpenAI. Requests are
+// translated to chat completions and sent to the model's deployment; the
+// endpoints take the place of regions.
+type azureProvider struct{}
+
+func (azureProvider) Ready() bool {
+	return cfg().AzureAPIKey != ""
+}
+
+func (azureProvider) BuildRequest(ctx context.Context, region, model string, body io.Reader) (*http.Request, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	deployment, ok := cfg().AzureDeployments[model]
+	if !ok {
+		return nil, invalidRequest(fmt.Sprintf("model %s is not deployed on Azure OpenAI", model))
+	}
+	// 部署名已决定模型，请求体中无需再指定
+	if data, _, err = translateMessagesRequest(data, ""); err != nil {
+		return nil, invalidRequest(err.Error())
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     region,
+		Path:     "/openai/deployments/" + deployment + "/chat/completions",
+		RawQuery: url.Values{"api-version": {cfg().AzureAPIVersion}}.Encode(),
+	}
+	return http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(data))
+}
+
+func (azureProvider) Authenticate(req *http.Request) error {
+	key := cfg().AzureAPIKey
+	if key == "" {
+		return errCredentialsUnavailable
+	}
+	req.Header.Set("api-key", key)
+	return nil
+}
+
+func (azureProvider) StreamResponse(resp *http.Response) *http.Response {
+	if id := resp.Header.Get("apim-request-id"); id != "" {
+		resp.Header.Set("request-id", id)
+	}
+	return adaptChatCompletionsResponse(resp)
+}
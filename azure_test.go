@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseAzureEndpoints(t *testing.T) {
+	got := parseAzureEndpoints([]string{"https://a.openai.azure.com/", "b.openai.azure.com", "http://c.openai.azure.com"})
+	if want := []string{"a.openai.azure.com", "b.openai.azure.com", "c.openai.azure.com"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAzureProvider(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "gpt-azure"
+		c.AzureDeployments = map[string]string{"gpt-azure": "prod-gpt"}
+		c.AzureEndpoints = []string{"my-resource.openai.azure.com"}
+		c.AzureAPIKey = "azure-key"
+		c.AzureAPIVersion = "2024-06-01"
+		c.ModelRegions = nil
+		c.ModelAliases = nil
+		c.ModelFailover = nil
+	})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "my-resource.openai.azure.com" || r.URL.Path != "/openai/deployments/prod-gpt/chat/completions" || r.URL.Query().Get("api-version") != "2024-06-01" {
+			t.Errorf("request to %s%s", r.Host, r.URL)
+		}
+		if r.Header.Get("api-key") != "azure-key" || r.Header.Get("Authorization") != "" {
+			t.Errorf("api-key %q, Authorization %q", r.Header.Get("api-key"), r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if fields["model"] != nil || string(fields["stream_options"]) != `{"include_usage":true}` {
+			t.Errorf("body %s", body)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("apim-request-id", "req-azure")
+		io.WriteString(w, "data: "+`{"id":"c1","model":"gpt-4o","choices":[{"delta":{"content":"Hello"}}]}`+"\n\n"+
+			"data: "+`{"choices":[{"delta":{"content":" world"},"finish_reason":"stop"}]}`+"\n\n"+
+			"data: "+`{"choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`+"\n\n"+
+			"data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	swap(t, &upstreamClient, &http.Client{Transport: redirectTransport{target}})
+	rec := recordUsage(t)
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var events []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, name)
+		}
+	}
+	want := []string{"message_start", "content_block_start", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}
+	if !slices.Equal(events, want) {
+		t.Errorf("events %v, want %v:\n%s", events, want, w.Body)
+	}
+	if got := w.Header().Get("X-Upstream-Request-Id"); got != "req-azure" {
+		t.Errorf("X-Upstream-Request-Id = %q", got)
+	}
+	waitFor(t, "the usage event", func() bool { return len(rec.published()) == 1 })
+	if u := rec.published()[0]; u.InputTokens != 10 || u.OutputTokens != 5 {
+		t.Errorf("usage %d/%d, want 10/5", u.InputTokens, u.OutputTokens)
+	}
+}
+
+func TestAzureProviderErrors(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.AzureDeployments = map[string]string{"gpt-azure": "prod-gpt"}
+		c.AzureAPIKey = ""
+	})
+	p := azureProvider{}
+	if p.Ready() {
+		t.Error("ready without an API key")
+	}
+	req := httptest.NewRequest(http.MethodPost, "https://my-resource.openai.azure.com/", nil)
+	if err := p.Authenticate(req); err != errCredentialsUnavailable {
+		t.Errorf("Authenticate = %v, want errCredentialsUnavailable", err)
+	}
+	for model, body := range map[string]string{
+		"gpt-other": `{"messages":[]}`,
+		"gpt-azure": `{"messages":[{"role":"robot","content":"hi"}]}`,
+	} {
+		if _, err := p.BuildRequest(req.Context(), "my-resource.openai.azure.com", model, strings.NewReader(body)); err == nil {
+			t.Errorf("%s %s: request built", model, body)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bedrockVersion is the anthropic_version Bedrock expects in request bodies.
+const bedrockVersion = "bedrock-2023-05-31"
+
+// bedrockProvider serves Claude on AWS Bedrock through the InvokeModel and
+// InvokeModelWithResponseStream APIs, signing calls with SigV4.
+type bedrockProvider struct{}
+
+func (bedrockProvider) Ready() bool {
+	return cfg().BedrockAccessKey != "" && cfg().BedrockSecretKey != ""
+}
+
+// BuildRequest moves the body to Bedrock's dialect: the model and stream flag
+// are part of the URL and anthropic_version names the Bedrock API. The body
+// is read in full since the signature covers it.
+func (bedrockProvider) BuildRequest(ctx context.Context, region, model string, body io.Reader) (*http.Request, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, invalidRequest(fmt.Sprintf("invalid request body: %v", err))
+	}
+	var stream bool
+	if raw, ok := fields["stream"]; ok {
+		json.Unmarshal(raw, &stream)
+	}
+	delete(fields, "stream")
+	delete(fields, "model")
+	fields["anthropic_version"], _ = json.Marshal(bedrockVersion)
+	if data, err = json.Marshal(fields); err != nil {
+		return nil, invalidRequest(fmt.Sprintf("invalid request body: %v", err))
+	}
+
+	id, ok := cfg().BedrockModels[model]
+	if !ok {
+		return nil, invalidRequest(fmt.Sprintf("model %s is not served by Bedrock", model))
+	}
+	action := "invoke"
+	if stream {
+		action = "invoke-with-response-stream"
+	}
+	// 模型 ID 含冒号等字符，按 AWS 的规则编码后放入路径
+	u := url.URL{
+		Scheme:  "https",
+		Host:    fmt.Sprintf("bedrock-runtime.%s.amazonaws.com", region),
+		Path:    "/model/" + id + "/" + action,
+		RawPath: "/model/" + awsURIEncode(id) + "/" + action,
+	}
+	return http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(data))
+}
+
+func (bedrockProvider) Authenticate(req *http.Request) error {
+	c := cfg()
+	if c.BedrockAccessKey == "" || c.BedrockSecretKey == "" {
+		return errCredentialsUnavailable
+	}
+	var payload []byte
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		if payload, err = io.ReadAll(body); err != nil {
+			return err
+		}
+	}
+	if c.BedrockSessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.BedrockSessionToken)
+	}
+	region := strings.TrimSuffix(strings.TrimPrefix(req.URL.Host, "bedrock-runtime."), ".amazonaws.com")
+	signV4(req, payload, c.BedrockAccessKey, c.BedrockSecretKey, region, "bedrock", time.Now())
+	return nil
+}
+
+// StreamResponse turns Bedrock's binary event stream into SSE events and its
+// {"message"} errors into Anthropic errors. Successful non-streaming
+// responses are already Anthropic messages.
+func (bedrockProvider) StreamResponse(resp *http.Response) *http.Response {
+	if id := resp.Header.Get("X-Amzn-Requestid"); id != "" {
+		resp.Header.Set("request-id", id)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case resp.StatusCode == http.StatusOK && mediaType == "application/vnd.amazon.eventstream":
+		resp.Body = &bedrockEventReader{body: resp.Body, r: bufio.NewReader(resp.Body)}
+		resp.Header.Set("Content-Type", "text/event-stream")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+	case resp.StatusCode >= http.StatusBadRequest:
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		var bedrockErr struct {
+			Message string `json:"message"`
+		}
+		message := strings.TrimSpace(string(body))
+		if json.Unmarshal(body, &bedrockErr) == nil && bedrockErr.Message != "" {
+			message = bedrockErr.Message
+		}
+		body = anthropicError(codeForStatus(resp.StatusCode), message)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.Header.Set("Content-Type", "application/json")
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		resp.ContentLength = int64(len(body))
+	}
+	return resp
+}
+
+// bedrockExceptionCodes maps the exceptions Bedrock sends inside a stream to
+// error types; the rest are api_error.
+var bedrockExceptionCodes = map[string]string{
+	"throttlingException":         codeRateLimit,
+	"serviceUnavailableException": codeOverloaded,
+	"modelTimeoutException":       codeTimeout,
+	"validationException":         codeInvalidRequest,
+}
+
+// bedrockEventReader reads a Bedrock response stream as Anthropic SSE
+// events. Each chunk message carries one Anthropic event, base64 encoded;
+// exceptions become error events.
+type bedrockEventReader struct {
+	body io.ReadCloser
+	r    *bufio.Reader
+	buf  bytes.Buffer
+	err  error
+}
+
+func (b *bedrockEventReader) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 && b.err == nil {
+		b.err = b.next()
+	}
+	if b.buf.Len() > 0 {
+		return b.buf.Read(p)
+	}
+	return 0, b.err
+}
+
+func (b *bedrockEventReader) Close() error {
+	return b.body.Close()
+}
+
+// next converts one stream message into buf.
+func (b *bedrockEventReader) next() error {
+	headers, payload, err := readEventStreamMessage(b.r)
+	if err != nil {
+		return err
+	}
+	switch headers[":message-type"] {
+	case "event":
+		if headers[":event-type"] != "chunk" {
+			return nil
+		}
+		var chunk struct {
+			Bytes []byte `json:"bytes"`
+		}
+		var event struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(payload, &chunk); err != nil {
+			return fmt.Errorf("invalid Bedrock chunk: %w", err)
+		}
+		if err := json.Unmarshal(chunk.Bytes, &event); err != nil {
+			return fmt.Errorf("invalid Bedrock event: %w", err)
+		}
+		// SSE 的 data 行不能含换行，事件 JSON 先压缩
+		fmt.Fprintf(&b.buf, "event: %s\ndata: ", event.Type)
+		json.Compact(&b.buf, chunk.Bytes)
+		b.buf.WriteString("\n\n")
+	case "exception":
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(payload, &e)
+		code, ok := bedrockExceptionCodes[headers[":exception-type"]]
+		if !ok {
+			code = codeAPI
+		}
+		writeSSEError(&b.buf, code, e.Message)
+	case "error":
+		writeSSEError(&b.buf, codeAPI, headers[":error-message"])
+	}
+	return nil
+}
+
+// maxEventStreamMessage bounds a single event stream message.
+const maxEventStreamMessage = 16 << 20
+
+// readEventStreamMessage reads one message in the AWS event stream encoding:
+// a prelude with the total and headers length and its CRC32, the headers,
+// the payload and a CRC32 of the whole message. Only string headers are
+// returned. A stream ending between messages returns io.EOF.
+func readEventStreamMessage(r io.Reader) (map[string]string, []byte, error) {
+	var prelude [12]byte
+	if _, err := io.ReadFull(r, prelude[:]); err != nil {
+		return nil, nil, err
+	}
+	total := binary.BigEndian.Uint32(prelude[0:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, nil, errors.New("event stream prelude checksum mismatch")
+	}
+	if total < 16 || headersLen > total-16 || total > maxEventStreamMessage {
+		return nil, nil, fmt.Errorf("invalid event stream message length %d", total)
+	}
+
+	msg := make([]byte, total-12)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(prelude[:])
+	crc.Write(msg[:len(msg)-4])
+	if crc.Sum32() != binary.BigEndian.Uint32(msg[len(msg)-4:]) {
+		return nil, nil, errors.New("event stream message checksum mismatch")
+	}
+	headers, err := parseEventStreamHeaders(msg[:headersLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	return headers, msg[headersLen : len(msg)-4], nil
+}
+
+// parseEventStreamHeaders decodes the headers of an event stream message,
+// keeping the string values.
+func parseEventStreamHeaders(b []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	for len(b) > 0 {
+		n := int(b[0])
+		if len(b) < n+2 {
+			return nil, errors.New("truncated event stream header")
+		}
+		name, valueType := string(b[1:n+1]), b[n+1]
+		b = b[n+2:]
+
+		var size int
+		switch valueType {
+		case 0, 1: // true, false
+		case 2: // byte
+			size = 1
+		case 3: // short
+			size = 2
+		case 4: // int
+			size = 4
+		case 5, 8: // long, timestamp
+			size = 8
+		case 9: // uuid
+			size = 16
+		case 6, 7: // bytes, string
+			if len(b) < 2 {
+				return nil, errors.New("truncated event stream header")
+			}
+			size = int(binary.BigEndian.Uint16(b))
+			b = b[2:]
+		default:
+			return nil, fmt.Errorf("unknown event stream header type %d", valueType)
+		}
+		if len(b) < size {
+			return nil, errors.New("truncated event stream header")
+		}
+		if valueType == 7 {
+			headers[name] = string(b[:size])
+		}
+		b = b[size:]
+	}
+	return headers, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// eventStreamMessage encodes one message in the AWS event stream encoding
+// with string headers.
+func eventStreamMessage(headers map[string]string, payload []byte) []byte {
+	var hb []byte
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		hb = append(hb, byte(len(name)))
+		hb = append(hb, name...)
+		hb = append(hb, 7)
+		hb = binary.BigEndian.AppendUint16(hb, uint16(len(headers[name])))
+		hb = append(hb, headers[name]...)
+	}
+	msg := binary.BigEndian.AppendUint32(nil, uint32(12+len(hb)+len(payload)+4))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(hb)))
+	msg = binary.BigEndian.AppendUint32(msg, crc32.ChecksumIEEE(msg))
+	msg = append(append(msg, hb...), payload...)
+	return binary.BigEndian.AppendUint32(msg, crc32.ChecksumIEEE(msg))
+}
+
+// bedrockChunk is an event stream message carrying one Anthropic event.
+func bedrockChunk(event string) []byte {
+	payload, _ := json.Marshal(struct {
+		Bytes []byte `json:"bytes"`
+	}{[]byte(event)})
+	return eventStreamMessage(map[string]string{":message-type": "event", ":event-type": "chunk", ":content-type": "application/json"}, payload)
+}
+
+// bedrockTranscript is sseTranscript as a Bedrock response stream.
+func bedrockTranscript() []byte {
+	var stream []byte
+	for _, line := range strings.Split(sseTranscript, "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			stream = append(stream, bedrockChunk(data)...)
+		}
+	}
+	return stream
+}
+
+func TestReadEventStreamMessage(t *testing.T) {
+	msg := eventStreamMessage(map[string]string{":message-type": "event", ":event-type": "chunk"}, []byte(`{"bytes":""}`))
+	headers, payload, err := readEventStreamMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers[":message-type"] != "event" || headers[":event-type"] != "chunk" || string(payload) != `{"bytes":""}` {
+		t.Errorf("headers %v, payload %q", headers, payload)
+	}
+
+	corrupt := func(i int) []byte {
+		b := slices.Clone(msg)
+		b[i] ^= 0xFF
+		return b
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"end of stream", nil, io.EOF.Error()},
+		{"truncated prelude", msg[:5], io.ErrUnexpectedEOF.Error()},
+		{"truncated message", msg[:len(msg)-1], io.ErrUnexpectedEOF.Error()},
+		{"prelude checksum", corrupt(9), "prelude checksum mismatch"},
+		{"message checksum", corrupt(len(msg) - 6), "message checksum mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readEventStreamMessage(bytes.NewReader(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseEventStreamHeaders(t *testing.T) {
+	// 非字符串类型的头部被跳过
+	b := []byte{2, 'o', 'k', 0}
+	b = append(b, 3, 'n', 'u', 'm', 4, 0, 0, 0, 7)
+	b = append(b, 2, 'i', 'd', 9)
+	b = append(b, make([]byte, 16)...)
+	b = append(b, 4, 't', 'y', 'p', 'e', 7, 0, 5)
+	b = append(b, "chunk"...)
+	headers, err := parseEventStreamHeaders(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 1 || headers["type"] != "chunk" {
+		t.Errorf("headers %v, want only the string header", headers)
+	}
+
+	for name, b := range map[string][]byte{
+		"truncated name":   {5, 'a'},
+		"truncated value":  {1, 'a', 7, 0, 9, 'x'},
+		"truncated length": {1, 'a', 6, 0},
+		"unknown type":     {1, 'a', 42},
+	} {
+		if _, err := parseEventStreamHeaders(b); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestBedrockEventReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		want   string
+	}{
+		{"events", bedrockTranscript(), sseTranscript},
+		{
+			name: "other events skipped",
+			stream: slices.Concat(
+				eventStreamMessage(map[string]string{":message-type": "event", ":event-type": "metadata"}, []byte(`{}`)),
+				bedrockChunk(`{"type":"message_stop"}`),
+			),
+			want: "event: message_stop\n" + `data: {"type":"message_stop"}` + "\n\n",
+		},
+		{
+			name: "indented event compacted",
+			stream: bedrockChunk(`{
+  "type": "ping"
+}`),
+			want: "event: ping\n" + `data: {"type":"ping"}` + "\n\n",
+		},
+		{
+			name: "exception",
+			stream: slices.Concat(
+				bedrockChunk(`{"type":"message_start"}`),
+				eventStreamMessage(map[string]string{":message-type": "exception", ":exception-type": "throttlingException"}, []byte(`{"message":"Too many tokens"}`)),
+			),
+			want: "event: message_start\n" + `data: {"type":"message_start"}` + "\n\n" +
+				"event: error\n" + `data: {"type":"error","error":{"type":"rate_limit_error","message":"Too many tokens"}}` + "\n\n",
+		},
+		{
+			name:   "unknown exception",
+			stream: eventStreamMessage(map[string]string{":message-type": "exception", ":exception-type": "internalServerException"}, []byte(`{"message":"boom"}`)),
+			want:   "event: error\n" + `data: {"type":"error","error":{"type":"api_error","message":"boom"}}` + "\n\n",
+		},
+		{
+			name:   "error message",
+			stream: eventStreamMessage(map[string]string{":message-type": "error", ":error-message": "stream broke"}, nil),
+			want:   "event: error\n" + `data: {"type":"error","error":{"type":"api_error","message":"stream broke"}}` + "\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := io.NopCloser(bytes.NewReader(tt.stream))
+			got, err := io.ReadAll(&bedrockEventReader{body: body, r: bufio.NewReader(body)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	// 消息损坏时读取出错，已转换的事件照常返回
+	stream := slices.Concat(bedrockChunk(`{"type":"message_start"}`), []byte{0, 0, 0, 20, 0, 0, 0, 0, 1, 2, 3, 4})
+	body := io.NopCloser(bytes.NewReader(stream))
+	got, err := io.ReadAll(&bedrockEventReader{body: body, r: bufio.NewReader(body)})
+	if err == nil || string(got) != "event: message_start\n"+`data: {"type":"message_start"}`+"\n\n" {
+		t.Errorf("corrupt stream read as %q, %v", got, err)
+	}
+}
+
+func TestBedrockStreamResponseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"throttled", http.StatusTooManyRequests, `{"message":"Too many requests, please wait before trying again."}`, `{"type":"error","error":{"type":"rate_limit_error","message":"Too many requests, please wait before trying again."}}`},
+		{"validation", http.StatusBadRequest, `{"message":"messages: roles must alternate"}`, `{"type":"error","error":{"type":"invalid_request_error","message":"messages: roles must alternate"}}`},
+		{"plain text", http.StatusServiceUnavailable, "Service Unavailable\n", `{"type":"error","error":{"type":"overloaded_error","message":"Service Unavailable"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tt.status,
+				Header:     http.Header{"Content-Type": {"application/json"}, "X-Amzn-Requestid": {"req-1"}},
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+			}
+			resp = bedrockProvider{}.StreamResponse(resp)
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("body %s, want %s", body, tt.want)
+			}
+			if resp.ContentLength != int64(len(body)) || resp.Header.Get("request-id") != "req-1" {
+				t.Errorf("length %d, request-id %q", resp.ContentLength, resp.Header.Get("request-id"))
+			}
+		})
+	}
+}
+
+func TestBedrockProvider(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-bedrock"
+		c.BedrockModels = map[string]string{"claude-bedrock": "anthropic.claude-3-5-sonnet-20240620-v1:0"}
+		c.BedrockRegions = []string{"us-west-2"}
+		c.BedrockAccessKey = "AKID"
+		c.BedrockSecretKey = "secret"
+		c.BedrockSessionToken = "session"
+		c.ModelRegions = nil
+		c.ModelAliases = nil
+		c.ModelFailover = nil
+	})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "bedrock-runtime.us-west-2.amazonaws.com" {
+			t.Errorf("host %s", r.Host)
+		}
+		if want := "/model/anthropic.claude-3-5-sonnet-20240620-v1%3A0/invoke-with-response-stream"; r.URL.EscapedPath() != want {
+			t.Errorf("path %s, want %s", r.URL.EscapedPath(), want)
+		}
+		if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-west-2/bedrock/aws4_request") || !strings.Contains(auth, "x-amz-security-token") {
+			t.Errorf("Authorization = %s", auth)
+		}
+		if r.Header.Get("X-Amz-Security-Token") != "session" {
+			t.Errorf("X-Amz-Security-Token = %q", r.Header.Get("X-Amz-Security-Token"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if string(fields["anthropic_version"]) != `"bedrock-2023-05-31"` || fields["model"] != nil || fields["stream"] != nil {
+			t.Errorf("body %s", body)
+		}
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		w.Header().Set("X-Amzn-Requestid", "req-bedrock")
+		w.Write(bedrockTranscript())
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	swap(t, &upstreamClient, &http.Client{Transport: redirectTransport{target}})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"model":"claude-bedrock","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusOK || w.Body.String() != sseTranscript {
+		t.Fatalf("got %d:\n%s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Upstream-Request-Id"); got != "req-bedrock" {
+		t.Errorf("X-Upstream-Request-Id = %q", got)
+	}
+	if got := w.Header().Get("X-Served-Region"); got != "us-west-2" {
+		t.Errorf("X-Served-Region = %q", got)
+	}
+
+	// 模型不在 BEDROCK_MODELS 中时不构造请求
+	if _, err := (bedrockProvider{}).BuildRequest(context.Background(), "us-west-2", "claude-other", strings.NewReader(`{}`)); !errors.As(err, new(*GatewayError)) {
+		t.Errorf("unknown model: err = %v, want a GatewayError", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// validationEnabled reports whether request bodies are validated, which
+// requires reading them before anything else is checked.
+func validationEnabled() bool {
+	return flags.Enabled(flagStrictValidation) || flags.Enabled(flagValidateParams) || flags.Enabled(flagValidateTools)
+}
+
+// needsBufferedBody reports whether the request body has to be read into
+// memory before it is forwarded: because its size is capped, it selects the
+// model, it is rewritten (by guardrails, a
+// default system prompt, user ID injection, request transformers or stream
+// aggregation), kept for capture or shadowing, or may be replayed against
+// another region on failover. All other bodies are streamed to the upstream
+// as they arrive.
+func needsBufferedBody(key *APIKey, regions []string, capture, shadow, aggregate bool) bool {
+	return rewritesBody(key) || modelSelectable(key) || requestLimitsFor(key).active() || systemPromptFor(key) != "" || flags.Enabled(flagInjectUserID) || len(requestPipeline) > 0 || capture || shadow || aggregate || len(regions) > 1
+}
+
+// readRequestBody reads the whole request body. The result is never nil on
+// success, so callers can use nil to tell a streamed body apart.
+func readRequestBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		body = []byte{}
+	}
+	logf(r.Context(), "Request body: %s", string(body))
+	return body, nil
+}
+
+// prepareRequestBody caps the request body at MAX_REQUEST_BYTES and inflates
+// a gzip-encoded body, so everything downstream sees the plain JSON that is
+// forwarded to Vertex AI. The cap applies to the decompressed size as well,
+// which stops small archives that expand without bound. It reports false
+// after answering the request itself.
+func prepareRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	limit := int64(cfg().MaxRequestBytes)
+	if limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return true
+	case "gzip":
+	default:
+		respondError(w, r, &GatewayError{Code: codeInvalidRequest, Status: http.StatusUnsupportedMediaType, Message: "Unsupported Content-Encoding " + strconv.Quote(encoding) + ", only gzip is accepted"})
+		return false
+	}
+
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		respondError(w, r, bodyError(err))
+		return false
+	}
+	var decoded io.Reader = zr
+	if limit > 0 {
+		// 多读一个字节用于判断解压后是否超出上限
+		decoded = io.LimitReader(zr, limit+1)
+	}
+	body, err := io.ReadAll(decoded)
+	if err == nil {
+		err = zr.Close()
+	}
+	if err != nil {
+		respondError(w, r, bodyError(err))
+		return false
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		logf(r.Context(), "Decompressed request body exceeds %d bytes", limit)
+		respondError(w, r, &http.MaxBytesError{Limit: limit})
+		return false
+	}
+
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Del("Content-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return true
+}
+
+// bodyError classifies an error reading the request body: 413 when it is
+// larger than MAX_REQUEST_BYTES, 400 otherwise.
+func bodyError(err error) error {
+	if errors.As(err, new(*http.MaxBytesError)) {
+		return err
+	}
+	return invalidRequest("Error reading request body").withDetail(err)
+}
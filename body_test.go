@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNeedsBufferedBody(t *testing.T) {
+	maxTemperature := 0.5
+	maxMessages := 10
+	setConfig(t, func(c *Config) {
+		c.MaxMessages = 0
+		c.MaxInputTokens = 0
+		c.DefaultSystemPrompt = ""
+	})
+	swap(t, &requestPipeline, nil)
+	forced := APIKey{ForcedModel: "claude-a"}
+	tests := []struct {
+		name      string
+		key       APIKey
+		regions   []string
+		capture   bool
+		aggregate bool
+		want      bool
+	}{
+		{"forced model streams", forced, []string{"us-east5"}, false, false, false},
+		{"model chosen by the body", APIKey{}, []string{"us-east5"}, false, false, true},
+		{"temperature cap", APIKey{ForcedModel: "claude-a", MaxTemperature: &maxTemperature}, []string{"us-east5"}, false, false, true},
+		{"message limit", APIKey{ForcedModel: "claude-a", MaxMessages: &maxMessages}, []string{"us-east5"}, false, false, true},
+		{"system prompt", APIKey{ForcedModel: "claude-a", SystemPrompt: "be brief"}, []string{"us-east5"}, false, false, true},
+		{"failover", forced, []string{"us-east5", "europe-west1"}, false, false, true},
+		{"capture", forced, []string{"us-east5"}, true, false, true},
+		{"aggregation", forced, []string{"us-east5"}, false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := needsBufferedBody(&tt.key, tt.regions, tt.capture, false, tt.aggregate); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLargeBodyStreamedToUpstream(t *testing.T) {
+	const model = "claude-test@20250101"
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = model
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.VertexAPIVersion = "v1"
+		c.VertexPublisher = "anthropic"
+		c.MaxMessages = 0
+		c.MaxInputTokens = 0
+		c.DefaultSystemPrompt = ""
+	})
+	swap(t, &requestPipeline, nil)
+	swap[TokenProvider](t, &tokenProvider, staticTokenProvider("fake-token"))
+	swap(t, &accessToken, "")
+	if err := refreshAccessToken(); err != nil {
+		t.Fatal(err)
+	}
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier, ForcedModel: model})
+
+	const image = 4 << 20
+	head := `{"model":"claude-other","messages":[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"`
+	tail := `"}}]}],"stream":true}`
+
+	// 上游收到大部分请求体时客户端还没有发完，说明网关没有先整体缓冲
+	arrived := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body strings.Builder
+		buf := make([]byte, 64<<10)
+		signalled := false
+		for {
+			n, err := r.Body.Read(buf)
+			body.Write(buf[:n])
+			if !signalled && body.Len() >= image {
+				close(arrived)
+				signalled = true
+			}
+			if err != nil {
+				break
+			}
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(body.String()), &fields); err != nil {
+			t.Errorf("upstream got %d bytes that aren't JSON: %v", body.Len(), err)
+		}
+		if _, ok := fields["model"]; ok {
+			t.Error("upstream body still names a model")
+		}
+		streamSSE(w, sseTranscript)
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	swap(t, &vertexClient, &http.Client{Transport: redirectTransport{target}})
+
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, head)
+		io.WriteString(pw, strings.Repeat("A", image))
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			pw.CloseWithError(io.ErrUnexpectedEOF)
+			return
+		}
+		io.WriteString(pw, tail)
+		pw.Close()
+	}()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/messages", pr)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("x-api-key", "k")
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, r)
+	select {
+	case <-arrived:
+	default:
+		t.Fatal("upstream only got the body after the client finished sending it")
+	}
+	if w.Code != http.StatusOK || w.Body.String() != sseTranscript {
+		t.Errorf("got %d:\n%s", w.Code, w.Body)
+	}
+}
+
+// gzipped compresses s.
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(zw, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestCompressedRequestBody(t *testing.T) {
+	const limit = 1 << 20
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.MaxRequestBytes = limit
+	})
+	var forwarded string
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		forwarded = string(body)
+		if enc := r.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("forwarded with Content-Encoding %q", enc)
+		}
+		streamSSE(w, sseTranscript)
+	})
+	plain := `{"messages":[{"role":"user","content":"hi"}],"stream":true}`
+	// 压缩后只有几 KB，解压后远超上限
+	bomb := gzipped(t, `{"messages":[{"role":"user","content":"`+strings.Repeat("a", 16*limit)+`"}]}`)
+	if len(bomb) >= limit {
+		t.Fatalf("zip bomb is %d bytes compressed, want it under the limit", len(bomb))
+	}
+
+	tests := []struct {
+		name       string
+		encoding   string
+		body       string
+		wantStatus int
+	}{
+		{"plain", "", plain, http.StatusOK},
+		{"gzip", "gzip", gzipped(t, plain), http.StatusOK},
+		{"gzip, mixed case", " GZip ", gzipped(t, plain), http.StatusOK},
+		{"zip bomb", "gzip", bomb, http.StatusRequestEntityTooLarge},
+		{"corrupt gzip", "gzip", plain, http.StatusBadRequest},
+		{"truncated gzip", "gzip", gzipped(t, plain)[:20], http.StatusBadRequest},
+		{"unsupported encoding", "br", plain, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+			forwarded = ""
+			r := newMessagesRequest("k", tt.body)
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if forwarded != "" || auth.remaining("k") != 10 {
+					t.Errorf("rejected body forwarded or charged: %q", forwarded)
+				}
+				return
+			}
+			if !strings.Contains(forwarded, `"content":"hi"`) {
+				t.Errorf("upstream got %q, want the decompressed JSON", forwarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "net/http"
+
+// writeKeyError writes a quota or access error for key. White-labelled keys
+// get their brand name and support URL in the error, and the support URL in
+// the message, so resellers' customers know where to turn; other keys get
+// the generic error. key may be nil.
+func writeKeyError(w http.ResponseWriter, key *APIKey, status int, errType, message string) {
+	var resp ErrorResponse
+	resp.Error.Type = errType
+	resp.Error.Message = message
+	if key != nil {
+		resp.Error.BrandName = key.BrandName
+		resp.Error.SupportURL = key.SupportURL
+		switch {
+		case key.BrandName != "" && key.SupportURL != "":
+			resp.Error.Message += ". Contact " + key.BrandName + " support at " + key.SupportURL
+		case key.SupportURL != "":
+			resp.Error.Message += ". Contact support at " + key.SupportURL
+		}
+	}
+	writeJSON(w, status, resp)
+}
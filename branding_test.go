@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteKeyError(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         *APIKey
+		wantMessage string
+	}{
+		{"no key", nil, "Rate limit exceeded"},
+		{"default key", &APIKey{}, "Rate limit exceeded"},
+		{"brand and support URL", &APIKey{BrandName: "Acme AI", SupportURL: "https://acme.example/help"}, "Rate limit exceeded. Contact Acme AI support at https://acme.example/help"},
+		{"support URL only", &APIKey{SupportURL: "https://acme.example/help"}, "Rate limit exceeded. Contact support at https://acme.example/help"},
+		{"brand only", &APIKey{BrandName: "Acme AI"}, "Rate limit exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeKeyError(w, tt.key, http.StatusTooManyRequests, codeRateLimit, "Rate limit exceeded")
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusTooManyRequests || resp.Error.Message != tt.wantMessage {
+				t.Errorf("got %d %q, want 429 %q", w.Code, resp.Error.Message, tt.wantMessage)
+			}
+			var brand, support string
+			if tt.key != nil {
+				brand, support = tt.key.BrandName, tt.key.SupportURL
+			}
+			if resp.Error.BrandName != brand || resp.Error.SupportURL != support {
+				t.Errorf("brand %q, support URL %q", resp.Error.BrandName, resp.Error.SupportURL)
+			}
+		})
+	}
+}
+
+func TestBrandedQuotaErrors(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	useKeys(t,
+		&APIKey{Key: "generic", RemainingCalls: 0, Tier: defaultTier},
+		&APIKey{Key: "branded", RemainingCalls: 0, Tier: defaultTier, BrandName: "Acme AI", SupportURL: "https://acme.example/help"},
+	)
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request without calls left reached the upstream")
+	})
+
+	tests := []struct {
+		key         string
+		wantBrand   string
+		wantSupport string
+	}{
+		{"generic", "", ""},
+		{"branded", "Acme AI", "https://acme.example/help"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest(tt.key, `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("status %d, want 403: %s", w.Code, w.Body)
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error.BrandName != tt.wantBrand || resp.Error.SupportURL != tt.wantSupport {
+				t.Errorf("error %+v", resp.Error)
+			}
+			if branded := strings.Contains(resp.Error.Message, "Contact"); branded != (tt.wantSupport != "") {
+				t.Errorf("message %q", resp.Error.Message)
+			}
+		})
+	}
+}
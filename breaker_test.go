@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+	tests := []struct {
+		name  string
+		steps func(b *circuitBreaker)
+		want  breakerState
+		allow bool
+	}{
+		{"closed below the threshold", func(b *circuitBreaker) {
+			b.Record(false)
+			b.Record(false)
+		}, breakerClosed, true},
+		{"success resets the failure count", func(b *circuitBreaker) {
+			b.Record(false)
+			b.Record(false)
+			b.Record(true)
+			b.Record(false)
+		}, breakerClosed, true},
+		{"opens at the threshold", func(b *circuitBreaker) {
+			for range 3 {
+				b.Record(false)
+			}
+		}, breakerOpen, false},
+		{"half-opens after the cooldown", func(b *circuitBreaker) {
+			for range 3 {
+				b.Record(false)
+			}
+			time.Sleep(cooldown)
+			if !b.Allow() {
+				t.Error("probe refused after the cooldown")
+			}
+		}, breakerHalfOpen, false},
+		{"successful probe closes", func(b *circuitBreaker) {
+			for range 3 {
+				b.Record(false)
+			}
+			time.Sleep(cooldown)
+			b.Allow()
+			b.Record(true)
+		}, breakerClosed, true},
+		{"failed probe re-opens", func(b *circuitBreaker) {
+			for range 3 {
+				b.Record(false)
+			}
+			time.Sleep(cooldown)
+			b.Allow()
+			b.Record(false)
+		}, breakerOpen, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(3, cooldown)
+			tt.steps(b)
+			if got := b.State(); got != tt.want {
+				t.Errorf("state %v, want %v", got, tt.want)
+			}
+			if got := b.Allow(); got != tt.allow {
+				t.Errorf("Allow() = %v, want %v", got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestOpenBreakerFailsFast(t *testing.T) {
+	b := newCircuitBreaker(1, time.Minute)
+	b.Record(false)
+	swap(t, &breaker, b)
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the upstream through an open breaker")
+	})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}]}`))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503: %s", w.Code, w.Body)
+	}
+	if got := auth.remaining("k"); got != 5 {
+		t.Errorf("key has %d calls left, want 5", got)
+	}
+
+	w = httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "llm_gateway_circuit_breaker_state 1\n") {
+		t.Error("/metrics doesn't report the open breaker")
+	}
+}
+
+func TestUpstreamFailuresOpenBreaker(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.FailoverCooldown = 0
+	})
+	swap(t, &breaker, newCircuitBreaker(2, time.Minute))
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal", http.StatusInternalServerError)
+	})
+
+	for i := range 2 {
+		w := httptest.NewRecorder()
+		handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}]}`))
+		if w.Code == http.StatusOK {
+			t.Fatalf("request %d succeeded against a failing upstream", i+1)
+		}
+	}
+	if got := breaker.State(); got != breakerOpen {
+		t.Errorf("breaker %v after two upstream failures, want open", got)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// expiringCache is a concurrency-safe map whose entries expire after a TTL.
+// Expired entries are invisible to Get and are removed by Reap, which the
+// janitor calls periodically.
+type expiringCache[K comparable, V any] struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[K]cacheEntry[V]
+}
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newExpiringCache[K comparable, V any](ttl time.Duration) *expiringCache[K, V] {
+	return &expiringCache[K, V]{ttl: ttl, items: make(map[K]cacheEntry[V])}
+}
+
+func (c *expiringCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.items[key]
+	if !ok || time.Now().After(entry.expires) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Set stores value with the cache's default TTL.
+func (c *expiringCache[K, V]) Set(key K, value V) {
+	c.SetUntil(key, value, time.Now().Add(c.ttl))
+}
+
+// SetUntil stores value with an explicit expiry time.
+func (c *expiringCache[K, V]) SetUntil(key K, value V, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items[key] = cacheEntry[V]{value: value, expires: expires}
+}
+
+func (c *expiringCache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.items, key)
+}
+
+// Reap removes expired entries and returns how many were evicted.
+func (c *expiringCache[K, V]) Reap() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	evicted := 0
+	for key, entry := range c.items {
+		if now.After(entry.expires) {
+			delete(c.items, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+func (c *expiringCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// reaper is anything holding expiring state the janitor should clean up.
+type reaper interface {
+	Reap() int
+}
+
+// janitor periodically reaps every registered cache from one goroutine.
+type janitor struct {
+	mu        sync.Mutex
+	reapers   map[string]reaper
+	evictions map[string]int64
+}
+
+var cacheJanitor = &janitor{
+	reapers:   make(map[string]reaper),
+	evictions: make(map[string]int64),
+}
+
+func (j *janitor) Register(name string, r reaper) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.reapers[name] = r
+}
+
+// Run reaps on every tick until ctx is cancelled.
+func (j *janitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.reapAll()
+		}
+	}
+}
+
+func (j *janitor) reapAll() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for name, r := range j.reapers {
+		if n := r.Reap(); n > 0 {
+			j.evictions[name] += int64(n)
+			log.Printf("Janitor evicted %d expired entries from %s", n, name)
+		}
+	}
+}
+
+// Evictions returns the cumulative eviction count per cache, sorted by name.
+func (j *janitor) Evictions() ([]string, []int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	names := make([]string, 0, len(j.reapers))
+	for name := range j.reapers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counts := make([]int64, len(names))
+	for i, name := range names {
+		counts[i] = j.evictions[name]
+	}
+	return names, counts
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExpiringCacheReap(t *testing.T) {
+	c := newExpiringCache[string, int](time.Hour)
+	c.Set("live", 1)
+	c.SetUntil("expired", 2, time.Now().Add(-time.Second))
+	c.SetUntil("also expired", 3, time.Now().Add(-time.Minute))
+
+	if _, ok := c.Get("expired"); ok {
+		t.Error("expired entry returned before reaping")
+	}
+	if n := c.Reap(); n != 2 {
+		t.Errorf("reaped %d entries, want 2", n)
+	}
+	if v, ok := c.Get("live"); !ok || v != 1 {
+		t.Errorf("live entry = (%d, %v) after reaping", v, ok)
+	}
+	if c.Len() != 1 {
+		t.Errorf("%d entries left, want 1", c.Len())
+	}
+	if n := c.Reap(); n != 0 {
+		t.Errorf("second reap evicted %d entries", n)
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	j := &janitor{reapers: make(map[string]reaper), evictions: make(map[string]int64)}
+	sessions := newExpiringCache[string, bool](time.Hour)
+	lockouts := newExpiringCache[string, bool](time.Hour)
+	j.Register("sessions", sessions)
+	j.Register("lockouts", lockouts)
+	sessions.SetUntil("a", true, time.Now().Add(-time.Second))
+	sessions.SetUntil("b", true, time.Now().Add(-time.Second))
+	sessions.Set("c", true)
+	lockouts.Set("d", true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		j.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+	waitFor(t, "the janitor to reap", func() bool { return sessions.Len() == 1 })
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("janitor kept running after its context ended")
+	}
+
+	names, counts := j.Evictions()
+	if !slices.Equal(names, []string{"lockouts", "sessions"}) || !slices.Equal(counts, []int64{0, 2}) {
+		t.Errorf("evictions %v %v, want lockouts 0 and sessions 2", names, counts)
+	}
+	if lockouts.Len() != 1 {
+		t.Error("live entry reaped")
+	}
+}
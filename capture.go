@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CaptureStore persists sampled request/response pairs for quality review.
+type CaptureStore interface {
+	PutObject(ctx context.Context, key string, data []byte) error
+}
+
+var captureStore CaptureStore
+
+// s3Store writes objects to an S3-compatible bucket using path-style URLs.
+type s3Store struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s *s3Store) PutObject(ctx context.Context, key string, data []byte) error {
+	url := fmt.Sprintf("%s/%s/%s", strings.TrimRight(s.endpoint, "/"), s.bucket, key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signV4(req, data, s.accessKey, s.secretKey, s.region, "s3", time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("put object failed: status=%d, body=%s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// shouldCapture decides whether this request's bodies are sampled.
+func shouldCapture(optOut bool) bool {
+	if captureStore == nil || optOut || cfg().CaptureSampleRate <= 0 || !flags.Enabled(flagCapture) {
+		return false
+	}
+	return rand.Float64() < cfg().CaptureSampleRate
+}
+
+// captureExchange uploads a request/response pair in the background so the
+// streamed response is never delayed by the store.
+func captureExchange(apiKey string, reqBody, respBody []byte) {
+	now := time.Now().UTC()
+	id := keyID(apiKey)
+	record, err := json.Marshal(struct {
+		KeyID     string          `json:"key_id"`
+		Timestamp time.Time       `json:"timestamp"`
+		Request   json.RawMessage `json:"request"`
+		Response  string          `json:"response"`
+	}{id, now, reqBody, string(respBody)})
+	if err != nil {
+		log.Printf("Error encoding capture: %v", err)
+		return
+	}
+	objectKey := fmt.Sprintf("captures/%s/%s-%d.json", now.Format("2006/01/02"), id, now.UnixNano())
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := captureStore.PutObject(ctx, objectKey, record); err != nil {
+			log.Printf("Error storing capture %s: %v", objectKey, err)
+		}
+	}()
+}
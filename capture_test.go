@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore keeps captured objects in memory.
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	put     chan string
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: make(map[string][]byte), put: make(chan string, 16)}
+}
+
+func (s *memStore) PutObject(_ context.Context, key string, data []byte) error {
+	s.mu.Lock()
+	s.objects[key] = data
+	s.mu.Unlock()
+	s.put <- key
+	return nil
+}
+
+func TestShouldCapture(t *testing.T) {
+	tests := []struct {
+		name     string
+		store    bool
+		rate     float64
+		flag     bool
+		optOut   bool
+		wantRate float64
+	}{
+		{"always sampled", true, 1, true, false, 1},
+		{"never sampled", true, 0, true, false, 0},
+		{"partial sampling", true, 0.3, true, false, 0.3},
+		{"key opted out", true, 1, true, true, 0},
+		{"flag off", true, 1, false, false, 0},
+		{"no store", false, 1, true, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.CaptureSampleRate = tt.rate })
+			setFlag(t, flagCapture, tt.flag)
+			var store CaptureStore
+			if tt.store {
+				store = newMemStore()
+			}
+			swap(t, &captureStore, store)
+
+			const n = 10000
+			sampled := 0
+			for range n {
+				if shouldCapture(tt.optOut) {
+					sampled++
+				}
+			}
+			if got := float64(sampled) / n; got < tt.wantRate-0.03 || got > tt.wantRate+0.03 {
+				t.Errorf("sampled %.3f of requests, want %.2f", got, tt.wantRate)
+			}
+		})
+	}
+}
+
+func TestCaptureExchange(t *testing.T) {
+	store := newMemStore()
+	swap[CaptureStore](t, &captureStore, store)
+
+	captureExchange("secret-key", []byte(`{"messages":[]}`), []byte("event: message_stop\n\n"))
+	var key string
+	select {
+	case key = <-store.put:
+	case <-time.After(5 * time.Second):
+		t.Fatal("capture was not stored")
+	}
+	if !strings.HasPrefix(key, "captures/") || !strings.Contains(key, keyID("secret-key")) {
+		t.Errorf("object key %q", key)
+	}
+	store.mu.Lock()
+	data := store.objects[key]
+	store.mu.Unlock()
+	if strings.Contains(string(data), "secret-key") {
+		t.Error("capture contains the plaintext key")
+	}
+	var record struct {
+		KeyID    string          `json:"key_id"`
+		Request  json.RawMessage `json:"request"`
+		Response string          `json:"response"`
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.KeyID != keyID("secret-key") || string(record.Request) != `{"messages":[]}` || record.Response != "event: message_stop\n\n" {
+		t.Errorf("unexpected record %s", data)
+	}
+}
+
+func TestS3StorePutObject(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s := &s3Store{endpoint: srv.URL + "/", bucket: "captures-bucket", region: "us-east-1", accessKey: "AKID", secretKey: "secret", client: srv.Client()}
+	if err := s.PutObject(context.Background(), "captures/a.json", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != http.MethodPut || got.URL.Path != "/captures-bucket/captures/a.json" || string(body) != `{}` {
+		t.Errorf("got %s %s with %q", got.Method, got.URL.Path, body)
+	}
+	if auth := got.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request") {
+		t.Errorf("Authorization = %q", auth)
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// translatedMessagesRequest is the part of a Messages API body that is
+// translated for upstreams speaking another API: OpenAI chat completions or
+// Gemini.
+type translatedMessagesRequest struct {
+	System        json.RawMessage   `json:"system"`
+	Messages      []messagesMessage `json:"messages"`
+	MaxTokens     *int              `json:"max_tokens"`
+	Temperature   *float64          `json:"temperature"`
+	TopP          *float64          `json:"top_p"`
+	TopK          *int              `json:"top_k"`
+	StopSequences []string          `json:"stop_sequences"`
+	Stream        bool              `json:"stream"`
+	Metadata      struct {
+		UserID string `json:"user_id"`
+	} `json:"metadata"`
+	Tools []struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		InputSchema json.RawMessage `json:"input_schema"`
+	} `json:"tools"`
+	ToolChoice *struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	} `json:"tool_choice"`
+}
+
+type messagesMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// messagesBlock is a content block of a Messages API message.
+type messagesBlock struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Source struct {
+		Type      string `json:"type"`
+		MediaType string `json:"media_type"`
+		Data      string `json:"data"`
+		URL       string `json:"url"`
+	} `json:"source"`
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content"`
+}
+
+// messagesBlocks decodes message content, a string or an array of blocks.
+func messagesBlocks(content json.RawMessage) ([]messagesBlock, error) {
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return []messagesBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []messagesBlock
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		return nil, errors.New("must be a string or an array of content blocks")
+	}
+	return blocks, nil
+}
+
+// blocksText joins the text of content given as a string or blocks; other
+// blocks are dropped.
+func blocksText(content json.RawMessage) string {
+	if len(content) == 0 || string(content) == "null" {
+		return ""
+	}
+	blocks, err := messagesBlocks(content)
+	if err != nil {
+		return ""
+	}
+	var texts []string
+	for _, b := range blocks {
+		if b.Type == "text" && b.Text != "" {
+			texts = append(texts, b.Text)
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// translateMessagesRequest converts a Messages API body into a chat
+// completions request for model. The system prompt becomes a system message,
+// tool_use and tool_result blocks become tool calls and tool messages, and
+// streams ask for a final usage chunk. Thinking blocks and parameters
+// without an equivalent, such as top_k, are dropped. It also reports whether
+// the request streams.
+func translateMessagesRequest(body []byte, model string) ([]byte, bool, error) {
+	var req translatedMessagesRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, false, fmt.Errorf("invalid request body: %v", err)
+	}
+
+	var messages []map[string]any
+	if system := blocksText(req.System); system != "" {
+		messages = append(messages, map[string]any{"role": "system", "content": system})
+	}
+	for i, m := range req.Messages {
+		blocks, err := messagesBlocks(m.Content)
+		if err != nil {
+			return nil, false, fmt.Errorf("messages[%d].content: %v", i, err)
+		}
+		var (
+			parts []map[string]any
+			calls []openAIToolCall
+			text  []string
+		)
+		for _, b := range blocks {
+			switch b.Type {
+			case "text":
+				parts = append(parts, map[string]any{"type": "text", "text": b.Text})
+				text = append(text, b.Text)
+			case "image":
+				url := b.Source.URL
+				if b.Source.Type == "base64" {
+					url = "data:" + b.Source.MediaType + ";base64," + b.Source.Data
+				}
+				parts = append(parts, map[string]any{"type": "image_url", "image_url": map[string]string{"url": url}})
+			case "tool_use":
+				input := string(b.Input)
+				if input == "" {
+					input = "{}"
+				}
+				calls = append(calls, openAIToolCall{ID: b.ID, Type: "function", Function: openAIFunctionCall{Name: b.Name, Arguments: input}})
+			case "tool_result":
+				// 工具结果需紧跟在助手的 tool_calls 之后，先于同一消息中的其他内容
+				messages = append(messages, map[string]any{"role": "tool", "tool_call_id": b.ToolUseID, "content": blocksText(b.Content)})
+			}
+		}
+		switch m.Role {
+		case "user":
+			if len(parts) > 0 {
+				messages = append(messages, map[string]any{"role": "user", "content": parts})
+			}
+		case "assistant":
+			msg := map[string]any{"role": "assistant", "content": strings.Join(text, "")}
+			if len(text) == 0 {
+				msg["content"] = nil
+			}
+			if len(calls) > 0 {
+				msg["tool_calls"] = calls
+			}
+			messages = append(messages, msg)
+		default:
+			return nil, false, fmt.Errorf("messages[%d].role: unsupported role %q", i, m.Role)
+		}
+	}
+
+	out := map[string]any{"messages": messages}
+	if model != "" {
+		out["model"] = model
+	}
+	if req.MaxTokens != nil {
+		out["max_tokens"] = *req.MaxTokens
+	}
+	if req.Temperature != nil {
+		out["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		out["top_p"] = *req.TopP
+	}
+	if len(req.StopSequences) > 0 {
+		out["stop"] = req.StopSequences
+	}
+	if req.Metadata.UserID != "" {
+		out["user"] = req.Metadata.UserID
+	}
+	if req.Stream {
+		out["stream"] = true
+		out["stream_options"] = map[string]bool{"include_usage": true}
+	}
+	if len(req.Tools) > 0 {
+		tools := make([]map[string]any, 0, len(req.Tools))
+		for _, t := range req.Tools {
+			function := map[string]any{"name": t.Name}
+			if t.Description != "" {
+				function["description"] = t.Description
+			}
+			if len(t.InputSchema) > 0 {
+				function["parameters"] = t.InputSchema
+			}
+			tools = append(tools, map[string]any{"type": "function", "function": function})
+		}
+		out["tools"] = tools
+	}
+	if req.ToolChoice != nil {
+		switch req.ToolChoice.Type {
+		case "auto", "none":
+			out["tool_choice"] = req.ToolChoice.Type
+		case "any":
+			out["tool_choice"] = "required"
+		case "tool":
+			out["tool_choice"] = map[string]any{"type": "function", "function": map[string]string{"name": req.ToolChoice.Name}}
+		}
+	}
+	body, err := json.Marshal(out)
+	return body, req.Stream, err
+}
+
+// messagesStopReason maps a finish_reason to a Messages API stop_reason.
+func messagesStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+// translateChatCompletion converts a chat completion into a Messages API
+// response.
+func translateChatCompletion(body []byte) ([]byte, error) {
+	var resp struct {
+		ID      string `json:"id"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Message struct {
+				Content   *string          `json:"content"`
+				ToolCalls []openAIToolCall `json:"tool_calls"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage openAIUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	content := []map[string]any{}
+	stopReason := "end_turn"
+	if len(resp.Choices) > 0 {
+		choice := resp.Choices[0]
+		if choice.Message.Content != nil && *choice.Message.Content != "" {
+			content = append(content, map[string]any{"type": "text", "text": *choice.Message.Content})
+		}
+		for _, call := range choice.Message.ToolCalls {
+			content = append(content, map[string]any{"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": toolInput(call.Function.Arguments)})
+		}
+		stopReason = messagesStopReason(choice.FinishReason)
+	}
+	return json.Marshal(map[string]any{
+		"id":            resp.ID,
+		"type":          "message",
+		"role":          "assistant",
+		"model":         resp.Model,
+		"content":       content,
+		"stop_reason":   stopReason,
+		"stop_sequence": nil,
+		"usage":         map[string]int{"input_tokens": resp.Usage.PromptTokens, "output_tokens": resp.Usage.CompletionTokens},
+	})
+}
+
+// toolInput returns tool call arguments as a JSON object, wrapping arguments
+// that aren't valid JSON so the message stays well-formed.
+func toolInput(arguments string) json.RawMessage {
+	if strings.TrimSpace(arguments) == "" {
+		return json.RawMessage("{}")
+	}
+	if !json.Valid([]byte(arguments)) {
+		raw, _ := json.Marshal(map[string]string{"arguments": arguments})
+		return raw
+	}
+	return json.RawMessage(arguments)
+}
+
+// adaptChatCompletionsResponse adapts a chat completions response to the
+// Messages API: streams are translated chunk by chunk, completions and
+// errors in one piece.
+func adaptChatCompletionsResponse(resp *http.Response) *http.Response {
+	switch {
+	case resp.StatusCode == http.StatusOK && isEventStream(resp.Header):
+		resp.Body = &chatCompletionsEventReader{body: resp.Body, r: bufio.NewReader(resp.Body)}
+	case resp.StatusCode == http.StatusOK:
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			if translated, terr := translateChatCompletion(body); terr == nil {
+				body = translated
+			}
+		}
+		replaceResponseBody(resp, body)
+	case resp.StatusCode >= http.StatusBadRequest:
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		replaceResponseBody(resp, anthropicError(codeForStatus(resp.StatusCode), upstreamErrorMessage(body)))
+	}
+	return resp
+}
+
+// replaceResponseBody swaps resp's body for a JSON document.
+func replaceResponseBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.ContentLength = int64(len(body))
+}
+
+// messagesEventWriter writes Messages API events into buf for the readers
+// translating other streams, keeping track of the open content block.
+type messagesEventWriter struct {
+	buf     bytes.Buffer
+	started bool
+	block   int
+	open    string
+}
+
+func (w *messagesEventWriter) emit(eventType string, event map[string]any) {
+	event["type"] = eventType
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(&w.buf, "event: %s\ndata: %s\n\n", eventType, data)
+}
+
+// startBlock closes the open content block and opens a new one.
+func (w *messagesEventWriter) startBlock(kind string, block map[string]any) {
+	w.stopBlock()
+	w.open = kind
+	w.emit("content_block_start", map[string]any{"index": w.block, "content_block": block})
+}
+
+func (w *messagesEventWriter) stopBlock() {
+	if w.open == "" {
+		return
+	}
+	w.emit("content_block_stop", map[string]any{"index": w.block})
+	w.open = ""
+	w.block++
+}
+
+// chatCompletionsEventReader reads a chat completions stream as Messages API
+// events. Text and each tool call get their own content block; the final
+// message_delta waits for the usage chunk, which comes after the finish
+// reason, and is sent on data: [DONE].
+type chatCompletionsEventReader struct {
+	body io.ReadCloser
+	r    *bufio.Reader
+	err  error
+	messagesEventWriter
+
+	toolBlocks map[int]int
+	stopReason string
+	usage      openAIUsage
+}
+
+func (c *chatCompletionsEventReader) Read(p []byte) (int, error) {
+	for c.buf.Len() == 0 && c.err == nil {
+		c.err = c.next()
+	}
+	if c.buf.Len() > 0 {
+		return c.buf.Read(p)
+	}
+	return 0, c.err
+}
+
+func (c *chatCompletionsEventReader) Close() error {
+	return c.body.Close()
+}
+
+// next converts one chunk into buf.
+func (c *chatCompletionsEventReader) next() error {
+	event, err := readSSEEvent(c.r)
+	if err != nil {
+		return err
+	}
+	data, ok := sseEventData(event)
+	if !ok {
+		return nil
+	}
+	if string(data) == "[DONE]" {
+		c.stopBlock()
+		c.emit("message_delta", map[string]any{
+			"delta": map[string]any{"stop_reason": c.stopReason, "stop_sequence": nil},
+			"usage": map[string]int{"input_tokens": c.usage.PromptTokens, "output_tokens": c.usage.CompletionTokens},
+		})
+		c.emit("message_stop", map[string]any{})
+		return nil
+	}
+
+	var chunk struct {
+		ID      string `json:"id"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Delta struct {
+				Content   string           `json:"content"`
+				ToolCalls []openAIToolCall `json:"tool_calls"`
+			} `json:"delta"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage *openAIUsage `json:"usage"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return fmt.Errorf("invalid chat completions chunk: %w", err)
+	}
+	if chunk.Error != nil {
+		writeSSEError(&c.buf, codeAPI, chunk.Error.Message)
+		return nil
+	}
+	if !c.started {
+		c.started = true
+		c.toolBlocks = make(map[int]int)
+		c.emit("message_start", map[string]any{"message": map[string]any{
+			"id": chunk.ID, "type": "message", "role": "assistant", "model": chunk.Model, "content": []any{},
+			"stop_reason": nil, "stop_sequence": nil, "usage": map[string]int{"input_tokens": 0, "output_tokens": 0},
+		}})
+	}
+	if chunk.Usage != nil {
+		c.usage = *chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return nil
+	}
+	choice := chunk.Choices[0]
+	if choice.Delta.Content != "" {
+		if c.open != "text" {
+			c.startBlock("text", map[string]any{"type": "text", "text": ""})
+		}
+		c.emit("content_block_delta", map[string]any{"index": c.block, "delta": map[string]any{"type": "text_delta", "text": choice.Delta.Content}})
+	}
+	for _, call := range choice.Delta.ToolCalls {
+		i := 0
+		if call.Index != nil {
+			i = *call.Index
+		}
+		// 新的工具调用以 id 开始，之后的分片只携带参数
+		if call.ID != "" {
+			c.startBlock("tool_use", map[string]any{"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": map[string]any{}})
+			c.toolBlocks[i] = c.block
+		}
+		if block, ok := c.toolBlocks[i]; ok && block == c.block && call.Function.Arguments != "" {
+			c.emit("content_block_delta", map[string]any{"index": c.block, "delta": map[string]any{"type": "input_json_delta", "partial_json": call.Function.Arguments}})
+		}
+	}
+	if choice.FinishReason != nil && *choice.FinishReason != "" {
+		c.stopReason = messagesStopReason(*choice.FinishReason)
+		c.stopBlock()
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTranslateMessagesRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		model      string
+		want       string
+		wantStream bool
+	}{
+		{
+			name:  "system prompt and parameters",
+			body:  `{"model":"claude","system":[{"type":"text","text":"Be brief."}],"messages":[{"role":"user","content":"hi"}],"max_tokens":100,"temperature":0.5,"top_p":0.9,"top_k":5,"stop_sequences":["END"],"metadata":{"user_id":"u-1"},"stream":true}`,
+			model: "gpt-4o",
+			want: `{"max_tokens":100,"messages":[{"content":"Be brief.","role":"system"},{"content":[{"text":"hi","type":"text"}],"role":"user"}],"model":"gpt-4o","stop":["END"],` +
+				`"stream":true,"stream_options":{"include_usage":true},"temperature":0.5,"top_p":0.9,"user":"u-1"}`,
+			wantStream: true,
+		},
+		{
+			name: "tool use round trip",
+			body: `{"messages":[{"role":"user","content":[{"type":"text","text":"weather?"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}]},` +
+				`{"role":"assistant","content":[{"type":"thinking","thinking":"hmm"},{"type":"text","text":"Checking."},{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}]},` +
+				`{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"sunny"}]},{"type":"text","text":"thanks"}]}],` +
+				`"tools":[{"name":"get_weather","description":"Look up weather","input_schema":{"type":"object"}}],"tool_choice":{"type":"any"}}`,
+			want: `{"messages":[{"content":[{"text":"weather?","type":"text"},{"image_url":{"url":"data:image/png;base64,AAAA"},"type":"image_url"}],"role":"user"},` +
+				`{"content":"Checking.","role":"assistant","tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},` +
+				`{"content":"sunny","role":"tool","tool_call_id":"toolu_1"},{"content":[{"text":"thanks","type":"text"}],"role":"user"}],` +
+				`"tool_choice":"required","tools":[{"function":{"description":"Look up weather","name":"get_weather","parameters":{"type":"object"}},"type":"function"}]}`,
+		},
+		{
+			name: "tool call without text or input",
+			body: `{"messages":[{"role":"user","content":[{"type":"image","source":{"type":"url","url":"https://example.com/a.png"}}]},{"role":"assistant","content":[{"type":"tool_use","id":"t","name":"f"}]}],` +
+				`"tools":[{"name":"f"}],"tool_choice":{"type":"tool","name":"f"}}`,
+			want: `{"messages":[{"content":[{"image_url":{"url":"https://example.com/a.png"},"type":"image_url"}],"role":"user"},{"content":null,"role":"assistant","tool_calls":[{"id":"t","type":"function","function":{"name":"f","arguments":"{}"}}]}],` +
+				`"tool_choice":{"function":{"name":"f"},"type":"function"},"tools":[{"function":{"name":"f"},"type":"function"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, stream, err := translateMessagesRequest([]byte(tt.body), tt.model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			if stream != tt.wantStream {
+				t.Errorf("stream %v, want %v", stream, tt.wantStream)
+			}
+		})
+	}
+
+	for body, wantErr := range map[string]string{
+		`{"messages":`: "invalid request body",
+		`{"messages":[{"role":"system","content":"hi"}]}`: `messages[0].role: unsupported role "system"`,
+		`{"messages":[{"role":"user","content":1}]}`:      "messages[0].content: must be a string or an array of content blocks",
+	} {
+		if _, _, err := translateMessagesRequest([]byte(body), ""); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: err = %v, want it to mention %q", body, err, wantErr)
+		}
+	}
+}
+
+func TestTranslateChatCompletion(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "text",
+			body: `{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"message":{"content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`,
+			want: `{"content":[{"text":"Hello","type":"text"}],"id":"chatcmpl-1","model":"gpt-4o","role":"assistant","stop_reason":"end_turn","stop_sequence":null,"type":"message","usage":{"input_tokens":10,"output_tokens":5}}`,
+		},
+		{
+			name: "tool calls",
+			body: `{"id":"chatcmpl-2","model":"gpt-4o","choices":[{"message":{"content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{\"a\":1}"}},{"id":"call_2","type":"function","function":{"name":"g","arguments":"not json"}}]},"finish_reason":"tool_calls"}]}`,
+			want: `{"content":[{"id":"call_1","input":{"a":1},"name":"f","type":"tool_use"},{"id":"call_2","input":{"arguments":"not json"},"name":"g","type":"tool_use"}],"id":"chatcmpl-2","model":"gpt-4o","role":"assistant","stop_reason":"tool_use","stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}}`,
+		},
+		{
+			name: "cut off",
+			body: `{"id":"chatcmpl-3","model":"gpt-4o","choices":[{"message":{"content":"Once"},"finish_reason":"length"}]}`,
+			want: `{"content":[{"text":"Once","type":"text"}],"id":"chatcmpl-3","model":"gpt-4o","role":"assistant","stop_reason":"max_tokens","stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}}`,
+		},
+		{
+			name: "no choices",
+			body: `{"id":"chatcmpl-4","model":"gpt-4o","choices":[]}`,
+			want: `{"content":[],"id":"chatcmpl-4","model":"gpt-4o","role":"assistant","stop_reason":"end_turn","stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := translateChatCompletion([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// messagesEvent formats a Messages API event as the readers write it.
+func messagesEvent(eventType, data string) string {
+	return "event: " + eventType + "\ndata: " + data + "\n\n"
+}
+
+func TestChatCompletionsEventReader(t *testing.T) {
+	chunks := func(data ...string) string {
+		var b strings.Builder
+		for _, d := range data {
+			b.WriteString("data: " + d + "\n\n")
+		}
+		return b.String()
+	}
+	messageStart := messagesEvent("message_start", `{"message":{"content":[],"id":"c1","model":"gpt-4o","role":"assistant","stop_reason":null,"stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}},"type":"message_start"}`)
+	tests := []struct {
+		name   string
+		stream string
+		want   string
+	}{
+		{
+			name: "text and tool call",
+			stream: chunks(
+				`{"id":"c1","model":"gpt-4o","choices":[{"delta":{"role":"assistant","content":""},"finish_reason":null}]}`,
+				`{"id":"c1","model":"gpt-4o","choices":[{"delta":{"content":"Hello"}}]}`,
+				`{"choices":[{"delta":{"content":" world"}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"f","arguments":""}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"a\":"}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"1}"}}]}}]}`,
+				`{"choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+				`{"choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`,
+				`[DONE]`,
+			),
+			want: messageStart +
+				messagesEvent("content_block_start", `{"content_block":{"text":"","type":"text"},"index":0,"type":"content_block_start"}`) +
+				messagesEvent("content_block_delta", `{"delta":{"text":"Hello","type":"text_delta"},"index":0,"type":"content_block_delta"}`) +
+				messagesEvent("content_block_delta", `{"delta":{"text":" world","type":"text_delta"},"index":0,"type":"content_block_delta"}`) +
+				messagesEvent("content_block_stop", `{"index":0,"type":"content_block_stop"}`) +
+				messagesEvent("content_block_start", `{"content_block":{"id":"call_1","input":{},"name":"f","type":"tool_use"},"index":1,"type":"content_block_start"}`) +
+				messagesEvent("content_block_delta", `{"delta":{"partial_json":"{\"a\":","type":"input_json_delta"},"index":1,"type":"content_block_delta"}`) +
+				messagesEvent("content_block_delta", `{"delta":{"partial_json":"1}","type":"input_json_delta"},"index":1,"type":"content_block_delta"}`) +
+				messagesEvent("content_block_stop", `{"index":1,"type":"content_block_stop"}`) +
+				messagesEvent("message_delta", `{"delta":{"stop_reason":"tool_use","stop_sequence":null},"type":"message_delta","usage":{"input_tokens":10,"output_tokens":5}}`) +
+				messagesEvent("message_stop", `{"type":"message_stop"}`),
+		},
+		{
+			name: "error chunk",
+			stream: chunks(
+				`{"id":"c1","model":"gpt-4o","choices":[{"delta":{"content":"Hi"}}]}`,
+				`{"error":{"message":"The server had an error"}}`,
+			),
+			want: messageStart +
+				messagesEvent("content_block_start", `{"content_block":{"text":"","type":"text"},"index":0,"type":"content_block_start"}`) +
+				messagesEvent("content_block_delta", `{"delta":{"text":"Hi","type":"text_delta"},"index":0,"type":"content_block_delta"}`) +
+				messagesEvent("error", `{"type":"error","error":{"type":"api_error","message":"The server had an error"}}`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := io.NopCloser(strings.NewReader(tt.stream))
+			got, err := io.ReadAll(&chatCompletionsEventReader{body: body, r: bufio.NewReader(body)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	body := io.NopCloser(strings.NewReader("data: {not json\n\n"))
+	if _, err := io.ReadAll(&chatCompletionsEventReader{body: body, r: bufio.NewReader(body)}); err == nil || !strings.Contains(err.Error(), "invalid chat completions chunk") {
+		t.Errorf("invalid chunk: err = %v", err)
+	}
+}
+
+func TestAdaptChatCompletionsResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{
+			name:   "completion",
+			status: http.StatusOK,
+			body:   `{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"message":{"content":"Hello"},"finish_reason":"stop"}]}`,
+			want:   `{"content":[{"text":"Hello","type":"text"}],"id":"chatcmpl-1","model":"gpt-4o","role":"assistant","stop_reason":"end_turn","stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}}`,
+		},
+		{
+			name:   "rate limited",
+			status: http.StatusTooManyRequests,
+			body:   `{"error":{"message":"Rate limit reached","type":"requests"}}`,
+			want:   `{"type":"error","error":{"type":"rate_limit_error","message":"Rate limit reached"}}`,
+		},
+		{
+			name:   "server error without a body",
+			status: http.StatusInternalServerError,
+			want:   `{"type":"error","error":{"type":"api_error","message":"Upstream rejected the request"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := adaptChatCompletionsResponse(&http.Response{
+				StatusCode: tt.status,
+				Header:     http.Header{"Content-Type": {"application/json"}},
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+			})
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("got  %s\nwant %s", body, tt.want)
+			}
+			if resp.ContentLength != int64(len(body)) {
+				t.Errorf("Content-Length %d for %d bytes", resp.ContentLength, len(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseCIDRs parses a list of CIDRs or bare IPs, skipping invalid entries.
+func parseCIDRs(entries []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if addr, err := netip.ParseAddr(entry); err == nil {
+				prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid CIDR %q", entry)
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent the request. The
+// X-Forwarded-For chain is only honoured when the direct peer is a trusted
+// proxy; it is then walked right to left, skipping further trusted proxies,
+// so a client can't spoof its address by prepending entries.
+func clientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+	if !prefixesContain(cfg().TrustedProxies, addr) {
+		return addr
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !prefixesContain(cfg().TrustedProxies, addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// ipAllowed reports whether addr may use a key restricted to cidrs. Keys
+// without restrictions are allowed from anywhere.
+func ipAllowed(addr netip.Addr, cidrs []string) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	return addr.IsValid() && prefixesContain(parseCIDRs(cidrs), addr)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"XFF from an untrusted peer is ignored", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entries before the real client", "10.0.0.2:5000", []string{"192.0.2.99, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:5000", []string{"198.51.100.1, 10.0.0.3", "10.0.0.4"}, "198.51.100.1"},
+		{"malformed hop stops the walk", "10.0.0.2:5000", []string{"198.51.100.1, garbage"}, "10.0.0.2"},
+		{"IPv4-mapped IPv6", "[::ffff:203.0.113.7]:5000", nil, "203.0.113.7"},
+	}
+	setConfig(t, func(c *Config) { c.TrustedProxies = parseCIDRs([]string{"10.0.0.0/8"}) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(r); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("clientIP = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPAllowlist(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.TrustedProxies = parseCIDRs([]string{"10.0.0.2"})
+	})
+	auth := useKeys(t,
+		&APIKey{Key: "office", RemainingCalls: 5, Tier: defaultTier, AllowedCIDRs: []string{"198.51.100.0/24", "2001:db8::/32"}},
+		&APIKey{Key: "open", RemainingCalls: 5, Tier: defaultTier},
+	)
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+
+	tests := []struct {
+		name       string
+		key        string
+		remoteAddr string
+		xff        string
+		wantStatus int
+	}{
+		{"in-range IP", "office", "198.51.100.20:4000", "", http.StatusOK},
+		{"in-range IPv6", "office", "[2001:db8::1]:4000", "", http.StatusOK},
+		{"out-of-range IP", "office", "203.0.113.7:4000", "", http.StatusForbidden},
+		{"in range behind the trusted proxy", "office", "10.0.0.2:4000", "198.51.100.20", http.StatusOK},
+		{"spoofed XFF from an untrusted peer", "office", "203.0.113.7:4000", "198.51.100.20", http.StatusForbidden},
+		{"key without restriction", "open", "203.0.113.7:4000", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := auth.remaining(tt.key)
+			r := newMessagesRequest(tt.key, `{"messages":[{"role":"user","content":"hi"}],"stream":true}`)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusForbidden && auth.remaining(tt.key) != before {
+				t.Error("rejected request was charged")
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// coalescingWriter batches SSE events into fewer writes and flushes. Each
+// Write must carry whole events; buffered data is flushed once it reaches
+// maxBytes or interval after the first buffered write, so a flush never splits
+// an event. With a zero interval every write is flushed immediately.
+type coalescingWriter struct {
+	mu       sync.Mutex
+	w        http.ResponseWriter
+	interval time.Duration
+	maxBytes int
+	buf      bytes.Buffer
+	timer    *time.Timer
+	err      error
+	stopped  bool
+}
+
+func newCoalescingWriter(w http.ResponseWriter, interval time.Duration, maxBytes int) *coalescingWriter {
+	return &coalescingWriter{w: w, interval: interval, maxBytes: maxBytes}
+}
+
+func (c *coalescingWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.buf.Write(p)
+	if c.interval <= 0 || c.stopped || c.buf.Len() >= c.maxBytes {
+		return len(p), c.flushLocked()
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.interval, c.Flush)
+	}
+	return len(p), nil
+}
+
+// Flush writes out everything buffered. It implements http.Flusher.
+func (c *coalescingWriter) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+}
+
+func (c *coalescingWriter) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.buf.Len() == 0 || c.err != nil {
+		return c.err
+	}
+	if _, err := c.w.Write(c.buf.Bytes()); err != nil {
+		c.err = err
+		return err
+	}
+	c.buf.Reset()
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// Stop flushes pending data and makes later writes unbuffered. It must be
+// called before the handler returns so the timer never touches a finished
+// response.
+func (c *coalescingWriter) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	return c.flushLocked()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingWriter records every write reaching the client and counts flushes.
+type countingWriter struct {
+	http.ResponseWriter
+	mu      sync.Mutex
+	writes  []string
+	flushes int
+	err     error // 非空时所有写入都失败
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.writes = append(c.writes, string(p))
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *countingWriter) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushes++
+}
+
+func (c *countingWriter) counts() (writes, flushes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.writes), c.flushes
+}
+
+// tokenEvents are n small content_block_delta events, like a token-by-token
+// stream.
+func tokenEvents(n int) []string {
+	events := make([]string, n)
+	for i := range events {
+		events[i] = "event: content_block_delta\n" + fmt.Sprintf(`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"t%d"}}`, i) + "\n\n"
+	}
+	return events
+}
+
+func TestCoalescingWriter(t *testing.T) {
+	events := tokenEvents(20)
+	size := len(events[0])
+	tests := []struct {
+		name        string
+		interval    time.Duration
+		maxBytes    int
+		wantWrites  int
+		wantFlushes int
+	}{
+		{"disabled", 0, 4096, 20, 20},
+		{"everything until Stop", time.Hour, 1 << 20, 1, 1},
+		{"size threshold", time.Hour, 5 * size, 4, 4},
+		{"threshold within an event", time.Hour, 5*size - 1, 4, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &countingWriter{ResponseWriter: httptest.NewRecorder()}
+			c := newCoalescingWriter(rec, tt.interval, tt.maxBytes)
+			for _, event := range events {
+				if _, err := c.Write([]byte(event)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.Stop(); err != nil {
+				t.Fatal(err)
+			}
+			if writes, flushes := rec.counts(); writes != tt.wantWrites || flushes != tt.wantFlushes {
+				t.Errorf("%d writes and %d flushes, want %d and %d", writes, flushes, tt.wantWrites, tt.wantFlushes)
+			}
+			for i, w := range rec.writes {
+				if !strings.HasSuffix(w, "\n\n") || !strings.HasPrefix(w, "event: ") {
+					t.Errorf("write %d splits an event: %q", i, w)
+				}
+			}
+			if got := strings.Join(rec.writes, ""); got != strings.Join(events, "") {
+				t.Error("client got other data than was written")
+			}
+		})
+	}
+}
+
+func TestCoalescingWriterInterval(t *testing.T) {
+	rec := &countingWriter{ResponseWriter: httptest.NewRecorder()}
+	c := newCoalescingWriter(rec, 10*time.Millisecond, 1<<20)
+	defer c.Stop()
+	c.Write([]byte(tokenEvents(1)[0]))
+	if writes, _ := rec.counts(); writes != 0 {
+		t.Fatal("written before the interval")
+	}
+	waitFor(t, "the interval flush", func() bool {
+		_, flushes := rec.counts()
+		return flushes == 1
+	})
+}
+
+func TestCoalescingWriterError(t *testing.T) {
+	gone := errors.New("broken pipe")
+	rec := &countingWriter{ResponseWriter: httptest.NewRecorder(), err: gone}
+	c := newCoalescingWriter(rec, time.Hour, 1<<20)
+	if _, err := c.Write([]byte("event: ping\ndata: {}\n\n")); err != nil {
+		t.Fatalf("buffered write failed: %v", err)
+	}
+	if err := c.Stop(); !errors.Is(err, gone) {
+		t.Errorf("Stop = %v, want the write error", err)
+	}
+	if _, err := c.Write([]byte("event: ping\ndata: {}\n\n")); !errors.Is(err, gone) {
+		t.Errorf("Write after a failure = %v, want the write error", err)
+	}
+}
+
+func TestCoalescedStreamIntegrity(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.SSECoalesceInterval = 5 * time.Millisecond
+		c.SSECoalesceBytes = 100
+	})
+	transcript := strings.Join(tokenEvents(50), "") + sseTranscript
+	_, body := relay(t, func(w http.ResponseWriter, r *http.Request) {
+		streamChunks(w, transcript, 37)
+	})
+	if body != transcript {
+		t.Errorf("client got\n%s\nwant the upstream events unchanged", body)
+	}
+}
+
+// BenchmarkCoalescingWriter reports the writes and flushes reaching the
+// client per streamed event, with and without coalescing.
+func BenchmarkCoalescingWriter(b *testing.B) {
+	events := tokenEvents(200)
+	for _, interval := range []time.Duration{0, 20 * time.Millisecond} {
+		b.Run(fmt.Sprintf("interval=%s", interval), func(b *testing.B) {
+			var writes, flushes int
+			for range b.N {
+				rec := &countingWriter{ResponseWriter: httptest.NewRecorder()}
+				c := newCoalescingWriter(rec, interval, 16<<10)
+				for _, event := range events {
+					c.Write([]byte(event))
+				}
+				c.Stop()
+				w, f := rec.counts()
+				writes += w
+				flushes += f
+			}
+			b.ReportMetric(float64(writes)/float64(b.N*len(events)), "writes/event")
+			b.ReportMetric(float64(flushes)/float64(b.N*len(events)), "flushes/event")
+		})
+	}
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the gateway settings derived from the environment.
+type Config struct {
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set. TLSReload
+	// picks up rotated files without a restart.
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion uint16
+	TLSReload     bool
+	// UpstreamCAFile adds root CAs for connections to Vertex AI, and
+	// UpstreamClientCertFile / UpstreamClientKeyFile present a client
+	// certificate to upstreams that require mTLS. UpstreamServerName
+	// overrides the name verified against the upstream certificate.
+	UpstreamCAFile         string
+	UpstreamClientCertFile string
+	UpstreamClientKeyFile  string
+	UpstreamServerName     string
+	// UpstreamDNSServer (host:port) resolves upstream host names instead of
+	// the system resolver; UpstreamDNSCacheTTL keeps the answers, 0 disables
+	// caching.
+	UpstreamDNSServer   string
+	UpstreamDNSCacheTTL time.Duration
+	// DBReplicaHosts are read replicas for lag-tolerant admin and usage
+	// queries; the primary is used when empty.
+	DBReplicaHosts []string
+	// AuthBackend selects how API keys are validated: db (the api_keys
+	// table) or introspection (an external service at AuthIntrospectionURL).
+	AuthBackend              string
+	AuthIntrospectionURL     string
+	AuthIntrospectionToken   string
+	AuthIntrospectionTimeout time.Duration
+	// OperatorKey is an emergency key that works without the database and
+	// isn't charged, limited to OperatorKeyRPM requests per minute. Disabled
+	// when empty.
+	OperatorKey    string
+	OperatorKeyRPM int
+	// DuplicateAuthHeaders is reject (400 for repeated x-api-key or
+	// Authorization headers) or first (use the first value).
+	DuplicateAuthHeaders string
+	// StartupMode is strict (fail fast on missing dependencies) or lenient
+	// (start degraded and retry in the background).
+	StartupMode string
+	// BasePath is the prefix all API routes are mounted under, for running
+	// behind a proxy that forwards a sub-path. BasePathIncludesOps also moves
+	// /health and /metrics under it.
+	BasePath            string
+	BasePathIncludesOps bool
+	// Projects are the Google Cloud projects requests are spread over by
+	// weight; ProjectCredentials maps a project to its own credentials file
+	// when it isn't reachable with the gateway's credentials.
+	Projects           []projectWeight
+	ProjectCredentials map[string]string
+	// Regions is the ordered list of Vertex AI locations to try. The first
+	// region is preferred; the rest are used for failover.
+	Regions []string
+	// VertexTargets replace the projects and Regions of Vertex AI requests
+	// with project and location pairs balanced by weight. StickyRouting
+	// keeps the requests of a key that use prompt caching on one target.
+	VertexTargets []vertexTarget
+	StickyRouting bool
+	// DefaultModel serves requests that don't select a model; AllowedModels
+	// are the other models a request body's "model" field may select.
+	DefaultModel  string
+	AllowedModels []string
+	// Warmup connects to every region's Vertex AI host at startup, waiting
+	// up to WarmupTimeout.
+	Warmup        bool
+	WarmupTimeout time.Duration
+	// VertexAPIVersion and VertexPublisher are the version and publisher
+	// segments of the Vertex AI model URL.
+	VertexAPIVersion string
+	VertexPublisher  string
+	// ModelRegions restricts models to the regions they are available in.
+	// When empty every model may use Regions.
+	ModelRegions map[string][]string
+	// ModelFailover lists, per model, the secondary models or aliases tried
+	// in order once every region of the model failed. Failed targets cool
+	// down for FailoverCooldown; FailoverOnRateLimit also fails over on 429.
+	ModelFailover       map[string][]string
+	FailoverCooldown    time.Duration
+	FailoverOnRateLimit bool
+	// BedrockModels maps model names to the AWS Bedrock model IDs serving
+	// them; requests for those models go to Bedrock in BedrockRegions
+	// instead of Vertex AI. The calls are signed with BedrockAccessKey and
+	// BedrockSecretKey, plus BedrockSessionToken for temporary credentials.
+	BedrockModels       map[string]string
+	BedrockRegions      []string
+	BedrockAccessKey    string
+	BedrockSecretKey    string
+	BedrockSessionToken string
+	// AzureDeployments maps model names to the Azure OpenAI deployments
+	// serving them. AzureEndpoints are the resource hosts tried in order,
+	// called with AzureAPIKey and AzureAPIVersion.
+	AzureDeployments map[string]string
+	AzureEndpoints   []string
+	AzureAPIKey      string
+	AzureAPIVersion  string
+	// OpenAIModels are served by the OpenAI API under their own names,
+	// called with OpenAIAPIKey and, when set, OpenAIOrganization.
+	OpenAIModels       []string
+	OpenAIAPIKey       string
+	OpenAIOrganization string
+	// OpenAICompatibleModels maps model names to the base URLs of
+	// self-hosted chat completions servers serving them, called with
+	// OpenAICompatibleAPIKey when set.
+	OpenAICompatibleModels map[string]string
+	OpenAICompatibleAPIKey string
+	// GeminiModels are Gemini models served by Vertex AI in the same
+	// projects and regions as Claude.
+	GeminiModels []string
+	// AnthropicModels maps model names to the Anthropic API model IDs
+	// serving them, called with AnthropicAPIKey and AnthropicVersion. With
+	// AnthropicFallback the models are served by Vertex AI and only fall
+	// back to the Anthropic API when every Vertex region failed or ran out
+	// of capacity.
+	AnthropicModels   map[string]string
+	AnthropicAPIKey   string
+	AnthropicVersion  string
+	AnthropicFallback bool
+	// ModelAliases map client-facing model names such as "fast" to the
+	// provider, model and regions serving them. Aliases set through the
+	// admin API take precedence.
+	ModelAliases map[string]modelRoute
+	// Pricing is the quota cost of a request per tier and model.
+	Pricing pricingTable
+	// TokenPrices is the USD price per million tokens by model, used for
+	// the X-Request-Cost-USD trailer.
+	TokenPrices map[string]tokenPrice
+	// RateLimitRPM is the per-key requests-per-minute limit, 0 disables it.
+	RateLimitRPM int
+	// TrustedProxies are the peers whose X-Forwarded-For header is honoured
+	// when determining the client IP.
+	TrustedProxies []netip.Prefix
+	// MaxInflightPerKey caps concurrent requests per key, 0 disables it.
+	MaxInflightPerKey int
+	// MaxUpstreamConcurrency caps concurrent upstream requests across all
+	// keys, 0 disables it. Requests wait up to AdmissionTimeout for a slot,
+	// interactive ones ahead of batch.
+	MaxUpstreamConcurrency int
+	AdmissionTimeout       time.Duration
+	// AuthLockoutThreshold is the number of unknown API keys a client IP may
+	// present within AuthLockoutWindow before it is blocked for
+	// AuthLockoutDuration. 0 disables the lockout.
+	AuthLockoutThreshold int
+	AuthLockoutWindow    time.Duration
+	AuthLockoutDuration  time.Duration
+	// UsageNATSURL enables publishing usage events to NATS when set.
+	UsageNATSURL     string
+	UsageNATSSubject string
+	// StrictValidation rejects request bodies containing unknown fields.
+	StrictValidation bool
+	// ValidateParams enables range checks of the sampling parameters listed
+	// in ParamBounds.
+	ValidateParams bool
+	ParamBounds    map[string]paramBound
+	// ValidateTools checks the structure of tool definitions.
+	ValidateTools bool
+	// InjectUserID adds a pseudonymous metadata.user_id derived from the API
+	// key when the client didn't send one.
+	InjectUserID bool
+	// CaptureSampleRate is the fraction (0-1) of requests whose bodies are
+	// captured to object storage.
+	CaptureSampleRate  float64
+	CaptureS3Endpoint  string
+	CaptureS3Bucket    string
+	CaptureS3Region    string
+	CaptureS3AccessKey string
+	CaptureS3SecretKey string
+	// TokenExchangeTimeout bounds a single Google token exchange.
+	TokenExchangeTimeout time.Duration
+	// TokenRefreshInterval is the longest an access token is kept before it
+	// is renewed; tokens are renewed sooner when their expires_in calls for it.
+	TokenRefreshInterval     time.Duration
+	TokenRetryInitialBackoff time.Duration
+	TokenRetryMaxBackoff     time.Duration
+	// BreakerThreshold is the number of consecutive upstream failures that
+	// opens the circuit breaker, 0 (the default) disables it.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// ShedLatencySLO is the upstream p99 latency above which requests are
+	// shed, 0 disables load shedding. Latencies older than ShedSampleMaxAge
+	// are ignored, and ShedTierWeights scales the shed rate per key tier.
+	ShedLatencySLO   time.Duration
+	ShedWindow       int
+	ShedStep         float64
+	ShedMaxRate      float64
+	ShedEvalInterval time.Duration
+	ShedSampleMaxAge time.Duration
+	ShedTierWeights  map[string]float64
+	// RetryBudget is the number of retries (region failover, token
+	// exchange) that may be made in a burst, refilled at RetryBudgetRate
+	// per second. 0 disables the budget.
+	RetryBudget     int
+	RetryBudgetRate float64
+	// UpstreamRetryAfter is sent to clients on an upstream 429 that carries
+	// no retry hint of its own.
+	UpstreamRetryAfter time.Duration
+	// UpstreamPacingThreshold is the remaining upstream request budget below
+	// which outgoing requests are paced, 0 disables pacing. Requests that
+	// would wait longer than UpstreamPacingMaxWait are rejected.
+	UpstreamPacingThreshold int
+	UpstreamPacingMaxWait   time.Duration
+	// DisconnectRefund refunds the request's cost when the client disconnects
+	// before any output token was streamed.
+	DisconnectRefund bool
+	// SSECoalesceInterval batches streamed events written within the
+	// interval into one write and flush, up to SSECoalesceBytes. 0 writes
+	// every event immediately.
+	SSECoalesceInterval time.Duration
+	SSECoalesceBytes    int
+	// MaxMessages and MaxInputTokens cap the messages and the estimated
+	// input tokens of a request, 0 is unlimited. Keys can override both.
+	MaxMessages    int
+	MaxInputTokens int
+	// MaxRequestBytes caps request bodies, after gzip decompression, 0 is
+	// unlimited.
+	MaxRequestBytes int
+	// MaxStreamBytes ends a stream with an error event once this many bytes
+	// were sent to the client, and fails responses buffered whole (not
+	// streamed, or aggregated) over this size; 0 is unlimited.
+	MaxStreamBytes int
+	// FeatureFlags seeds runtime feature flags as name=bool entries;
+	// stored overrides are re-read every FeatureFlagRefresh.
+	FeatureFlags       []string
+	FeatureFlagRefresh time.Duration
+	// DefaultSystemPrompt is used for requests that carry no system prompt
+	// when the key has none of its own.
+	DefaultSystemPrompt string
+	// RequestTransformers is the ordered list of transformers applied to
+	// request bodies, see transformerRegistry.
+	RequestTransformers []string
+	// SystemPromptPrefix is prepended to the system prompt by the
+	// system_prompt transformer.
+	SystemPromptPrefix string
+	// DefaultParams are the fields set by the default_params transformer
+	// when the client omits them; ModelDefaultParams take precedence for
+	// the model serving the request.
+	DefaultParams      map[string]json.RawMessage
+	ModelDefaultParams map[string]map[string]json.RawMessage
+	// ResponseEnvelope wraps every non-streaming JSON response in a
+	// {"data", "meta"} envelope; clients can also ask with X-Envelope.
+	ResponseEnvelope bool
+	// AggregateStreams serves non-streaming requests from the upstream
+	// stream, assembling the final message in the gateway; clients can also
+	// ask with X-Aggregate-Stream.
+	AggregateStreams bool
+	// AdminToken enables the admin endpoints when set.
+	AdminToken string
+	// PprofAddr is the separate listener serving the runtime profiles to
+	// admins, off when empty.
+	PprofAddr string
+	// SSEHeartbeat is the keep-alive interval of long-lived event streams.
+	SSEHeartbeat time.Duration
+	// JanitorInterval is how often expired in-memory state is reaped.
+	JanitorInterval time.Duration
+	// ShadowModel receives a ShadowSampleRate fraction of traffic in
+	// parallel for evaluation; its output is discarded.
+	ShadowModel      string
+	ShadowSampleRate float64
+	// RouteTimeouts maps a route pattern (without BasePath) to its request
+	// deadline. Routes that aren't listed, or map to 0, are unbounded.
+	RouteTimeouts map[string]time.Duration
+	// DeprecatedRoutes maps a route pattern (without BasePath) to its
+	// deprecation and sunset dates; DeprecationLink points clients to the
+	// migration guide.
+	DeprecatedRoutes map[string]routeDeprecation
+	DeprecationLink  string
+	// ReceiptSecret enables HMAC-signed X-Usage-Receipt trailers when set.
+	ReceiptSecret string
+	// LogRedactPatterns are extra regular expressions scrubbed from logs.
+	LogRedactPatterns []string
+	// AccessLog is where Combined Log Format access lines go: stdout,
+	// stderr or a file path. Empty disables the access log.
+	AccessLog string
+	// OutputRedactPatterns are regular expressions masked in the model
+	// output, streamed or not. OutputRedactHoldback is the number of trailing runes held
+	// back so matches split across deltas are still caught; it must cover the
+	// longest possible match.
+	OutputRedactPatterns []string
+	OutputRedactHoldback int
+}
+
+// liveConfig holds the running settings. Handlers read them through cfg, so
+// a reload takes effect for the next read while anything holding the previous
+// *Config keeps a consistent snapshot.
+var liveConfig atomic.Pointer[Config]
+
+// cfg returns the running settings.
+func cfg() *Config {
+	return liveConfig.Load()
+}
+
+// loadConfig builds the settings from the environment. The result is never
+// modified once published with liveConfig.Store; a reload publishes a new one.
+func loadConfig() *Config {
+	return &Config{
+		StartupMode: parseStartupMode(getEnv("STARTUP_MODE", startupStrict)),
+
+		DBReplicaHosts: getEnvList("DB_REPLICA_HOST", nil),
+
+		AuthBackend:              getEnv("AUTH_BACKEND", "db"),
+		AuthIntrospectionURL:     os.Getenv("AUTH_INTROSPECTION_URL"),
+		AuthIntrospectionToken:   os.Getenv("AUTH_INTROSPECTION_TOKEN"),
+		AuthIntrospectionTimeout: getEnvDuration("AUTH_INTROSPECTION_TIMEOUT", defaultIntrospectionTimeout),
+		DuplicateAuthHeaders:     getEnv("DUPLICATE_AUTH_HEADERS", "reject"),
+		OperatorKey:              getEnv("OPERATOR_KEY", ""),
+		OperatorKeyRPM:           getEnvInt("OPERATOR_KEY_RPM", 10),
+
+		TLSCertFile:   os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:    os.Getenv("TLS_KEY_FILE"),
+		TLSMinVersion: parseTLSVersion(getEnv("TLS_MIN_VERSION", "1.2")),
+		TLSReload:     getEnvBool("TLS_RELOAD", false),
+
+		UpstreamCAFile:         os.Getenv("UPSTREAM_CA_FILE"),
+		UpstreamClientCertFile: os.Getenv("UPSTREAM_CLIENT_CERT_FILE"),
+		UpstreamClientKeyFile:  os.Getenv("UPSTREAM_CLIENT_KEY_FILE"),
+		UpstreamServerName:     os.Getenv("UPSTREAM_TLS_SERVER_NAME"),
+		UpstreamDNSServer:      os.Getenv("UPSTREAM_DNS_SERVER"),
+		UpstreamDNSCacheTTL:    getEnvDuration("UPSTREAM_DNS_CACHE_TTL", 0),
+
+		BasePath:            normalizeBasePath(os.Getenv("BASE_PATH")),
+		BasePathIncludesOps: getEnvBool("BASE_PATH_INCLUDE_OPS", false),
+
+		Projects:           parseProjectWeights(getEnvList("GC_PROJECTS", nil), os.Getenv("GC_PROJECT_ID")),
+		ProjectCredentials: parseProjectCredentials(getEnvList("GC_PROJECT_CREDENTIALS", nil)),
+
+		Warmup:        getEnvBool("WARMUP", false),
+		WarmupTimeout: getEnvDuration("WARMUP_TIMEOUT", 5*time.Second),
+
+		VertexAPIVersion: parseURLSegment("VERTEX_API_VERSION", getEnv("VERTEX_API_VERSION", "v1"), "v1", vertexAPIVersionPattern),
+		VertexPublisher:  parseURLSegment("VERTEX_PUBLISHER", getEnv("VERTEX_PUBLISHER", "anthropic"), "anthropic", vertexPublisherPattern),
+
+		Regions:       getEnvList("VERTEX_REGIONS", []string{"us-east5"}),
+		VertexTargets: parseVertexTargets(getEnvList("VERTEX_TARGETS", nil)),
+		StickyRouting: getEnvBool("STICKY_ROUTING", true),
+		DefaultModel:  getEnv("DEFAULT_MODEL", "claude-3-5-sonnet@20240620"),
+		AllowedModels: getEnvList("ALLOWED_MODELS", nil),
+		ModelRegions:  parseModelLists("MODEL_REGIONS", getEnvList("MODEL_REGIONS", nil)),
+
+		ModelFailover:       parseModelLists("MODEL_FAILOVER", getEnvList("MODEL_FAILOVER", nil)),
+		FailoverCooldown:    getEnvDuration("FAILOVER_COOLDOWN", 30*time.Second),
+		FailoverOnRateLimit: getEnvBool("FAILOVER_ON_RATE_LIMIT", true),
+
+		BedrockModels:       parseModelTargets("BEDROCK_MODELS", getEnvList("BEDROCK_MODELS", nil)),
+		BedrockRegions:      getEnvList("BEDROCK_REGIONS", []string{"us-east-1"}),
+		BedrockAccessKey:    getEnv("BEDROCK_ACCESS_KEY", os.Getenv("AWS_ACCESS_KEY_ID")),
+		BedrockSecretKey:    getEnv("BEDROCK_SECRET_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		BedrockSessionToken: getEnv("BEDROCK_SESSION_TOKEN", os.Getenv("AWS_SESSION_TOKEN")),
+
+		AzureDeployments: parseModelTargets("AZURE_OPENAI_DEPLOYMENTS", getEnvList("AZURE_OPENAI_DEPLOYMENTS", nil)),
+		AzureEndpoints:   parseAzureEndpoints(getEnvList("AZURE_OPENAI_ENDPOINTS", nil)),
+		AzureAPIKey:      os.Getenv("AZURE_OPENAI_API_KEY"),
+		AzureAPIVersion:  getEnv("AZURE_OPENAI_API_VERSION", "2024-10-21"),
+
+		OpenAIModels:       getEnvList("OPENAI_MODELS", nil),
+		OpenAIAPIKey:       os.Getenv("OPENAI_API_KEY"),
+		OpenAIOrganization: os.Getenv("OPENAI_ORGANIZATION"),
+
+		OpenAICompatibleModels: parseModelTargets("OPENAI_COMPATIBLE_MODELS", getEnvList("OPENAI_COMPATIBLE_MODELS", nil)),
+		OpenAICompatibleAPIKey: os.Getenv("OPENAI_COMPATIBLE_API_KEY"),
+
+		GeminiModels: getEnvList("GEMINI_MODELS", nil),
+
+		AnthropicModels:   parseModelTargets("ANTHROPIC_MODELS", getEnvList("ANTHROPIC_MODELS", nil)),
+		AnthropicAPIKey:   os.Getenv("ANTHROPIC_API_KEY"),
+		AnthropicVersion:  getEnv("ANTHROPIC_VERSION", "2023-06-01"),
+		AnthropicFallback: getEnvBool("ANTHROPIC_FALLBACK", false),
+
+		ModelAliases: parseModelAliases(getEnvList("MODEL_ALIASES", nil)),
+
+		Pricing:      parsePricing(getEnvList("MODEL_PRICING", nil)),
+		TokenPrices:  parseTokenPrices(getEnvList("MODEL_TOKEN_PRICES", nil)),
+		RateLimitRPM: getEnvInt("RATE_LIMIT_RPM", 0),
+
+		TrustedProxies: parseCIDRs(getEnvList("TRUSTED_PROXIES", nil)),
+
+		MaxInflightPerKey: getEnvInt("MAX_INFLIGHT_PER_KEY", 0),
+
+		MaxUpstreamConcurrency: getEnvInt("MAX_UPSTREAM_CONCURRENCY", 0),
+		AdmissionTimeout:       getEnvDuration("ADMISSION_TIMEOUT", 30*time.Second),
+
+		AuthLockoutThreshold: getEnvInt("AUTH_LOCKOUT_THRESHOLD", 0),
+		AuthLockoutWindow:    getEnvDuration("AUTH_LOCKOUT_WINDOW", 5*time.Minute),
+		AuthLockoutDuration:  getEnvDuration("AUTH_LOCKOUT_DURATION", 15*time.Minute),
+
+		UsageNATSURL:     os.Getenv("USAGE_NATS_URL"),
+		UsageNATSSubject: getEnv("USAGE_NATS_SUBJECT", "llm-gateway.usage"),
+
+		StrictValidation: getEnvBool("STRICT_VALIDATION", false),
+		ValidateParams:   getEnvBool("VALIDATE_PARAMS", false),
+		ParamBounds: parseParamBounds(getEnvList("PARAM_BOUNDS", []string{
+			"temperature=0:1",
+			"top_p=0:1",
+			"top_k=0:",
+			"max_tokens=1:",
+		})),
+		ValidateTools: getEnvBool("VALIDATE_TOOLS", false),
+		InjectUserID:  getEnvBool("INJECT_USER_ID", false),
+
+		CaptureSampleRate:  getEnvFloat("CAPTURE_SAMPLE_RATE", 0),
+		CaptureS3Endpoint:  os.Getenv("CAPTURE_S3_ENDPOINT"),
+		CaptureS3Bucket:    os.Getenv("CAPTURE_S3_BUCKET"),
+		CaptureS3Region:    getEnv("CAPTURE_S3_REGION", "us-east-1"),
+		CaptureS3AccessKey: os.Getenv("CAPTURE_S3_ACCESS_KEY"),
+		CaptureS3SecretKey: os.Getenv("CAPTURE_S3_SECRET_KEY"),
+
+		TokenExchangeTimeout:     getEnvDuration("TOKEN_EXCHANGE_TIMEOUT", 10*time.Second),
+		TokenRefreshInterval:     getEnvDuration("TOKEN_REFRESH_INTERVAL", 45*time.Minute),
+		TokenRetryInitialBackoff: getEnvDuration("TOKEN_RETRY_INITIAL_BACKOFF", time.Second),
+		TokenRetryMaxBackoff:     getEnvDuration("TOKEN_RETRY_MAX_BACKOFF", time.Minute),
+
+		BreakerThreshold: getEnvInt("BREAKER_FAILURE_THRESHOLD", 0),
+		BreakerCooldown:  getEnvDuration("BREAKER_COOLDOWN", 30*time.Second),
+
+		ShedLatencySLO:   getEnvDuration("SHED_LATENCY_SLO", 0),
+		ShedWindow:       getEnvInt("SHED_WINDOW", 500),
+		ShedStep:         getEnvFloat("SHED_STEP", 0.1),
+		ShedMaxRate:      getEnvFloat("SHED_MAX_RATE", 0.9),
+		ShedEvalInterval: getEnvDuration("SHED_EVAL_INTERVAL", 5*time.Second),
+		ShedSampleMaxAge: getEnvDuration("SHED_SAMPLE_MAX_AGE", time.Minute),
+		ShedTierWeights:  parseShedTierWeights(getEnvList("SHED_TIER_WEIGHTS", nil)),
+
+		RetryBudget:     getEnvInt("RETRY_BUDGET", 0),
+		RetryBudgetRate: getEnvFloat("RETRY_BUDGET_RATE", 1),
+
+		UpstreamRetryAfter: getEnvDuration("UPSTREAM_RETRY_AFTER_DEFAULT", 10*time.Second),
+
+		UpstreamPacingThreshold: getEnvInt("UPSTREAM_PACING_THRESHOLD", 0),
+		UpstreamPacingMaxWait:   getEnvDuration("UPSTREAM_PACING_MAX_WAIT", 10*time.Second),
+
+		DisconnectRefund:    getEnvBool("DISCONNECT_REFUND", false),
+		SSECoalesceInterval: getEnvDuration("SSE_COALESCE_INTERVAL", 0),
+		SSECoalesceBytes:    getEnvInt("SSE_COALESCE_BYTES", 16*1024),
+		MaxStreamBytes:      getEnvInt("MAX_STREAM_BYTES", 0),
+		MaxRequestBytes:     getEnvInt("MAX_REQUEST_BYTES", 32<<20),
+		MaxMessages:         getEnvInt("MAX_MESSAGES", 0),
+		MaxInputTokens:      getEnvInt("MAX_INPUT_TOKENS", 0),
+
+		FeatureFlags:       getEnvList("FEATURE_FLAGS", nil),
+		FeatureFlagRefresh: getEnvDuration("FEATURE_FLAG_REFRESH", 30*time.Second),
+
+		DefaultSystemPrompt: os.Getenv("DEFAULT_SYSTEM_PROMPT"),
+		RequestTransformers: getEnvList("REQUEST_TRANSFORMERS", nil),
+		SystemPromptPrefix:  os.Getenv("SYSTEM_PROMPT_PREFIX"),
+		DefaultParams:       parseDefaultParams(getEnvList("DEFAULT_PARAMS", nil)),
+		ModelDefaultParams:  parseModelDefaultParams(getEnvList("MODEL_DEFAULT_PARAMS", nil)),
+
+		ResponseEnvelope: getEnvBool("RESPONSE_ENVELOPE", false),
+		AggregateStreams: getEnvBool("AGGREGATE_STREAMS", false),
+
+		AdminToken:   os.Getenv("ADMIN_TOKEN"),
+		PprofAddr:    os.Getenv("PPROF_ADDR"),
+		SSEHeartbeat: getEnvDuration("SSE_HEARTBEAT", 15*time.Second),
+
+		JanitorInterval: getEnvDuration("JANITOR_INTERVAL", time.Minute),
+
+		ShadowModel:      os.Getenv("SHADOW_MODEL"),
+		ShadowSampleRate: getEnvFloat("SHADOW_SAMPLE_RATE", 0),
+
+		RouteTimeouts: parseRouteTimeouts(getEnvList("ROUTE_TIMEOUTS", []string{
+			"/=5m",
+			"/v1/messages=5m",
+			"/v1/messages/ws=5m",
+			"/v1/messages/count_tokens=30s",
+			"/v1/chat/completions=5m",
+			"/v1/multi=5m",
+			"/v1/pricing=10s",
+			"/v1/selftest=30s",
+			"/v1/replay=5m",
+			"/v1/config/reload=10s",
+			"/v1/allowed-models=10s",
+			"/v1/allowed-models/{model}=10s",
+			"/v1/model-aliases=10s",
+			"/v1/model-aliases/{alias}=10s",
+			"/v1/flags=10s",
+			"/v1/flags/{name}=10s",
+			"/v1/export/usage.csv=5m",
+			"/v1/keys=10s",
+			"/v1/keys/{id}=10s",
+			"/v1/keys/{id}/reset=10s",
+			"/health=5s",
+			"/metrics=10s",
+		})),
+		DeprecatedRoutes: parseDeprecatedRoutes(getEnvList("DEPRECATED_ROUTES", nil)),
+		DeprecationLink:  getEnv("DEPRECATION_LINK", ""),
+
+		ReceiptSecret: os.Getenv("RECEIPT_SECRET"),
+
+		LogRedactPatterns: getEnvList("LOG_REDACT_PATTERNS", nil),
+		AccessLog:         getEnv("ACCESS_LOG", ""),
+
+		OutputRedactPatterns: getEnvList("OUTPUT_REDACT_PATTERNS", nil),
+		OutputRedactHoldback: getEnvInt("OUTPUT_REDACT_HOLDBACK", 32),
+	}
+}
+
+// secretSettings are the settings holding credentials. Their values are
+// scrubbed from the logs wherever they appear, so every setting added for a
+// password, token or key belongs here.
+var secretSettings = []string{
+	"GC_PRIVATE_KEY",
+	"STATIC_ACCESS_TOKEN",
+	"DB_PASSWORD",
+	"ADMIN_TOKEN",
+	"OPERATOR_KEY",
+	"RECEIPT_SECRET",
+	"CAPTURE_S3_SECRET_KEY",
+	"AUTH_INTROSPECTION_TOKEN",
+	"BEDROCK_SECRET_KEY",
+	"AWS_SECRET_ACCESS_KEY",
+	"BEDROCK_SESSION_TOKEN",
+	"AWS_SESSION_TOKEN",
+	"AZURE_OPENAI_API_KEY",
+	"OPENAI_API_KEY",
+	"OPENAI_COMPATIBLE_API_KEY",
+	"ANTHROPIC_API_KEY",
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// getEnvList parses a comma separated environment variable, ignoring empty
+// entries.
+func getEnvList(key string, fallback []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	if len(list) == 0 {
+		return fallback
+	}
+	return list
+}
+
+func getEnvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid integer for %s: %q, using default %d", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Invalid boolean for %s: %q, using default %t", key, v, fallback)
+		return fallback
+	}
+	return b
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("Invalid number for %s: %q, using default %g", key, v, fallback)
+		return fallback
+	}
+	return f
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid duration for %s: %q, using default %s", key, v, fallback)
+		return fallback
+	}
+	return d
+}
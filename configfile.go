@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configFile is the optional JSON settings file named by CONFIG_FILE. Keys
+// are the environment variable names; defaults apply to every environment
+// and the profile selected by APP_ENV is layered on top. Variables set in the
+// environment (or .env) always win, so the file only supplies what they leave
+// unset:
+//
+//	{
+//	  "defaults": {"VERTEX_REGIONS": ["us-east5", "europe-west1"], "RATE_LIMIT_RPM": 60},
+//	  "profiles": {
+//	    "staging": {"RATE_LIMIT_RPM": 600},
+//	    "prod": {"WARMUP": true, "MODEL_PRICING": ["*/claude-3-opus@20240229=5"]}
+//	  }
+//	}
+//
+// Values may be strings, numbers, booleans or arrays of those, which are
+// joined with commas like list variables.
+type configFile struct {
+	Defaults map[string]json.RawMessage            `json:"defaults"`
+	Profiles map[string]map[string]json.RawMessage `json:"profiles"`
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// loadConfigFile sets the variables from path that the environment doesn't
+// already define, using the defaults and then the named profile.
+func loadConfigFile(path, profile string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	var file configFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	settings, err := configSettings(file.Defaults, "defaults")
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if profile != "" {
+		values, ok := file.Profiles[profile]
+		if !ok {
+			names := make([]string, 0, len(file.Profiles))
+			for name := range file.Profiles {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			return fmt.Errorf("config file %s: unknown APP_ENV profile %q (have: %s)", path, profile, strings.Join(names, ", "))
+		}
+		overrides, err := configSettings(values, "profiles."+profile)
+		if err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+		for name, value := range overrides {
+			settings[name] = value
+		}
+	}
+
+	for name, value := range settings {
+		if _, ok := os.LookupEnv(name); !ok {
+			os.Setenv(name, value)
+		}
+	}
+	return nil
+}
+
+func configSettings(values map[string]json.RawMessage, section string) (map[string]string, error) {
+	settings := make(map[string]string, len(values))
+	for name, raw := range values {
+		if !envNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("%s: %q is not an environment variable name", section, name)
+		}
+		value, err := configValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", section, name, err)
+		}
+		settings[name] = value
+	}
+	return settings, nil
+}
+
+// configValue renders a JSON value the way it would be written in the
+// environment.
+func configValue(raw json.RawMessage) (string, error) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, ok := scalarString(item)
+			if !ok {
+				return "", errors.New("list items must be strings, numbers or booleans")
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	default:
+		s, ok := scalarString(v)
+		if !ok {
+			return "", errors.New("must be a string, number, boolean or list")
+		}
+		return s, nil
+	}
+}
+
+func scalarString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// validateConfig checks the merged settings for values that can't work
+// together, so a bad profile fails at startup rather than on first use.
+func validateConfig(c Config) error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(len(c.Regions) > 0, "VERTEX_REGIONS must list at least one region")
+	for i, t := range c.VertexTargets {
+		check(slices.ContainsFunc(c.Projects, func(p projectWeight) bool { return p.ID == t.Project }), "VERTEX_TARGETS entry %s names a project missing from GC_PROJECTS", t.Region())
+		check(!slices.ContainsFunc(c.VertexTargets[:i], func(o vertexTarget) bool { return o.Region() == t.Region() }), "VERTEX_TARGETS lists %s twice", t.Region())
+	}
+	if len(c.BedrockModels) > 0 {
+		check(len(c.BedrockRegions) > 0, "BEDROCK_REGIONS must list at least one region")
+		check(c.BedrockAccessKey != "" && c.BedrockSecretKey != "", "BEDROCK_MODELS needs BEDROCK_ACCESS_KEY and BEDROCK_SECRET_KEY")
+	}
+	if len(c.AzureDeployments) > 0 {
+		check(len(c.AzureEndpoints) > 0, "AZURE_OPENAI_DEPLOYMENTS needs AZURE_OPENAI_ENDPOINTS")
+		check(c.AzureAPIKey != "", "AZURE_OPENAI_DEPLOYMENTS needs AZURE_OPENAI_API_KEY")
+	}
+	if len(c.OpenAIModels) > 0 {
+		check(c.OpenAIAPIKey != "", "OPENAI_MODELS needs OPENAI_API_KEY")
+	}
+	if len(c.AnthropicModels) > 0 {
+		check(c.AnthropicAPIKey != "", "ANTHROPIC_MODELS needs ANTHROPIC_API_KEY")
+	}
+	check(c.FailoverCooldown >= 0, "FAILOVER_COOLDOWN must not be negative")
+	for model, secondaries := range c.ModelFailover {
+		check(!slices.Contains(secondaries, model), "MODEL_FAILOVER entry for %s lists the model itself", model)
+	}
+	for alias, route := range c.ModelAliases {
+		err := route.validate(&c)
+		check(err == nil, "MODEL_ALIASES entry for %s is invalid: %v", alias, err)
+		_, chained := c.ModelAliases[route.Model]
+		check(!chained, "MODEL_ALIASES entry for %s points to another alias", alias)
+	}
+	for model, baseURL := range c.OpenAICompatibleModels {
+		u, err := url.Parse(baseURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "OPENAI_COMPATIBLE_MODELS entry for %s must be an http(s) base URL, got %q", model, baseURL)
+	}
+	check((c.TLSCertFile == "") == (c.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	check((c.UpstreamClientCertFile == "") == (c.UpstreamClientKeyFile == ""), "UPSTREAM_CLIENT_CERT_FILE and UPSTREAM_CLIENT_KEY_FILE must be set together")
+	check(c.DuplicateAuthHeaders == "reject" || c.DuplicateAuthHeaders == "first", "DUPLICATE_AUTH_HEADERS must be reject or first, got %q", c.DuplicateAuthHeaders)
+	check(c.OperatorKey == "" || c.OperatorKeyRPM > 0, "OPERATOR_KEY_RPM must be positive when OPERATOR_KEY is set")
+	if c.PprofAddr != "" {
+		_, _, err := net.SplitHostPort(c.PprofAddr)
+		check(err == nil, "PPROF_ADDR must be host:port, got %q", c.PprofAddr)
+	}
+	if c.UpstreamDNSServer != "" {
+		_, _, err := net.SplitHostPort(c.UpstreamDNSServer)
+		check(err == nil, "UPSTREAM_DNS_SERVER must be host:port, got %q", c.UpstreamDNSServer)
+	}
+	check(c.TokenRefreshInterval > 0 && c.TokenRefreshInterval < time.Hour, "TOKEN_REFRESH_INTERVAL must be between 0 and 1h, got %s", c.TokenRefreshInterval)
+	check(c.UpstreamDNSCacheTTL >= 0, "UPSTREAM_DNS_CACHE_TTL must not be negative")
+	check(c.AuthBackend == "db" || c.AuthBackend == "introspection", "AUTH_BACKEND must be db or introspection, got %q", c.AuthBackend)
+	for name, n := range map[string]int{
+		"RATE_LIMIT_RPM":           c.RateLimitRPM,
+		"MAX_INFLIGHT_PER_KEY":     c.MaxInflightPerKey,
+		"MAX_UPSTREAM_CONCURRENCY": c.MaxUpstreamConcurrency,
+		"RETRY_BUDGET":             c.RetryBudget,
+	} {
+		check(n >= 0, "%s must not be negative, got %d", name, n)
+	}
+	for name, rate := range map[string]float64{
+		"CAPTURE_SAMPLE_RATE": c.CaptureSampleRate,
+		"SHADOW_SAMPLE_RATE":  c.ShadowSampleRate,
+	} {
+		check(rate >= 0 && rate <= 1, "%s must be between 0 and 1, got %g", name, rate)
+	}
+	check(c.ShadowSampleRate == 0 || c.ShadowModel != "", "SHADOW_SAMPLE_RATE needs SHADOW_MODEL")
+	// 丢弃比例达到 1 时没有请求到达上游，延迟样本无从更新
+	check(c.ShedMaxRate >= 0 && c.ShedMaxRate < 1, "SHED_MAX_RATE must be at least 0 and below 1, got %g", c.ShedMaxRate)
+	check(c.ShedSampleMaxAge > 0, "SHED_SAMPLE_MAX_AGE must be positive")
+	check(c.RetryBudgetRate >= 0, "RETRY_BUDGET_RATE must not be negative")
+	check(c.SSECoalesceBytes > 0, "SSE_COALESCE_BYTES must be positive")
+	check(c.MaxMessages >= 0, "MAX_MESSAGES must not be negative")
+	check(c.MaxInputTokens >= 0, "MAX_INPUT_TOKENS must not be negative")
+	check(c.MaxRequestBytes >= 0, "MAX_REQUEST_BYTES must not be negative")
+	check(c.MaxStreamBytes >= 0, "MAX_STREAM_BYTES must not be negative")
+	for route, d := range c.RouteTimeouts {
+		check(d >= 0 && d < 24*time.Hour, "ROUTE_TIMEOUTS entry for %s is out of range: %s", route, d)
+	}
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
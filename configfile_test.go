@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const profilesFile = `{
+  "defaults": {"TEST_REGIONS": ["us-east5", "europe-west1"], "TEST_RPM": 60, "TEST_WARMUP": false, "TEST_NAME": "base"},
+  "profiles": {
+    "staging": {"TEST_RPM": 600},
+    "prod": {"TEST_WARMUP": true, "TEST_RPM": 1.5}
+  }
+}`
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(profilesFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		profile string
+		env     map[string]string
+		want    map[string]string
+	}{
+		{
+			name: "defaults only",
+			want: map[string]string{"TEST_REGIONS": "us-east5,europe-west1", "TEST_RPM": "60", "TEST_WARMUP": "false", "TEST_NAME": "base"},
+		},
+		{
+			name:    "profile over defaults",
+			profile: "staging",
+			want:    map[string]string{"TEST_RPM": "600", "TEST_WARMUP": "false", "TEST_NAME": "base"},
+		},
+		{
+			name:    "other profile",
+			profile: "prod",
+			want:    map[string]string{"TEST_RPM": "1.5", "TEST_WARMUP": "true"},
+		},
+		{
+			name:    "environment over profile",
+			profile: "prod",
+			env:     map[string]string{"TEST_RPM": "5", "TEST_NAME": ""},
+			want:    map[string]string{"TEST_RPM": "5", "TEST_WARMUP": "true", "TEST_NAME": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// t.Setenv 在测试结束时恢复原值，未设置的变量先清除
+			for _, name := range []string{"TEST_REGIONS", "TEST_RPM", "TEST_WARMUP", "TEST_NAME"} {
+				t.Setenv(name, "")
+				os.Unsetenv(name)
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			if err := loadConfigFile(path, tt.profile); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				if got, ok := os.LookupEnv(name); !ok || got != want {
+					t.Errorf("%s = %q (set %v), want %q", name, got, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		profile string
+		wantErr string
+	}{
+		{"unknown profile", profilesFile, "qa", `unknown APP_ENV profile "qa" (have: prod, staging)`},
+		{"unknown section", `{"default": {}}`, "", "unknown field"},
+		{"bad name", `{"defaults": {"rate-limit": 1}}`, "", `defaults: "rate-limit" is not an environment variable name`},
+		{"nested object", `{"profiles": {"prod": {"TEST_RPM": {"n": 1}}}}`, "prod", "profiles.prod.TEST_RPM: must be a string"},
+		{"nested list", `{"defaults": {"TEST_REGIONS": [["us-east5"]]}}`, "", "defaults.TEST_REGIONS: list items"},
+		{"invalid JSON", `{"defaults":`, "", "parsing config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			err := loadConfigFile(path, tt.profile)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+	if err := loadConfigFile(filepath.Join(t.TempDir(), "missing.json"), ""); err == nil {
+		t.Error("missing file accepted")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := validateConfig(*cfg()); err != nil {
+		t.Fatalf("test config invalid: %v", err)
+	}
+	tests := []struct {
+		name    string
+		edit    func(*Config)
+		wantErr []string
+	}{
+		{"no regions", func(c *Config) { c.Regions = nil }, []string{"VERTEX_REGIONS must list at least one region"}},
+		{"half a TLS pair", func(c *Config) { c.TLSCertFile = "cert.pem"; c.TLSKeyFile = "" }, []string{"TLS_CERT_FILE and TLS_KEY_FILE"}},
+		{"sample rate", func(c *Config) { c.CaptureSampleRate = 2 }, []string{"CAPTURE_SAMPLE_RATE must be between 0 and 1, got 2"}},
+		{"shadow without model", func(c *Config) { c.ShadowSampleRate = 0.5; c.ShadowModel = "" }, []string{"SHADOW_SAMPLE_RATE needs SHADOW_MODEL"}},
+		{"shedding everything", func(c *Config) { c.ShedMaxRate = 1 }, []string{"SHED_MAX_RATE must be at least 0 and below 1, got 1"}},
+		{
+			name:    "every problem reported",
+			edit:    func(c *Config) { c.RateLimitRPM = -1; c.AuthBackend = "ldap" },
+			wantErr: []string{"AUTH_BACKEND must be db or introspection", "RATE_LIMIT_RPM must not be negative, got -1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *cfg()
+			tt.edit(&c)
+			err := validateConfig(c)
+			if err == nil {
+				t.Fatal("invalid config accepted")
+			}
+			if lines := strings.Split(err.Error(), "\n"); len(lines) != len(tt.wantErr) {
+				t.Errorf("errors %q, want %d", lines, len(tt.wantErr))
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("err = %v, want it to mention %q", err, want)
+				}
+			}
+		})
+	}
+}
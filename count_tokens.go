@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+)
+
+// handleCountTokens forwards a token counting request to the Anthropic
+// count-tokens endpoint on Vertex. Counting is free: the key must be valid
+// but no call is deducted from its quota. It still counts towards the RPM
+// limiter.
+func handleCountTokens(w http.ResponseWriter, r *http.Request) {
+	if !checkAuthLockout(w, r) {
+		return
+	}
+	apiKey := r.Header.Get("x-api-key")
+	if apiKey == "" {
+		respondError(w, r, errAPIKeyRequired)
+		return
+	}
+
+	if !prepareRequestBody(w, r) {
+		return
+	}
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondError(w, r, bodyError(err))
+		return
+	}
+	defer r.Body.Close()
+
+	provider := countTokensProvider{vertexProvider{project: projects.Next()}}
+	if !provider.Ready() {
+		respondError(w, r, errCredentialsUnavailable)
+		return
+	}
+
+	key, err := authenticator.Authenticate(r.Context(), r)
+	if errors.Is(err, errNoRemainingCalls) {
+		respondKeyError(w, r, key, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, authFailure(r, apiKey, err))
+		return
+	}
+	if !ipAllowed(clientIP(r), key.AllowedCIDRs) {
+		respondKeyError(w, r, key, errKeyIPNotAllowed)
+		return
+	}
+	if limiter != nil {
+		remaining, reset, ok := limiter.Allow(apiKey)
+		setRateLimitHeaders(w, rateLimitInfo{Limit: limiter.limit, Remaining: remaining, Reset: reset})
+		if !ok {
+			respondKeyError(w, r, key, errRateLimitExceeded)
+			return
+		}
+	}
+
+	// count-tokens 需要在请求体中指定模型
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(reqBody, &fields); err != nil {
+		respondError(w, r, invalidRequest(fmt.Sprintf("invalid request body: %v", err)))
+		return
+	}
+	countModel, err := selectModel(key, reqBody)
+	if err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+	// 计数接口只有 Vertex AI 提供
+	if !servedByVertex(countModel) {
+		respondError(w, r, invalidRequest(fmt.Sprintf("token counting is not available for %s", countModel)))
+		return
+	}
+	target := countModel
+	if route, ok := modelAliases.Lookup(countModel); ok {
+		target = route.Model
+	}
+	fields["model"], _ = json.Marshal(target)
+	delete(fields, "stream")
+	upstreamBody, err := json.Marshal(fields)
+	if err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+
+	regions, err := regionsForModel(countModel)
+	if err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+	// Anthropic API 兜底没有计数接口，只在 Vertex 区域间切换
+	regions = slices.DeleteFunc(slices.Clone(regions), func(region string) bool { return region == anthropicHost })
+	headers := map[string]string{
+		"Content-Type": "application/json; charset=utf-8",
+		"X-Request-Id": requestIDFor(r),
+	}
+	resp, served, err := forwardWithFailover(r.Context(), provider, regions, target, headers, upstreamBody)
+	if err != nil {
+		respondError(w, r, upstreamFailure("Upstream request failed", fmt.Errorf("count tokens: %w", err)))
+		return
+	}
+	defer resp.Body.Close()
+
+	// 故障转移到备用模型时标明实际计数的模型，否则保留请求中的名称（可能是别名）
+	servedModel := countModel
+	if served.model != target {
+		servedModel = served.model
+	}
+	w.Header().Set("X-Served-Model", servedModel)
+	w.Header().Set("X-Served-Region", served.region)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		respondError(w, r, upstreamFailure("Upstream request failed", fmt.Errorf("reading count tokens response: %w", err)))
+		return
+	}
+	writeBody(w, resp.StatusCode, "application/json", body)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCountTokensPassthrough(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-test@20250101"
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.VertexAPIVersion = "v1"
+		c.VertexPublisher = "anthropic"
+	})
+	swap[TokenProvider](t, &tokenProvider, staticTokenProvider("fake-token"))
+	swap(t, &accessToken, "")
+	if err := refreshAccessToken(); err != nil {
+		t.Fatal(err)
+	}
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want := "/v1/projects/test-project/locations/us-east5/publishers/anthropic/models/count-tokens:rawPredict"; r.URL.Path != want {
+			t.Errorf("path %s, want %s", r.URL.Path, want)
+		}
+		var body map[string]json.RawMessage
+		raw, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(raw, &body); err != nil {
+			t.Fatalf("upstream body %s: %v", raw, err)
+		}
+		if string(body["model"]) != `"claude-test@20250101"` {
+			t.Errorf("model %s, want it named in the body", body["model"])
+		}
+		if _, ok := body["stream"]; ok {
+			t.Errorf("body %s still has stream", raw)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"input_tokens":42}`))
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	swap(t, &vertexClient, &http.Client{Transport: redirectTransport{target}})
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"default model", `{"messages":[{"role":"user","content":"hi"}]}`},
+		{"stream flag dropped", `{"model":"claude-test@20250101","messages":[{"role":"user","content":"hi"}],"stream":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newMessagesRequest("k", tt.body)
+			r.URL.Path = "/v1/messages/count_tokens"
+			w := httptest.NewRecorder()
+			handleCountTokens(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != `{"input_tokens":42}` {
+				t.Fatalf("got %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("X-Served-Region"); got != "us-east5" {
+				t.Errorf("X-Served-Region = %q", got)
+			}
+		})
+	}
+	if got := auth.remaining("k"); got != 5 {
+		t.Errorf("key has %d calls left, want counting to be free", got)
+	}
+}
+
+func TestCountTokensRequiresKey(t *testing.T) {
+	swap(t, &accessToken, "fake-token")
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+	tests := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"missing key", "", http.StatusUnauthorized},
+		{"unknown key", "nope", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleCountTokens(w, newMessagesRequest(tt.key, `{"messages":[{"role":"user","content":"hi"}]}`))
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
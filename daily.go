@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"strconv"
+	"time"
+)
+
+// dailyClock tells the time the daily counters go by. The day is the
+// gateway's rather than the database's, so it agrees with the Retry-After
+// given at the cap.
+var dailyClock = time.Now
+
+// usageDay is the UTC date requests made now count towards.
+func usageDay() string {
+	return dailyClock().UTC().Format(time.DateOnly)
+}
+
+// nextUTCMidnight is when the daily request counters reset.
+func nextUTCMidnight() time.Time {
+	now := dailyClock().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// dailyRetryAfter is the Retry-After of a request over the daily cap: the
+// seconds until the counters reset.
+func dailyRetryAfter() string {
+	return strconv.Itoa(int(math.Ceil(nextUTCMidnight().Sub(dailyClock()).Seconds())))
+}
+
+// takeDailyUsage counts a request against the key's cap for the current UTC
+// day and returns that day. It reports false, without counting, once the cap
+// is reached.
+func takeDailyUsage(apiKey string, limit int) (string, bool, error) {
+	var requests int
+	day := usageDay()
+	err := db.QueryRow(`
+		INSERT INTO daily_usage (key, day, requests)
+		SELECT $1, $3::date, 1 WHERE $2 > 0
+		ON CONFLICT (key, day) DO UPDATE SET requests = daily_usage.requests + 1
+		WHERE daily_usage.requests < $2
+		RETURNING requests`, apiKey, limit, day).Scan(&requests)
+	if err == sql.ErrNoRows {
+		return day, false, nil
+	}
+	return day, err == nil, err
+}
+
+// returnDailyUsage undoes takeDailyUsage for a request that was not served,
+// on the day takeDailyUsage counted it even when midnight has passed since.
+func returnDailyUsage(apiKey, day string) error {
+	_, err := db.Exec(`
+		UPDATE daily_usage SET requests = requests - 1
+		WHERE key = $1 AND day = $2::date AND requests > 0`, apiKey, day)
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dailyUsageTable answers the daily_usage statements like the table would,
+// counting requests per key and day.
+type dailyUsageTable struct {
+	mu       sync.Mutex
+	requests map[[2]string]int64
+}
+
+func (d *dailyUsageTable) handle(q fakeQuery) fakeResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case strings.Contains(q.SQL, "INSERT INTO daily_usage"):
+		row := [2]string{q.Args[0].(string), q.Args[2].(string)}
+		if limit := q.Args[1].(int64); limit <= 0 || d.requests[row] >= limit {
+			return fakeResult{Columns: []string{"requests"}}
+		}
+		d.requests[row]++
+		return fakeResult{Columns: []string{"requests"}, Rows: [][]driver.Value{{d.requests[row]}}}
+	case strings.Contains(q.SQL, "UPDATE daily_usage SET requests = requests - 1"):
+		if row := [2]string{q.Args[0].(string), q.Args[1].(string)}; d.requests[row] > 0 {
+			d.requests[row]--
+		}
+	}
+	return fakeResult{}
+}
+
+func TestDailyRetryAfter(t *testing.T) {
+	tests := []struct {
+		now       time.Time
+		wantDay   string
+		wantRetry string
+	}{
+		{time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC), "2026-03-01", "60"},
+		{time.Date(2026, 3, 1, 23, 59, 59, 500e6, time.UTC), "2026-03-01", "1"},
+		{time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), "2026-03-02", "86400"},
+		{time.Date(2026, 3, 2, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*3600)), "2026-03-01", "3600"},
+	}
+	for _, tt := range tests {
+		swap(t, &dailyClock, func() time.Time { return tt.now })
+		if day, retry := usageDay(), dailyRetryAfter(); day != tt.wantDay || retry != tt.wantRetry {
+			t.Errorf("at %v: day %s, Retry-After %s; want %s, %s", tt.now, day, retry, tt.wantDay, tt.wantRetry)
+		}
+	}
+}
+
+func TestDailyLimit(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	limit := 2
+	auth := useKeys(t,
+		&APIKey{Key: "capped", RemainingCalls: 10, Tier: defaultTier, DailyLimit: &limit},
+		&APIKey{Key: "free", RemainingCalls: 10, Tier: defaultTier},
+	)
+	useFakeDB(t, (&dailyUsageTable{requests: make(map[[2]string]int64)}).handle)
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+	now := time.Date(2026, 3, 1, 23, 58, 30, 0, time.UTC)
+	swap(t, &dailyClock, func() time.Time { return now })
+
+	tests := []struct {
+		name          string
+		key           string
+		advance       time.Duration
+		wantStatus    int
+		wantRetry     string
+		wantRemaining int
+	}{
+		{"first request of the day", "capped", 0, http.StatusOK, "", 9},
+		{"last request under the cap", "capped", 0, http.StatusOK, "", 8},
+		{"cap reached", "capped", 30 * time.Second, http.StatusTooManyRequests, "60", 8},
+		{"uncapped key", "free", 0, http.StatusOK, "", 9},
+		{"still capped before midnight", "capped", 59 * time.Second, http.StatusTooManyRequests, "1", 8},
+		{"next day", "capped", 2 * time.Second, http.StatusOK, "", 7},
+		{"second request of the next day", "capped", time.Hour, http.StatusOK, "", 6},
+		{"cap reached again", "capped", 0, http.StatusTooManyRequests, "82799", 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest(tt.key, `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetry {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetry)
+			}
+			if got := auth.remaining(tt.key); got != tt.wantRemaining {
+				t.Errorf("%d calls left, want %d", got, tt.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestDailyUsageReturnedWithRefund(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.ModelFailover = nil
+		c.FailoverCooldown = 0
+	})
+	limit := 1
+	auth := useKeys(t, &APIKey{Key: "capped", RemainingCalls: 10, Tier: defaultTier, DailyLimit: &limit})
+	table := &dailyUsageTable{requests: make(map[[2]string]int64)}
+	useFakeDB(t, table.handle)
+	var mu sync.Mutex
+	now := time.Date(2026, 3, 1, 23, 59, 59, 0, time.UTC)
+	swap(t, &dailyClock, func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		// 上游失败前已过 UTC 零点，退还的仍是计入的那一天
+		mu.Lock()
+		now = now.Add(2 * time.Second)
+		mu.Unlock()
+		http.Error(w, `{"type":"error","error":{"type":"api_error","message":"internal"}}`, http.StatusInternalServerError)
+	})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("capped", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500: %s", w.Code, w.Body)
+	}
+	table.mu.Lock()
+	day1, day2 := table.requests[[2]string{"capped", "2026-03-01"}], table.requests[[2]string{"capped", "2026-03-02"}]
+	table.mu.Unlock()
+	if day1 != 0 || day2 != 0 || auth.remaining("capped") != 10 {
+		t.Errorf("after the failure: %d requests on Mar 1, %d on Mar 2, %d calls left; want 0, 0, 10", day1, day2, auth.remaining("capped"))
+	}
+}
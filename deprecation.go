@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// routeDeprecation describes a route that clients should migrate off.
+type routeDeprecation struct {
+	// Since is when the route was deprecated.
+	Since time.Time
+	// Sunset is when the route will stop working, zero when not yet known.
+	Sunset time.Time
+}
+
+// parseDeprecatedRoutes parses route=since|sunset entries with dates as
+// YYYY-MM-DD (UTC); the sunset date is optional.
+func parseDeprecatedRoutes(entries []string) map[string]routeDeprecation {
+	routes := make(map[string]routeDeprecation)
+	for _, entry := range entries {
+		route, dates, ok := strings.Cut(entry, "=")
+		since, sunset, hasSunset := strings.Cut(dates, "|")
+		var d routeDeprecation
+		var err error
+		if ok {
+			d.Since, err = time.Parse(time.DateOnly, strings.TrimSpace(since))
+		}
+		if ok && err == nil && hasSunset {
+			d.Sunset, err = time.Parse(time.DateOnly, strings.TrimSpace(sunset))
+		}
+		if !ok || err != nil {
+			log.Printf("Ignoring invalid deprecated route %q", entry)
+			continue
+		}
+		routes[strings.TrimSpace(route)] = d
+	}
+	return routes
+}
+
+// withDeprecation marks responses of a route listed in DEPRECATED_ROUTES
+// with a Deprecation header (RFC 9745), a Sunset header (RFC 8594) when the
+// date is known, a Link to DEPRECATION_LINK, and a Warning for clients that
+// only surface that.
+func withDeprecation(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := cfg()
+		d, ok := c.DeprecatedRoutes[route]
+		if !ok {
+			handler(w, r)
+			return
+		}
+		warning := "This endpoint is deprecated"
+		h := w.Header()
+		h.Set("Deprecation", "@"+strconv.FormatInt(d.Since.Unix(), 10))
+		if !d.Sunset.IsZero() {
+			h.Set("Sunset", d.Sunset.Format(http.TimeFormat))
+			warning += " and will be removed on " + d.Sunset.Format(time.DateOnly)
+		}
+		if c.DeprecationLink != "" {
+			h.Add("Link", "<"+c.DeprecationLink+`>; rel="deprecation"`)
+			warning += ", see " + c.DeprecationLink
+		}
+		h.Add("Warning", `299 - "`+warning+`"`)
+		handler(w, r)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseDeprecatedRoutes(t *testing.T) {
+	day := func(m time.Month, d int) time.Time { return time.Date(2026, m, d, 0, 0, 0, 0, time.UTC) }
+	got := parseDeprecatedRoutes([]string{
+		"/=2026-01-01|2026-07-01",
+		" /v1/pricing = 2026-03-15 ",
+		"/v1/bad=soon",
+		"/v1/sunset=2026-01-01|later",
+		"/v1/no-dates",
+	})
+	want := map[string]routeDeprecation{
+		"/":           {Since: day(time.January, 1), Sunset: day(time.July, 1)},
+		"/v1/pricing": {Since: day(time.March, 15)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for route, d := range want {
+		if !got[route].Since.Equal(d.Since) || !got[route].Sunset.Equal(d.Sunset) {
+			t.Errorf("%s: %+v, want %+v", route, got[route], d)
+		}
+	}
+}
+
+func TestDeprecationHeaders(t *testing.T) {
+	useFakeDB(t, nil)
+	since := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		deprecation routeDeprecation
+		link        string
+		method      string
+		path        string
+		want        map[string]string
+	}{
+		{
+			name:        "flagged route with sunset and link",
+			deprecation: routeDeprecation{Since: since, Sunset: time.Date(2026, time.July, 1, 0, 0, 0, 0, time.UTC)},
+			link:        "https://docs.example/migrate",
+			method:      http.MethodPost, path: "/",
+			want: map[string]string{
+				"Deprecation": "@1767225600",
+				"Sunset":      "Wed, 01 Jul 2026 00:00:00 GMT",
+				"Link":        `<https://docs.example/migrate>; rel="deprecation"`,
+				"Warning":     `299 - "This endpoint is deprecated and will be removed on 2026-07-01, see https://docs.example/migrate"`,
+			},
+		},
+		{
+			name:        "flagged route without sunset",
+			deprecation: routeDeprecation{Since: since},
+			method:      http.MethodPost, path: "/",
+			want: map[string]string{
+				"Deprecation": "@1767225600",
+				"Sunset":      "",
+				"Link":        "",
+				"Warning":     `299 - "This endpoint is deprecated"`,
+			},
+		},
+		{
+			name:        "other route",
+			deprecation: routeDeprecation{Since: since},
+			method:      http.MethodGet, path: "/v1/pricing",
+			want: map[string]string{"Deprecation": "", "Sunset": "", "Warning": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.BasePath = ""
+				c.DeprecatedRoutes = map[string]routeDeprecation{"/": tt.deprecation}
+				c.DeprecationLink = tt.link
+			})
+			// 请求未携带密钥，错误响应同样带有弃用提示
+			w := httptest.NewRecorder()
+			newRouter().ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			for name, want := range tt.want {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// hostResolver looks up the addresses of a host name; *net.Resolver
+// implements it.
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// newUpstreamResolver returns a resolver that sends every query to server
+// (host:port), or the system resolver when server is empty.
+func newUpstreamResolver(server string) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// cachingDialer resolves host names with its own resolver and keeps the
+// answers for ttl, so new upstream connections skip the lookup. Addresses
+// are dialled in order until one connects. A ttl of 0 resolves on every dial.
+type cachingDialer struct {
+	dialer   *net.Dialer
+	resolver hostResolver
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+func newCachingDialer(dialer *net.Dialer, resolver hostResolver, ttl time.Duration) *cachingDialer {
+	return &cachingDialer{dialer: dialer, resolver: resolver, ttl: ttl, entries: make(map[string]dnsEntry)}
+}
+
+func (d *cachingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// 缓存的地址全部连接失败时丢弃缓存，下次重新解析
+	d.forget(host)
+	return nil, errors.Join(errs...)
+}
+
+func (d *cachingDialer) lookup(ctx context.Context, host string) ([]string, error) {
+	now := time.Now()
+	d.mu.Lock()
+	entry, ok := d.entries[host]
+	d.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if d.ttl > 0 {
+		d.mu.Lock()
+		d.entries[host] = dnsEntry{addrs: addrs, expires: now.Add(d.ttl)}
+		d.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+func (d *cachingDialer) forget(host string) {
+	d.mu.Lock()
+	delete(d.entries, host)
+	d.mu.Unlock()
+}
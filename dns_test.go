@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers lookups from hosts and counts them.
+type fakeResolver struct {
+	mu      sync.Mutex
+	hosts   map[string][]string
+	lookups int
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *fakeResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+// listen accepts and closes connections on a local port until the test ends.
+func listen(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestCachingDialer(t *testing.T) {
+	_, port, _ := net.SplitHostPort(listen(t))
+	// 192.0.2.1 (TEST-NET-1) 无法连接，用于模拟失效的地址
+	tests := []struct {
+		name        string
+		ttl         time.Duration
+		addrs       []string
+		dials       int
+		wantLookups int
+		wantErr     bool
+	}{
+		{"no cache", 0, []string{"127.0.0.1"}, 3, 3, false},
+		{"cached", time.Minute, []string{"127.0.0.1"}, 3, 1, false},
+		{"first address down", time.Minute, []string{"192.0.2.1", "127.0.0.1"}, 2, 1, false},
+		{"all addresses down", time.Minute, []string{"192.0.2.1"}, 2, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &fakeResolver{hosts: map[string][]string{"us-east5-aiplatform.googleapis.com": tt.addrs}}
+			d := newCachingDialer(&net.Dialer{Timeout: 100 * time.Millisecond}, resolver, tt.ttl)
+			for range tt.dials {
+				conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("us-east5-aiplatform.googleapis.com", port))
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("dial error %v, want error %v", err, tt.wantErr)
+				}
+				if conn != nil {
+					conn.Close()
+				}
+			}
+			if got := resolver.count(); got != tt.wantLookups {
+				t.Errorf("%d lookups for %d dials, want %d", got, tt.dials, tt.wantLookups)
+			}
+		})
+	}
+}
+
+func TestCachingDialerExpiry(t *testing.T) {
+	_, port, _ := net.SplitHostPort(listen(t))
+	resolver := &fakeResolver{hosts: map[string][]string{"vertex.internal": {"127.0.0.1"}}}
+	d := newCachingDialer(&net.Dialer{}, resolver, time.Minute)
+	dial := func() error {
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("vertex.internal", port))
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := dial(); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	entry := d.entries["vertex.internal"]
+	entry.expires = time.Now().Add(-time.Second)
+	d.entries["vertex.internal"] = entry
+	d.mu.Unlock()
+	if err := dial(); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolver.count(); got != 2 {
+		t.Errorf("%d lookups, want the expired entry resolved again", got)
+	}
+
+	// IP 地址与解析失败
+	if err := func() error {
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port))
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}(); err != nil || resolver.count() != 2 {
+		t.Errorf("dialling an IP: err %v, %d lookups", err, resolver.count())
+	}
+	_, err := d.DialContext(context.Background(), "tcp", "unknown.internal:443")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("unknown host: err %v, want the lookup error", err)
+	}
+}
+
+// serveDNS answers A queries for every name with ip over UDP and returns the
+// server address and the names asked for.
+func serveDNS(t *testing.T, ip net.IP) (string, func() []string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			// 问题部分：以 0 结尾的标签序列，随后是 QTYPE 与 QCLASS
+			end := 12
+			var name []byte
+			for end < n && query[end] != 0 {
+				l := int(query[end])
+				name = append(append(name, query[end+1:end+1+l]...), '.')
+				end += 1 + l
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(query[end-4:])
+			mu.Lock()
+			names = append(names, string(name))
+			mu.Unlock()
+
+			resp := append([]byte{}, query[:end]...)
+			resp[2], resp[3] = 0x81, 0x80
+			binary.BigEndian.PutUint16(resp[6:], 0)
+			binary.BigEndian.PutUint16(resp[8:], 0)
+			binary.BigEndian.PutUint16(resp[10:], 0)
+			if qtype == 1 {
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				resp = append(resp, 0xC0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+				resp = append(resp, ip.To4()...)
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(names)
+	}
+}
+
+func TestUpstreamResolver(t *testing.T) {
+	if newUpstreamResolver("") != net.DefaultResolver {
+		t.Error("no UPSTREAM_DNS_SERVER should use the system resolver")
+	}
+
+	server, asked := serveDNS(t, net.IPv4(127, 0, 0, 1))
+	resolver := newUpstreamResolver(server)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := resolver.LookupHost(ctx, "us-east5-aiplatform.googleapis.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(addrs, "127.0.0.1") {
+		t.Errorf("resolved %v, want the custom server's answer", addrs)
+	}
+	if !slices.Contains(asked(), "us-east5-aiplatform.googleapis.com.") {
+		t.Errorf("custom server was asked for %v", asked())
+	}
+
+	// 经由自定义解析器建立上游连接
+	_, port, _ := net.SplitHostPort(listen(t))
+	d := newCachingDialer(&net.Dialer{}, resolver, time.Minute)
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort("europe-west1-aiplatform.googleapis.com", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !slices.Contains(asked(), "europe-west1-aiplatform.googleapis.com.") {
+		t.Errorf("dial did not consult the custom server: %v", asked())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envelope is the standard wrapper around non-streaming JSON responses for
+// consumers that ask for it.
+type envelope struct {
+	Data json.RawMessage `json:"data"`
+	Meta envelopeMeta    `json:"meta"`
+}
+
+type envelopeMeta struct {
+	RequestID  string `json:"request_id"`
+	Status     int    `json:"status"`
+	DurationMS int64  `json:"duration_ms"`
+	Model      string `json:"model,omitempty"`
+}
+
+// wantsEnvelope reports whether the response should be wrapped: always when
+// RESPONSE_ENVELOPE is set, otherwise when the client sends X-Envelope: true.
+func wantsEnvelope(r *http.Request) bool {
+	if cfg().ResponseEnvelope {
+		return true
+	}
+	on, _ := strconv.ParseBool(r.Header.Get("X-Envelope"))
+	return on
+}
+
+// withEnvelope wraps JSON responses of handler in an envelope. Event streams
+// and other content types pass through untouched.
+func withEnvelope(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !wantsEnvelope(r) {
+			handler(w, r)
+			return
+		}
+		start := time.Now()
+		ew := &envelopeWriter{ResponseWriter: w}
+		handler(ew, r)
+		if !ew.wrapping {
+			return
+		}
+
+		data := bytes.TrimSpace(ew.buf.Bytes())
+		if !json.Valid(data) {
+			data, _ = json.Marshal(string(data))
+		}
+		body, _ := json.Marshal(envelope{
+			Data: data,
+			Meta: envelopeMeta{
+				RequestID:  requestIDFor(r),
+				Status:     ew.status,
+				DurationMS: time.Since(start).Milliseconds(),
+				Model:      w.Header().Get("X-Served-Model"),
+			},
+		})
+		writeBody(w, ew.status, "application/json", append(body, '\n'))
+	}
+}
+
+// envelopeWriter buffers a JSON response so it can be wrapped once the
+// handler is done. Anything else is written straight through.
+type envelopeWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	wrapping    bool
+	buf         bytes.Buffer
+}
+
+func (ew *envelopeWriter) WriteHeader(status int) {
+	if ew.wroteHeader {
+		return
+	}
+	ew.wroteHeader = true
+	mediaType, _, _ := mime.ParseMediaType(ew.Header().Get("Content-Type"))
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		ew.wrapping = true
+		ew.status = status
+		ew.Header().Del("Content-Length")
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *envelopeWriter) Write(p []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.wrapping {
+		return ew.buf.Write(p)
+	}
+	return ew.ResponseWriter.Write(p)
+}
+
+func (ew *envelopeWriter) Flush() {
+	if ew.wrapping {
+		return
+	}
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (ew *envelopeWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestWithEnvelope(t *testing.T) {
+	jsonHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-Model", "claude-served")
+		writeJSON(w, http.StatusCreated, map[string]string{"id": "msg_1"})
+	}
+	streamHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(sseTranscript))
+	}
+	tests := []struct {
+		name       string
+		configured bool
+		header     string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantBody   string // 不包装时的原始响应
+	}{
+		{name: "unwrapped by default", handler: jsonHandler, wantStatus: http.StatusCreated, wantBody: `{"id":"msg_1"}` + "\n"},
+		{name: "header off", header: "false", handler: jsonHandler, wantStatus: http.StatusCreated, wantBody: `{"id":"msg_1"}` + "\n"},
+		{name: "header on", header: "true", handler: jsonHandler, wantStatus: http.StatusCreated},
+		{name: "configured", configured: true, handler: jsonHandler, wantStatus: http.StatusCreated},
+		{name: "configured overrides header", configured: true, header: "false", handler: jsonHandler, wantStatus: http.StatusCreated},
+		{name: "stream exempt", configured: true, handler: streamHandler, wantStatus: http.StatusOK, wantBody: sseTranscript},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.ResponseEnvelope = tt.configured })
+			r := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+			r.Header.Set("X-Request-Id", "req-123")
+			if tt.header != "" {
+				r.Header.Set("X-Envelope", tt.header)
+			}
+			w := httptest.NewRecorder()
+			withEnvelope(tt.handler)(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" {
+				if w.Body.String() != tt.wantBody {
+					t.Errorf("body %q, want it unchanged", w.Body)
+				}
+				return
+			}
+
+			var env struct {
+				Data map[string]string
+				Meta envelopeMeta
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+				t.Fatalf("%v: %s", err, w.Body)
+			}
+			if env.Data["id"] != "msg_1" {
+				t.Errorf("data %v, want the handler's response", env.Data)
+			}
+			if env.Meta.RequestID != "req-123" || env.Meta.Status != http.StatusCreated || env.Meta.Model != "claude-served" || env.Meta.DurationMS < 0 {
+				t.Errorf("meta %+v", env.Meta)
+			}
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("Content-Length %s for a %d byte body", got, w.Body.Len())
+			}
+		})
+	}
+}
+
+func TestEnvelopeNonJSONBody(t *testing.T) {
+	setConfig(t, func(c *Config) { c.ResponseEnvelope = true })
+	w := httptest.NewRecorder()
+	withEnvelope(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("upstream said no"))
+	})(w, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	var env struct{ Data string }
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil || env.Data != "upstream said no" {
+		t.Errorf("body %s, want the text as a JSON string", w.Body)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Error codes sent as the error type, following the Anthropic API.
+const (
+	codeInvalidRequest  = "invalid_request_error"
+	codeAuthentication  = "authentication_error"
+	codePermission      = "permission_error"
+	codeNotFound        = "not_found_error"
+	codeRequestTooLarge = "request_too_large"
+	codeRateLimit       = "rate_limit_error"
+	codeAPI             = "api_error"
+	codeOverloaded      = "overloaded_error"
+	codeTimeout         = "timeout_error"
+)
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+		// BrandName and SupportURL are set on errors for white-labelled keys.
+		BrandName  string `json:"brand_name,omitempty"`
+		SupportURL string `json:"support_url,omitempty"`
+	} `json:"error"`
+}
+
+// anthropicError encodes an error in the format of Anthropic's error
+// responses and stream events.
+func anthropicError(errType, message string) []byte {
+	var resp struct {
+		Type string `json:"type"`
+		ErrorResponse
+	}
+	resp.Type = "error"
+	resp.Error.Type = errType
+	resp.Error.Message = message
+	body, _ := json.Marshal(resp)
+	return body
+}
+
+// codeForStatus returns the error type matching an upstream error status.
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return codeInvalidRequest
+	case http.StatusUnauthorized:
+		return codeAuthentication
+	case http.StatusForbidden:
+		return codePermission
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusRequestEntityTooLarge:
+		return codeRequestTooLarge
+	case http.StatusTooManyRequests:
+		return codeRateLimit
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return codeTimeout
+	case http.StatusServiceUnavailable, 529:
+		return codeOverloaded
+	default:
+		return codeAPI
+	}
+}
+
+// GatewayError is an error a handler answers with. Code and Message are sent
+// to the client with Status; Detail is the internal cause, which is logged
+// but never leaves the gateway.
+type GatewayError struct {
+	Code    string
+	Status  int
+	Message string
+	Detail  error
+}
+
+func (e *GatewayError) Error() string {
+	if e.Detail != nil {
+		return e.Message + ": " + e.Detail.Error()
+	}
+	return e.Message
+}
+
+func (e *GatewayError) Unwrap() error {
+	return e.Detail
+}
+
+// withDetail returns a copy of e carrying the internal cause err, so shared
+// errors can be reused.
+func (e *GatewayError) withDetail(err error) *GatewayError {
+	c := *e
+	c.Detail = err
+	return &c
+}
+
+func invalidRequest(message string) *GatewayError {
+	return &GatewayError{Code: codeInvalidRequest, Status: http.StatusBadRequest, Message: message}
+}
+
+func unauthenticated(message string) *GatewayError {
+	return &GatewayError{Code: codeAuthentication, Status: http.StatusUnauthorized, Message: message}
+}
+
+func permissionDenied(message string) *GatewayError {
+	return &GatewayError{Code: codePermission, Status: http.StatusForbidden, Message: message}
+}
+
+func notFound(message string) *GatewayError {
+	return &GatewayError{Code: codeNotFound, Status: http.StatusNotFound, Message: message}
+}
+
+func rateLimited(message string) *GatewayError {
+	return &GatewayError{Code: codeRateLimit, Status: http.StatusTooManyRequests, Message: message}
+}
+
+func internalError(message string, detail error) *GatewayError {
+	return &GatewayError{Code: codeAPI, Status: http.StatusInternalServerError, Message: message, Detail: detail}
+}
+
+func upstreamFailure(message string, detail error) *GatewayError {
+	return &GatewayError{Code: codeAPI, Status: http.StatusBadGateway, Message: message, Detail: detail}
+}
+
+// unavailable is a temporary failure of a dependency; clients should retry.
+func unavailable(message string, detail error) *GatewayError {
+	return &GatewayError{Code: codeAPI, Status: http.StatusServiceUnavailable, Message: message, Detail: detail}
+}
+
+func overloaded(message string) *GatewayError {
+	return &GatewayError{Code: codeOverloaded, Status: http.StatusServiceUnavailable, Message: message}
+}
+
+func timedOut(message string) *GatewayError {
+	return &GatewayError{Code: codeTimeout, Status: http.StatusGatewayTimeout, Message: message}
+}
+
+// Errors shared by several handlers.
+var (
+	errAPIKeyRequired         = unauthenticated("API key is required")
+	errInvalidAPIKey          = unauthenticated("Invalid or expired API key")
+	errAuthUnavailable        = unavailable("Authentication is temporarily unavailable, please retry later", nil)
+	errKeyIPNotAllowed        = permissionDenied("API key is not allowed from this IP address")
+	errRateLimitExceeded      = rateLimited("Rate limit exceeded")
+	errCredentialsUnavailable = unavailable("Upstream credentials are not available yet", nil)
+	errQuotaUpdateFailed      = internalError("Failed to update API key quota", nil)
+)
+
+// asGatewayError maps any error to the taxonomy. Errors that aren't a
+// GatewayError are matched against the gateway's sentinel errors; anything
+// else is an internal error whose details stay in the log.
+func asGatewayError(err error) *GatewayError {
+	var ge *GatewayError
+	if errors.As(err, &ge) {
+		return ge
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		return errInvalidAPIKey
+	case errors.Is(err, errNoRemainingCalls):
+		return permissionDenied("API key has no remaining calls")
+	case errors.As(err, &tooLarge):
+		return &GatewayError{Code: codeRequestTooLarge, Status: http.StatusRequestEntityTooLarge, Message: "Request body exceeds " + strconv.FormatInt(tooLarge.Limit, 10) + " bytes"}
+	case errors.Is(err, context.DeadlineExceeded):
+		return timedOut("Request timed out").withDetail(err)
+	default:
+		return internalError("Internal server error", err)
+	}
+}
+
+// respondError answers the request with err in the ErrorResponse shape and
+// logs its internal detail, if any.
+func respondError(w http.ResponseWriter, r *http.Request, err error) {
+	respondKeyError(w, r, nil, err)
+}
+
+// respondKeyError is respondError for errors tied to key, which are branded
+// for white-labelled keys. key may be nil.
+func respondKeyError(w http.ResponseWriter, r *http.Request, key *APIKey, err error) {
+	ge := asGatewayError(err)
+	if ge.Detail != nil {
+		logf(r.Context(), "%s (%d %s): %v", ge.Message, ge.Status, ge.Code, ge.Detail)
+	}
+	writeKeyError(w, key, ge.Status, ge.Code, ge.Message)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRespondError(t *testing.T) {
+	dbDown := errors.New("pq: password authentication failed for user \"gateway\"")
+	tests := []struct {
+		name        string
+		err         error
+		wantStatus  int
+		wantCode    string
+		wantMessage string
+		wantLogged  string // 记录到日志但不返回给客户端的内部细节
+	}{
+		{"gateway error", invalidRequest("messages: field required"), http.StatusBadRequest, codeInvalidRequest, "messages: field required", ""},
+		{"wrapped gateway error", fmt.Errorf("validating: %w", rateLimited("Rate limit exceeded")), http.StatusTooManyRequests, codeRateLimit, "Rate limit exceeded", ""},
+		{"unknown key", errKeyNotFound, http.StatusUnauthorized, codeAuthentication, "Invalid or expired API key", ""},
+		{"no calls left", fmt.Errorf("charging: %w", errNoRemainingCalls), http.StatusForbidden, codePermission, "API key has no remaining calls", ""},
+		{"body too large", &http.MaxBytesError{Limit: 1024}, http.StatusRequestEntityTooLarge, codeRequestTooLarge, "Request body exceeds 1024 bytes", ""},
+		{"deadline", fmt.Errorf("calling upstream: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, codeTimeout, "Request timed out", "deadline exceeded"},
+		{"database error", dbDown, http.StatusInternalServerError, codeAPI, "Internal server error", "password authentication failed"},
+		{"auth backend down", errAuthUnavailable.withDetail(dbDown), http.StatusServiceUnavailable, codeAPI, "Authentication is temporarily unavailable, please retry later", "password authentication failed"},
+		{"upstream failure", upstreamFailure("Error forwarding request", errors.New("dial tcp: i/o timeout")), http.StatusBadGateway, codeAPI, "Error forwarding request", "i/o timeout"},
+		{"overloaded", overloaded("Gateway is overloaded"), http.StatusServiceUnavailable, codeOverloaded, "Gateway is overloaded", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs syncBuffer
+			prev := slog.Default()
+			slog.SetDefault(slog.New(&redactingHandler{next: slog.NewTextHandler(&logs, nil)}))
+			t.Cleanup(func() { slog.SetDefault(prev) })
+
+			w := httptest.NewRecorder()
+			respondError(w, httptest.NewRequest(http.MethodPost, "/v1/messages", nil), tt.err)
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("body %s: %v", w.Body, err)
+			}
+			if w.Code != tt.wantStatus || resp.Error.Type != tt.wantCode || resp.Error.Message != tt.wantMessage {
+				t.Errorf("got %d %s %q, want %d %s %q", w.Code, resp.Error.Type, resp.Error.Message, tt.wantStatus, tt.wantCode, tt.wantMessage)
+			}
+			if tt.wantLogged == "" {
+				return
+			}
+			if strings.Contains(w.Body.String(), tt.wantLogged) {
+				t.Errorf("internal detail sent to the client: %s", w.Body)
+			}
+			if !strings.Contains(logs.String(), tt.wantLogged) {
+				t.Errorf("detail %q not logged:\n%s", tt.wantLogged, logs.String())
+			}
+		})
+	}
+}
+
+func TestAuthFailure(t *testing.T) {
+	r := newMessagesRequest("k", `{}`)
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{"unknown key", errKeyNotFound, http.StatusUnauthorized},
+		{"key outside its endpoints", errEndpointNotAllowed, http.StatusForbidden},
+		// 数据库故障不能被当作无效密钥
+		{"database down", errors.New("connection refused"), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		if got := asGatewayError(authFailure(r, "k", tt.err)).Status; got != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.wantStatus)
+		}
+	}
+}
+
+func TestCodeForStatus(t *testing.T) {
+	for status, want := range map[int]string{
+		http.StatusBadRequest:          codeInvalidRequest,
+		http.StatusUnprocessableEntity: codeInvalidRequest,
+		http.StatusUnauthorized:        codeAuthentication,
+		http.StatusForbidden:           codePermission,
+		http.StatusNotFound:            codeNotFound,
+		http.StatusTooManyRequests:     codeRateLimit,
+		http.StatusGatewayTimeout:      codeTimeout,
+		529:                            codeOverloaded,
+		http.StatusInternalServerError: codeAPI,
+	} {
+		if got := codeForStatus(status); got != want {
+			t.Errorf("codeForStatus(%d) = %s, want %s", status, got, want)
+		}
+	}
+}
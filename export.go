@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// timeRange bounds usage queries: From is inclusive, To exclusive. A zero
+// bound is open.
+type timeRange struct {
+	From, To time.Time
+}
+
+// parseTimeRange reads the from and to query parameters, each an RFC 3339
+// timestamp or a YYYY-MM-DD date meaning midnight UTC.
+func parseTimeRange(r *http.Request) (timeRange, error) {
+	var tr timeRange
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &tr.From}, {"to", &tr.To}} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			t, err = time.Parse(time.DateOnly, v)
+		}
+		if err != nil {
+			return tr, fmt.Errorf("%s must be an RFC 3339 timestamp or a YYYY-MM-DD date", p.name)
+		}
+		*p.dst = t
+	}
+	if !tr.From.IsZero() && !tr.To.IsZero() && !tr.From.Before(tr.To) {
+		return tr, fmt.Errorf("from must be before to")
+	}
+	return tr, nil
+}
+
+// args returns the bounds as query arguments, NULL for an open bound, for
+// use with `($n::timestamptz IS NULL OR created_at >= $n)`.
+func (tr timeRange) args() (from, to any) {
+	if !tr.From.IsZero() {
+		from = tr.From
+	}
+	if !tr.To.IsZero() {
+		to = tr.To
+	}
+	return from, to
+}
+
+// exportFlushRows is how many CSV rows are written between flushes.
+const exportFlushRows = 500
+
+// handleExportUsage streams per-key, per-model usage over the from/to range
+// as CSV. Rows are written as they are read so large exports are never held
+// in memory; cost_usd is empty for models without a token price.
+func handleExportUsage(w http.ResponseWriter, r *http.Request) {
+	tr, err := parseTimeRange(r)
+	if err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+	from, to := tr.args()
+	rows, err := readDB().QueryContext(r.Context(), `
+		SELECT key_id, model, COUNT(*), COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0)
+		FROM usage_log
+		WHERE ($1::timestamptz IS NULL OR created_at >= $1)
+		AND ($2::timestamptz IS NULL OR created_at < $2)
+		GROUP BY key_id, model
+		ORDER BY key_id, model`, from, to)
+	if err != nil {
+		respondError(w, r, internalError("Failed to export usage", err))
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+	rc := http.NewResponseController(w)
+	out := csv.NewWriter(w)
+	out.Write([]string{"key_id", "model", "requests", "input_tokens", "output_tokens", "cost_usd"})
+
+	// 表头已写出后无法再返回错误状态码，出错时只能记录日志并截断输出
+	n := 0
+	for rows.Next() {
+		var (
+			id, model string
+			usage     usageTracker
+			requests  int64
+		)
+		if err := rows.Scan(&id, &model, &requests, &usage.InputTokens, &usage.OutputTokens); err != nil {
+			log.Printf("Error exporting usage: %v", err)
+			break
+		}
+		cost := ""
+		if usd, ok := tokenCostUSD(model, usage); ok {
+			cost = strconv.FormatFloat(usd, 'f', 6, 64)
+		}
+		out.Write([]string{id, model, strconv.FormatInt(requests, 10), strconv.Itoa(usage.InputTokens), strconv.Itoa(usage.OutputTokens), cost})
+		if n++; n%exportFlushRows == 0 {
+			out.Flush()
+			rc.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error exporting usage: %v", err)
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("Error writing usage export: %v", err)
+	}
+}
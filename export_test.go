@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimeRange(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 3, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		query   string
+		want    timeRange
+		wantErr bool
+	}{
+		{"", timeRange{}, false},
+		{"from=2026-03-01", timeRange{From: day(1)}, false},
+		{"to=2026-03-02T00:00:00Z", timeRange{To: day(2)}, false},
+		{"from=2026-03-01&to=2026-03-02", timeRange{From: day(1), To: day(2)}, false},
+		{"from=yesterday", timeRange{}, true},
+		{"from=2026-03-02&to=2026-03-01", timeRange{}, true},
+		{"from=2026-03-01&to=2026-03-01", timeRange{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeRange(httptest.NewRequest(http.MethodGet, "/v1/export/usage.csv?"+tt.query, nil))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v, want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (!got.From.Equal(tt.want.From) || !got.To.Equal(tt.want.To)) {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestHandleExportUsage(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.TokenPrices = map[string]tokenPrice{"claude-a": {3, 15}}
+	})
+	tests := []struct {
+		name       string
+		query      string
+		rows       [][]driver.Value
+		wantStatus int
+		wantArgs   []driver.Value
+		wantCSV    [][]string
+	}{
+		{
+			name: "seeded rows",
+			rows: [][]driver.Value{
+				{"key-1", "claude-a", int64(3), int64(1000), int64(200)},
+				{"key-1", "claude-b", int64(1), int64(10), int64(5)},
+			},
+			wantStatus: http.StatusOK,
+			wantArgs:   []driver.Value{nil, nil},
+			wantCSV: [][]string{
+				{"key_id", "model", "requests", "input_tokens", "output_tokens", "cost_usd"},
+				{"key-1", "claude-a", "3", "1000", "200", "0.006000"},
+				{"key-1", "claude-b", "1", "10", "5", ""},
+			},
+		},
+		{
+			name:       "date range",
+			query:      "?from=2026-03-01&to=2026-04-01",
+			wantStatus: http.StatusOK,
+			wantArgs:   []driver.Value{time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+			wantCSV:    [][]string{{"key_id", "model", "requests", "input_tokens", "output_tokens", "cost_usd"}},
+		},
+		{name: "invalid range", query: "?from=march", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, func(q fakeQuery) fakeResult {
+				return fakeResult{Columns: []string{"key_id", "model", "count", "input", "output"}, Rows: tt.rows}
+			})
+			w := httptest.NewRecorder()
+			handleExportUsage(w, httptest.NewRequest(http.MethodGet, "/v1/export/usage.csv"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if len(fake.ran()) != 0 {
+					t.Error("invalid request queried the database")
+				}
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+				t.Errorf("Content-Type %s", ct)
+			}
+			if ran := fake.ran(); len(ran) != 1 || fmt.Sprint(ran[0].Args) != fmt.Sprint(tt.wantArgs) {
+				t.Errorf("queried with %v, want %v", ran, tt.wantArgs)
+			}
+			got, err := csv.NewReader(w.Body).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.EqualFunc(got, tt.wantCSV, slices.Equal) {
+				t.Errorf("CSV %v, want %v", got, tt.wantCSV)
+			}
+		})
+	}
+}
+
+func TestExportUsageFlushes(t *testing.T) {
+	rows := make([][]driver.Value, 2*exportFlushRows+1)
+	for i := range rows {
+		rows[i] = []driver.Value{fmt.Sprintf("key-%04d", i), "claude-a", int64(1), int64(1), int64(1)}
+	}
+	useFakeDB(t, func(q fakeQuery) fakeResult {
+		return fakeResult{Columns: []string{"key_id", "model", "count", "input", "output"}, Rows: rows}
+	})
+	rec := &countingWriter{ResponseWriter: httptest.NewRecorder()}
+	handleExportUsage(rec, httptest.NewRequest(http.MethodGet, "/v1/export/usage.csv", nil))
+	if _, flushes := rec.counts(); flushes != 2 {
+		t.Errorf("%d flushes while streaming, want one per %d rows", flushes, exportFlushRows)
+	}
+}
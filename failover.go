@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxCooldown caps the cooldown an upstream's Retry-After can ask for.
+const maxCooldown = 5 * time.Minute
+
+// failoverTarget is one place a request can be sent: a model of a provider
+// in one of its regions.
+type failoverTarget struct {
+	provider Provider
+	model    string
+	region   string
+}
+
+// cooldownTracker remembers the targets that failed recently, so requests
+// skip them until their cooldown ends instead of hitting a dead region or an
+// exhausted quota again.
+type cooldownTracker struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+var cooldowns = &cooldownTracker{until: make(map[string]time.Time)}
+
+func cooldownKey(model, region string) string {
+	return region + "/" + model
+}
+
+// Cooling reports whether model in region is cooling down.
+func (c *cooldownTracker) Cooling(model, region string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cooldownKey(model, region)
+	until, ok := c.until[key]
+	if ok && time.Now().After(until) {
+		delete(c.until, key)
+		return false
+	}
+	return ok
+}
+
+// Start puts model in region on cooldown for d.
+func (c *cooldownTracker) Start(model, region string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.until[cooldownKey(model, region)] = time.Now().Add(d)
+}
+
+// Count returns the number of targets cooling down.
+func (c *cooldownTracker) Count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, until := range c.until {
+		if time.Now().Before(until) {
+			n++
+		}
+	}
+	return n
+}
+
+// cooldownFor returns how long a target answering resp should rest:
+// FAILOVER_COOLDOWN, or longer when a 429 asks for it with Retry-After.
+func cooldownFor(resp *http.Response) time.Duration {
+	d := cfg().FailoverCooldown
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		return d
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		d = max(d, min(time.Duration(secs)*time.Second, maxCooldown))
+	}
+	return d
+}
+
+// failoverTargets lists where a request for model goes, in order: model with
+// p in each of regions, then every secondary model of MODEL_FAILOVER in its
+// own regions. Targets cooling down are left out unless all of them are.
+func failoverTargets(p Provider, regions []string, model string) []failoverTarget {
+	var targets []failoverTarget
+	for _, region := range regions {
+		targets = append(targets, failoverTarget{provider: p, model: model, region: region})
+	}
+	for _, secondary := range cfg().ModelFailover[model] {
+		sp := newProvider(secondary)
+		sregions, err := regionsForModel(secondary)
+		if err != nil || !sp.Ready() {
+			continue
+		}
+		for _, region := range sregions {
+			targets = append(targets, failoverTarget{provider: sp, model: secondary, region: region})
+		}
+	}
+
+	var available []failoverTarget
+	for _, t := range targets {
+		if !cooldowns.Cooling(t.model, t.region) {
+			available = append(available, t)
+		}
+	}
+	if len(available) == 0 {
+		return targets
+	}
+	return available
+}
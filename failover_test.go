@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCooldownTracker(t *testing.T) {
+	c := &cooldownTracker{until: make(map[string]time.Time)}
+	c.Start("claude-a", "us-east5", time.Minute)
+	c.Start("claude-a", "europe-west1", -time.Second)
+
+	tests := []struct {
+		model, region string
+		want          bool
+	}{
+		{"claude-a", "us-east5", true},
+		{"claude-b", "us-east5", false},
+		{"claude-a", "asia-southeast1", false},
+		{"claude-a", "europe-west1", false},
+	}
+	for _, tt := range tests {
+		if got := c.Cooling(tt.model, tt.region); got != tt.want {
+			t.Errorf("Cooling(%s, %s) = %v, want %v", tt.model, tt.region, got, tt.want)
+		}
+	}
+	if n := c.Count(); n != 1 {
+		t.Errorf("Count() = %d, want 1", n)
+	}
+	// 过期的冷却在查询时被清理
+	if _, ok := c.until[cooldownKey("claude-a", "europe-west1")]; ok {
+		t.Error("expired cooldown kept")
+	}
+}
+
+func TestCooldownFor(t *testing.T) {
+	setConfig(t, func(c *Config) { c.FailoverCooldown = 10 * time.Second })
+	response := func(status int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+	tests := []struct {
+		name string
+		resp *http.Response
+		want time.Duration
+	}{
+		{"transport error", nil, 10 * time.Second},
+		{"server error", response(http.StatusServiceUnavailable, "60"), 10 * time.Second},
+		{"rate limited", response(http.StatusTooManyRequests, ""), 10 * time.Second},
+		{"longer Retry-After", response(http.StatusTooManyRequests, "30"), 30 * time.Second},
+		{"shorter Retry-After", response(http.StatusTooManyRequests, "1"), 10 * time.Second},
+		{"capped Retry-After", response(http.StatusTooManyRequests, "3600"), maxCooldown},
+		{"HTTP date", response(http.StatusTooManyRequests, "Wed, 21 Oct 2015 07:28:00 GMT"), 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cooldownFor(tt.resp); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailoverTargets(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5", "europe-west1"}
+		c.ModelRegions = map[string][]string{"claude-a": {"us-east5", "europe-west1"}, "claude-b": {"asia-southeast1"}}
+		c.VertexTargets = nil
+		c.AnthropicModels = nil
+		c.ModelFailover = map[string][]string{"claude-a": {"claude-b", "claude-unknown"}}
+	})
+	swap(t, &modelAliases, &modelAliasTable{})
+	fakeUpstream(t, func(http.ResponseWriter, *http.Request) {})
+
+	all := []string{"us-east5/claude-a", "europe-west1/claude-a", "asia-southeast1/claude-b"}
+	tests := []struct {
+		name    string
+		cooling []string
+		want    []string
+	}{
+		{"none cooling", nil, all},
+		{"primary region cooling", []string{"us-east5/claude-a"}, []string{"europe-west1/claude-a", "asia-southeast1/claude-b"}},
+		{"primary model cooling", []string{"us-east5/claude-a", "europe-west1/claude-a"}, []string{"asia-southeast1/claude-b"}},
+		{"all cooling", all, all},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			swap(t, &cooldowns, &cooldownTracker{until: make(map[string]time.Time)})
+			for _, key := range tt.cooling {
+				region, model, _ := strings.Cut(key, "/")
+				cooldowns.Start(model, region, time.Minute)
+			}
+			var got []string
+			for _, target := range failoverTargets(newProvider("claude-a"), []string{"us-east5", "europe-west1"}, "claude-a") {
+				got = append(got, cooldownKey(target.model, target.region))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("targets %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelFailover(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-a"
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = map[string][]string{"claude-a": {"us-east5"}, "claude-b": {"europe-west1"}}
+		c.VertexTargets = nil
+		c.ModelAliases = nil
+		c.AnthropicModels = nil
+		c.ModelFailover = map[string][]string{"claude-a": {"claude-b"}}
+		c.FailoverOnRateLimit = true
+		c.FailoverCooldown = time.Minute
+	})
+	swap(t, &modelAliases, &modelAliasTable{})
+	swap(t, &cooldowns, &cooldownTracker{until: make(map[string]time.Time)})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	var (
+		mu    sync.Mutex
+		tried []string
+	)
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tried = append(tried, strings.TrimPrefix(r.URL.Path, "/"))
+		mu.Unlock()
+		if upstreamRegion(r) == "us-east5" {
+			w.Header().Set("Retry-After", "120")
+			http.Error(w, `{"type":"error","error":{"type":"rate_limit_error","message":"quota"}}`, http.StatusTooManyRequests)
+			return
+		}
+		streamSSE(w, sseTranscript)
+	})
+
+	tests := []struct {
+		name      string
+		wantTried []string
+	}{
+		{"fails over to the secondary model", []string{"us-east5/claude-a", "europe-west1/claude-b"}},
+		// 主模型仍在冷却，直接发往备用模型
+		{"skips the target cooling down", []string{"europe-west1/claude-b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tried = nil
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if w.Code != http.StatusOK || w.Body.String() != sseTranscript {
+				t.Fatalf("got %d:\n%s", w.Code, w.Body)
+			}
+			if w.Header().Get("X-Served-Model") != "claude-b" || w.Header().Get("X-Served-Region") != "europe-west1" {
+				t.Errorf("served by %s in %s, want claude-b in europe-west1", w.Header().Get("X-Served-Model"), w.Header().Get("X-Served-Region"))
+			}
+			if !slices.Equal(tried, tt.wantTried) {
+				t.Errorf("tried %v, want %v", tried, tt.wantTried)
+			}
+		})
+	}
+	// Retry-After 长于 FAILOVER_COOLDOWN 时按其冷却
+	cooldowns.mu.Lock()
+	until := cooldowns.until[cooldownKey("claude-a", "us-east5")]
+	cooldowns.mu.Unlock()
+	if left := time.Until(until); left < 110*time.Second || left > 120*time.Second {
+		t.Errorf("cooling down for %v, want about 2m", left)
+	}
+
+	// 直接调用时返回实际服务的目标
+	resp, served, err := forwardWithFailover(context.Background(), newProvider("claude-a"), []string{"us-east5"}, "claude-a", nil, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if served.model != "claude-b" || served.region != "europe-west1" {
+		t.Errorf("served by %s in %s", served.model, served.region)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feature flags toggle optional behaviors at runtime. Each flag starts from
+// its environment setting, FEATURE_FLAGS can override the seed, and flags
+// flipped through the admin API are stored in the feature_flags table, which
+// every instance re-reads periodically.
+const (
+	flagStrictValidation = "strict_validation"
+	flagValidateParams   = "validate_params"
+	flagValidateTools    = "validate_tools"
+	flagInjectUserID     = "inject_user_id"
+	flagShadowTraffic    = "shadow_traffic"
+	flagCapture          = "capture"
+)
+
+type featureFlags struct {
+	mu     sync.RWMutex
+	values map[string]bool
+}
+
+var flags = &featureFlags{values: make(map[string]bool)}
+
+// seedFlags sets every known flag from the configuration and FEATURE_FLAGS.
+func seedFlags() {
+	seed := map[string]bool{
+		flagStrictValidation: cfg().StrictValidation,
+		flagValidateParams:   cfg().ValidateParams,
+		flagValidateTools:    cfg().ValidateTools,
+		flagInjectUserID:     cfg().InjectUserID,
+		flagShadowTraffic:    true,
+		flagCapture:          true,
+	}
+	for _, entry := range cfg().FeatureFlags {
+		name, value, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		enabled, err := strconv.ParseBool(strings.TrimSpace(value))
+		if _, known := seed[name]; !ok || !known || err != nil {
+			log.Printf("Ignoring invalid feature flag %q", entry)
+			continue
+		}
+		seed[name] = enabled
+	}
+	flags.mu.Lock()
+	flags.values = seed
+	flags.mu.Unlock()
+}
+
+// Enabled reports whether the flag is on. Unknown flags are off.
+func (f *featureFlags) Enabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.values[name]
+}
+
+// Set changes a known flag and reports whether the flag exists.
+func (f *featureFlags) Set(name string, enabled bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.values[name]; !ok {
+		return false
+	}
+	f.values[name] = enabled
+	return true
+}
+
+// Snapshot returns a copy of all flags.
+func (f *featureFlags) Snapshot() map[string]bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := make(map[string]bool, len(f.values))
+	for name, enabled := range f.values {
+		out[name] = enabled
+	}
+	return out
+}
+
+// Load applies the overrides stored in the feature_flags table.
+func (f *featureFlags) Load(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name, enabled FROM feature_flags`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name    string
+			enabled bool
+		)
+		if err := rows.Scan(&name, &enabled); err != nil {
+			return err
+		}
+		f.Set(name, enabled)
+	}
+	return rows.Err()
+}
+
+// Run reloads the stored overrides on every tick until ctx is cancelled, so
+// flags flipped on another instance take effect here too. A zero interval
+// disables reloading.
+func (f *featureFlags) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !dbReady.Load() {
+				continue
+			}
+			if err := f.Load(db); err != nil {
+				log.Printf("Error loading feature flags: %v", err)
+			}
+		}
+	}
+}
+
+type flagState struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// handleListFlags returns every feature flag and its current value.
+func handleListFlags(w http.ResponseWriter, r *http.Request) {
+	resp := struct {
+		Flags []flagState `json:"flags"`
+	}{Flags: []flagState{}}
+	for name, enabled := range flags.Snapshot() {
+		resp.Flags = append(resp.Flags, flagState{Name: name, Enabled: enabled})
+	}
+	sort.Slice(resp.Flags, func(i, j int) bool { return resp.Flags[i].Name < resp.Flags[j].Name })
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleSetFlag flips a flag from a {"enabled": bool} body and persists it.
+func handleSetFlag(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		respondError(w, r, invalidRequest(`body must be {"enabled": true|false}`))
+		return
+	}
+	if _, ok := flags.Snapshot()[name]; !ok {
+		respondError(w, r, notFound("Unknown feature flag"))
+		return
+	}
+
+	_, err := db.ExecContext(r.Context(), `
+		INSERT INTO feature_flags (name, enabled, updated_at) VALUES ($1, $2, now())
+		ON CONFLICT (name) DO UPDATE SET enabled = EXCLUDED.enabled, updated_at = EXCLUDED.updated_at`,
+		name, *req.Enabled)
+	if err != nil {
+		respondError(w, r, internalError("Failed to store feature flag", fmt.Errorf("flag %s: %w", name, err)))
+		return
+	}
+	flags.Set(name, *req.Enabled)
+	log.Printf("Feature flag %s set to %t", name, *req.Enabled)
+	writeJSON(w, http.StatusOK, flagState{Name: name, Enabled: *req.Enabled})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSeedFlags(t *testing.T) {
+	swap(t, &flags, &featureFlags{values: make(map[string]bool)})
+	setConfig(t, func(c *Config) {
+		c.StrictValidation = true
+		c.ValidateParams = false
+		c.ValidateTools = false
+		c.InjectUserID = false
+		c.FeatureFlags = []string{"capture=false", "validate_tools = true", "unknown=true", "inject_user_id=maybe", "shadow_traffic"}
+	})
+	seedFlags()
+	want := map[string]bool{
+		flagStrictValidation: true,
+		flagValidateParams:   false,
+		flagValidateTools:    true,
+		flagInjectUserID:     false,
+		flagShadowTraffic:    true,
+		flagCapture:          false,
+	}
+	if got := flags.Snapshot(); !maps.Equal(got, want) {
+		t.Errorf("flags %v, want %v", got, want)
+	}
+	if flags.Set("unknown", true) || flags.Enabled("unknown") {
+		t.Error("unknown flag can be set")
+	}
+}
+
+func TestFlagsLoad(t *testing.T) {
+	swap(t, &flags, &featureFlags{values: map[string]bool{flagCapture: true, flagShadowTraffic: true}})
+	conn, _ := openFakeDB(t, func(q fakeQuery) fakeResult {
+		return fakeResult{Columns: []string{"name", "enabled"}, Rows: [][]driver.Value{{flagCapture, false}, {"retired_flag", true}}}
+	})
+	if err := flags.Load(conn); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{flagCapture: false, flagShadowTraffic: true}; !maps.Equal(flags.Snapshot(), want) {
+		t.Errorf("flags %v, want %v", flags.Snapshot(), want)
+	}
+}
+
+func TestFlagsConcurrentAccess(t *testing.T) {
+	f := &featureFlags{values: map[string]bool{flagCapture: false}}
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				f.Set(flagCapture, i%2 == 0)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				f.Enabled(flagCapture)
+				f.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// setFlagRequest calls the admin endpoint flipping name.
+func setFlagRequest(name, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, "/v1/flags/"+name, strings.NewReader(body))
+	r.SetPathValue("name", name)
+	w := httptest.NewRecorder()
+	handleSetFlag(w, r)
+	return w
+}
+
+func TestHandleSetFlag(t *testing.T) {
+	setFlag(t, flagCapture, true)
+	tests := []struct {
+		name       string
+		flag       string
+		body       string
+		wantStatus int
+	}{
+		{"turn off", flagCapture, `{"enabled":false}`, http.StatusOK},
+		{"unknown flag", "warp_drive", `{"enabled":true}`, http.StatusNotFound},
+		{"missing value", flagCapture, `{}`, http.StatusBadRequest},
+		{"not JSON", flagCapture, `off`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, nil)
+			w := setFlagRequest(tt.flag, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			ran := fake.ran()
+			if tt.wantStatus != http.StatusOK {
+				if len(ran) != 0 {
+					t.Errorf("rejected change ran %d statements", len(ran))
+				}
+				return
+			}
+			if len(ran) != 1 || !strings.Contains(ran[0].SQL, "INSERT INTO feature_flags") || ran[0].Args[0] != tt.flag || ran[0].Args[1] != false {
+				t.Errorf("stored with %v", ran)
+			}
+			if flags.Enabled(tt.flag) {
+				t.Error("flag still on")
+			}
+		})
+	}
+
+	t.Run("list", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleListFlags(w, httptest.NewRequest(http.MethodGet, "/v1/flags", nil))
+		var resp struct{ Flags []flagState }
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Flags) != len(flags.Snapshot()) {
+			t.Errorf("listed %d flags, want %d", len(resp.Flags), len(flags.Snapshot()))
+		}
+		for _, f := range resp.Flags {
+			if f.Name == flagCapture && f.Enabled {
+				t.Error("capture listed as on")
+			}
+		}
+	})
+}
+
+func TestFlagFlipChangesHandler(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	setFlag(t, flagStrictValidation, false)
+	useFakeDB(t, nil)
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+	send := func() int {
+		w := httptest.NewRecorder()
+		handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true,"colour":"blue"}`))
+		return w.Code
+	}
+
+	steps := []struct {
+		enabled bool
+		want    int
+	}{
+		{false, http.StatusOK},
+		{true, http.StatusBadRequest},
+		{false, http.StatusOK},
+	}
+	for _, step := range steps {
+		if w := setFlagRequest(flagStrictValidation, `{"enabled":`+strconv.FormatBool(step.enabled)+`}`); w.Code != http.StatusOK {
+			t.Fatalf("setting the flag: %d %s", w.Code, w.Body)
+		}
+		if got := send(); got != step.want {
+			t.Errorf("strict validation %v: status %d, want %d", step.enabled, got, step.want)
+		}
+	}
+}
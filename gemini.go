@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+)
+
+// isGeminiModel reports whether model is a Gemini model on Vertex AI.
+func isGeminiModel(model string) bool {
+	return slices.Contains(cfg().GeminiModels, model)
+}
+
+// geminiProvider serves Gemini models on Vertex AI through generateContent
+// and streamGenerateContent. It shares the project and token of
+// vertexProvider; requests and responses are translated from and to the
+// Messages API.
+type geminiProvider struct {
+	vertexProvider
+}
+
+func (g geminiProvider) BuildRequest(ctx context.Context, region, model string, body io.Reader) (*http.Request, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	data, stream, err := translateGeminiRequest(data)
+	if err != nil {
+		return nil, invalidRequest(err.Error())
+	}
+	// Gemini 的模型由 google 发布，流式响应通过 alt=sse 以 SSE 返回
+	method := "generateContent"
+	if stream {
+		method = "streamGenerateContent?alt=sse"
+	}
+	project, location := g.locate(region)
+	url := fmt.Sprintf("%s/%s/projects/%s/locations/%s/publishers/google/models/%s:%s",
+		vertexBaseURL(location), cfg().VertexAPIVersion, project, location, model, method)
+	return http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+}
+
+// StreamResponse translates generateContent responses, streamed or not, into
+// the Messages API, and Google errors into Anthropic errors.
+func (geminiProvider) StreamResponse(resp *http.Response) *http.Response {
+	switch {
+	case resp.StatusCode == http.StatusOK && isEventStream(resp.Header):
+		resp.Body = &geminiEventReader{body: resp.Body, r: bufio.NewReader(resp.Body)}
+	case resp.StatusCode == http.StatusOK:
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			if translated, terr := translateGeminiResponse(body); terr == nil {
+				body = translated
+			}
+		}
+		replaceResponseBody(resp, body)
+	case resp.StatusCode >= http.StatusBadRequest:
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		replaceResponseBody(resp, anthropicError(codeForStatus(resp.StatusCode), upstreamErrorMessage(body)))
+	}
+	return resp
+}
+
+// geminiUnsupportedSchemaKeys are JSON Schema keywords Gemini rejects in
+// function parameters.
+var geminiUnsupportedSchemaKeys = []string{"$schema", "additionalProperties"}
+
+// geminiSchema strips the keywords Gemini rejects from a tool's input schema,
+// at every level.
+func geminiSchema(schema any) any {
+	switch s := schema.(type) {
+	case map[string]any:
+		for _, key := range geminiUnsupportedSchemaKeys {
+			delete(s, key)
+		}
+		for k, v := range s {
+			s[k] = geminiSchema(v)
+		}
+	case []any:
+		for i, v := range s {
+			s[i] = geminiSchema(v)
+		}
+	}
+	return schema
+}
+
+// translateGeminiRequest converts a Messages API body into a generateContent
+// request. The system prompt becomes the system instruction, assistant turns
+// use the model role, and tool_use and tool_result blocks become function
+// calls and function responses. Thinking blocks are dropped. It also reports
+// whether the request streams.
+func translateGeminiRequest(body []byte) ([]byte, bool, error) {
+	var req translatedMessagesRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, false, fmt.Errorf("invalid request body: %v", err)
+	}
+
+	// 函数响应按名称对应调用，记下每个 tool_use 的名称
+	toolNames := make(map[string]string)
+	contents := make([]map[string]any, 0, len(req.Messages))
+	for i, m := range req.Messages {
+		blocks, err := messagesBlocks(m.Content)
+		if err != nil {
+			return nil, false, fmt.Errorf("messages[%d].content: %v", i, err)
+		}
+		var role string
+		switch m.Role {
+		case "user":
+			role = "user"
+		case "assistant":
+			role = "model"
+		default:
+			return nil, false, fmt.Errorf("messages[%d].role: unsupported role %q", i, m.Role)
+		}
+		var parts []map[string]any
+		for _, b := range blocks {
+			switch b.Type {
+			case "text":
+				if b.Text != "" {
+					parts = append(parts, map[string]any{"text": b.Text})
+				}
+			case "image":
+				if b.Source.Type == "base64" {
+					parts = append(parts, map[string]any{"inlineData": map[string]string{"mimeType": b.Source.MediaType, "data": b.Source.Data}})
+				} else {
+					parts = append(parts, map[string]any{"fileData": map[string]string{"mimeType": b.Source.MediaType, "fileUri": b.Source.URL}})
+				}
+			case "tool_use":
+				toolNames[b.ID] = b.Name
+				args := b.Input
+				if len(args) == 0 {
+					args = json.RawMessage("{}")
+				}
+				parts = append(parts, map[string]any{"functionCall": map[string]any{"name": b.Name, "args": args}})
+			case "tool_result":
+				parts = append(parts, map[string]any{"functionResponse": map[string]any{
+					"name":     toolNames[b.ToolUseID],
+					"response": map[string]string{"content": blocksText(b.Content)},
+				}})
+			}
+		}
+		if len(parts) > 0 {
+			contents = append(contents, map[string]any{"role": role, "parts": parts})
+		}
+	}
+
+	out := map[string]any{"contents": contents}
+	if system := blocksText(req.System); system != "" {
+		out["systemInstruction"] = map[string]any{"parts": []map[string]string{{"text": system}}}
+	}
+	config := map[string]any{}
+	if req.MaxTokens != nil {
+		config["maxOutputTokens"] = *req.MaxTokens
+	}
+	if req.Temperature != nil {
+		config["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		config["topP"] = *req.TopP
+	}
+	if req.TopK != nil {
+		config["topK"] = *req.TopK
+	}
+	if len(req.StopSequences) > 0 {
+		config["stopSequences"] = req.StopSequences
+	}
+	if len(config) > 0 {
+		out["generationConfig"] = config
+	}
+	if len(req.Tools) > 0 {
+		declarations := make([]map[string]any, 0, len(req.Tools))
+		for _, t := range req.Tools {
+			declaration := map[string]any{"name": t.Name}
+			if t.Description != "" {
+				declaration["description"] = t.Description
+			}
+			var schema any
+			if json.Unmarshal(t.InputSchema, &schema) == nil && schema != nil {
+				declaration["parameters"] = geminiSchema(schema)
+			}
+			declarations = append(declarations, declaration)
+		}
+		out["tools"] = []map[string]any{{"functionDeclarations": declarations}}
+	}
+	if req.ToolChoice != nil {
+		calling := map[string]any{}
+		switch req.ToolChoice.Type {
+		case "auto":
+			calling["mode"] = "AUTO"
+		case "none":
+			calling["mode"] = "NONE"
+		case "any":
+			calling["mode"] = "ANY"
+		case "tool":
+			calling["mode"] = "ANY"
+			calling["allowedFunctionNames"] = []string{req.ToolChoice.Name}
+		}
+		if len(calling) > 0 {
+			out["toolConfig"] = map[string]any{"functionCallingConfig": calling}
+		}
+	}
+	data, err := json.Marshal(out)
+	return data, req.Stream, err
+}
+
+// geminiResponse is a generateContent response, or one chunk of a stream.
+type geminiResponse struct {
+	ResponseID   string `json:"responseId"`
+	ModelVersion string `json:"modelVersion"`
+	Candidates   []struct {
+		Content struct {
+			Parts []geminiPart `json:"parts"`
+		} `json:"content"`
+		FinishReason string `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata *struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type geminiPart struct {
+	Text         string `json:"text"`
+	Thought      bool   `json:"thought"`
+	FunctionCall *struct {
+		Name string          `json:"name"`
+		Args json.RawMessage `json:"args"`
+	} `json:"functionCall"`
+}
+
+// geminiToolID makes up an ID for a function call, which Gemini leaves
+// unnamed, in the format of Anthropic tool_use IDs.
+func geminiToolID() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return "toolu_" + hex.EncodeToString(b[:])
+}
+
+// geminiStopReason maps a finishReason to a Messages API stop_reason.
+func geminiStopReason(finishReason string, calledTools bool) string {
+	switch {
+	case finishReason == "MAX_TOKENS":
+		return "max_tokens"
+	case calledTools:
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+// translateGeminiResponse converts a generateContent response into a
+// Messages API response.
+func translateGeminiResponse(body []byte) ([]byte, error) {
+	var resp geminiResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	content := []map[string]any{}
+	var finishReason string
+	calledTools := false
+	if len(resp.Candidates) > 0 {
+		for _, part := range resp.Candidates[0].Content.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				content = append(content, map[string]any{"type": "tool_use", "id": geminiToolID(), "name": part.FunctionCall.Name, "input": toolInput(string(part.FunctionCall.Args))})
+				calledTools = true
+			case part.Text != "" && !part.Thought:
+				content = append(content, map[string]any{"type": "text", "text": part.Text})
+			}
+		}
+		finishReason = resp.Candidates[0].FinishReason
+	}
+	usage := map[string]int{"input_tokens": 0, "output_tokens": 0}
+	if resp.UsageMetadata != nil {
+		usage["input_tokens"] = resp.UsageMetadata.PromptTokenCount
+		usage["output_tokens"] = resp.UsageMetadata.CandidatesTokenCount
+	}
+	return json.Marshal(map[string]any{
+		"id":            resp.ResponseID,
+		"type":          "message",
+		"role":          "assistant",
+		"model":         resp.ModelVersion,
+		"content":       content,
+		"stop_reason":   geminiStopReason(finishReason, calledTools),
+		"stop_sequence": nil,
+		"usage":         usage,
+	})
+}
+
+// geminiEventReader reads a streamGenerateContent stream as Messages API
+// events. Text parts extend a text block and each function call, which
+// arrives whole, gets its own tool_use block. The stream has no end marker:
+// the message is finished when the chunk with the finish reason is followed
+// by the end of the body.
+type geminiEventReader struct {
+	body io.ReadCloser
+	r    *bufio.Reader
+	err  error
+	messagesEventWriter
+
+	finishReason string
+	calledTools  bool
+	input        int
+	output       int
+}
+
+func (g *geminiEventReader) Read(p []byte) (int, error) {
+	for g.buf.Len() == 0 && g.err == nil {
+		g.err = g.next()
+	}
+	if g.buf.Len() > 0 {
+		return g.buf.Read(p)
+	}
+	return 0, g.err
+}
+
+func (g *geminiEventReader) Close() error {
+	return g.body.Close()
+}
+
+// next converts one chunk into buf.
+func (g *geminiEventReader) next() error {
+	event, err := readSSEEvent(g.r)
+	if err == io.EOF {
+		if g.finishReason != "" {
+			g.stopBlock()
+			g.emit("message_delta", map[string]any{
+				"delta": map[string]any{"stop_reason": geminiStopReason(g.finishReason, g.calledTools), "stop_sequence": nil},
+				"usage": map[string]int{"input_tokens": g.input, "output_tokens": g.output},
+			})
+			g.emit("message_stop", map[string]any{})
+			g.finishReason = ""
+			return nil
+		}
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	data, ok := sseEventData(event)
+	if !ok {
+		return nil
+	}
+
+	var chunk geminiResponse
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return fmt.Errorf("invalid Gemini chunk: %w", err)
+	}
+	if chunk.Error != nil {
+		writeSSEError(&g.buf, codeAPI, chunk.Error.Message)
+		return nil
+	}
+	if chunk.UsageMetadata != nil {
+		g.input, g.output = chunk.UsageMetadata.PromptTokenCount, chunk.UsageMetadata.CandidatesTokenCount
+	}
+	if !g.started {
+		g.started = true
+		g.emit("message_start", map[string]any{"message": map[string]any{
+			"id": chunk.ResponseID, "type": "message", "role": "assistant", "model": chunk.ModelVersion, "content": []any{},
+			"stop_reason": nil, "stop_sequence": nil, "usage": map[string]int{"input_tokens": g.input, "output_tokens": 0},
+		}})
+	}
+	if len(chunk.Candidates) == 0 {
+		return nil
+	}
+	candidate := chunk.Candidates[0]
+	for _, part := range candidate.Content.Parts {
+		switch {
+		case part.FunctionCall != nil:
+			g.calledTools = true
+			g.startBlock("tool_use", map[string]any{"type": "tool_use", "id": geminiToolID(), "name": part.FunctionCall.Name, "input": map[string]any{}})
+			g.emit("content_block_delta", map[string]any{"index": g.block, "delta": map[string]any{"type": "input_json_delta", "partial_json": string(toolInput(string(part.FunctionCall.Args)))}})
+		case part.Text != "" && !part.Thought:
+			if g.open != "text" {
+				g.startBlock("text", map[string]any{"type": "text", "text": ""})
+			}
+			g.emit("content_block_delta", map[string]any{"index": g.block, "delta": map[string]any{"type": "text_delta", "text": part.Text}})
+		}
+	}
+	if candidate.FinishReason != "" {
+		g.finishReason = candidate.FinishReason
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// geminiToolIDs matches the tool_use IDs made up for Gemini function calls.
+var geminiToolIDs = regexp.MustCompile(`toolu_[0-9a-f]{24}`)
+
+func TestTranslateGeminiRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		want       string
+		wantStream bool
+	}{
+		{
+			name: "system prompt and generation config",
+			body: `{"model":"gemini-2.0-flash","system":"Be brief.","messages":[{"role":"user","content":"hi"},{"role":"assistant","content":[{"type":"thinking","thinking":"hmm"}]},{"role":"assistant","content":"Hello"}],` +
+				`"max_tokens":100,"temperature":0.5,"top_p":0.9,"top_k":40,"stop_sequences":["END"],"stream":true}`,
+			want: `{"contents":[{"parts":[{"text":"hi"}],"role":"user"},{"parts":[{"text":"Hello"}],"role":"model"}],` +
+				`"generationConfig":{"maxOutputTokens":100,"stopSequences":["END"],"temperature":0.5,"topK":40,"topP":0.9},"systemInstruction":{"parts":[{"text":"Be brief."}]}}`,
+			wantStream: true,
+		},
+		{
+			name: "images and function calls",
+			body: `{"messages":[{"role":"user","content":[{"type":"text","text":"weather?"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}},{"type":"image","source":{"type":"url","media_type":"image/png","url":"gs://b/a.png"}}]},` +
+				`{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}]},` +
+				`{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"sunny"}]}],` +
+				`"tools":[{"name":"get_weather","description":"Look up weather","input_schema":{"$schema":"https://json-schema.org/draft/2020-12/schema","type":"object","additionalProperties":false,"properties":{"city":{"type":"string","additionalProperties":false}}}}],` +
+				`"tool_choice":{"type":"tool","name":"get_weather"}}`,
+			want: `{"contents":[{"parts":[{"text":"weather?"},{"inlineData":{"data":"AAAA","mimeType":"image/png"}},{"fileData":{"fileUri":"gs://b/a.png","mimeType":"image/png"}}],"role":"user"},` +
+				`{"parts":[{"functionCall":{"args":{"city":"Paris"},"name":"get_weather"}}],"role":"model"},` +
+				`{"parts":[{"functionResponse":{"name":"get_weather","response":{"content":"sunny"}}}],"role":"user"}],` +
+				`"toolConfig":{"functionCallingConfig":{"allowedFunctionNames":["get_weather"],"mode":"ANY"}},` +
+				`"tools":[{"functionDeclarations":[{"description":"Look up weather","name":"get_weather","parameters":{"properties":{"city":{"type":"string"}},"type":"object"}}]}]}`,
+		},
+		{
+			name: "tools turned off",
+			body: `{"messages":[{"role":"user","content":"go"},{"role":"assistant","content":[{"type":"tool_use","id":"t","name":"f"}]}],"tools":[{"name":"f"}],"tool_choice":{"type":"none"}}`,
+			want: `{"contents":[{"parts":[{"text":"go"}],"role":"user"},{"parts":[{"functionCall":{"args":{},"name":"f"}}],"role":"model"}],` +
+				`"toolConfig":{"functionCallingConfig":{"mode":"NONE"}},"tools":[{"functionDeclarations":[{"name":"f"}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, stream, err := translateGeminiRequest([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			if stream != tt.wantStream {
+				t.Errorf("stream %v, want %v", stream, tt.wantStream)
+			}
+		})
+	}
+
+	for body, wantErr := range map[string]string{
+		`{"messages":`: "invalid request body",
+		`{"messages":[{"role":"system","content":"hi"}]}`: `messages[0].role: unsupported role "system"`,
+		`{"messages":[{"role":"user","content":true}]}`:   "messages[0].content",
+	} {
+		if _, _, err := translateGeminiRequest([]byte(body)); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: err = %v, want it to mention %q", body, err, wantErr)
+		}
+	}
+}
+
+func TestTranslateGeminiResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "text without thoughts",
+			body: `{"responseId":"r1","modelVersion":"gemini-2.0-flash","candidates":[{"content":{"parts":[{"text":"Let me think.","thought":true},{"text":"Hello"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":5}}`,
+			want: `{"content":[{"text":"Hello","type":"text"}],"id":"r1","model":"gemini-2.0-flash","role":"assistant","stop_reason":"end_turn","stop_sequence":null,"type":"message","usage":{"input_tokens":10,"output_tokens":5}}`,
+		},
+		{
+			name: "function call",
+			body: `{"responseId":"r2","modelVersion":"gemini-2.0-flash","candidates":[{"content":{"parts":[{"text":"Checking."},{"functionCall":{"name":"f","args":{"a":1}}}]},"finishReason":"STOP"}]}`,
+			want: `{"content":[{"text":"Checking.","type":"text"},{"id":"toolu_X","input":{"a":1},"name":"f","type":"tool_use"}],"id":"r2","model":"gemini-2.0-flash","role":"assistant","stop_reason":"tool_use","stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}}`,
+		},
+		{
+			name: "cut off",
+			body: `{"responseId":"r3","candidates":[{"content":{"parts":[{"text":"Once"}]},"finishReason":"MAX_TOKENS"}]}`,
+			want: `{"content":[{"text":"Once","type":"text"}],"id":"r3","model":"","role":"assistant","stop_reason":"max_tokens","stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}}`,
+		},
+		{
+			name: "no candidates",
+			body: `{"responseId":"r4","candidates":[]}`,
+			want: `{"content":[],"id":"r4","model":"","role":"assistant","stop_reason":"end_turn","stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := translateGeminiResponse([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := geminiToolIDs.ReplaceAllString(string(got), "toolu_X"); s != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeminiEventReader(t *testing.T) {
+	chunks := func(data ...string) string {
+		var b strings.Builder
+		for _, d := range data {
+			b.WriteString("data: " + d + "\r\n\r\n")
+		}
+		return b.String()
+	}
+	messageStart := messagesEvent("message_start", `{"message":{"content":[],"id":"r1","model":"gemini-2.0-flash","role":"assistant","stop_reason":null,"stop_sequence":null,"type":"message","usage":{"input_tokens":10,"output_tokens":0}},"type":"message_start"}`)
+	textStart := messagesEvent("content_block_start", `{"content_block":{"text":"","type":"text"},"index":0,"type":"content_block_start"}`) +
+		messagesEvent("content_block_delta", `{"delta":{"text":"Hel","type":"text_delta"},"index":0,"type":"content_block_delta"}`)
+	tests := []struct {
+		name   string
+		stream string
+		want   string
+	}{
+		{
+			name: "text and function call",
+			stream: chunks(
+				`{"responseId":"r1","modelVersion":"gemini-2.0-flash","candidates":[{"content":{"parts":[{"text":"Hel"}]}}],"usageMetadata":{"promptTokenCount":10}}`,
+				`{"candidates":[{"content":{"parts":[{"text":"hmm","thought":true},{"text":"lo"}]}}]}`,
+				`{"candidates":[{"content":{"parts":[{"functionCall":{"name":"f","args":{"a":1}}}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":5}}`,
+			),
+			want: messageStart + textStart +
+				messagesEvent("content_block_delta", `{"delta":{"text":"lo","type":"text_delta"},"index":0,"type":"content_block_delta"}`) +
+				messagesEvent("content_block_stop", `{"index":0,"type":"content_block_stop"}`) +
+				messagesEvent("content_block_start", `{"content_block":{"id":"toolu_X","input":{},"name":"f","type":"tool_use"},"index":1,"type":"content_block_start"}`) +
+				messagesEvent("content_block_delta", `{"delta":{"partial_json":"{\"a\":1}","type":"input_json_delta"},"index":1,"type":"content_block_delta"}`) +
+				messagesEvent("content_block_stop", `{"index":1,"type":"content_block_stop"}`) +
+				messagesEvent("message_delta", `{"delta":{"stop_reason":"tool_use","stop_sequence":null},"type":"message_delta","usage":{"input_tokens":10,"output_tokens":5}}`) +
+				messagesEvent("message_stop", `{"type":"message_stop"}`),
+		},
+		{
+			name: "max tokens",
+			stream: chunks(
+				`{"responseId":"r1","modelVersion":"gemini-2.0-flash","candidates":[{"content":{"parts":[{"text":"Hel"}]},"finishReason":"MAX_TOKENS"}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":1}}`,
+			),
+			want: messageStart + textStart +
+				messagesEvent("content_block_stop", `{"index":0,"type":"content_block_stop"}`) +
+				messagesEvent("message_delta", `{"delta":{"stop_reason":"max_tokens","stop_sequence":null},"type":"message_delta","usage":{"input_tokens":10,"output_tokens":1}}`) +
+				messagesEvent("message_stop", `{"type":"message_stop"}`),
+		},
+		{
+			// 没有结束原因时不补发 message_stop，截断的流照常被识别
+			name: "cut short",
+			stream: chunks(
+				`{"responseId":"r1","modelVersion":"gemini-2.0-flash","candidates":[{"content":{"parts":[{"text":"Hel"}]}}],"usageMetadata":{"promptTokenCount":10}}`,
+			),
+			want: messageStart + textStart,
+		},
+		{
+			name: "error chunk",
+			stream: chunks(
+				`{"responseId":"r1","modelVersion":"gemini-2.0-flash","candidates":[{"content":{"parts":[{"text":"Hel"}]}}],"usageMetadata":{"promptTokenCount":10}}`,
+				`{"error":{"code":500,"message":"Internal error encountered."}}`,
+			),
+			want: messageStart + textStart +
+				messagesEvent("error", `{"type":"error","error":{"type":"api_error","message":"Internal error encountered."}}`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := io.NopCloser(strings.NewReader(tt.stream))
+			got, err := io.ReadAll(&geminiEventReader{body: body, r: bufio.NewReader(body)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := geminiToolIDs.ReplaceAllString(string(got), "toolu_X"); s != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	body := io.NopCloser(strings.NewReader("data: [{]\n\n"))
+	if _, err := io.ReadAll(&geminiEventReader{body: body, r: bufio.NewReader(body)}); err == nil || !strings.Contains(err.Error(), "invalid Gemini chunk") {
+		t.Errorf("invalid chunk: err = %v", err)
+	}
+}
+
+func TestGeminiProvider(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "gemini-2.0-flash"
+		c.GeminiModels = []string{"gemini-2.0-flash"}
+		c.Regions = []string{"us-central1"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.ModelAliases = nil
+		c.ModelFailover = nil
+		c.VertexAPIVersion = "v1"
+	})
+	swap[TokenProvider](t, &tokenProvider, staticTokenProvider("fake-token"))
+	swap(t, &accessToken, "")
+	if err := refreshAccessToken(); err != nil {
+		t.Fatal(err)
+	}
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fake-token" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		if want := "/v1/projects/test-project/locations/us-central1/publishers/google/models/gemini-2.0-flash:streamGenerateContent"; r.URL.Path != want || r.URL.Query().Get("alt") != "sse" {
+			t.Errorf("request to %s, want %s?alt=sse", r.URL, want)
+		}
+		var body map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["contents"] == nil || body["messages"] != nil {
+			t.Errorf("body not translated: %v", body)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: "+`{"responseId":"r1","modelVersion":"gemini-2.0-flash","candidates":[{"content":{"parts":[{"text":"Hello"}]}}],"usageMetadata":{"promptTokenCount":10}}`+"\r\n\r\n"+
+			"data: "+`{"candidates":[{"content":{"parts":[{"text":" world"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":5}}`+"\r\n\r\n")
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	swap(t, &vertexClient, &http.Client{Transport: redirectTransport{target}})
+	rec := recordUsage(t)
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := messagesText(t, w.Body.String()); got != "Hello world" || !strings.HasSuffix(w.Body.String(), messagesEvent("message_stop", `{"type":"message_stop"}`)) {
+		t.Errorf("text %q in\n%s", got, w.Body)
+	}
+	waitFor(t, "the usage event", func() bool { return len(rec.published()) == 1 })
+	if u := rec.published()[0]; u.InputTokens != 10 || u.OutputTokens != 5 {
+		t.Errorf("usage %d/%d, want 10/5", u.InputTokens, u.OutputTokens)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errUpstreamBusy = errors.New("upstream request budget exhausted")
+
+// rateGovernor paces outgoing requests using the anthropic-ratelimit-*
+// response headers. While the remaining request budget is above the
+// threshold requests pass straight through; below it they are spaced evenly
+// across the time left until the budget resets, instead of running into hard
+// upstream 429s.
+type rateGovernor struct {
+	mu        sync.Mutex
+	threshold int
+	maxWait   time.Duration
+
+	known     bool
+	remaining int
+	reset     time.Time
+	next      time.Time
+}
+
+func newRateGovernor(threshold int, maxWait time.Duration) *rateGovernor {
+	return &rateGovernor{threshold: threshold, maxWait: maxWait}
+}
+
+// Observe updates the budget from an upstream response.
+func (g *rateGovernor) Observe(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("anthropic-ratelimit-requests-remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := time.Parse(time.RFC3339, header.Get("anthropic-ratelimit-requests-reset"))
+	if err != nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.known = true
+	g.remaining = remaining
+	g.reset = reset
+}
+
+// Wait blocks until the request may be sent. It returns errUpstreamBusy if
+// the request would have to wait longer than maxWait.
+func (g *rateGovernor) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	now := time.Now()
+	if !g.known || g.remaining > g.threshold || !now.Before(g.reset) {
+		g.mu.Unlock()
+		return nil
+	}
+	interval := g.reset.Sub(now) / time.Duration(max(g.remaining, 0)+1)
+	slot := now
+	if g.next.After(now) {
+		slot = g.next
+	}
+	if slot.Sub(now) > g.maxWait {
+		g.mu.Unlock()
+		return errUpstreamBusy
+	}
+	g.next = slot.Add(interval)
+	g.remaining--
+	g.mu.Unlock()
+
+	delay := time.Until(slot)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rateLimitHeaders are upstream headers reporting remaining requests until
+// reset.
+func rateLimitHeaders(remaining int, reset time.Time) http.Header {
+	h := http.Header{}
+	h.Set("anthropic-ratelimit-requests-remaining", strconv.Itoa(remaining))
+	h.Set("anthropic-ratelimit-requests-reset", reset.Format(time.RFC3339Nano))
+	return h
+}
+
+func TestRateGovernorPassesThrough(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"no budget known", nil},
+		{"malformed headers", http.Header{"Anthropic-Ratelimit-Requests-Remaining": {"many"}}},
+		{"budget above the threshold", rateLimitHeaders(100, time.Now().Add(time.Minute))},
+		{"budget already reset", rateLimitHeaders(0, time.Now().Add(-time.Second))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newRateGovernor(10, time.Second)
+			g.Observe(tt.header)
+			start := time.Now()
+			for range 5 {
+				if err := g.Wait(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+				t.Errorf("requests waited %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestRateGovernorPacesLowBudget(t *testing.T) {
+	g := newRateGovernor(10, time.Second)
+	reset := time.Now().Add(400 * time.Millisecond)
+	var sent []time.Time
+	for remaining := 3; remaining > 0; remaining-- {
+		// 每个响应报告的剩余额度递减
+		g.Observe(rateLimitHeaders(remaining, reset))
+		if err := g.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, time.Now())
+	}
+	// 剩余 3 次、400ms 后重置：约 0、100、233ms 时发出
+	for i, min := range []time.Duration{80 * time.Millisecond, 110 * time.Millisecond} {
+		if gap := sent[i+1].Sub(sent[i]); gap < min {
+			t.Errorf("request %d sent %v after the previous one, want at least %v", i+2, gap, min)
+		}
+	}
+	if !sent[2].Before(reset) {
+		t.Error("pacing spread requests past the reset")
+	}
+}
+
+func TestRateGovernorGivesUp(t *testing.T) {
+	g := newRateGovernor(10, 50*time.Millisecond)
+	g.Observe(rateLimitHeaders(0, time.Now().Add(time.Hour)))
+	if err := g.Wait(context.Background()); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := g.Wait(context.Background()); err != errUpstreamBusy {
+		t.Errorf("request beyond the maximum wait: %v, want errUpstreamBusy", err)
+	}
+
+	g = newRateGovernor(10, time.Minute)
+	g.Observe(rateLimitHeaders(0, time.Now().Add(30*time.Second)))
+	g.Wait(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("waiting past the context: %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestUpstreamBusyIsFree(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	g := newRateGovernor(10, 10*time.Millisecond)
+	g.Observe(rateLimitHeaders(0, time.Now().Add(time.Hour)))
+	g.Wait(context.Background())
+	swap(t, &governor, g)
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request sent with the budget exhausted")
+	})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}]}`))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d with Retry-After %q, want a 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := auth.remaining("k"); got != 5 {
+		t.Errorf("key has %d calls left, want 5", got)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// guardrailResult holds the values actually used for the upstream call after
+// the key's guardrails were applied.
+type guardrailResult struct {
+	Model       string
+	Temperature *float64
+}
+
+// effectiveModel is the model used for the key's requests unless the
+// request picks another one with selectModel.
+func effectiveModel(key *APIKey) string {
+	if key.ForcedModel != "" {
+		return key.ForcedModel
+	}
+	return cfg().DefaultModel
+}
+
+// modelSelectable reports whether the key's requests choose their model with
+// the body's "model" field, which requires reading the body first.
+func modelSelectable(key *APIKey) bool {
+	return key.ForcedModel == ""
+}
+
+// selectModel returns the model a request is served by: the body's "model"
+// when it is an allowed model (or DEFAULT_MODEL), effectiveModel when
+// the body names none or the key can't choose. Any other model is an error,
+// also without allowed models, so a client naming a model isn't silently
+// served by another.
+func selectModel(key *APIKey, body []byte) (string, error) {
+	if !modelSelectable(key) || body == nil {
+		return effectiveModel(key), nil
+	}
+	var fields struct {
+		Model *string `json:"model"`
+	}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return "", fmt.Errorf("invalid request body: %v", err)
+	}
+	if fields.Model == nil || *fields.Model == "" {
+		return cfg().DefaultModel, nil
+	}
+	if m := *fields.Model; m != cfg().DefaultModel && !slices.Contains(allowedModels(), m) {
+		return "", errModelNotAllowed(m)
+	}
+	return *fields.Model, nil
+}
+
+// modelAllowed reports whether requests may select m: DEFAULT_MODEL, an
+// allowed model or an alias, like selectModel. Without allowed models only
+// DEFAULT_MODEL is, so a client can't make up a name that ends up in an
+// upstream URL.
+func modelAllowed(m string) bool {
+	return m == cfg().DefaultModel || slices.Contains(allowedModels(), m)
+}
+
+func errModelNotAllowed(m string) error {
+	models := allowedModels()
+	if !slices.Contains(models, cfg().DefaultModel) {
+		models = append([]string{cfg().DefaultModel}, models...)
+	}
+	return fmt.Errorf("model %q is not available, use one of: %s", m, strings.Join(models, ", "))
+}
+
+// rewritesBody reports whether applyGuardrails has to read the key's request
+// bodies. A forced model alone doesn't: every provider sets or drops the
+// body's "model" itself, so a body streamed from the client can still go to
+// the forced model.
+func rewritesBody(key *APIKey) bool {
+	return key.MaxTemperature != nil
+}
+
+// applyGuardrails enforces the key's safety restrictions on the request body.
+// The temperature is clamped to MaxTemperature (and set explicitly when the
+// client omitted it, since the upstream default may be higher) and the model
+// is replaced by ForcedModel.
+func applyGuardrails(body []byte, key *APIKey) ([]byte, guardrailResult, error) {
+	result := guardrailResult{Model: effectiveModel(key)}
+	if !rewritesBody(key) {
+		if key.ForcedModel != "" && body != nil {
+			body = replaceBodyModel(body, key.ForcedModel)
+		}
+		return body, result, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, result, fmt.Errorf("invalid request body: %v", err)
+	}
+
+	if key.MaxTemperature != nil {
+		temperature := *key.MaxTemperature
+		if raw, ok := fields["temperature"]; ok && string(raw) != "null" {
+			var requested float64
+			if err := json.Unmarshal(raw, &requested); err != nil {
+				return nil, result, fmt.Errorf("temperature: must be a number")
+			}
+			temperature = min(requested, temperature)
+		}
+		fields["temperature"] = json.RawMessage(strconv.FormatFloat(temperature, 'g', -1, 64))
+		result.Temperature = &temperature
+	}
+
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, result, err
+	}
+	if key.ForcedModel != "" {
+		body = replaceBodyModel(body, key.ForcedModel)
+	}
+	return body, result, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestApplyGuardrails(t *testing.T) {
+	maxTemperature := 0.3
+	tests := []struct {
+		name            string
+		key             APIKey
+		body            string
+		wantModel       string
+		wantTemperature string // in the body, "" when absent
+	}{
+		{"no guardrails", APIKey{}, `{"model":"claude-a","temperature":0.9}`, "claude-a", "0.9"},
+		{"temperature clamped", APIKey{MaxTemperature: &maxTemperature}, `{"temperature":0.9}`, "", "0.3"},
+		{"lower temperature kept", APIKey{MaxTemperature: &maxTemperature}, `{"temperature":0.1}`, "", "0.1"},
+		{"missing temperature set to the cap", APIKey{MaxTemperature: &maxTemperature}, `{}`, "", "0.3"},
+		{"model overridden", APIKey{ForcedModel: "claude-safe"}, `{"model":"claude-a","temperature":0.9}`, "claude-safe", "0.9"},
+		{"both", APIKey{MaxTemperature: &maxTemperature, ForcedModel: "claude-safe"}, `{"model":"claude-a","temperature":1}`, "claude-safe", "0.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, result, err := applyGuardrails([]byte(tt.body), &tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields struct {
+				Model       string          `json:"model"`
+				Temperature json.RawMessage `json:"temperature"`
+			}
+			if err := json.Unmarshal(body, &fields); err != nil {
+				t.Fatal(err)
+			}
+			if fields.Model != tt.wantModel || string(fields.Temperature) != tt.wantTemperature {
+				t.Errorf("body %s, want model %q and temperature %s", body, tt.wantModel, tt.wantTemperature)
+			}
+			if tt.key.ForcedModel != "" && result.Model != tt.key.ForcedModel {
+				t.Errorf("effective model %q, want %q", result.Model, tt.key.ForcedModel)
+			}
+			if (result.Temperature != nil) != (tt.key.MaxTemperature != nil) {
+				t.Errorf("effective temperature %v with cap %v", result.Temperature, tt.key.MaxTemperature)
+			}
+		})
+	}
+}
+
+func TestGuardrailsOnForwardedRequest(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	maxTemperature := 0.3
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier, MaxTemperature: &maxTemperature, ForcedModel: "claude-safe"})
+	var gotPath, gotBody string
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotPath, gotBody = r.URL.Path, string(body)
+		streamSSE(w, sseTranscript)
+	})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"model":"claude-other","messages":[{"role":"user","content":"hi"}],"temperature":0.9,"stream":true}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if gotPath != "/us-east5/claude-safe" {
+		t.Errorf("upstream path %s, want the forced model", gotPath)
+	}
+	if !strings.Contains(gotBody, `"temperature":0.3`) || strings.Contains(gotBody, "claude-other") {
+		t.Errorf("upstream body %s, want the clamped temperature and forced model", gotBody)
+	}
+	if got := w.Header().Get("X-Effective-Model"); got != "claude-safe" {
+		t.Errorf("X-Effective-Model = %q", got)
+	}
+	if got := w.Header().Get("X-Effective-Temperature"); got != "0.3" {
+		t.Errorf("X-Effective-Temperature = %q", got)
+	}
+}
+
+func TestSelectModel(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-default"
+		c.AllowedModels = []string{"claude-a"}
+		c.ModelAliases = nil
+	})
+	swap(t, &storedModels, &modelAllowlist{})
+	tests := []struct {
+		name    string
+		key     APIKey
+		body    string
+		want    string
+		wantErr string
+	}{
+		{"no model", APIKey{}, `{"messages":[]}`, "claude-default", ""},
+		{"empty model", APIKey{}, `{"model":""}`, "claude-default", ""},
+		{"allowed model", APIKey{}, `{"model":"claude-a"}`, "claude-a", ""},
+		{"default model named", APIKey{}, `{"model":"claude-default"}`, "claude-default", ""},
+		{"forced model wins", APIKey{ForcedModel: "claude-safe"}, `{"model":"claude-a"}`, "claude-safe", ""},
+		{"model not allowed", APIKey{}, `{"model":"claude-x"}`, "", `model "claude-x" is not available, use one of: claude-default, claude-a`},
+		{"invalid body", APIKey{}, `{"model":`, "", "invalid request body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectModel(&tt.key, []byte(tt.body))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("selectModel = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+	if got, err := selectModel(&APIKey{}, nil); err != nil || got != "claude-default" {
+		t.Errorf("without a body: %q, %v", got, err)
+	}
+}
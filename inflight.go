@@ -0,0 +1,37 @@
+package main
+
+import "sync"
+
+// inflightLimiter caps the number of concurrent requests per key. Unlike the
+// RPM limiter it bounds concurrency, not rate, which stops a runaway client
+// loop from fanning out thousands of parallel requests.
+type inflightLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	counts map[string]int
+}
+
+func newInflightLimiter(limit int) *inflightLimiter {
+	return &inflightLimiter{limit: limit, counts: make(map[string]int)}
+}
+
+// Acquire reserves a slot for key, reporting false when the key is at its cap.
+func (l *inflightLimiter) Acquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[key] >= l.limit {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
+
+func (l *inflightLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[key] <= 1 {
+		delete(l.counts, key)
+		return
+	}
+	l.counts[key]--
+}
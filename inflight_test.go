@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestInflightLimiter(t *testing.T) {
+	l := newInflightLimiter(2)
+	if !l.Acquire("k") || !l.Acquire("k") {
+		t.Fatal("requests under the cap refused")
+	}
+	if l.Acquire("k") {
+		t.Error("third concurrent request allowed")
+	}
+	if !l.Acquire("other") {
+		t.Error("other key refused")
+	}
+	l.Release("k")
+	if !l.Acquire("k") {
+		t.Error("request refused after a release")
+	}
+}
+
+func TestInflightCapRejectsExtraRequest(t *testing.T) {
+	const limit = 2
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	swap(t, &inflight, newInflightLimiter(limit))
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	arrived, release := make(chan struct{}), make(chan struct{})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		streamSSE(w, sseTranscript)
+	})
+	send := func() int {
+		w := httptest.NewRecorder()
+		handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+		return w.Code
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, limit)
+	for i := range limit {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = send()
+		}()
+	}
+	for range limit {
+		<-arrived
+	}
+	if code := send(); code != http.StatusTooManyRequests {
+		t.Errorf("request over the cap got %d, want 429", code)
+	}
+	close(release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d got %d", i+1, code)
+		}
+	}
+
+	go func() { <-arrived }()
+	if code := send(); code != http.StatusOK {
+		t.Errorf("request after the others completed got %d, want 200", code)
+	}
+
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal", http.StatusInternalServerError)
+	})
+	send()
+	if n := inflight.counts["k"]; n != 0 {
+		t.Errorf("%d requests still counted after a failed request", n)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// keyMetadata is the admin view of an API key. The plaintext key is never
+// echoed back; keys are identified by their key ID.
+type keyMetadata struct {
+	KeyID             string `json:"key_id"`
+	RemainingCalls    int    `json:"remaining_calls"`
+	OutputTokenBudget *int64 `json:"output_token_budget"`
+	DailyLimit        *int64 `json:"daily_limit"`
+	Tier              string `json:"tier"`
+	Disabled          bool   `json:"disabled"`
+	// ExpiresAt is when the key stops being accepted, nil when it doesn't.
+	ExpiresAt      *time.Time `json:"expires_at"`
+	CaptureOptOut  bool       `json:"capture_opt_out"`
+	MaxTemperature *float64   `json:"max_temperature"`
+	ForcedModel    *string    `json:"forced_model"`
+	SystemPrompt   *string    `json:"system_prompt"`
+	BrandName      *string    `json:"brand_name"`
+	SupportURL     *string    `json:"support_url"`
+	// MaxRequestDuration is in seconds.
+	MaxRequestDuration *float64 `json:"max_request_duration"`
+	MaxMessages        *int64   `json:"max_messages"`
+	MaxInputTokens     *int64   `json:"max_input_tokens"`
+	AllowedCIDRs       []string `json:"allowed_cidrs"`
+	AllowedEndpoints   []string `json:"allowed_endpoints"`
+	// UsageResetAt is when the usage totals were last reset.
+	UsageResetAt *time.Time `json:"usage_reset_at"`
+	Usage        *keyUsage  `json:"usage,omitempty"`
+}
+
+type keyUsage struct {
+	Requests     int64 `json:"requests"`
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+}
+
+// keyMetadataColumns are the api_keys columns read by scanKeyMetadata.
+const keyMetadataColumns = `key_id, remaining_calls, output_token_budget, daily_limit, tier, capture_opt_out, max_temperature, forced_model, system_prompt, brand_name, support_url, EXTRACT(EPOCH FROM max_request_duration), max_messages, max_input_tokens, usage_reset_at, disabled, expires_at, allowed_cidrs, allowed_endpoints`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanKeyMetadata(row rowScanner) (keyMetadata, error) {
+	var (
+		meta              keyMetadata
+		outputTokenBudget sql.NullInt64
+		dailyLimit        sql.NullInt64
+		maxTemperature    sql.NullFloat64
+		forcedModel       sql.NullString
+		systemPrompt      sql.NullString
+		brandName         sql.NullString
+		supportURL        sql.NullString
+		maxDuration       sql.NullFloat64
+		maxMessages       sql.NullInt64
+		maxInputTokens    sql.NullInt64
+		usageResetAt      sql.NullTime
+		expiresAt         sql.NullTime
+	)
+	err := row.Scan(&meta.KeyID, &meta.RemainingCalls, &outputTokenBudget, &dailyLimit, &meta.Tier, &meta.CaptureOptOut, &maxTemperature, &forcedModel, &systemPrompt, &brandName, &supportURL, &maxDuration, &maxMessages, &maxInputTokens, &usageResetAt,
+		&meta.Disabled, &expiresAt, pq.Array(&meta.AllowedCIDRs), pq.Array(&meta.AllowedEndpoints))
+	if err != nil {
+		return meta, err
+	}
+	if outputTokenBudget.Valid {
+		meta.OutputTokenBudget = &outputTokenBudget.Int64
+	}
+	if dailyLimit.Valid {
+		meta.DailyLimit = &dailyLimit.Int64
+	}
+	if maxTemperature.Valid {
+		meta.MaxTemperature = &maxTemperature.Float64
+	}
+	if forcedModel.Valid {
+		meta.ForcedModel = &forcedModel.String
+	}
+	if systemPrompt.Valid {
+		meta.SystemPrompt = &systemPrompt.String
+	}
+	if brandName.Valid {
+		meta.BrandName = &brandName.String
+	}
+	if supportURL.Valid {
+		meta.SupportURL = &supportURL.String
+	}
+	if maxDuration.Valid {
+		meta.MaxRequestDuration = &maxDuration.Float64
+	}
+	if maxMessages.Valid {
+		meta.MaxMessages = &maxMessages.Int64
+	}
+	if maxInputTokens.Valid {
+		meta.MaxInputTokens = &maxInputTokens.Int64
+	}
+	if usageResetAt.Valid {
+		meta.UsageResetAt = &usageResetAt.Time
+	}
+	if expiresAt.Valid {
+		meta.ExpiresAt = &expiresAt.Time
+	}
+	return meta, nil
+}
+
+const errInvalidKeyRef = "key must be addressed by its key ID or SHA-256 hash"
+
+// parseKeyRef parses the {id} of the admin key routes: a key ID, or the
+// key's full SHA-256 hash for callers that keep hashes rather than IDs. Keys
+// are looked up by id, and also by hash when one was given. Plaintext keys
+// are refused so they never appear in URLs.
+func parseKeyRef(ref string) (id, hash string, ok bool) {
+	switch {
+	case isKeyID(ref):
+		return ref, "", true
+	case isKeyHash(ref):
+		return ref[:16], ref, true
+	default:
+		return "", "", false
+	}
+}
+
+// keyRefCondition matches the api_keys row of a parsed key reference passed
+// as $1 (id) and $2 (hash).
+const keyRefCondition = `key_id = $1 AND ($2 = '' OR encode(sha256(convert_to(key, 'UTF8')), 'hex') = $2)`
+
+// handleGetKey returns a key's state and usage totals without consuming it.
+// The totals count the usage since the last reset and can be limited further
+// to a from/to range.
+func handleGetKey(w http.ResponseWriter, r *http.Request) {
+	id, hash, ok := parseKeyRef(r.PathValue("id"))
+	if !ok {
+		respondError(w, r, invalidRequest(errInvalidKeyRef))
+		return
+	}
+	tr, err := parseTimeRange(r)
+	if err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+	meta, err := scanKeyMetadata(readDB().QueryRow(`
+		SELECT `+keyMetadataColumns+`
+		FROM api_keys WHERE `+keyRefCondition, id, hash))
+	if err == sql.ErrNoRows {
+		respondError(w, r, notFound("API key not found"))
+		return
+	}
+	if err != nil {
+		respondError(w, r, internalError("Failed to load API key", fmt.Errorf("key %s: %w", id, err)))
+		return
+	}
+
+	meta.Usage = new(keyUsage)
+	from, to := tr.args()
+	err = readDB().QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0)
+		FROM usage_log WHERE key_id = $1
+		AND ($2::timestamptz IS NULL OR created_at >= $2)
+		AND ($3::timestamptz IS NULL OR created_at < $3)
+		AND ($4::timestamptz IS NULL OR created_at >= $4)`, meta.KeyID, from, to, meta.UsageResetAt).
+		Scan(&meta.Usage.Requests, &meta.Usage.InputTokens, &meta.Usage.OutputTokens)
+	if err != nil {
+		respondError(w, r, internalError("Failed to load key usage", fmt.Errorf("key %s: %w", meta.KeyID, err)))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, meta)
+}
+
+const (
+	defaultKeyPageSize = 50
+	maxKeyPageSize     = 500
+)
+
+// handleListKeys returns a page of keys in a stable order, optionally
+// filtered by ?tier= and ?disabled=true|false. Paging uses ?limit= (1-500,
+// default 50) and ?offset=.
+func handleListKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, offset := defaultKeyPageSize, 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxKeyPageSize {
+			respondError(w, r, invalidRequest("limit must be between 1 and "+strconv.Itoa(maxKeyPageSize)))
+			return
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respondError(w, r, invalidRequest("offset must be a non-negative integer"))
+			return
+		}
+		offset = n
+	}
+	// 未指定时为 NULL，不按停用状态过滤
+	var disabled sql.NullBool
+	if v := query.Get("disabled"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			respondError(w, r, invalidRequest("disabled must be true or false"))
+			return
+		}
+		disabled = sql.NullBool{Bool: b, Valid: true}
+	}
+
+	// 多取一条用于判断是否还有下一页
+	rows, err := readDB().QueryContext(r.Context(), `
+		SELECT `+keyMetadataColumns+`
+		FROM api_keys
+		WHERE ($1 = '' OR tier = $1)
+		AND ($4::boolean IS NULL OR disabled = $4)
+		ORDER BY key_id
+		LIMIT $2 OFFSET $3`, query.Get("tier"), limit+1, offset, disabled)
+	if err != nil {
+		respondError(w, r, internalError("Failed to list API keys", err))
+		return
+	}
+	defer rows.Close()
+
+	resp := struct {
+		Keys    []keyMetadata `json:"keys"`
+		Limit   int           `json:"limit"`
+		Offset  int           `json:"offset"`
+		HasMore bool          `json:"has_more"`
+	}{Keys: []keyMetadata{}, Limit: limit, Offset: offset}
+	for rows.Next() {
+		meta, err := scanKeyMetadata(rows)
+		if err != nil {
+			respondError(w, r, internalError("Failed to list API keys", err))
+			return
+		}
+		if len(resp.Keys) == limit {
+			resp.HasMore = true
+			break
+		}
+		resp.Keys = append(resp.Keys, meta)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(w, r, internalError("Failed to list API keys", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleResetKeyUsage zeroes a key's usage counters in one transaction: its
+// token totals restart from now and today's daily request count from 0. The
+// usage_log rows stay for billing and exports, and the balance, tier and
+// guardrails are left as they are.
+func handleResetKeyUsage(w http.ResponseWriter, r *http.Request) {
+	id, hash, ok := parseKeyRef(r.PathValue("id"))
+	if !ok {
+		respondError(w, r, invalidRequest(errInvalidKeyRef))
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, r, internalError("Failed to reset key usage", fmt.Errorf("key %s: %w", id, err)))
+		return
+	}
+	defer tx.Rollback()
+
+	meta, err := scanKeyMetadata(tx.QueryRowContext(r.Context(), `
+		SELECT `+keyMetadataColumns+`
+		FROM api_keys WHERE `+keyRefCondition+` FOR UPDATE`, id, hash))
+	if err == sql.ErrNoRows {
+		respondError(w, r, notFound("API key not found"))
+		return
+	}
+	if err == nil {
+		err = tx.QueryRowContext(r.Context(), `
+			UPDATE api_keys SET usage_reset_at = now() WHERE key_id = $1
+			RETURNING usage_reset_at`, id).Scan(&meta.UsageResetAt)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(r.Context(), `
+			UPDATE daily_usage SET requests = 0
+			WHERE key = (SELECT key FROM api_keys WHERE key_id = $1)
+			AND day = $2::date`, id, usageDay())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondError(w, r, internalError("Failed to reset key usage", fmt.Errorf("key %s: %w", id, err)))
+		return
+	}
+
+	log.Printf("Usage reset for key %s", meta.KeyID)
+	meta.Usage = new(keyUsage)
+	writeJSON(w, http.StatusOK, meta)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seededKey answers the admin key queries like a database holding one key,
+// sk-test, with some usage.
+func seededKey(q fakeQuery) fakeResult {
+	switch {
+	case strings.Contains(q.SQL, "FROM api_keys"):
+		if q.Args[0] != keyID("sk-test") {
+			return fakeResult{}
+		}
+		if hash := q.Args[1].(string); hash != "" && hash != fullKeyHash("sk-test") {
+			return fakeResult{}
+		}
+		expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		return fakeResult{Rows: [][]driver.Value{{
+			keyID("sk-test"), int64(42), int64(100000), nil, "pro", false, 0.3, "claude-safe", nil, nil, nil,
+			nil, nil, nil, nil, true, expires, []byte(`{10.0.0.0/8}`), nil,
+		}}}
+	case strings.Contains(q.SQL, "FROM usage_log"):
+		return fakeResult{Rows: [][]driver.Value{{int64(3), int64(120), int64(45)}}}
+	}
+	return fakeResult{}
+}
+
+func fullKeyHash(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestHandleGetKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		ref        string
+		wantStatus int
+	}{
+		{"by key ID", keyID("sk-test"), http.StatusOK},
+		{"by SHA-256 hash", fullKeyHash("sk-test"), http.StatusOK},
+		{"unknown key", keyID("sk-other"), http.StatusNotFound},
+		{"hash of another key with the same ID prefix", keyID("sk-test") + strings.Repeat("0", 48), http.StatusNotFound},
+		{"plaintext key refused", "sk-test", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, seededKey)
+			req := httptest.NewRequest(http.MethodGet, "/v1/keys/"+tt.ref, nil)
+			req.SetPathValue("id", tt.ref)
+			w := httptest.NewRecorder()
+			handleGetKey(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			for _, q := range fake.ran() {
+				if !strings.HasPrefix(strings.TrimSpace(q.SQL), "SELECT") {
+					t.Errorf("looking up a key ran %q", q.SQL)
+				}
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if strings.Contains(w.Body.String(), "sk-test") {
+				t.Error("response contains the plaintext key")
+			}
+			var meta keyMetadata
+			if err := json.Unmarshal(w.Body.Bytes(), &meta); err != nil {
+				t.Fatal(err)
+			}
+			if meta.KeyID != keyID("sk-test") || meta.RemainingCalls != 42 || meta.Tier != "pro" || !meta.Disabled {
+				t.Errorf("metadata %+v", meta)
+			}
+			if meta.ExpiresAt == nil || !meta.ExpiresAt.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+				t.Errorf("expires_at %v", meta.ExpiresAt)
+			}
+			if meta.ForcedModel == nil || *meta.ForcedModel != "claude-safe" || meta.DailyLimit != nil {
+				t.Errorf("forced_model %v, daily_limit %v", meta.ForcedModel, meta.DailyLimit)
+			}
+			if len(meta.AllowedCIDRs) != 1 || meta.AllowedCIDRs[0] != "10.0.0.0/8" {
+				t.Errorf("allowed_cidrs %v", meta.AllowedCIDRs)
+			}
+			if meta.Usage == nil || *meta.Usage != (keyUsage{Requests: 3, InputTokens: 120, OutputTokens: 45}) {
+				t.Errorf("usage %+v", meta.Usage)
+			}
+		})
+	}
+}
+
+// keyTable answers the key listing like a database holding n keys, key-00
+// to key-NN, alternating between the default and pro tiers, with every third
+// key disabled.
+func keyTable(n int) func(q fakeQuery) fakeResult {
+	return func(q fakeQuery) fakeResult {
+		tier := q.Args[0].(string)
+		limit, offset := int(q.Args[1].(int64)), int(q.Args[2].(int64))
+		var rows [][]driver.Value
+		for i := range n {
+			rowTier, disabled := defaultTier, i%3 == 0
+			if i%2 == 1 {
+				rowTier = "pro"
+			}
+			if tier != "" && rowTier != tier || q.Args[3] != nil && q.Args[3] != disabled {
+				continue
+			}
+			rows = append(rows, []driver.Value{
+				fmt.Sprintf("key-%02d", i), int64(10), int64(100000), nil, rowTier, disabled, nil, nil, nil, nil, nil,
+				nil, nil, nil, nil, false, nil, nil, nil,
+			})
+		}
+		rows = rows[min(offset, len(rows)):]
+		return fakeResult{Rows: rows[:min(limit, len(rows))]}
+	}
+}
+
+func TestHandleListKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		wantStatus  int
+		wantKeys    []string
+		wantHasMore bool
+	}{
+		{"first page", "?limit=3", http.StatusOK, []string{"key-00", "key-01", "key-02"}, true},
+		{"middle page", "?limit=3&offset=3", http.StatusOK, []string{"key-03", "key-04", "key-05"}, true},
+		{"last page exactly full", "?limit=4&offset=6", http.StatusOK, []string{"key-06", "key-07", "key-08", "key-09"}, false},
+		{"past the end", "?offset=20", http.StatusOK, []string{}, false},
+		{"default page size", "", http.StatusOK, []string{"key-00", "key-01", "key-02", "key-03", "key-04", "key-05", "key-06", "key-07", "key-08", "key-09"}, false},
+		{"largest page", "?limit=500", http.StatusOK, []string{"key-00", "key-01", "key-02", "key-03", "key-04", "key-05", "key-06", "key-07", "key-08", "key-09"}, false},
+		{"by tier", "?tier=pro", http.StatusOK, []string{"key-01", "key-03", "key-05", "key-07", "key-09"}, false},
+		{"disabled", "?disabled=true", http.StatusOK, []string{"key-00", "key-03", "key-06", "key-09"}, false},
+		{"enabled pro keys paged", "?tier=pro&disabled=false&limit=2", http.StatusOK, []string{"key-01", "key-05"}, true},
+		{"zero limit", "?limit=0", http.StatusBadRequest, nil, false},
+		{"limit too large", "?limit=501", http.StatusBadRequest, nil, false},
+		{"limit not a number", "?limit=ten", http.StatusBadRequest, nil, false},
+		{"negative offset", "?offset=-1", http.StatusBadRequest, nil, false},
+		{"invalid disabled", "?disabled=maybe", http.StatusBadRequest, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, keyTable(10))
+			w := httptest.NewRecorder()
+			handleListKeys(w, httptest.NewRequest(http.MethodGet, "/v1/keys"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if n := len(fake.ran()); n != 0 {
+					t.Errorf("invalid query ran %d statements", n)
+				}
+				return
+			}
+			var resp struct {
+				Keys    []keyMetadata
+				HasMore bool `json:"has_more"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, k := range resp.Keys {
+				got = append(got, k.KeyID)
+			}
+			if !slices.Equal(got, tt.wantKeys) || resp.HasMore != tt.wantHasMore {
+				t.Errorf("keys %v, has_more %v; want %v, %v", got, resp.HasMore, tt.wantKeys, tt.wantHasMore)
+			}
+		})
+	}
+}
+
+// usageStore is one key, sk-test, with usage the reset endpoint can clear: a
+// usage_log with three requests and today's daily count.
+type usageStore struct {
+	mu       sync.Mutex
+	resetAt  any // usage_reset_at，nil 表示从未重置
+	logged   []time.Time
+	daily    int64
+	dailyDay string
+}
+
+func (s *usageStore) handle(q fakeQuery) fakeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.Contains(q.SQL, "UPDATE api_keys SET usage_reset_at = now()"):
+		s.resetAt = time.Now()
+		return fakeResult{Rows: [][]driver.Value{{s.resetAt}}}
+	case strings.Contains(q.SQL, "UPDATE daily_usage SET requests = 0"):
+		if q.Args[1] == s.dailyDay {
+			s.daily = 0
+		}
+	case strings.Contains(q.SQL, "FROM api_keys"):
+		if q.Args[0] != keyID("sk-test") {
+			return fakeResult{}
+		}
+		return fakeResult{Rows: [][]driver.Value{{
+			keyID("sk-test"), int64(42), nil, int64(10), "pro", false, nil, nil, nil, nil, nil,
+			nil, nil, nil, s.resetAt, false, nil, nil, nil,
+		}}}
+	case strings.Contains(q.SQL, "FROM usage_log"):
+		var n int64
+		for _, at := range s.logged {
+			if since, ok := q.Args[3].(time.Time); !ok || !at.Before(since) {
+				n++
+			}
+		}
+		return fakeResult{Rows: [][]driver.Value{{n, 40 * n, 15 * n}}}
+	}
+	return fakeResult{}
+}
+
+func TestHandleResetKeyUsage(t *testing.T) {
+	hourAgo := time.Now().Add(-time.Hour)
+	store := &usageStore{logged: []time.Time{hourAgo, hourAgo, hourAgo}, daily: 7, dailyDay: usageDay()}
+	fake := useFakeDB(t, store.handle)
+	call := func(handler http.HandlerFunc, method, ref string) (int, keyMetadata) {
+		req := httptest.NewRequest(method, "/v1/keys/"+ref, nil)
+		req.SetPathValue("id", ref)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		var meta keyMetadata
+		json.Unmarshal(w.Body.Bytes(), &meta)
+		return w.Code, meta
+	}
+
+	if _, meta := call(handleGetKey, http.MethodGet, keyID("sk-test")); *meta.Usage != (keyUsage{Requests: 3, InputTokens: 120, OutputTokens: 45}) {
+		t.Fatalf("seeded usage %+v", meta.Usage)
+	}
+
+	status, meta := call(handleResetKeyUsage, http.MethodPost, keyID("sk-test"))
+	if status != http.StatusOK {
+		t.Fatalf("reset: status %d", status)
+	}
+	if meta.RemainingCalls != 42 || meta.Tier != "pro" || meta.UsageResetAt == nil || *meta.Usage != (keyUsage{}) {
+		t.Errorf("reset returned %+v, usage %+v", meta, meta.Usage)
+	}
+	if store.daily != 0 {
+		t.Errorf("daily count %d after the reset, want 0", store.daily)
+	}
+	if fake.commits != 1 {
+		t.Errorf("%d commits, want the reset in one transaction", fake.commits)
+	}
+	for _, q := range fake.ran() {
+		if strings.Contains(q.SQL, "remaining_calls =") || strings.Contains(q.SQL, "DELETE") {
+			t.Errorf("reset ran %q", q.SQL)
+		}
+	}
+
+	// 重置后只统计新的用量，历史记录仍保留
+	store.logged = append(store.logged, time.Now().Add(time.Second))
+	_, meta = call(handleGetKey, http.MethodGet, keyID("sk-test"))
+	if meta.RemainingCalls != 42 || *meta.Usage != (keyUsage{Requests: 1, InputTokens: 40, OutputTokens: 15}) {
+		t.Errorf("after the reset: %d calls left, usage %+v", meta.RemainingCalls, meta.Usage)
+	}
+	if len(store.logged) != 4 {
+		t.Error("usage_log rows were removed")
+	}
+
+	if status, _ := call(handleResetKeyUsage, http.MethodPost, keyID("sk-other")); status != http.StatusNotFound || fake.commits != 1 {
+		t.Errorf("unknown key: status %d, %d commits", status, fake.commits)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// authLockout blocks client IPs that present too many unknown API keys
+// within a window, which suggests key guessing. Counters and blocks live in
+// expiring caches, so they reset on their own.
+type authLockout struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	failures  *expiringCache[netip.Addr, *rateWindow]
+	blocked   *expiringCache[netip.Addr, time.Time]
+}
+
+func newAuthLockout(threshold int, window, duration time.Duration) *authLockout {
+	return &authLockout{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		failures:  newExpiringCache[netip.Addr, *rateWindow](window),
+		blocked:   newExpiringCache[netip.Addr, time.Time](duration),
+	}
+}
+
+// Blocked reports whether addr is locked out and until when.
+func (l *authLockout) Blocked(addr netip.Addr) (time.Time, bool) {
+	return l.blocked.Get(addr)
+}
+
+// RecordFailure counts a failed authentication from addr and blocks it once
+// the threshold is reached within the window.
+func (l *authLockout) RecordFailure(addr netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	win, exists := l.failures.Get(addr)
+	if !exists || now.Sub(win.start) >= l.window {
+		win = &rateWindow{start: now}
+		l.failures.SetUntil(addr, win, now.Add(l.window))
+	}
+	win.count++
+	if win.count >= l.threshold {
+		until := now.Add(l.duration)
+		l.blocked.SetUntil(addr, until, until)
+		l.failures.Delete(addr)
+	}
+}
+
+// Reap drops ended windows and expired blocks.
+func (l *authLockout) Reap() int {
+	return l.failures.Reap() + l.blocked.Reap()
+}
+
+// checkAuthLockout rejects the request when its client IP is locked out,
+// whatever key it presents. It reports whether the request may proceed.
+func checkAuthLockout(w http.ResponseWriter, r *http.Request) bool {
+	if lockout == nil {
+		return true
+	}
+	until, blocked := lockout.Blocked(clientIP(r))
+	if !blocked {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+	respondError(w, r, rateLimited("Too many failed authentication attempts, please retry later"))
+	return false
+}
+
+// recordAuthFailure counts an unknown API key against the client IP.
+func recordAuthFailure(r *http.Request) {
+	if lockout != nil {
+		lockout.RecordFailure(clientIP(r))
+	}
+}
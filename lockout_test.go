@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestAuthLockout(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("192.0.2.2")
+	tests := []struct {
+		name        string
+		failures    int
+		pause       time.Duration // 两轮失败之间的等待
+		then        int
+		wantBlocked bool
+	}{
+		{"below the threshold", 2, 0, 0, false},
+		{"threshold reached", 3, 0, 0, true},
+		{"failures spread over the window", 2, 0, 1, true},
+		{"window reset", 2, 80 * time.Millisecond, 1, false},
+		{"threshold reached again after the reset", 2, 80 * time.Millisecond, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newAuthLockout(3, 50*time.Millisecond, time.Minute)
+			for range tt.failures {
+				l.RecordFailure(addr)
+			}
+			time.Sleep(tt.pause)
+			for range tt.then {
+				l.RecordFailure(addr)
+			}
+			until, blocked := l.Blocked(addr)
+			if blocked != tt.wantBlocked {
+				t.Fatalf("blocked = %v, want %v", blocked, tt.wantBlocked)
+			}
+			if blocked {
+				if left := time.Until(until); left <= 0 || left > time.Minute {
+					t.Errorf("blocked for %v, want the lockout duration", left)
+				}
+			}
+			if _, blocked := l.Blocked(other); blocked {
+				t.Error("another address is blocked too")
+			}
+		})
+	}
+}
+
+func TestAuthLockoutExpires(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.1")
+	l := newAuthLockout(1, time.Minute, 30*time.Millisecond)
+	l.RecordFailure(addr)
+	if _, blocked := l.Blocked(addr); !blocked {
+		t.Fatal("not blocked after reaching the threshold")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, blocked := l.Blocked(addr); blocked {
+		t.Error("still blocked after the lockout duration")
+	}
+	if n := l.Reap(); n != 1 {
+		t.Errorf("reaped %d entries, want the expired block", n)
+	}
+}
+
+func TestLockoutRejectsAnyKey(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	swap(t, &lockout, newAuthLockout(2, time.Minute, time.Minute))
+	useKeys(t, &APIKey{Key: "valid", RemainingCalls: 5, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+
+	tests := []struct {
+		name       string
+		key        string
+		remoteAddr string
+		want       int
+	}{
+		{"first unknown key", "guess-1", "198.51.100.7:1000", http.StatusUnauthorized},
+		{"second unknown key", "guess-2", "198.51.100.7:1001", http.StatusUnauthorized},
+		{"locked out", "guess-3", "198.51.100.7:1002", http.StatusTooManyRequests},
+		{"valid key from the locked out IP", "valid", "198.51.100.7:1003", http.StatusTooManyRequests},
+		{"valid key from another IP", "valid", "198.51.100.8:1000", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newMessagesRequest(tt.key, `{"messages":[{"role":"user","content":"hi"}],"stream":true}`)
+			r.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Error("lockout without Retry-After")
+			}
+		})
+	}
+}
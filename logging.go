@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// defaultRedactPatterns match credentials that may end up in log lines via
+// headers, errors or request dumps.
+var defaultRedactPatterns = []string{
+	`(?i)bearer\s+[A-Za-z0-9._~+/=-]+`,
+	`(?i)(x-api-key["']?\s*[:=]\s*["']?)[^\s"',]+`,
+	`ya29\.[A-Za-z0-9._-]+`,
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+}
+
+// redactingHandler scrubs secrets from log messages and string attributes
+// before passing records to the wrapped handler.
+type redactingHandler struct {
+	next     slog.Handler
+	patterns []*regexp.Regexp
+	// secrets are the literal values of secretSettings, which must never
+	// be logged verbatim.
+	secrets []string
+}
+
+func (h *redactingHandler) redact(s string) string {
+	for _, secret := range h.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	for _, re := range h.patterns {
+		s = re.ReplaceAllStringFunc(s, func(match string) string {
+			// 保留 header 名称等前缀，仅替换敏感值
+			if sub := re.FindStringSubmatch(match); len(sub) > 1 {
+				return sub[1] + redacted
+			}
+			return redacted
+		})
+	}
+	return s
+}
+
+func (h *redactingHandler) redactAttr(a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(h.redact(a.Value.String()))
+	case slog.KindGroup:
+		attrs := a.Value.Group()
+		for i := range attrs {
+			attrs[i] = h.redactAttr(attrs[i])
+		}
+		a.Value = slog.GroupValue(attrs...)
+	}
+	return a
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, h.redact(r.Message), r.PC)
+	if id := requestIDFromContext(ctx); id != "" {
+		out.AddAttrs(slog.String("request_id", id))
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = h.redactAttr(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redactedAttrs), patterns: h.patterns, secrets: h.secrets}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name), patterns: h.patterns, secrets: h.secrets}
+}
+
+// logRedactor is the handler installed by setupLogging, kept to scrub lines
+// written outside slog such as the access log.
+var logRedactor *redactingHandler
+
+// redactLine scrubs a log line written outside slog.
+func redactLine(s string) string {
+	if logRedactor == nil {
+		return s
+	}
+	return logRedactor.redact(s)
+}
+
+// setupLogging installs the redacting handler as the default logger. slog
+// also takes over the standard log package, so log.Printf calls are scrubbed
+// too.
+func setupLogging() {
+	var patterns []*regexp.Regexp
+	for _, p := range append(defaultRedactPatterns, cfg().LogRedactPatterns...) {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			log.Printf("Ignoring invalid redaction pattern %q: %v", p, err)
+			continue
+		}
+		patterns = append(patterns, re)
+	}
+
+	var secrets []string
+	for _, env := range secretSettings {
+		if v := os.Getenv(env); len(v) >= 8 {
+			secrets = append(secrets, v)
+		}
+	}
+
+	logRedactor = &redactingHandler{
+		next:     slog.NewTextHandler(os.Stderr, nil),
+		patterns: patterns,
+		secrets:  secrets,
+	}
+	slog.SetDefault(slog.New(logRedactor))
+}
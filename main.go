@@ -1,56 +1,177 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-type ErrorResponse struct {
-	Error struct {
-		Type    string `json:"type"`
-		Message string `json:"message"`
-	} `json:"error"`
-}
-
 var (
-	db          *sql.DB
-	accessToken string
-)
-
-const (
-	model    = "claude-3-5-sonnet@20240620"
-	location = "us-east5"
+	db        *sql.DB
+	limiter   *rateLimiter
+	lockout   *authLockout
+	inflight  *inflightLimiter
+	admission *admissionQueue
+	breaker   *circuitBreaker
+	shedder   *loadShedder
+	governor  *rateGovernor
+	projects  *projectPool
+	retries   *retryBudget
 )
 
-func init() {
-	if err := loadEnv(); err != nil {
-		log.Fatalf("Failed to load .env file: %v", err)
+// setup loads the configuration and builds the gateway's shared state. It
+// runs first in main rather than as init, so tests can bring up only the
+// parts they exercise.
+func setup() {
+	envErr := loadEnv()
+	liveConfig.Store(loadConfig())
+	seedFlags()
+	setupLogging()
+	if envErr != nil {
+		startupFailure("Failed to load configuration: %v", envErr)
+	}
+	if err := validateConfig(*cfg()); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
 	initDB()
+	if cfg().RateLimitRPM > 0 {
+		limiter = newRateLimiter(cfg().RateLimitRPM, time.Minute)
+		cacheJanitor.Register("rate_limiter", limiter)
+	}
+	if cfg().AuthLockoutThreshold > 0 {
+		lockout = newAuthLockout(cfg().AuthLockoutThreshold, cfg().AuthLockoutWindow, cfg().AuthLockoutDuration)
+		cacheJanitor.Register("auth_lockout", lockout)
+	}
+	auth, err := newAuthenticator()
+	if err != nil {
+		log.Fatalf("Failed to configure authentication: %v", err)
+	}
+	auth = endpointScope{next: auth}
+	if cfg().OperatorKey != "" {
+		auth = operatorAuthenticator{next: auth}
+		operatorLimiter = newRateLimiter(cfg().OperatorKeyRPM, time.Minute)
+		cacheJanitor.Register("operator_limiter", operatorLimiter)
+	}
+	authenticator = auth
+	if accessLog, err = openAccessLog(cfg().AccessLog); err != nil {
+		log.Fatalf("Failed to open access log: %v", err)
+	}
+	if projects, err = newProjectPool(); err != nil {
+		log.Fatalf("Failed to configure Google Cloud projects: %v", err)
+	}
+	upstreamTLS, err := newUpstreamTLSConfig()
+	if err != nil {
+		log.Fatalf("Failed to configure upstream TLS: %v", err)
+	}
+	vertexClient.Transport.(*http.Transport).TLSClientConfig = upstreamTLS
+	if cfg().UpstreamDNSServer != "" || cfg().UpstreamDNSCacheTTL > 0 {
+		dialer := newCachingDialer(upstreamDialer, newUpstreamResolver(cfg().UpstreamDNSServer), cfg().UpstreamDNSCacheTTL)
+		upstreamClient.Transport.(*http.Transport).DialContext = dialer.DialContext
+		vertexClient.Transport.(*http.Transport).DialContext = dialer.DialContext
+	}
+	if requestPipeline, err = newRequestPipeline(cfg().RequestTransformers); err != nil {
+		log.Fatalf("Failed to configure request transformers: %v", err)
+	}
+	if cfg().MaxInflightPerKey > 0 {
+		inflight = newInflightLimiter(cfg().MaxInflightPerKey)
+	}
+	if cfg().MaxUpstreamConcurrency > 0 {
+		admission = newAdmissionQueue(cfg().MaxUpstreamConcurrency)
+	}
+	if len(cfg().OutputRedactPatterns) > 0 {
+		var patterns []*regexp.Regexp
+		for _, p := range cfg().OutputRedactPatterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				log.Fatalf("Invalid output redaction pattern %q: %v", p, err)
+			}
+			patterns = append(patterns, re)
+		}
+		newStreamTransformer = func() StreamTransformer {
+			return newRedactionTransformer(patterns, cfg().OutputRedactHoldback)
+		}
+		transformMessage = messageTextFilter(redactionFilter(patterns))
+	}
+	if cfg().RetryBudget > 0 {
+		retries = newRetryBudget(float64(cfg().RetryBudget), cfg().RetryBudgetRate)
+	}
+	if cfg().BreakerThreshold > 0 {
+		breaker = newCircuitBreaker(cfg().BreakerThreshold, cfg().BreakerCooldown)
+	}
+	if cfg().UpstreamPacingThreshold > 0 {
+		governor = newRateGovernor(cfg().UpstreamPacingThreshold, cfg().UpstreamPacingMaxWait)
+	}
+	if cfg().ShedLatencySLO > 0 && cfg().ShedWindow > 0 {
+		shedder = newLoadShedder(cfg().ShedLatencySLO, cfg().ShedWindow, cfg().ShedStep, cfg().ShedMaxRate, cfg().ShedEvalInterval, cfg().ShedSampleMaxAge)
+	}
+	usageSinks = append(usageSinks, newAsyncPublisher(dbUsageLog{}, 1024))
+	if cfg().UsageNATSURL != "" {
+		publisher, err := newNATSPublisher(cfg().UsageNATSURL, cfg().UsageNATSSubject)
+		if err != nil {
+			log.Fatalf("Failed to configure usage publisher: %v", err)
+		}
+		usageSinks = append(usageSinks, newAsyncPublisher(publisher, 1024))
+	}
+	if cfg().CaptureS3Endpoint != "" && cfg().CaptureS3Bucket != "" {
+		captureStore = &s3Store{
+			endpoint:  cfg().CaptureS3Endpoint,
+			bucket:    cfg().CaptureS3Bucket,
+			region:    cfg().CaptureS3Region,
+			accessKey: cfg().CaptureS3AccessKey,
+			secretKey: cfg().CaptureS3SecretKey,
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}
+	}
 }
 
+// processEnv names the variables the gateway was started with. Everything
+// else in the environment was loaded from .env or CONFIG_FILE, and is dropped
+// and read again when loadEnv runs for a reload.
+var processEnv map[string]bool
+
 func loadEnv() error {
+	if processEnv == nil {
+		processEnv = make(map[string]bool)
+		for _, kv := range os.Environ() {
+			name, _, _ := strings.Cut(kv, "=")
+			processEnv[name] = true
+		}
+	} else {
+		for _, kv := range os.Environ() {
+			if name, _, _ := strings.Cut(kv, "="); !processEnv[name] {
+				os.Unsetenv(name)
+			}
+		}
+	}
+
 	// try to get the .env file from the current directory
 	// if it doesn't exist, use the system's environment
 	_ = godotenv.Load()
 
+	// 配置文件只补充环境变量中未设置的项
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := loadConfigFile(path, os.Getenv("APP_ENV")); err != nil {
+			return err
+		}
+	}
+
 	requiredEnvs := []string{
 		"APP_PORT",
-		"GC_PROJECT_ID",
-		"GC_CLIENT_EMAIL",
-		"GC_PRIVATE_KEY_ID",
-		"GC_PRIVATE_KEY",
 		"DB_USER",
 		"DB_PASSWORD",
 		"DB_NAME",
@@ -61,13 +182,16 @@ func loadEnv() error {
 			return fmt.Errorf("required environment variable not set: %s", env)
 		}
 	}
+	if os.Getenv("GC_PROJECT_ID") == "" && os.Getenv("GC_PROJECTS") == "" {
+		return fmt.Errorf("required environment variable not set: GC_PROJECT_ID or GC_PROJECTS")
+	}
 	return nil
 }
 
-func initDB() {
+// postgresURL builds the connection URL for host from the DB_* settings.
+func postgresURL(dbHost string) string {
 	dbUser := os.Getenv("DB_USER")
 	dbPassword := os.Getenv("DB_PASSWORD")
-	dbHost := "localhost"
 	dbPort := os.Getenv("DB_PORT")
 	dbName := os.Getenv("DB_NAME")
 
@@ -81,51 +205,52 @@ func initDB() {
 	dbPassword = strings.ReplaceAll(dbPassword, "(", "%28")
 	dbPassword = strings.ReplaceAll(dbPassword, ")", "%29")
 
-	dbURL := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable",
+	return fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable",
 		dbUser,
 		dbPassword,
 		dbHost,
 		dbPort,
 		dbName)
+}
 
+func initDB() {
 	var err error
-	db, err = sql.Open("postgres", dbURL)
+	db, err = sql.Open("postgres", postgresURL("localhost"))
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 	db.SetMaxOpenConns(25)
 	db.SetMaxIdleConns(25)
 	db.SetConnMaxLifetime(5 * time.Minute)
-	if err = db.Ping(); err != nil {
-		log.Fatalf("Failed to ping database: %v", err)
-	}
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS api_keys (
-			key TEXT PRIMARY KEY,
-			remaining_calls INTEGER NOT NULL
-		)
-	`)
-	if err != nil {
-		log.Fatalf("Error creating table: %v", err)
+	if err = prepareDB(db); err != nil {
+		startupFailure("Failed to prepare database: %v", err)
+		go retryDB(db)
 	}
+	initReplicas()
 }
 
 func main() {
-	// Get access token
-	gcClientEmail := os.Getenv("GC_CLIENT_EMAIL")
-	gcPrivateKeyID := os.Getenv("GC_PRIVATE_KEY_ID")
-	gcPrivateKey := os.Getenv("GC_PRIVATE_KEY")
-	newAccessToken, err := GetAccessToken(gcClientEmail, gcPrivateKey, gcPrivateKeyID)
+	setup()
+	provider, err := newTokenProvider()
 	if err != nil {
-		fmt.Printf("Error getting access token: %v\n", err)
-		return
+		log.Fatalf("Failed to configure upstream credentials: %v", err)
 	}
-	accessToken = newAccessToken
-	// fmt.Printf("Access Token: %s\n", accessToken)
+	tokenProvider = provider
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handleForwardToEndpoint)
-	mux.HandleFunc("/health", handleHealthCheck)
+	// Get access token. A failure here is not fatal: the server comes up
+	// unhealthy and keeps retrying in the background.
+	if err := refreshAccessToken(); err != nil {
+		log.Printf("Error getting access token: %v, retrying in background", err)
+		go retryAccessToken(context.Background(), refreshAccessToken)
+	}
+	projects.refreshTokens()
+
+	// 预先建立到上游的连接，首个请求无需等待 DNS 解析与 TLS 握手
+	if cfg().Warmup {
+		warmupUpstream(cfg().WarmupTimeout)
+	}
+
+	mux := newRouter()
 
 	port := os.Getenv("APP_PORT")
 	if port == "" {
@@ -134,163 +259,615 @@ func main() {
 
 	server := &http.Server{
 		Addr:         ":" + port,
-		Handler:      mux,
+		Handler:      withAccessLog(mux),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
-	log.Printf("Server is running on :%s", port)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Failed to start server: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	reloadOnSIGHUP()
+	// access token 有效期为一小时，到期前在后台定期刷新
+	go keepTokenFresh(ctx, refreshAccessToken, currentTokenExpiry)
+	projects.keepTokensFresh(ctx)
+	// 性能分析接口使用独立的监听地址，不暴露在对外端口上
+	if cfg().PprofAddr != "" {
+		go servePprof(ctx, cfg().PprofAddr)
+	}
+	go cacheJanitor.Run(ctx, cfg().JanitorInterval)
+	go flags.Run(ctx, cfg().FeatureFlagRefresh)
+	go storedModels.Run(ctx, cfg().FeatureFlagRefresh)
+	go modelAliases.Run(ctx, cfg().FeatureFlagRefresh)
+
+	// 配置了证书时直接提供 HTTPS，否则使用 HTTP
+	useTLS := cfg().TLSCertFile != "" && cfg().TLSKeyFile != ""
+	if useTLS {
+		tlsConfig, err := newTLSConfig()
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	go func() {
+		var err error
+		if useTLS {
+			log.Printf("Server is running on :%s (TLS)", port)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Server is running on :%s", port)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Printf("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
 	}
 }
 
 func handleForwardToEndpoint(w http.ResponseWriter, r *http.Request) {
-	// 只允许 POST 方法
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// 多次使用无效密钥的来源 IP 暂时封禁
+	if !checkAuthLockout(w, r) {
 		return
 	}
 
 	// 验证 API 密钥
 	apiKey := r.Header.Get("x-api-key")
 	if apiKey == "" {
-		http.Error(w, "API key is required", http.StatusUnauthorized)
+		respondError(w, r, errAPIKeyRequired)
 		return
 	}
 
-	// 检查并减少 API 密钥的剩余调用次数
-	remainingCalls, err := checkAndDecrementAPIKey(apiKey)
-	if err != nil {
-		http.Error(w, "Invalid or expired API key", http.StatusUnauthorized)
+	// 限制请求体大小，gzip 压缩的请求体先解压
+	if !prepareRequestBody(w, r) {
+		return
+	}
+
+	// 开启校验时读取请求体，无效请求不消耗额度
+	var (
+		reqBody []byte
+		err     error
+	)
+	if validationEnabled() {
+		if reqBody, err = readRequestBody(r); err != nil {
+			respondError(w, r, bodyError(err))
+			return
+		}
+		if err := validateRequest(reqBody); err != nil {
+			respondError(w, r, invalidRequest(err.Error()))
+			return
+		}
+	}
+
+	// 熔断器打开时快速失败，不消耗额度
+	if breaker != nil && !breaker.Allow() {
+		respondError(w, r, overloaded("Upstream is unavailable, please retry later"))
 		return
 	}
 
-	if remainingCalls <= 0 {
-		http.Error(w, "API key has no remaining calls", http.StatusForbidden)
+	// 加载密钥信息（不扣减额度）
+	key, err := authenticator.Authenticate(r.Context(), r)
+	if errors.Is(err, errNoRemainingCalls) {
+		respondKeyError(w, r, key, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, authFailure(r, apiKey, err))
 		return
 	}
 
-	// 设置剩余调用次数的响应头
-	w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", remainingCalls))
+	// 上游延迟超出 SLO 时按比例丢弃请求，高等级的密钥按权重少丢，不消耗额度
+	if shedder != nil && shedder.ShouldShed(key.Tier) {
+		respondKeyError(w, r, key, overloaded("Gateway is overloaded, please retry later"))
+		return
+	}
 
-	// ... [其余的代码保持不变] ...
+	// 密钥设置了请求时长上限时替代路由的默认超时，流式响应超时后以错误事件结束
+	if key.MaxRequestDuration > 0 {
+		ctx, cancel := overrideRouteTimeout(r, key.MaxRequestDuration)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
 
-	gcProjectID := os.Getenv("GC_PROJECT_ID")
+	// 输出 token 总预算已用完的密钥不再受理新请求（准确用量在流结束后才结算）
+	if key.OutputTokenBudget != nil && *key.OutputTokenBudget <= 0 {
+		respondKeyError(w, r, key, permissionDenied("API key has exhausted its output token budget"))
+		return
+	}
 
-	url := fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:streamRawPredict",
-		location, gcProjectID, location, model)
+	// 密钥限定了来源 IP 段时校验客户端 IP
+	if !ipAllowed(clientIP(r), key.AllowedCIDRs) {
+		respondKeyError(w, r, key, errKeyIPNotAllowed)
+		return
+	}
 
-	headers := map[string]string{
-		"Authorization": "Bearer " + accessToken,
-		"Content-Type":  "application/json; charset=utf-8",
+	// 选择可提供该模型的区域
+	regions, err := regionsForModel(effectiveModel(key))
+	if err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
 	}
 
-	// 读取请求体
-	reqBody, err := io.ReadAll(r.Body)
+	// 客户端可只订阅部分流事件以节省带宽
+	filter, err := parseEventFilter(r)
 	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		respondError(w, r, invalidRequest(err.Error()))
 		return
 	}
-	log.Printf("Request body: %s", string(reqBody))
-	defer r.Body.Close()
 
-	resp, err := sendRequest(url, headers, reqBody)
+	// 只有需要改写、留存或重放请求体时才完整读取，否则直接流式转发给上游，
+	// 避免大请求（如图片）先整体缓冲在内存中
+	capture := shouldCapture(key.CaptureOptOut)
+	shadow := shouldShadow()
+	aggregate := wantsAggregation(r)
+	if reqBody == nil && needsBufferedBody(key, regions, capture, shadow, aggregate) {
+		if reqBody, err = readRequestBody(r); err != nil {
+			respondError(w, r, bodyError(err))
+			return
+		}
+	}
+
+	// 请求体可在允许的模型中选择，选中的模型决定区域与模型级默认参数
+	selected, err := selectModel(key, reqBody)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Request failed: %v", err), http.StatusInternalServerError)
+		respondError(w, r, invalidRequest(err.Error()))
 		return
 	}
-	defer resp.Body.Close()
+	if selected != effectiveModel(key) {
+		if regions, err = regionsForModel(selected); err != nil {
+			respondError(w, r, invalidRequest(err.Error()))
+			return
+		}
+	}
 
-	// 设置响应头
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	// 上游凭据尚不可用时直接拒绝，不消耗额度
+	provider := newProvider(selected)
+	if !provider.Ready() {
+		respondError(w, r, errCredentialsUnavailable)
+		return
+	}
 
-	// 创建一个缓冲读取器
-	reader := bufio.NewReader(resp.Body)
+	// 消息条数与估算输入 token 上限，超出时在扣减额度前拒绝
+	if err := validateRequestSize(reqBody, requestLimitsFor(key)); err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
 
-	// 逐行读取响应并写入 ResponseWriter
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Error reading from response: %v", err)
-			break
+	// 客户端未提供系统提示词时依次使用密钥级、全局默认值；
+	// 再依次应用配置的请求改写插件，最后施加密钥的安全限制（温度上限、强制模型）
+	upstreamBody, err := applyDefaultSystemPrompt(reqBody, key)
+	if err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+	transformKey := key
+	if selected != effectiveModel(key) {
+		k := *key
+		k.ForcedModel = selected
+		transformKey = &k
+	}
+	upstreamBody, err = transformRequest(upstreamBody, transformKey)
+	if err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+	upstreamBody, effective, err := applyGuardrails(upstreamBody, key)
+	if err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+	effective.Model = selected
+	if flags.Enabled(flagInjectUserID) {
+		if upstreamBody, err = injectUserID(upstreamBody, apiKey); err != nil {
+			respondError(w, r, invalidRequest("invalid request body: "+err.Error()))
+			return
+		}
+	}
+	// 非流式请求改为向上游请求流式响应，由网关组装最终消息
+	if aggregate {
+		if upstreamBody, aggregate, err = streamForAggregation(upstreamBody); err != nil {
+			respondError(w, r, invalidRequest("invalid request body: "+err.Error()))
+			return
 		}
+	}
+	if key.ForcedModel != "" {
+		w.Header().Set("X-Effective-Model", effective.Model)
+	}
+	if effective.Temperature != nil {
+		w.Header().Set("X-Effective-Temperature", strconv.FormatFloat(*effective.Temperature, 'g', -1, 64))
+	}
+
+	// 限制单个密钥的并发请求数，请求结束（含出错）时释放
+	if inflight != nil {
+		if !inflight.Acquire(apiKey) {
+			respondKeyError(w, r, key, rateLimited("Too many concurrent requests for this API key"))
+			return
+		}
+		defer inflight.Release(apiKey)
+	}
 
-		// 写入每一行到 ResponseWriter
-		_, err = w.Write(line)
+	// 上游并发已满时排队等待，interactive 请求优先于 batch
+	if admission != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), cfg().AdmissionTimeout)
+		err := admission.Acquire(ctx, parsePriority(r.Header.Get("X-Priority")))
+		cancel()
 		if err != nil {
-			log.Printf("Error writing to ResponseWriter: %v", err)
-			break
+			respondError(w, r, overloaded("Gateway is at capacity, please retry later"))
+			return
 		}
+		defer admission.Release()
+	}
 
-		// 刷新写入的内容
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
+	// 按分钟限流，被限流的请求不消耗额度；运维密钥使用独立的限流器
+	var rl rateLimitInfo
+	keyLimiter := limiter
+	if key.Operator {
+		keyLimiter = operatorLimiter
+	}
+	if keyLimiter != nil {
+		remaining, reset, ok := keyLimiter.Allow(apiKey)
+		rl = rateLimitInfo{Limit: keyLimiter.limit, Remaining: remaining, Reset: reset}
+		if !ok {
+			setRateLimitHeaders(w, rl)
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+			respondKeyError(w, r, key, errRateLimitExceeded)
+			return
 		}
 	}
-}
 
-func checkAndDecrementAPIKey(apiKey string) (int, error) {
-	var remainingCalls int
-	err := db.QueryRow("SELECT remaining_calls FROM api_keys WHERE key = $1", apiKey).Scan(&remainingCalls)
+	// 每日请求上限，UTC 零点重置；记下计入的日期，退还时减回同一天
+	var usedDay string
+	if key.DailyLimit != nil {
+		day, ok, err := takeDailyUsage(apiKey, *key.DailyLimit)
+		if err != nil {
+			respondError(w, r, errQuotaUpdateFailed.withDetail(fmt.Errorf("daily usage of key %s: %w", keyID(apiKey), err)))
+			return
+		}
+		if !ok {
+			w.Header().Set("Retry-After", dailyRetryAfter())
+			respondKeyError(w, r, key, rateLimited("Daily request limit reached for this API key"))
+			return
+		}
+		usedDay = day
+	}
+	// 未实际受理的请求不计入当日用量
+	returnDaily := func() {
+		if usedDay == "" {
+			return
+		}
+		if err := returnDailyUsage(apiKey, usedDay); err != nil {
+			logf(r.Context(), "Error updating daily usage of API key %s: %v", keyID(apiKey), err)
+		}
+	}
+
+	// 检查并减少 API 密钥的剩余调用次数
+	cost := modelCost(key.Tier, effective.Model)
+	key.RemainingCalls, err = authenticator.Charge(r.Context(), key, cost)
+	if err != nil {
+		returnDaily()
+	}
+	if err == errNoRemainingCalls {
+		respondKeyError(w, r, key, errNoRemainingCalls)
+		return
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, fmt.Errorf("API key not found")
+		respondError(w, r, errQuotaUpdateFailed.withDetail(fmt.Errorf("decrementing key %s: %w", keyID(apiKey), err)))
+		return
+	}
+
+	// 剩余次数取分钟窗口与总额度（扣减后）中较小者
+	windowRemaining := rl.Remaining
+	if keyLimiter == nil || key.RemainingCalls < rl.Remaining {
+		rl.Remaining = key.RemainingCalls
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json; charset=utf-8",
+		"X-Request-Id": requestIDFor(r),
+	}
+
+	if shadow {
+		shadowRequest(headers, upstreamBody, effective.Model)
+	}
+
+	// 客户端断开时主动取消上游请求，不等待请求上下文自行结束
+	upstreamCtx, cancelUpstream := context.WithCancel(r.Context())
+	defer cancelUpstream()
+
+	// 按权重在 Vertex 目标间分流，使用提示缓存的请求按密钥固定到同一目标
+	regions = targetBalance.Order(regions, effective.Model, stickyKey(key, upstreamBody))
+
+	upstreamStart := time.Now()
+	var resp *http.Response
+	served := failoverTarget{provider: provider, model: effective.Model}
+	if reqBody != nil {
+		resp, served, err = forwardWithFailover(upstreamCtx, provider, regions, effective.Model, headers, upstreamBody)
+	} else {
+		resp, served.region, err = forwardStream(upstreamCtx, provider, regions, effective.Model, headers, r.Body)
+	}
+	// 超时的请求至少按已耗时计入，否则最慢的请求恰好不被采样
+	if shedder != nil && (err == nil || errors.Is(err, context.DeadlineExceeded)) {
+		shedder.Record(time.Since(upstreamStart))
+	}
+	if breaker != nil && !errors.Is(err, errUpstreamBusy) && !errors.Is(err, context.Canceled) && !errors.As(err, new(*http.MaxBytesError)) && !errors.As(err, new(*GatewayError)) {
+		breaker.Record(!isRegionFailure(resp, err))
+	}
+	// 上游未产生任何输出的失败退还额度；客户端主动断开则按 DISCONNECT_REFUND 处理
+	refund := func() {
+		returnDaily()
+		if err := authenticator.Refund(context.Background(), key, cost); err != nil {
+			logf(r.Context(), "Error refunding API key %s: %v", keyID(apiKey), err)
+			return
+		}
+		key.RemainingCalls += cost
+		rl.Remaining = key.RemainingCalls
+		if keyLimiter != nil {
+			rl.Remaining = min(windowRemaining, key.RemainingCalls)
 		}
-		return 0, err
 	}
+	switch {
+	case errors.Is(err, errUpstreamBusy):
+		refund()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(cfg().UpstreamRetryAfter.Seconds()))))
+		respondKeyError(w, r, key, rateLimited("Upstream rate limit nearly exhausted, please retry later"))
+		return
+	case errors.Is(err, context.Canceled):
+		// 客户端已断开，无法再返回错误
+		logf(r.Context(), "Client disconnected before the upstream responded")
+		if cfg().DisconnectRefund {
+			refund()
+		}
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		refund()
+		respondError(w, r, timedOut("Upstream request timed out").withDetail(err))
+		return
+	case errors.As(err, new(*http.MaxBytesError)):
+		// 流式转发途中请求体超出上限
+		refund()
+		respondError(w, r, bodyError(err))
+		return
+	case errors.As(err, new(*GatewayError)):
+		// 提供方在发出请求前拒绝，如请求体无法转换或凭据失效
+		refund()
+		respondError(w, r, err)
+		return
+	case err != nil:
+		// 所有区域都连接失败，上游没有产生输出
+		refund()
+		respondError(w, r, upstreamFailure("Upstream request failed", err))
+		return
+	}
+	defer resp.Body.Close()
 
-	if remainingCalls <= 0 {
-		return 0, nil
+	// 标明实际服务本次请求的模型与区域（含故障转移后的结果）
+	w.Header().Set("X-Served-Model", served.model)
+	if region := servedRegion(served.region); region != "" {
+		w.Header().Set("X-Served-Region", region)
+	}
+	// 记录上游的请求 ID，便于与客户端、网关的请求 ID 对应排查
+	if upstreamID := resp.Header.Get("request-id"); upstreamID != "" {
+		w.Header().Set("X-Upstream-Request-Id", upstreamID)
+		logf(r.Context(), "Upstream request id %s", upstreamID)
 	}
 
-	_, err = db.Exec("UPDATE api_keys SET remaining_calls = remaining_calls - 1 WHERE key = $1", apiKey)
-	if err != nil {
-		return 0, err
+	// 故障转移后上游仍限流或出错，没有产生输出，与 /v1/multi 一样退还额度
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		refund()
 	}
 
-	return remainingCalls - 1, nil
-}
+	// 上游限流时透传 Retry-After，方便客户端退避
+	if resp.StatusCode == http.StatusTooManyRequests {
+		body, _ := io.ReadAll(resp.Body)
+		retryAfter := upstreamRetryAfter(resp.Header, body)
+		setRateLimitHeaders(w, rl)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondKeyError(w, r, key, rateLimited("Upstream rate limit exceeded, please retry later"))
+		return
+	}
 
-func sendRequest(url string, headers map[string]string, body []byte) (*http.Response, error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
+	// 设置响应头
+	setRateLimitHeaders(w, rl)
+
+	// SSE 逐个事件转发；非流式响应（stream=false 或上游错误）整体读取后带 Content-Length 返回；
+	// 需要聚合的流读取完毕后组装为单个消息返回
+	var (
+		usage    usageTracker
+		captured []byte
+	)
+	switch {
+	case !isEventStream(resp.Header):
+		usage, captured = bufferResponse(w, resp, apiKey, effective.Model, cost, capture)
+	case aggregate:
+		usage, captured = aggregateResponse(w, resp, apiKey, effective.Model, cost, capture)
+	default:
+		var werr error
+		usage, captured, werr = streamResponse(w, resp, apiKey, effective.Model, cost, capture, filter)
+		if werr != nil {
+			// 客户端已断开：立即取消上游请求并关闭响应体
+			cancelUpstream()
+			resp.Body.Close()
+			if cfg().DisconnectRefund && usage.OutputTokens == 0 {
+				refund()
+			}
+		}
 	}
 
-	for key, value := range headers {
-		req.Header.Set(key, value)
+	if key.OutputTokenBudget != nil && usage.OutputTokens > 0 {
+		if err := chargeOutputTokens(apiKey, usage.OutputTokens); err != nil {
+			logf(r.Context(), "Error charging output tokens to API key %s: %v", keyID(apiKey), err)
+		}
+	}
+	if captured != nil {
+		captureExchange(apiKey, reqBody, captured)
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	publishUsage(UsageEvent{
+		KeyID:        keyID(apiKey),
+		Model:        effective.Model,
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+		Status:       resp.StatusCode,
+		Timestamp:    time.Now(),
+	})
+}
+
+// APIKey is the per-key state loaded while authorizing a request.
+type APIKey struct {
+	Key            string
+	RemainingCalls int
+	CaptureOptOut  bool
+	// MaxTemperature and ForcedModel are optional guardrails for
+	// safety-restricted keys.
+	MaxTemperature *float64
+	ForcedModel    string
+	// AllowedCIDRs restricts the client IPs the key may be used from.
+	AllowedCIDRs []string
+	// AllowedEndpoints restricts the paths the key may call, all when empty.
+	AllowedEndpoints []string
+	// Tier selects the pricing applied to the key.
+	Tier string
+	// OutputTokenBudget is the total output tokens the key may still
+	// generate, nil when unlimited. It is charged after each stream ends, so
+	// the last request may overshoot it.
+	OutputTokenBudget *int64
+	// DailyLimit caps the requests per UTC day, nil when uncapped.
+	DailyLimit *int
+	// SystemPrompt is used for requests without a system prompt, ahead of
+	// DEFAULT_SYSTEM_PROMPT.
+	SystemPrompt string
+	// BrandName and SupportURL brand the key's 403 and 429 errors.
+	BrandName  string
+	SupportURL string
+	// MaxRequestDuration replaces the route timeout for the key's requests
+	// when set, shorter or longer.
+	MaxRequestDuration time.Duration
+	// MaxMessages and MaxInputTokens override MAX_MESSAGES and
+	// MAX_INPUT_TOKENS for the key when set; 0 lifts the cap.
+	MaxMessages    *int
+	MaxInputTokens *int
+	// Operator marks OPERATOR_KEY, which is neither looked up nor charged.
+	Operator bool
+}
+
+var (
+	errKeyNotFound      = errors.New("API key not found")
+	errNoRemainingCalls = errors.New("API key has no remaining calls")
+)
+
+// lookupAPIKey loads the key's state without consuming a call, so requests
+// rejected by per-key checks are never charged. Disabled and expired keys are
+// unknown; an exhausted key is returned together with errNoRemainingCalls.
+func lookupAPIKey(apiKey string) (*APIKey, error) {
+	key := &APIKey{Key: apiKey}
+	var (
+		maxTemperature    sql.NullFloat64
+		forcedModel       sql.NullString
+		outputTokenBudget sql.NullInt64
+		dailyLimit        sql.NullInt64
+		systemPrompt      sql.NullString
+		brandName         sql.NullString
+		supportURL        sql.NullString
+		maxDuration       sql.NullFloat64
+		maxMessages       sql.NullInt64
+		maxInputTokens    sql.NullInt64
+	)
+	err := db.QueryRow(`
+		SELECT remaining_calls, capture_opt_out, max_temperature, forced_model, allowed_cidrs, tier, output_token_budget, daily_limit, system_prompt, brand_name, support_url,
+			EXTRACT(EPOCH FROM max_request_duration), max_messages, max_input_tokens, allowed_endpoints
+		FROM api_keys WHERE key = $1 AND NOT disabled AND (expires_at IS NULL OR expires_at > now())`, apiKey).
+		Scan(&key.RemainingCalls, &key.CaptureOptOut, &maxTemperature, &forcedModel, pq.Array(&key.AllowedCIDRs), &key.Tier, &outputTokenBudget, &dailyLimit, &systemPrompt, &brandName, &supportURL, &maxDuration, &maxMessages, &maxInputTokens, pq.Array(&key.AllowedEndpoints))
+	if err == sql.ErrNoRows {
+		return nil, errKeyNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
+	if maxTemperature.Valid {
+		key.MaxTemperature = &maxTemperature.Float64
+	}
+	key.ForcedModel = forcedModel.String
+	key.SystemPrompt = systemPrompt.String
+	key.BrandName = brandName.String
+	key.SupportURL = supportURL.String
+	if maxDuration.Valid {
+		key.MaxRequestDuration = time.Duration(maxDuration.Float64 * float64(time.Second))
+	}
+	if outputTokenBudget.Valid {
+		key.OutputTokenBudget = &outputTokenBudget.Int64
+	}
+	if dailyLimit.Valid {
+		limit := int(dailyLimit.Int64)
+		key.DailyLimit = &limit
+	}
+	if maxMessages.Valid {
+		limit := int(maxMessages.Int64)
+		key.MaxMessages = &limit
+	}
+	if maxInputTokens.Valid {
+		limit := int(maxInputTokens.Int64)
+		key.MaxInputTokens = &limit
+	}
+	if key.RemainingCalls <= 0 {
+		return key, errNoRemainingCalls
+	}
+	return key, nil
+}
 
-	defer resp.Body.Close()
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// chargeOutputTokens deducts the tokens a finished request generated from the
+// key's output token budget, if it has one.
+func chargeOutputTokens(apiKey string, tokens int) error {
+	_, err := db.Exec(`
+		UPDATE api_keys SET output_token_budget = output_token_budget - $2
+		WHERE key = $1 AND output_token_budget IS NOT NULL`, apiKey, tokens)
+	return err
+}
+
+// refundAPIKey gives cost calls back to the key.
+func refundAPIKey(apiKey string, cost int) error {
+	_, err := db.Exec(`UPDATE api_keys SET remaining_calls = remaining_calls + $2 WHERE key = $1`, apiKey, cost)
+	return err
+}
+
+// decrementAPIKey atomically deducts cost calls from the key and returns the
+// balance left after the decrement.
+func decrementAPIKey(apiKey string, cost int) (int, error) {
+	var remainingCalls int
+	err := db.QueryRow(`
+		UPDATE api_keys SET remaining_calls = remaining_calls - $2
+		WHERE key = $1 AND remaining_calls >= $2
+		RETURNING remaining_calls`, apiKey, cost).Scan(&remainingCalls)
+	if err == sql.ErrNoRows {
+		// 余额不足以支付本次费用，或查询后被并发请求耗尽
+		return 0, errNoRemainingCalls
 	}
-	return &http.Response{
-		StatusCode: resp.StatusCode,
-		Body:       io.NopCloser(bytes.NewBuffer(respBody)),
-	}, nil
+	return remainingCalls, err
 }
 
 func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	if !dbReady.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Database not ready")
+		return
+	}
 	if err := db.Ping(); err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		fmt.Fprintf(w, "Database connection failed")
 		return
 	}
+	if !projects.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Access token unavailable")
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "OK")
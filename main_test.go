@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMain runs the tests with the configuration the environment gives, like
+// the gateway would, but without setup: tests bring up the state they use.
+func TestMain(m *testing.M) {
+	liveConfig.Store(loadConfig())
+	seedFlags()
+	dbReady.Store(true)
+	projects = &projectPool{projects: []*gcpProject{{ID: "test-project", weight: 1}}, total: 1}
+	os.Exit(m.Run())
+}
+
+// setConfig publishes a copy of the running configuration changed by edit
+// for the rest of the test.
+func setConfig(t *testing.T, edit func(c *Config)) {
+	t.Helper()
+	prev := cfg()
+	next := *prev
+	edit(&next)
+	liveConfig.Store(&next)
+	t.Cleanup(func() { liveConfig.Store(prev) })
+}
+
+// swap sets *p to v for the rest of the test.
+func swap[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	prev := *p
+	*p = v
+	t.Cleanup(func() { *p = prev })
+}
+
+// setFlag turns a feature flag on or off for the rest of the test.
+func setFlag(t *testing.T, name string, enabled bool) {
+	t.Helper()
+	prev := flags.Enabled(name)
+	if !flags.Set(name, enabled) {
+		t.Fatalf("unknown flag %s", name)
+	}
+	t.Cleanup(func() { flags.Set(name, prev) })
+}
+
+// fakeProvider sends requests to a test server, each region and model being
+// a path on it: /{region}/{model}.
+type fakeProvider struct {
+	url string
+}
+
+func (fakeProvider) Ready() bool { return true }
+
+func (p fakeProvider) BuildRequest(ctx context.Context, region, model string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/"+region+"/"+model, body)
+}
+
+func (fakeProvider) Authenticate(*http.Request) error { return nil }
+
+func (fakeProvider) StreamResponse(resp *http.Response) *http.Response { return resp }
+
+// fakeUpstream is a test server standing in for every provider. Its handler
+// receives the region and model from the path. No target is cooling down
+// from an earlier test.
+func fakeUpstream(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	swap(t, &newProvider, func(string) Provider { return fakeProvider{url: srv.URL} })
+	swap(t, &cooldowns, &cooldownTracker{until: make(map[string]time.Time)})
+	return srv
+}
+
+// upstreamRegion returns the region a request to a fakeUpstream went to.
+func upstreamRegion(r *http.Request) string {
+	region, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return region
+}
+
+// memAuthenticator keeps keys in memory, so handlers can be tested without
+// a database.
+type memAuthenticator struct {
+	mu   sync.Mutex
+	keys map[string]*APIKey
+}
+
+func newMemAuthenticator(keys ...*APIKey) *memAuthenticator {
+	a := &memAuthenticator{keys: make(map[string]*APIKey)}
+	for _, key := range keys {
+		a.keys[key.Key] = key
+	}
+	return a
+}
+
+func (a *memAuthenticator) Authenticate(_ context.Context, r *http.Request) (*APIKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key, ok := a.keys[r.Header.Get("x-api-key")]
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	copied := *key
+	if copied.RemainingCalls <= 0 {
+		return &copied, errNoRemainingCalls
+	}
+	return &copied, nil
+}
+
+func (a *memAuthenticator) Charge(_ context.Context, key *APIKey, cost int) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stored := a.keys[key.Key]
+	if stored.RemainingCalls < cost {
+		return 0, errNoRemainingCalls
+	}
+	stored.RemainingCalls -= cost
+	return stored.RemainingCalls, nil
+}
+
+func (a *memAuthenticator) Refund(_ context.Context, key *APIKey, cost int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys[key.Key].RemainingCalls += cost
+	return nil
+}
+
+// remaining returns the calls left on the key.
+func (a *memAuthenticator) remaining(apiKey string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.keys[apiKey].RemainingCalls
+}
+
+// useKeys authenticates requests against keys for the rest of the test.
+func useKeys(t *testing.T, keys ...*APIKey) *memAuthenticator {
+	t.Helper()
+	auth := newMemAuthenticator(keys...)
+	swap[Authenticator](t, &authenticator, auth)
+	return auth
+}
+
+// newMessagesRequest builds a Messages request authenticated with apiKey.
+func newMessagesRequest(apiKey, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+	return req
+}
+
+// sseTranscript is a complete upstream stream with 10 input and 5 output
+// tokens.
+const sseTranscript = "event: message_start\n" +
+	`data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude","content":[],"usage":{"input_tokens":10,"output_tokens":1}}}` + "\n\n" +
+	"event: content_block_start\n" +
+	`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}` + "\n\n" +
+	"event: content_block_delta\n" +
+	`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}` + "\n\n" +
+	"event: content_block_delta\n" +
+	`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" world"}}` + "\n\n" +
+	"event: content_block_stop\n" +
+	`data: {"type":"content_block_stop","index":0}` + "\n\n" +
+	"event: message_delta\n" +
+	`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}` + "\n\n" +
+	"event: message_stop\n" +
+	`data: {"type":"message_stop"}` + "\n\n"
+
+// streamSSE answers with body as an event stream.
+func streamSSE(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	io.WriteString(w, body)
+}
+
+// fakeQuery is a statement run against a fakeDB.
+type fakeQuery struct {
+	SQL  string
+	Args []driver.Value
+}
+
+// fakeResult answers a fakeQuery: rows for queries, the affected row count
+// for statements, or an error.
+type fakeResult struct {
+	Columns  []string
+	Rows     [][]driver.Value
+	Affected int64
+	Err      error
+}
+
+// fakeDB is a database/sql driver answering every statement with a handler
+// and recording what ran, for code paths that need a database but not its
+// semantics.
+type fakeDB struct {
+	mu      sync.Mutex
+	handler func(q fakeQuery) fakeResult
+	queries []fakeQuery
+	commits int
+}
+
+// openFakeDB returns a database answered by handler; a nil handler answers
+// every statement with no rows.
+func openFakeDB(t *testing.T, handler func(q fakeQuery) fakeResult) (*sql.DB, *fakeDB) {
+	t.Helper()
+	if handler == nil {
+		handler = func(fakeQuery) fakeResult { return fakeResult{} }
+	}
+	f := &fakeDB{handler: handler}
+	conn := sql.OpenDB(f)
+	t.Cleanup(func() { conn.Close() })
+	return conn, f
+}
+
+// useFakeDB installs a fakeDB as the gateway's database for the rest of the
+// test.
+func useFakeDB(t *testing.T, handler func(q fakeQuery) fakeResult) *fakeDB {
+	t.Helper()
+	conn, f := openFakeDB(t, handler)
+	swap(t, &db, conn)
+	return f
+}
+
+// ran returns the statements run so far.
+func (f *fakeDB) ran() []fakeQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeQuery(nil), f.queries...)
+}
+
+func (f *fakeDB) run(query string, args []driver.NamedValue) fakeResult {
+	q := fakeQuery{SQL: query}
+	for _, arg := range args {
+		q.Args = append(q.Args, arg.Value)
+	}
+	f.mu.Lock()
+	f.queries = append(f.queries, q)
+	f.mu.Unlock()
+	return f.handler(q)
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+
+func (f *fakeDB) Driver() driver.Driver { return nil }
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakeDB: prepared statements are not supported")
+}
+
+func (c fakeConn) Close() error { return nil }
+
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx(c), nil }
+
+func (c fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return fakeTx(c), nil
+}
+
+func (c fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res := c.db.run(query, args)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return &fakeRows{columns: res.Columns, rows: res.Rows}, nil
+}
+
+func (c fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res := c.db.run(query, args)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return driver.RowsAffected(res.Affected), nil
+}
+
+type fakeTx fakeConn
+
+func (tx fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.commits++
+	return nil
+}
+
+func (tx fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if r.columns == nil && len(r.rows) > 0 {
+		return make([]string, len(r.rows[0]))
+	}
+	return r.columns
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestServedModelAndRegionHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        APIKey
+		model      string // in the body
+		down       string // region answering 503
+		wantModel  string
+		wantRegion string
+	}{
+		{"default model", APIKey{}, "", "", "claude-default", "us-east5"},
+		{"model chosen in the body", APIKey{}, "claude-other", "", "claude-other", "us-east5"},
+		{"forced model", APIKey{ForcedModel: "claude-safe"}, "claude-other", "", "claude-safe", "us-east5"},
+		{"after a regional fallback", APIKey{}, "", "us-east5", "claude-default", "europe-west1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.DefaultModel = "claude-default"
+				c.AllowedModels = []string{"claude-other"}
+				c.Regions = []string{"us-east5", "europe-west1"}
+				c.ModelRegions = nil
+				c.VertexTargets = nil
+				c.ModelFailover = nil
+				c.FailoverCooldown = 0
+			})
+			key := tt.key
+			key.Key, key.RemainingCalls, key.Tier = "k", 10, defaultTier
+			useKeys(t, &key)
+			fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if upstreamRegion(r) == tt.down {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				streamSSE(w, sseTranscript)
+			})
+
+			body := `{"messages":[{"role":"user","content":"hi"}],"stream":true}`
+			if tt.model != "" {
+				body = `{"model":"` + tt.model + `","messages":[{"role":"user","content":"hi"}],"stream":true}`
+			}
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest("k", body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("X-Served-Model"); got != tt.wantModel {
+				t.Errorf("X-Served-Model = %q, want %q", got, tt.wantModel)
+			}
+			if got := w.Header().Get("X-Served-Region"); got != tt.wantRegion {
+				t.Errorf("X-Served-Region = %q, want %q", got, tt.wantRegion)
+			}
+		})
+	}
+}
+
+func TestOutputTokenBudget(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	budget := int64(7)
+	auth := useKeys(t,
+		&APIKey{Key: "budgeted", RemainingCalls: 10, Tier: defaultTier, OutputTokenBudget: &budget},
+		&APIKey{Key: "unlimited", RemainingCalls: 10, Tier: defaultTier},
+	)
+	// 结算语句把用掉的 token 从内存中的预算扣除
+	fake := useFakeDB(t, func(q fakeQuery) fakeResult {
+		if strings.Contains(q.SQL, "output_token_budget = output_token_budget -") && q.Args[0] == "budgeted" {
+			auth.mu.Lock()
+			*auth.keys["budgeted"].OutputTokenBudget -= q.Args[1].(int64)
+			auth.mu.Unlock()
+		}
+		return fakeResult{}
+	})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+
+	tests := []struct {
+		name       string
+		key        string
+		wantStatus int
+		wantBudget int64
+	}{
+		{"within the budget", "budgeted", http.StatusOK, 2},
+		{"budget left is smaller than the output", "budgeted", http.StatusOK, -3},
+		{"budget exhausted", "budgeted", http.StatusForbidden, -3},
+		{"key without a budget", "unlimited", http.StatusOK, -3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := auth.remaining(tt.key)
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest(tt.key, `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			auth.mu.Lock()
+			left := budget
+			auth.mu.Unlock()
+			if left != tt.wantBudget {
+				t.Errorf("budget %d, want %d", left, tt.wantBudget)
+			}
+			if tt.wantStatus == http.StatusForbidden && auth.remaining(tt.key) != before {
+				t.Error("rejected request was charged")
+			}
+		})
+	}
+	for _, q := range fake.ran() {
+		if strings.Contains(q.SQL, "output_token_budget") && q.Args[0] != "budgeted" {
+			t.Errorf("charged output tokens to %v", q.Args[0])
+		}
+	}
+}
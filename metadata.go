@@ -0,0 +1,30 @@
+package main
+
+import "encoding/json"
+
+// injectUserID sets metadata.user_id to a pseudonymous ID derived from the
+// API key so upstream abuse detection can tell end users apart. A user_id
+// supplied by the client is always preserved.
+func injectUserID(body []byte, apiKey string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]json.RawMessage)
+	if raw, ok := fields["metadata"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &metadata); err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := metadata["user_id"]; ok && string(raw) != "null" && string(raw) != `""` {
+		return body, nil
+	}
+
+	metadata["user_id"], _ = json.Marshal(keyID(apiKey))
+	var err error
+	if fields["metadata"], err = json.Marshal(metadata); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInjectUserID(t *testing.T) {
+	id := keyID("k")
+	tests := []struct {
+		name string
+		body string
+		want string // metadata.user_id after injection
+	}{
+		{"no metadata", `{"messages":[]}`, id},
+		{"null metadata", `{"messages":[],"metadata":null}`, id},
+		{"metadata without user_id", `{"messages":[],"metadata":{"trace":"t1"}}`, id},
+		{"empty user_id", `{"messages":[],"metadata":{"user_id":""}}`, id},
+		{"client user_id preserved", `{"messages":[],"metadata":{"user_id":"end-user-7"}}`, "end-user-7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := injectUserID([]byte(tt.body), "k")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var req struct {
+				Messages []json.RawMessage          `json:"messages"`
+				Metadata map[string]json.RawMessage `json:"metadata"`
+			}
+			if err := json.Unmarshal(out, &req); err != nil {
+				t.Fatal(err)
+			}
+			var userID string
+			json.Unmarshal(req.Metadata["user_id"], &userID)
+			if userID != tt.want || req.Messages == nil {
+				t.Errorf("body %s, want user_id %q", out, tt.want)
+			}
+			if _, ok := req.Metadata["trace"]; tt.name == "metadata without user_id" && !ok {
+				t.Errorf("other metadata dropped: %s", out)
+			}
+		})
+	}
+
+	if _, err := injectUserID([]byte(`{"metadata":"x"}`), "k"); err == nil {
+		t.Error("metadata that isn't an object accepted")
+	}
+}
+
+func TestUserIDInjectedUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		want    string
+	}{
+		{"enabled", true, keyID("k")},
+		{"disabled", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.Regions = []string{"us-east5"}
+				c.ModelRegions = nil
+				c.VertexTargets = nil
+			})
+			setFlag(t, flagInjectUserID, tt.enabled)
+			useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+			var got string
+			fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Metadata struct {
+						UserID string `json:"user_id"`
+					} `json:"metadata"`
+				}
+				body, _ := io.ReadAll(r.Body)
+				json.Unmarshal(body, &req)
+				got = req.Metadata.UserID
+				streamSSE(w, sseTranscript)
+			})
+
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got != tt.want {
+				t.Errorf("upstream user_id %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// handleMetrics exposes gateway state in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	if breaker != nil {
+		fmt.Fprintln(w, "# HELP llm_gateway_circuit_breaker_state Upstream circuit breaker state (0=closed, 1=open, 2=half-open).")
+		fmt.Fprintln(w, "# TYPE llm_gateway_circuit_breaker_state gauge")
+		fmt.Fprintf(w, "llm_gateway_circuit_breaker_state %d\n", breaker.State())
+	}
+
+	fmt.Fprintln(w, "# HELP llm_gateway_cooling_targets Model/region targets skipped after a recent failure.")
+	fmt.Fprintln(w, "# TYPE llm_gateway_cooling_targets gauge")
+	fmt.Fprintf(w, "llm_gateway_cooling_targets %d\n", cooldowns.Count())
+
+	if shedder != nil {
+		fmt.Fprintln(w, "# HELP llm_gateway_shed_rate Fraction of requests currently shed due to upstream latency.")
+		fmt.Fprintln(w, "# TYPE llm_gateway_shed_rate gauge")
+		fmt.Fprintf(w, "llm_gateway_shed_rate %g\n", shedder.Rate())
+	}
+
+	if admission != nil {
+		interactive, batch := admission.Waiting()
+		fmt.Fprintln(w, "# HELP llm_gateway_admission_waiting Requests queued for an upstream slot.")
+		fmt.Fprintln(w, "# TYPE llm_gateway_admission_waiting gauge")
+		fmt.Fprintf(w, "llm_gateway_admission_waiting{priority=%q} %d\n", priorityInteractive, interactive)
+		fmt.Fprintf(w, "llm_gateway_admission_waiting{priority=%q} %d\n", priorityBatch, batch)
+	}
+
+	if retries != nil {
+		fmt.Fprintln(w, "# HELP llm_gateway_retry_budget_tokens Retries currently available in the shared retry budget.")
+		fmt.Fprintln(w, "# TYPE llm_gateway_retry_budget_tokens gauge")
+		fmt.Fprintf(w, "llm_gateway_retry_budget_tokens %g\n", retries.Level())
+		fmt.Fprintln(w, "# HELP llm_gateway_retry_budget_denied_total Retries skipped because the retry budget was exhausted.")
+		fmt.Fprintln(w, "# TYPE llm_gateway_retry_budget_denied_total counter")
+		denied := retries.Denied()
+		for _, site := range []string{retrySiteFailover, retrySiteToken} {
+			fmt.Fprintf(w, "llm_gateway_retry_budget_denied_total{site=%q} %d\n", site, denied[site])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP llm_gateway_streams_truncated_total Streams ended because they exceeded MAX_STREAM_BYTES.")
+	fmt.Fprintln(w, "# TYPE llm_gateway_streams_truncated_total counter")
+	fmt.Fprintf(w, "llm_gateway_streams_truncated_total %d\n", streamsTruncated.Load())
+
+	names, counts := cacheJanitor.Evictions()
+	if len(names) > 0 {
+		fmt.Fprintln(w, "# HELP llm_gateway_janitor_evictions_total Expired entries removed from in-memory caches.")
+		fmt.Fprintln(w, "# TYPE llm_gateway_janitor_evictions_total counter")
+		for i, name := range names {
+			fmt.Fprintf(w, "llm_gateway_janitor_evictions_total{cache=%q} %d\n", name, counts[i])
+		}
+	}
+}
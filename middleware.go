@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// allowMethods rejects requests whose method is not in methods with a 405
+// and an Allow header listing the accepted methods.
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			respondError(w, r, &GatewayError{Code: codeInvalidRequest, Status: http.StatusMethodNotAllowed, Message: "Method not allowed"})
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		method, path string
+		wantAllow    string
+	}{
+		{http.MethodGet, "/v1/messages", "POST"},
+		{http.MethodGet, "/", "POST"},
+		{http.MethodPut, "/v1/messages", "POST"},
+		{http.MethodDelete, "/v1/chat/completions", "POST"},
+		{http.MethodPost, "/v1/pricing", "GET"},
+		{http.MethodPost, "/health", "GET, HEAD"},
+	}
+	mux := newRouter()
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("status %d, want 405", w.Code)
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if !strings.Contains(w.Body.String(), `"invalid_request_error"`) {
+				t.Errorf("body %s, want an invalid_request_error", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations is the ordered list of schema changes. Entries are applied once
+// and must never be edited or reordered; append new ones instead. The early
+// statements use IF NOT EXISTS because they predate the runner.
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		key TEXT PRIMARY KEY,
+		remaining_calls INTEGER NOT NULL
+	)`,
+	// 2: per-key capture opt-out
+	`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS capture_opt_out BOOLEAN NOT NULL DEFAULT FALSE`,
+	// 3: safety guardrails
+	`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS max_temperature DOUBLE PRECISION;
+	 ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS forced_model TEXT`,
+	// 4: per-request usage log, keyed by the hashed key ID
+	`CREATE TABLE usage_log (
+		id BIGSERIAL PRIMARY KEY,
+		key_id TEXT NOT NULL,
+		model TEXT NOT NULL,
+		input_tokens INTEGER NOT NULL,
+		output_tokens INTEGER NOT NULL,
+		status INTEGER NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX usage_log_key_id_created_at ON usage_log (key_id, created_at)`,
+	// 5: per-key client IP allowlist
+	`ALTER TABLE api_keys ADD COLUMN allowed_cidrs TEXT[]`,
+	// 6: pricing tier
+	`ALTER TABLE api_keys ADD COLUMN tier TEXT NOT NULL DEFAULT 'default'`,
+	// 7: total output token budget, NULL is unlimited
+	`ALTER TABLE api_keys ADD COLUMN output_token_budget BIGINT`,
+	// 8: runtime feature flag overrides
+	`CREATE TABLE feature_flags (
+		name TEXT PRIMARY KEY,
+		enabled BOOLEAN NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	// 9: per-key daily request caps
+	`ALTER TABLE api_keys ADD COLUMN daily_limit INTEGER;
+	CREATE TABLE daily_usage (
+		key TEXT NOT NULL,
+		day DATE NOT NULL,
+		requests INTEGER NOT NULL,
+		PRIMARY KEY (key, day)
+	)`,
+	// 10: per-key system prompt used when the client sends none
+	`ALTER TABLE api_keys ADD COLUMN system_prompt TEXT`,
+	// 11: reseller branding on quota and access errors
+	`ALTER TABLE api_keys ADD COLUMN brand_name TEXT;
+	ALTER TABLE api_keys ADD COLUMN support_url TEXT`,
+	// 12: per-key request deadline replacing the route timeout
+	`ALTER TABLE api_keys ADD COLUMN max_request_duration INTERVAL`,
+	// 13: per-key caps on conversation length
+	`ALTER TABLE api_keys ADD COLUMN max_messages INTEGER;
+	ALTER TABLE api_keys ADD COLUMN max_input_tokens INTEGER`,
+	// 14: per-key endpoint scoping
+	`ALTER TABLE api_keys ADD COLUMN allowed_endpoints TEXT[]`,
+	// 15: models allowed through the admin API
+	`CREATE TABLE allowed_models (
+		model TEXT PRIMARY KEY,
+		added_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	// 16: model aliases set through the admin API
+	`CREATE TABLE model_aliases (
+		alias TEXT PRIMARY KEY,
+		provider TEXT NOT NULL DEFAULT '',
+		model TEXT NOT NULL,
+		regions TEXT[] NOT NULL DEFAULT '{}',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	// 17: start of the usage counted in a key's totals, set by a reset
+	`ALTER TABLE api_keys ADD COLUMN usage_reset_at TIMESTAMPTZ`,
+	// 18: disabling and expiring keys
+	`ALTER TABLE api_keys ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE api_keys ADD COLUMN expires_at TIMESTAMPTZ`,
+	// 19: key IDs (see keyID) for addressing keys in admin routes
+	`CREATE FUNCTION api_key_id(key TEXT) RETURNS TEXT IMMUTABLE LANGUAGE sql
+		AS $$ SELECT left(encode(sha256(convert_to(key, 'UTF8')), 'hex'), 16) $$;
+	ALTER TABLE api_keys ADD COLUMN key_id TEXT GENERATED ALWAYS AS (api_key_id(key)) STORED;
+	CREATE UNIQUE INDEX api_keys_key_id ON api_keys (key_id)`,
+}
+
+// runMigrations applies pending migrations in a single transaction. An
+// advisory lock serializes concurrent gateway instances starting together.
+func runMigrations(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('llm_gateway_migrations'))`); err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			return fmt.Errorf("applying migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			return fmt.Errorf("recording migration %d: %w", version, err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// schemaVersions answers the runner's statements like a database whose
+// schema_migrations holds the versions applied so far; failAt makes that
+// migration fail.
+type schemaVersions struct {
+	mu       sync.Mutex
+	applied  []int
+	migrated int // migration statements run
+	failAt   int
+}
+
+func (s *schemaVersions) handle(q fakeQuery) fakeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.Contains(q.SQL, "MAX(version)"):
+		return fakeResult{Columns: []string{"max"}, Rows: [][]driver.Value{{int64(len(s.applied))}}}
+	case strings.HasPrefix(q.SQL, "INSERT INTO schema_migrations"):
+		s.applied = append(s.applied, int(q.Args[0].(int64)))
+	case strings.Contains(q.SQL, "pg_advisory_xact_lock"), strings.Contains(q.SQL, "CREATE TABLE IF NOT EXISTS schema_migrations"):
+	default:
+		s.migrated++
+		if s.migrated == s.failAt {
+			return fakeResult{Err: errors.New("syntax error")}
+		}
+	}
+	return fakeResult{}
+}
+
+func TestRunMigrations(t *testing.T) {
+	t.Run("applies every migration once", func(t *testing.T) {
+		versions := &schemaVersions{}
+		conn, fake := openFakeDB(t, versions.handle)
+		for run := 1; run <= 2; run++ {
+			if err := runMigrations(conn); err != nil {
+				t.Fatalf("run %d: %v", run, err)
+			}
+		}
+		if versions.migrated != len(migrations) {
+			t.Errorf("ran %d migrations over two runs, want %d", versions.migrated, len(migrations))
+		}
+		for i, v := range versions.applied {
+			if v != i+1 {
+				t.Fatalf("recorded versions %v, want 1..%d in order", versions.applied, len(migrations))
+			}
+		}
+		if fake.commits != 2 {
+			t.Errorf("%d commits, want one per run", fake.commits)
+		}
+	})
+
+	t.Run("resumes after the current version", func(t *testing.T) {
+		versions := &schemaVersions{applied: []int{1, 2, 3}}
+		conn, _ := openFakeDB(t, versions.handle)
+		if err := runMigrations(conn); err != nil {
+			t.Fatal(err)
+		}
+		if versions.migrated != len(migrations)-3 {
+			t.Errorf("ran %d migrations, want %d", versions.migrated, len(migrations)-3)
+		}
+	})
+
+	t.Run("failed migration isn't committed", func(t *testing.T) {
+		versions := &schemaVersions{failAt: 2}
+		conn, fake := openFakeDB(t, versions.handle)
+		err := runMigrations(conn)
+		if err == nil || !strings.Contains(err.Error(), "applying migration 2") {
+			t.Errorf("err = %v, want migration 2 to fail", err)
+		}
+		if fake.commits != 0 {
+			t.Error("failed migrations were committed")
+		}
+	})
+}
+
+// TestMigrationsPostgres applies the migrations to the database at
+// TEST_DATABASE_URL, in a schema of its own that is dropped afterwards.
+func TestMigrationsPostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	schema := fmt.Sprintf("test_migrations_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+	conn, err := sql.Open("postgres", dsn+" search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for run := 1; run <= 2; run++ {
+		if err := runMigrations(conn); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+	var version, count int
+	if err := conn.QueryRow(`SELECT MAX(version), COUNT(*) FROM schema_migrations`).Scan(&version, &count); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) || count != len(migrations) {
+		t.Errorf("schema at version %d with %d rows, want %d", version, count, len(migrations))
+	}
+}
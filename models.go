@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// modelAllowlist holds the models admins allowed through the API. They are
+// stored in the allowed_models table, which every instance re-reads
+// periodically like the feature flags, and add to ALLOWED_MODELS.
+type modelAllowlist struct {
+	mu     sync.RWMutex
+	models []string
+}
+
+var storedModels = &modelAllowlist{}
+
+// Models returns the stored models, sorted.
+func (l *modelAllowlist) Models() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.models
+}
+
+func (l *modelAllowlist) set(models []string) {
+	slices.Sort(models)
+	l.mu.Lock()
+	l.models = models
+	l.mu.Unlock()
+}
+
+// Load replaces the models with the contents of the allowed_models table.
+func (l *modelAllowlist) Load(db *sql.DB) error {
+	rows, err := db.Query(`SELECT model FROM allowed_models`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	models := []string{}
+	for rows.Next() {
+		var m string
+		if err := rows.Scan(&m); err != nil {
+			return err
+		}
+		models = append(models, m)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	l.set(models)
+	return nil
+}
+
+// Run reloads the table on every tick until ctx is cancelled, so changes
+// made on another instance take effect here too. A zero interval disables
+// reloading.
+func (l *modelAllowlist) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !dbReady.Load() {
+				continue
+			}
+			if err := l.Load(db); err != nil {
+				log.Printf("Error loading allowed models: %v", err)
+			}
+		}
+	}
+}
+
+// allowedModels lists the models requests may select besides DEFAULT_MODEL:
+// ALLOWED_MODELS plus the models added through the admin API, and the model
+// aliases.
+func allowedModels() []string {
+	models := slices.Clone(cfg().AllowedModels)
+	for _, m := range slices.Concat(storedModels.Models(), aliasNames()) {
+		if !slices.Contains(models, m) {
+			models = append(models, m)
+		}
+	}
+	return models
+}
+
+type allowedModelsResponse struct {
+	Default string `json:"default"`
+	// Configured come from ALLOWED_MODELS and can only change with the
+	// configuration; Stored were added through the API.
+	Configured []string `json:"configured"`
+	Stored     []string `json:"stored"`
+}
+
+// handleListAllowedModels returns the models requests may select.
+func handleListAllowedModels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, allowedModelsResponse{
+		Default:    cfg().DefaultModel,
+		Configured: append([]string{}, cfg().AllowedModels...),
+		Stored:     append([]string{}, storedModels.Models()...),
+	})
+}
+
+// handleAllowedModel adds the model with PUT and removes it with DELETE.
+func handleAllowedModel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		handleDisallowModel(w, r)
+		return
+	}
+	handleAllowModel(w, r)
+}
+
+// handleAllowModel adds a model to the stored allowlist.
+func handleAllowModel(w http.ResponseWriter, r *http.Request) {
+	m := r.PathValue("model")
+	if !vertexModelPattern.MatchString(m) {
+		respondError(w, r, invalidRequest("Invalid model ID "+m))
+		return
+	}
+	_, err := db.ExecContext(r.Context(), `INSERT INTO allowed_models (model) VALUES ($1) ON CONFLICT (model) DO NOTHING`, m)
+	if err != nil {
+		respondError(w, r, internalError("Failed to store allowed model", fmt.Errorf("model %s: %w", m, err)))
+		return
+	}
+	if err := storedModels.Load(db); err != nil {
+		log.Printf("Error loading allowed models: %v", err)
+	}
+	log.Printf("Model %s allowed", m)
+	handleListAllowedModels(w, r)
+}
+
+// handleDisallowModel removes a model from the stored allowlist. Models from
+// ALLOWED_MODELS can't be removed this way.
+func handleDisallowModel(w http.ResponseWriter, r *http.Request) {
+	m := r.PathValue("model")
+	res, err := db.ExecContext(r.Context(), `DELETE FROM allowed_models WHERE model = $1`, m)
+	if err != nil {
+		respondError(w, r, internalError("Failed to remove allowed model", fmt.Errorf("model %s: %w", m, err)))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondError(w, r, notFound("Model is not in the stored allowlist"))
+		return
+	}
+	if err := storedModels.Load(db); err != nil {
+		log.Printf("Error loading allowed models: %v", err)
+	}
+	log.Printf("Model %s disallowed", m)
+	handleListAllowedModels(w, r)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAllowedModelsAPI(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-default"
+		c.AllowedModels = []string{"claude-a"}
+		c.ModelAliases = nil
+	})
+	swap(t, &storedModels, &modelAllowlist{})
+	var (
+		mu     sync.Mutex
+		stored = map[string]bool{}
+	)
+	useFakeDB(t, func(q fakeQuery) fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(q.SQL, "INSERT INTO allowed_models"):
+			stored[q.Args[0].(string)] = true
+		case strings.HasPrefix(q.SQL, "DELETE FROM allowed_models"):
+			if !stored[q.Args[0].(string)] {
+				return fakeResult{}
+			}
+			delete(stored, q.Args[0].(string))
+			return fakeResult{Affected: 1}
+		case strings.HasPrefix(q.SQL, "SELECT model FROM allowed_models"):
+			res := fakeResult{Columns: []string{"model"}}
+			for m := range stored {
+				res.Rows = append(res.Rows, []driver.Value{m})
+			}
+			return res
+		}
+		return fakeResult{}
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		model      string
+		wantStatus int
+		wantStored []string
+	}{
+		{"add", http.MethodPut, "claude-c", http.StatusOK, []string{"claude-c"}},
+		{"add another", http.MethodPut, "claude-b@20250101", http.StatusOK, []string{"claude-b@20250101", "claude-c"}},
+		{"add twice", http.MethodPut, "claude-c", http.StatusOK, []string{"claude-b@20250101", "claude-c"}},
+		{"invalid model ID", http.MethodPut, "claude c", http.StatusBadRequest, []string{"claude-b@20250101", "claude-c"}},
+		{"remove", http.MethodDelete, "claude-c", http.StatusOK, []string{"claude-b@20250101"}},
+		{"remove a configured model", http.MethodDelete, "claude-a", http.StatusNotFound, []string{"claude-b@20250101"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/allowed-models/"+url.PathEscape(tt.model), nil)
+			r.SetPathValue("model", tt.model)
+			w := httptest.NewRecorder()
+			handleAllowedModel(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := storedModels.Models(); !slices.Equal(got, tt.wantStored) {
+				t.Errorf("stored models %v, want %v", got, tt.wantStored)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var resp allowedModelsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Default != "claude-default" || !slices.Equal(resp.Configured, []string{"claude-a"}) || !slices.Equal(resp.Stored, tt.wantStored) {
+				t.Errorf("response %+v", resp)
+			}
+		})
+	}
+
+	// 存储的模型可被请求选择，与 ALLOWED_MODELS 一样
+	for model, want := range map[string]bool{"claude-a": true, "claude-b@20250101": true, "claude-c": false} {
+		if _, err := selectModel(&APIKey{}, []byte(`{"model":"`+model+`"}`)); (err == nil) != want {
+			t.Errorf("selecting %s: err = %v, want allowed %v", model, err, want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxMultiModels caps the models a single /v1/multi request fans out to.
+const maxMultiModels = 8
+
+type multiRequest struct {
+	// Models are the Vertex model IDs the request is sent to.
+	Models []string `json:"models"`
+	// Request is a Messages API body; streaming is turned off.
+	Request json.RawMessage `json:"request"`
+}
+
+type multiResult struct {
+	Model     string          `json:"model"`
+	Status    int             `json:"status"`
+	Region    string          `json:"region,omitempty"`
+	LatencyMS int64           `json:"latency_ms"`
+	Response  json.RawMessage `json:"response,omitempty"`
+	Error     *multiError     `json:"error,omitempty"`
+}
+
+type multiError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type multiResponse struct {
+	Results   []multiResult `json:"results"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+}
+
+// handleMulti sends one Messages request to several models in parallel and
+// returns every model's response in request order. A model that fails is
+// reported in its own result instead of failing the batch, and only
+// successful calls are charged: each model costs what a single request to it
+// would, deducted before the call and refunded when it doesn't succeed. The
+// request counts once towards the RPM and daily limits.
+func handleMulti(w http.ResponseWriter, r *http.Request) {
+	if !checkAuthLockout(w, r) {
+		return
+	}
+	apiKey := r.Header.Get("x-api-key")
+	if apiKey == "" {
+		respondError(w, r, errAPIKeyRequired)
+		return
+	}
+
+	if !prepareRequestBody(w, r) {
+		return
+	}
+	var req multiRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, r, bodyError(err))
+		return
+	}
+	if len(req.Models) == 0 || len(req.Request) == 0 {
+		respondError(w, r, invalidRequest(`body must be {"models": ["..."], "request": {...}}`))
+		return
+	}
+	if len(req.Models) > maxMultiModels {
+		respondError(w, r, invalidRequest(fmt.Sprintf("at most %d models can be requested at once", maxMultiModels)))
+		return
+	}
+	if validationEnabled() {
+		if err := validateRequest(req.Request); err != nil {
+			respondError(w, r, invalidRequest(err.Error()))
+			return
+		}
+	}
+
+	key, err := authenticator.Authenticate(r.Context(), r)
+	if errors.Is(err, errNoRemainingCalls) {
+		respondKeyError(w, r, key, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, authFailure(r, apiKey, err))
+		return
+	}
+
+	// 上游延迟超出 SLO 时按比例丢弃请求，高等级的密钥按权重少丢，不消耗额度
+	if shedder != nil && shedder.ShouldShed(key.Tier) {
+		respondKeyError(w, r, key, overloaded("Gateway is overloaded, please retry later"))
+		return
+	}
+	if key.MaxRequestDuration > 0 {
+		ctx, cancel := overrideRouteTimeout(r, key.MaxRequestDuration)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	if key.ForcedModel != "" {
+		respondKeyError(w, r, key, permissionDenied("API key is restricted to model "+key.ForcedModel))
+		return
+	}
+	if key.OutputTokenBudget != nil && *key.OutputTokenBudget <= 0 {
+		respondKeyError(w, r, key, permissionDenied("API key has exhausted its output token budget"))
+		return
+	}
+	if !ipAllowed(clientIP(r), key.AllowedCIDRs) {
+		respondKeyError(w, r, key, errKeyIPNotAllowed)
+		return
+	}
+	if err := validateRequestSize(req.Request, requestLimitsFor(key)); err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+
+	if inflight != nil {
+		if !inflight.Acquire(apiKey) {
+			respondKeyError(w, r, key, rateLimited("Too many concurrent requests for this API key"))
+			return
+		}
+		defer inflight.Release(apiKey)
+	}
+	keyLimiter := limiter
+	if key.Operator {
+		keyLimiter = operatorLimiter
+	}
+	if keyLimiter != nil {
+		remaining, reset, ok := keyLimiter.Allow(apiKey)
+		setRateLimitHeaders(w, rateLimitInfo{Limit: keyLimiter.limit, Remaining: remaining, Reset: reset})
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+			respondKeyError(w, r, key, errRateLimitExceeded)
+			return
+		}
+	}
+	var usedDay string
+	if key.DailyLimit != nil {
+		day, ok, err := takeDailyUsage(apiKey, *key.DailyLimit)
+		if err != nil {
+			respondError(w, r, errQuotaUpdateFailed.withDetail(fmt.Errorf("daily usage of key %s: %w", keyID(apiKey), err)))
+			return
+		}
+		if !ok {
+			w.Header().Set("Retry-After", dailyRetryAfter())
+			respondKeyError(w, r, key, rateLimited("Daily request limit reached for this API key"))
+			return
+		}
+		usedDay = day
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json; charset=utf-8",
+		"X-Request-Id": requestIDFor(r),
+	}
+
+	// 各模型并行请求，每个 goroutine 只写入自己的结果位置；单个模型失败不影响其他模型
+	prio := parsePriority(r.Header.Get("X-Priority"))
+	out := multiResponse{Results: make([]multiResult, len(req.Models))}
+	var wg sync.WaitGroup
+	for i, m := range req.Models {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out.Results[i] = callModel(r.Context(), key, headers, prio, m, req.Request)
+		}()
+	}
+	wg.Wait()
+	for _, res := range out.Results {
+		if res.Error == nil {
+			out.Succeeded++
+		}
+	}
+	out.Failed = len(out.Results) - out.Succeeded
+
+	if out.Succeeded == 0 && usedDay != "" {
+		// 全部失败的请求不计入当日用量
+		if err := returnDailyUsage(apiKey, usedDay); err != nil {
+			logf(r.Context(), "Error updating daily usage of API key %s: %v", keyID(apiKey), err)
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// callModel sends body to one model through the regular request pipeline
+// (default system prompt, transformers, guardrails and regional failover)
+// and charges key for it when the upstream answers with a 200.
+func callModel(ctx context.Context, key *APIKey, headers map[string]string, prio priority, m string, body []byte) multiResult {
+	result := multiResult{Model: m}
+	fail := func(err error) multiResult {
+		ge := asGatewayError(err)
+		if ge.Detail != nil {
+			logf(ctx, "Multi request to %s: %s: %v", m, ge.Message, ge.Detail)
+		}
+		result.Status = ge.Status
+		result.Error = &multiError{Type: ge.Code, Message: ge.Message}
+		return result
+	}
+
+	if !modelAllowed(m) {
+		return fail(invalidRequest(errModelNotAllowed(m).Error()))
+	}
+	regions, err := regionsForModel(m)
+	if err != nil {
+		return fail(invalidRequest(err.Error()))
+	}
+	// 以强制模型的方式让模型级默认参数与模型替换按目标模型生效
+	modelKey := *key
+	modelKey.ForcedModel = m
+	upstreamBody, err := applyDefaultSystemPrompt(body, &modelKey)
+	if err == nil {
+		upstreamBody, err = transformRequest(upstreamBody, &modelKey)
+	}
+	if err == nil {
+		upstreamBody, _, err = applyGuardrails(upstreamBody, &modelKey)
+	}
+	if err == nil && flags.Enabled(flagInjectUserID) {
+		upstreamBody, err = injectUserID(upstreamBody, key.Key)
+	}
+	if err == nil {
+		upstreamBody, err = disableStreaming(upstreamBody)
+	}
+	if err != nil {
+		return fail(invalidRequest(err.Error()))
+	}
+
+	p := newProvider(m)
+	if !p.Ready() {
+		return fail(errCredentialsUnavailable)
+	}
+	if breaker != nil && !breaker.Allow() {
+		return fail(overloaded("Upstream is unavailable, please retry later"))
+	}
+	if admission != nil {
+		actx, cancel := context.WithTimeout(ctx, cfg().AdmissionTimeout)
+		err := admission.Acquire(actx, prio)
+		cancel()
+		if err != nil {
+			return fail(overloaded("Gateway is at capacity, please retry later"))
+		}
+		defer admission.Release()
+	}
+
+	cost := modelCost(key.Tier, m)
+	if _, err := authenticator.Charge(ctx, key, cost); err != nil {
+		if errors.Is(err, errNoRemainingCalls) {
+			return fail(err)
+		}
+		return fail(errQuotaUpdateFailed.withDetail(fmt.Errorf("decrementing key %s: %w", keyID(key.Key), err)))
+	}
+	charged := false
+	defer func() {
+		if charged {
+			return
+		}
+		if err := authenticator.Refund(context.Background(), key, cost); err != nil {
+			logf(ctx, "Error refunding API key %s: %v", keyID(key.Key), err)
+		}
+	}()
+
+	start := time.Now()
+	resp, served, err := forwardWithFailover(ctx, p, targetBalance.Order(regions, m, stickyKey(key, upstreamBody)), m, headers, upstreamBody)
+	result.Region = servedRegion(served.region)
+	result.LatencyMS = time.Since(start).Milliseconds()
+	if shedder != nil && (err == nil || errors.Is(err, context.DeadlineExceeded)) {
+		shedder.Record(time.Since(start))
+	}
+	if breaker != nil && !errors.Is(err, errUpstreamBusy) && !errors.Is(err, context.Canceled) && !errors.As(err, new(*GatewayError)) {
+		breaker.Record(!isRegionFailure(resp, err))
+	}
+	switch {
+	case errors.As(err, new(*GatewayError)):
+		return fail(err)
+	case errors.Is(err, errUpstreamBusy):
+		return fail(rateLimited("Upstream rate limit nearly exhausted, please retry later"))
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return fail(timedOut("Upstream request timed out").withDetail(err))
+	case err != nil:
+		return fail(upstreamFailure("Upstream request failed", err))
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	result.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		return fail(upstreamFailure("Failed to read upstream response", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		result.Status = resp.StatusCode
+		code := codeAPI
+		switch resp.StatusCode {
+		case http.StatusBadRequest:
+			code = codeInvalidRequest
+		case http.StatusTooManyRequests:
+			code = codeRateLimit
+		}
+		result.Error = &multiError{Type: code, Message: upstreamErrorMessage(respBody)}
+		return result
+	}
+	if !json.Valid(respBody) {
+		return fail(upstreamFailure("Upstream returned an invalid response", fmt.Errorf("%d bytes of %s", len(respBody), resp.Header.Get("Content-Type"))))
+	}
+	charged = true
+	result.Status = resp.StatusCode
+	result.Response = transformMessage(respBody)
+
+	var usage usageTracker
+	usage.observeMessage(respBody)
+	if key.OutputTokenBudget != nil && usage.OutputTokens > 0 {
+		if err := chargeOutputTokens(key.Key, usage.OutputTokens); err != nil {
+			logf(ctx, "Error charging output tokens to API key %s: %v", keyID(key.Key), err)
+		}
+	}
+	publishUsage(UsageEvent{
+		KeyID:        keyID(key.Key),
+		Model:        m,
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+		Status:       resp.StatusCode,
+		Timestamp:    time.Now(),
+	})
+	return result
+}
+
+// disableStreaming sets "stream": false, since /v1/multi returns complete
+// messages.
+func disableStreaming(body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("invalid request body: %v", err)
+	}
+	fields["stream"] = json.RawMessage("false")
+	return json.Marshal(fields)
+}
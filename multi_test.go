@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHandleMulti(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.ModelFailover = nil
+		c.AllowedModels = []string{"claude-a", "claude-b", "claude-overloaded", "claude-invalid"}
+	})
+	swap(t, &storedModels, &modelAllowlist{})
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	var (
+		mu     sync.Mutex
+		called []string
+	)
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Stream *bool }
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Stream == nil || *body.Stream {
+			t.Error("multi request forwarded without stream: false")
+		}
+		model := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		mu.Lock()
+		called = append(called, model)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch model {
+		case "claude-overloaded":
+			w.WriteHeader(529)
+			io.WriteString(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+		case "claude-invalid":
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: too large"}}`)
+		default:
+			io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","model":"`+model+`","content":[{"type":"text","text":"hi from `+model+`"}],"usage":{"input_tokens":3,"output_tokens":4}}`)
+		}
+	})
+
+	body := `{"models":["claude-a","claude-overloaded","claude-b","claude-unknown","claude-invalid"],"request":{"messages":[{"role":"user","content":"hi"}],"stream":true}}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/multi", strings.NewReader(body))
+	r.Header.Set("x-api-key", "k")
+	w := httptest.NewRecorder()
+	handleMulti(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp multiResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		model     string
+		status    int
+		errorType string
+		text      string
+	}{
+		{"claude-a", http.StatusOK, "", "hi from claude-a"},
+		{"claude-overloaded", 529, codeAPI, ""},
+		{"claude-b", http.StatusOK, "", "hi from claude-b"},
+		{"claude-unknown", http.StatusBadRequest, codeInvalidRequest, ""},
+		{"claude-invalid", http.StatusBadRequest, codeInvalidRequest, ""},
+	}
+	if len(resp.Results) != len(want) || resp.Succeeded != 2 || resp.Failed != 3 {
+		t.Fatalf("got %d results, %d succeeded, %d failed: %s", len(resp.Results), resp.Succeeded, resp.Failed, w.Body)
+	}
+	for i, tt := range want {
+		res := resp.Results[i]
+		if res.Model != tt.model || res.Status != tt.status {
+			t.Errorf("result %d: %s %d, want %s %d", i, res.Model, res.Status, tt.model, tt.status)
+		}
+		if tt.errorType == "" {
+			if res.Error != nil || !strings.Contains(string(res.Response), tt.text) {
+				t.Errorf("%s: error %v, response %s", tt.model, res.Error, res.Response)
+			}
+			continue
+		}
+		if res.Error == nil || res.Error.Type != tt.errorType || res.Response != nil {
+			t.Errorf("%s: error %+v, response %s, want a %s", tt.model, res.Error, res.Response, tt.errorType)
+		}
+	}
+	if res := resp.Results[4]; res.Error != nil && res.Error.Message != "max_tokens: too large" {
+		t.Errorf("upstream error message %q not passed on", res.Error.Message)
+	}
+	// 未允许的模型不发往上游；只有成功的调用扣减额度
+	if len(called) != 4 {
+		t.Errorf("upstream called for %v", called)
+	}
+	if got := auth.remaining("k"); got != 8 {
+		t.Errorf("%d calls left, want 8 after two successful models", got)
+	}
+}
+
+func TestHandleMultiRejectsBadRequests(t *testing.T) {
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("invalid multi request reached the upstream")
+	})
+	tests := []struct {
+		name       string
+		key        string
+		body       string
+		wantStatus int
+	}{
+		{"no models", "k", `{"models":[],"request":{"messages":[]}}`, http.StatusBadRequest},
+		{"no request", "k", `{"models":["claude-a"]}`, http.StatusBadRequest},
+		{"too many models", "k", `{"models":["a","b","c","d","e","f","g","h","i"],"request":{"messages":[]}}`, http.StatusBadRequest},
+		{"malformed body", "k", `{"models":`, http.StatusBadRequest},
+		{"no key", "", `{"models":["claude-a"],"request":{"messages":[]}}`, http.StatusUnauthorized},
+		{"unknown key", "nope", `{"models":["claude-a"],"request":{"messages":[]}}`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/v1/multi", strings.NewReader(tt.body))
+		if tt.key != "" {
+			r.Header.Set("x-api-key", tt.key)
+		}
+		w := httptest.NewRecorder()
+		handleMulti(w, r)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.wantStatus, w.Body)
+		}
+	}
+	if got := auth.remaining("k"); got != 10 {
+		t.Errorf("%d calls left, want rejected requests free", got)
+	}
+}
+
+func TestHandleMultiWithoutAllowlist(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-default"
+		c.AllowedModels = nil
+		c.ModelAliases = nil
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.ModelFailover = nil
+	})
+	swap(t, &storedModels, &modelAllowlist{})
+	swap(t, &modelAliases, &modelAliasTable{})
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	var (
+		mu     sync.Mutex
+		called []string
+	)
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		called = append(called, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"hi"}],"usage":{"input_tokens":3,"output_tokens":4}}`)
+	})
+
+	// 没有允许列表时只能使用默认模型，任意名称不会拼进上游 URL
+	body := `{"models":["claude-default","x/../../y","claude-other:rawPredict?alt=sse"],"request":{"messages":[{"role":"user","content":"hi"}]}}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/multi", strings.NewReader(body))
+	r.Header.Set("x-api-key", "k")
+	w := httptest.NewRecorder()
+	handleMulti(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp multiResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Succeeded != 1 || resp.Failed != 2 {
+		t.Fatalf("%d succeeded, %d failed: %s", resp.Succeeded, resp.Failed, w.Body)
+	}
+	for _, res := range resp.Results[1:] {
+		if res.Status != http.StatusBadRequest || res.Error == nil || res.Error.Type != codeInvalidRequest {
+			t.Errorf("%s: status %d, error %+v, want an invalid_request_error", res.Model, res.Status, res.Error)
+		}
+	}
+	if len(called) != 1 || called[0] != "/us-east5/claude-default" {
+		t.Errorf("upstream called for %v", called)
+	}
+	if got := auth.remaining("k"); got != 9 {
+		t.Errorf("%d calls left, want 9", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsPublisher publishes usage events to a NATS subject using the core
+// text protocol. The connection is established lazily and re-dialed after
+// any failure.
+type natsPublisher struct {
+	addr    string
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newNATSPublisher(rawURL, subject string) (*natsPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing NATS URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("NATS URL has no host: %s", rawURL)
+	}
+	return &natsPublisher{addr: u.Host, subject: subject}, nil
+}
+
+func (p *natsPublisher) PublishUsage(event UsageEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\n", p.subject, len(payload), payload); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return fmt.Errorf("publishing to NATS: %w", err)
+	}
+	return nil
+}
+
+func (p *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("connecting to NATS: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	info, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return fmt.Errorf("reading NATS INFO: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if _, err := fmt.Fprint(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"llm-gateway\"}\r\n"); err != nil {
+		conn.Close()
+		return fmt.Errorf("sending NATS CONNECT: %w", err)
+	}
+	p.conn = conn
+	go p.keepAlive(conn, reader)
+	return nil
+}
+
+// keepAlive answers server PINGs so the connection isn't dropped as stale.
+func (p *natsPublisher) keepAlive(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			p.mu.Lock()
+			if p.conn == conn {
+				p.conn.Close()
+				p.conn = nil
+			}
+			p.mu.Unlock()
+			return
+		}
+		if strings.HasPrefix(line, "PING") {
+			p.mu.Lock()
+			fmt.Fprint(conn, "PONG\r\n")
+			p.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNATSPublisher(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type frame struct {
+		connect, pub, payload string
+	}
+	received := make(chan frame, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+		reader := bufio.NewReader(conn)
+		var f frame
+		f.connect, _ = reader.ReadString('\n')
+		f.pub, _ = reader.ReadString('\n')
+		f.payload, _ = reader.ReadString('\n')
+		received <- f
+	}()
+
+	p, err := newNATSPublisher("nats://"+ln.Addr().String(), "usage.events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := UsageEvent{KeyID: keyID("k"), Model: "claude", InputTokens: 10, OutputTokens: 5, Status: 200, Timestamp: time.Unix(1700000000, 0).UTC()}
+	if err := p.PublishUsage(event); err != nil {
+		t.Fatal(err)
+	}
+
+	var f frame
+	select {
+	case f = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message reached the server")
+	}
+	if !strings.HasPrefix(f.connect, "CONNECT {") {
+		t.Errorf("handshake %q, want CONNECT", f.connect)
+	}
+	payload := strings.TrimSuffix(f.payload, "\r\n")
+	if want := "PUB usage.events " + strconv.Itoa(len(payload)) + "\r\n"; f.pub != want {
+		t.Errorf("got %q, want %q", f.pub, want)
+	}
+	var got UsageEvent
+	if err := json.Unmarshal([]byte(payload), &got); err != nil || got != event {
+		t.Errorf("payload %s decodes to %+v (%v), want %+v", payload, got, err, event)
+	}
+}
+
+func TestNewNATSPublisherRejectsBadURLs(t *testing.T) {
+	for _, raw := range []string{"nats://", "://bad", "localhost:4222"} {
+		if _, err := newNATSPublisher(raw, "usage"); err == nil {
+			t.Errorf("newNATSPublisher(%q) succeeded", raw)
+		}
+	}
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultOpenAIMaxTokens is sent when an OpenAI request doesn't set
+// max_tokens, which the Messages API requires.
+const defaultOpenAIMaxTokens = 4096
+
+// vertexAnthropicVersion is the API version Vertex AI expects in the body.
+const vertexAnthropicVersion = "vertex-2023-10-16"
+
+type openAIChatRequest struct {
+	Model               string          `json:"model"`
+	Messages            []openAIMessage `json:"messages"`
+	MaxTokens           *int            `json:"max_tokens"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens"`
+	Temperature         *float64        `json:"temperature"`
+	TopP                *float64        `json:"top_p"`
+	Stop                json.RawMessage `json:"stop"`
+	N                   *int            `json:"n"`
+	Stream              bool            `json:"stream"`
+	StreamOptions       *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+	Tools      []openAITool    `json:"tools"`
+	ToolChoice json.RawMessage `json:"tool_choice"`
+	User       string          `json:"user"`
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    json.RawMessage  `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIToolCall struct {
+	// Index is only set in stream chunks.
+	Index    *int               `json:"index,omitempty"`
+	ID       string             `json:"id,omitempty"`
+	Type     string             `json:"type,omitempty"`
+	Function openAIFunctionCall `json:"function"`
+}
+
+type openAIFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+type openAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type openAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL struct {
+		URL string `json:"url"`
+	} `json:"image_url"`
+}
+
+// translateOpenAIRequest converts a chat completions request into a Messages
+// API body for Vertex AI. System and developer messages become the system
+// prompt, tool calls and results become tool_use and tool_result blocks, and
+// consecutive messages of the same role are merged. It also reports whether
+// a stream should end with a usage chunk.
+func translateOpenAIRequest(body []byte) ([]byte, bool, error) {
+	var req openAIChatRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, false, fmt.Errorf("invalid request body: %v", err)
+	}
+	if len(req.Messages) == 0 {
+		return nil, false, errors.New("messages: at least one message is required")
+	}
+	if req.N != nil && *req.N != 1 {
+		return nil, false, errors.New("n: only 1 is supported")
+	}
+
+	out := map[string]any{"anthropic_version": vertexAnthropicVersion}
+	// 只有可选的模型才写入请求体，其余（如 gpt-4o）使用网关默认模型
+	if req.Model != "" && len(allowedModels()) > 0 && modelAllowed(req.Model) {
+		out["model"] = req.Model
+	}
+
+	var (
+		system   []string
+		messages []map[string]any
+	)
+	appendBlocks := func(role string, blocks []map[string]any) {
+		if n := len(messages); n > 0 && messages[n-1]["role"] == role {
+			messages[n-1]["content"] = append(messages[n-1]["content"].([]map[string]any), blocks...)
+			return
+		}
+		messages = append(messages, map[string]any{"role": role, "content": blocks})
+	}
+	for i, m := range req.Messages {
+		blocks, err := openAIContentBlocks(m.Content)
+		if err != nil {
+			return nil, false, fmt.Errorf("messages[%d].content: %v", i, err)
+		}
+		switch m.Role {
+		case "system", "developer":
+			for _, b := range blocks {
+				if b["type"] != "text" {
+					return nil, false, fmt.Errorf("messages[%d].content: system messages can only contain text", i)
+				}
+				system = append(system, b["text"].(string))
+			}
+		case "user":
+			appendBlocks("user", blocks)
+		case "assistant":
+			for j, call := range m.ToolCalls {
+				input := json.RawMessage("{}")
+				if strings.TrimSpace(call.Function.Arguments) != "" {
+					input = json.RawMessage(call.Function.Arguments)
+				}
+				if !json.Valid(input) {
+					return nil, false, fmt.Errorf("messages[%d].tool_calls[%d].function.arguments: must be JSON", i, j)
+				}
+				blocks = append(blocks, map[string]any{"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": input})
+			}
+			appendBlocks("assistant", blocks)
+		case "tool":
+			result := map[string]any{"type": "tool_result", "tool_use_id": m.ToolCallID, "content": blocks}
+			appendBlocks("user", []map[string]any{result})
+		default:
+			return nil, false, fmt.Errorf("messages[%d].role: unsupported role %q", i, m.Role)
+		}
+	}
+	out["messages"] = messages
+	if len(system) > 0 {
+		out["system"] = strings.Join(system, "\n\n")
+	}
+
+	out["max_tokens"] = defaultOpenAIMaxTokens
+	if req.MaxCompletionTokens != nil {
+		out["max_tokens"] = *req.MaxCompletionTokens
+	} else if req.MaxTokens != nil {
+		out["max_tokens"] = *req.MaxTokens
+	}
+	if req.Temperature != nil {
+		// OpenAI 的温度范围为 0-2，Anthropic 为 0-1
+		out["temperature"] = min(*req.Temperature, 1)
+	}
+	if req.TopP != nil {
+		out["top_p"] = *req.TopP
+	}
+	if len(req.Stop) > 0 && string(req.Stop) != "null" {
+		var stop []string
+		if err := json.Unmarshal(req.Stop, &stop); err != nil {
+			var single string
+			if err := json.Unmarshal(req.Stop, &single); err != nil {
+				return nil, false, errors.New("stop: must be a string or an array of strings")
+			}
+			stop = []string{single}
+		}
+		out["stop_sequences"] = stop
+	}
+	if req.Stream {
+		out["stream"] = true
+	}
+	if req.User != "" {
+		out["metadata"] = map[string]string{"user_id": req.User}
+	}
+
+	if len(req.Tools) > 0 {
+		tools := make([]map[string]any, 0, len(req.Tools))
+		for i, t := range req.Tools {
+			if t.Type != "function" {
+				return nil, false, fmt.Errorf("tools[%d].type: only function tools are supported", i)
+			}
+			schema := t.Function.Parameters
+			if len(schema) == 0 {
+				schema = json.RawMessage(`{"type":"object","properties":{}}`)
+			}
+			tool := map[string]any{"name": t.Function.Name, "input_schema": schema}
+			if t.Function.Description != "" {
+				tool["description"] = t.Function.Description
+			}
+			tools = append(tools, tool)
+		}
+		out["tools"] = tools
+	}
+	if len(req.ToolChoice) > 0 && string(req.ToolChoice) != "null" {
+		choice, err := translateToolChoice(req.ToolChoice)
+		if err != nil {
+			return nil, false, err
+		}
+		if choice["type"] == "none" {
+			delete(out, "tools")
+		} else {
+			out["tool_choice"] = choice
+		}
+	}
+	body, err := json.Marshal(out)
+	return body, req.Stream && req.StreamOptions != nil && req.StreamOptions.IncludeUsage, err
+}
+
+// openAIContentBlocks converts message content, a string or an array of text
+// and image_url parts, into Messages API content blocks. Images given as
+// data URLs are sent inline, others by URL.
+func openAIContentBlocks(content json.RawMessage) ([]map[string]any, error) {
+	if len(content) == 0 || string(content) == "null" {
+		return []map[string]any{}, nil
+	}
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		if text == "" {
+			return []map[string]any{}, nil
+		}
+		return []map[string]any{{"type": "text", "text": text}}, nil
+	}
+	var parts []openAIContentPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return nil, errors.New("must be a string or an array of content parts")
+	}
+	blocks := make([]map[string]any, 0, len(parts))
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			blocks = append(blocks, map[string]any{"type": "text", "text": p.Text})
+		case "image_url":
+			source := map[string]string{"type": "url", "url": p.ImageURL.URL}
+			if meta, data, ok := strings.Cut(strings.TrimPrefix(p.ImageURL.URL, "data:"), ","); ok && strings.HasPrefix(p.ImageURL.URL, "data:") {
+				mediaType, isBase64 := strings.CutSuffix(meta, ";base64")
+				if !isBase64 {
+					return nil, errors.New("image data URLs must be base64 encoded")
+				}
+				source = map[string]string{"type": "base64", "media_type": mediaType, "data": data}
+			}
+			blocks = append(blocks, map[string]any{"type": "image", "source": source})
+		default:
+			return nil, fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+	}
+	return blocks, nil
+}
+
+// translateToolChoice maps "auto", "none", "required" and
+// {"type": "function", "function": {"name": ...}} to the Messages API.
+func translateToolChoice(raw json.RawMessage) (map[string]any, error) {
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil {
+		switch mode {
+		case "auto":
+			return map[string]any{"type": "auto"}, nil
+		case "none":
+			return map[string]any{"type": "none"}, nil
+		case "required":
+			return map[string]any{"type": "any"}, nil
+		}
+		return nil, fmt.Errorf("tool_choice: unsupported value %q", mode)
+	}
+	var named struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &named); err != nil || named.Function.Name == "" {
+		return nil, errors.New(`tool_choice: must be "auto", "none", "required" or a function`)
+	}
+	return map[string]any{"type": "tool", "name": named.Function.Name}, nil
+}
+
+// openAIFinishReason maps a Messages API stop_reason to a finish_reason.
+func openAIFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "":
+		return ""
+	default:
+		return "stop"
+	}
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func newOpenAIUsage(input, output int) *openAIUsage {
+	return &openAIUsage{PromptTokens: input, CompletionTokens: output, TotalTokens: input + output}
+}
+
+type openAIResponseMessage struct {
+	Role      string           `json:"role,omitempty"`
+	Content   *string          `json:"content,omitempty"`
+	ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
+}
+
+type openAIChoice struct {
+	Index        int                    `json:"index"`
+	Message      *openAIResponseMessage `json:"message,omitempty"`
+	Delta        *openAIResponseMessage `json:"delta,omitempty"`
+	FinishReason *string                `json:"finish_reason"`
+}
+
+type openAIResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage,omitempty"`
+}
+
+// translateAnthropicMessage converts a Messages API response into a chat
+// completion.
+func translateAnthropicMessage(body []byte, model string, created int64) ([]byte, error) {
+	var msg struct {
+		ID      string `json:"id"`
+		Content []struct {
+			Type  string          `json:"type"`
+			Text  string          `json:"text"`
+			ID    string          `json:"id"`
+			Name  string          `json:"name"`
+			Input json.RawMessage `json:"input"`
+		} `json:"content"`
+		StopReason string `json:"stop_reason"`
+		Usage      struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	var (
+		text  strings.Builder
+		calls []openAIToolCall
+	)
+	for _, block := range msg.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			calls = append(calls, openAIToolCall{ID: block.ID, Type: "function", Function: openAIFunctionCall{Name: block.Name, Arguments: string(block.Input)}})
+		}
+	}
+	message := &openAIResponseMessage{Role: "assistant", ToolCalls: calls}
+	if text.Len() > 0 || len(calls) == 0 {
+		s := text.String()
+		message.Content = &s
+	}
+	finish := openAIFinishReason(msg.StopReason)
+	return json.Marshal(openAIResponse{
+		ID:      msg.ID,
+		Object:  "chat.completion",
+		Created: created,
+		Model:   model,
+		Choices: []openAIChoice{{Message: message, FinishReason: &finish}},
+		Usage:   newOpenAIUsage(msg.Usage.InputTokens, msg.Usage.OutputTokens),
+	})
+}
+
+// openAIError renders an error body of the gateway or the upstream in the
+// OpenAI error shape.
+func openAIError(body []byte) []byte {
+	var resp struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &resp)
+	if resp.Error.Type == "" {
+		resp.Error.Type = codeAPI
+	}
+	out, _ := json.Marshal(map[string]any{"error": map[string]any{
+		"message": upstreamErrorMessage(body),
+		"type":    resp.Error.Type,
+		"code":    nil,
+	}})
+	return out
+}
+
+// openAIStream turns Messages API stream events into chat.completion.chunk
+// events, ending with data: [DONE].
+type openAIStream struct {
+	id, model    string
+	created      int64
+	includeUsage bool
+
+	// toolCalls maps content block indexes to tool call indexes.
+	toolCalls    map[int]int
+	inputTokens  int
+	outputTokens int
+}
+
+func (s *openAIStream) chunk(delta *openAIResponseMessage, finish *string) []byte {
+	data, _ := json.Marshal(openAIResponse{
+		ID:      s.id,
+		Object:  "chat.completion.chunk",
+		Created: s.created,
+		Model:   s.model,
+		Choices: []openAIChoice{{Delta: delta, FinishReason: finish}},
+	})
+	return []byte("data: " + string(data) + "\n\n")
+}
+
+// translate returns the chunks for one Messages API event, if any.
+func (s *openAIStream) translate(event []byte) []byte {
+	data, ok := sseEventData(event)
+	if !ok {
+		return nil
+	}
+	var ev struct {
+		Type    string `json:"type"`
+		Index   int    `json:"index"`
+		Message struct {
+			ID    string `json:"id"`
+			Usage struct {
+				InputTokens int `json:"input_tokens"`
+			} `json:"usage"`
+		} `json:"message"`
+		ContentBlock struct {
+			Type string `json:"type"`
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"content_block"`
+		Delta struct {
+			Type        string `json:"type"`
+			Text        string `json:"text"`
+			PartialJSON string `json:"partial_json"`
+			StopReason  string `json:"stop_reason"`
+		} `json:"delta"`
+		Usage struct {
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return nil
+	}
+
+	switch ev.Type {
+	case "message_start":
+		s.id = ev.Message.ID
+		s.inputTokens = ev.Message.Usage.InputTokens
+		empty := ""
+		return s.chunk(&openAIResponseMessage{Role: "assistant", Content: &empty}, nil)
+	case "content_block_start":
+		if ev.ContentBlock.Type != "tool_use" {
+			return nil
+		}
+		i := len(s.toolCalls)
+		s.toolCalls[ev.Index] = i
+		return s.chunk(&openAIResponseMessage{ToolCalls: []openAIToolCall{{
+			Index: &i, ID: ev.ContentBlock.ID, Type: "function", Function: openAIFunctionCall{Name: ev.ContentBlock.Name},
+		}}}, nil)
+	case "content_block_delta":
+		switch ev.Delta.Type {
+		case "text_delta":
+			return s.chunk(&openAIResponseMessage{Content: &ev.Delta.Text}, nil)
+		case "input_json_delta":
+			i, ok := s.toolCalls[ev.Index]
+			if !ok {
+				return nil
+			}
+			return s.chunk(&openAIResponseMessage{ToolCalls: []openAIToolCall{{
+				Index: &i, Function: openAIFunctionCall{Arguments: ev.Delta.PartialJSON},
+			}}}, nil)
+		}
+	case "message_delta":
+		s.outputTokens = ev.Usage.OutputTokens
+		if finish := openAIFinishReason(ev.Delta.StopReason); finish != "" {
+			return s.chunk(&openAIResponseMessage{}, &finish)
+		}
+	case "message_stop":
+		var out []byte
+		if s.includeUsage {
+			data, _ := json.Marshal(openAIResponse{
+				ID:      s.id,
+				Object:  "chat.completion.chunk",
+				Created: s.created,
+				Model:   s.model,
+				Choices: []openAIChoice{},
+				Usage:   newOpenAIUsage(s.inputTokens, s.outputTokens),
+			})
+			out = append(out, "data: "+string(data)+"\n\n"...)
+		}
+		return append(out, "data: [DONE]\n\n"...)
+	case "error":
+		return []byte("data: " + string(openAIError(data)) + "\n\n")
+	}
+	return nil
+}
+
+// openAIResponseWriter adapts the forwarding handler's Messages API
+// responses to the chat completions format. Streams are translated event by
+// event as they are written; any other response, including errors, is
+// buffered and translated by finish.
+type openAIResponseWriter struct {
+	w      http.ResponseWriter
+	stream *openAIStream
+	status int
+	buf    bytes.Buffer
+}
+
+func newOpenAIResponseWriter(w http.ResponseWriter) *openAIResponseWriter {
+	return &openAIResponseWriter{w: w, stream: &openAIStream{created: time.Now().Unix(), toolCalls: make(map[int]int)}}
+}
+
+func (ow *openAIResponseWriter) Header() http.Header { return ow.w.Header() }
+
+func (ow *openAIResponseWriter) WriteHeader(status int) {
+	if ow.status != 0 {
+		return
+	}
+	ow.status = status
+	if ow.streaming() {
+		ow.w.Header().Del("Content-Length")
+		ow.w.WriteHeader(status)
+	}
+}
+
+func (ow *openAIResponseWriter) streaming() bool {
+	return ow.status == http.StatusOK && isEventStream(ow.w.Header())
+}
+
+func (ow *openAIResponseWriter) Write(p []byte) (int, error) {
+	ow.WriteHeader(http.StatusOK)
+	ow.buf.Write(p)
+	if !ow.streaming() {
+		return len(p), nil
+	}
+	if ow.stream.model == "" {
+		ow.stream.model = ow.w.Header().Get("X-Served-Model")
+	}
+	// 只转换完整的事件，不完整的部分留待后续写入
+	for {
+		i := bytes.Index(ow.buf.Bytes(), []byte("\n\n"))
+		if i < 0 {
+			return len(p), nil
+		}
+		if chunk := ow.stream.translate(ow.buf.Next(i + 2)); len(chunk) > 0 {
+			if _, err := ow.w.Write(chunk); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+func (ow *openAIResponseWriter) Flush() {
+	if f, ok := ow.w.(http.Flusher); ok && ow.streaming() {
+		f.Flush()
+	}
+}
+
+func (ow *openAIResponseWriter) Unwrap() http.ResponseWriter { return ow.w }
+
+// finish writes a buffered response: a chat completion for a successful
+// message, an OpenAI error otherwise.
+func (ow *openAIResponseWriter) finish() {
+	if ow.streaming() || ow.status == 0 {
+		return
+	}
+	body := ow.buf.Bytes()
+	out := openAIError(body)
+	if ow.status == http.StatusOK {
+		completion, err := translateAnthropicMessage(body, ow.w.Header().Get("X-Served-Model"), ow.stream.created)
+		if err != nil {
+			ow.status = http.StatusBadGateway
+			out = openAIError([]byte(`{"error":{"type":"api_error","message":"Upstream returned an invalid response"}}`))
+		} else {
+			out = completion
+		}
+	}
+	writeBody(ow.w, ow.status, "application/json", out)
+}
+
+// handleChatCompletions serves OpenAI's chat completions API: the request is
+// translated into a Messages request, sent through the regular forwarding
+// handler (authentication, limits, quota and failover all apply), and the
+// response or stream is translated back. OpenAI SDKs send the API key as a
+// bearer token, which is accepted in place of x-api-key.
+func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("x-api-key") == "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			r.Header.Set("x-api-key", strings.TrimSpace(token))
+			r.Header.Del("Authorization")
+		}
+	}
+
+	ow := newOpenAIResponseWriter(w)
+	defer ow.finish()
+	if !prepareRequestBody(ow, r) {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondError(ow, r, bodyError(err))
+		return
+	}
+	translated, includeUsage, err := translateOpenAIRequest(body)
+	if err != nil {
+		respondError(ow, r, invalidRequest(err.Error()))
+		return
+	}
+	ow.stream.includeUsage = includeUsage
+
+	r.Body = io.NopCloser(bytes.NewReader(translated))
+	r.ContentLength = int64(len(translated))
+	r.Header.Set("Content-Length", strconv.Itoa(len(translated)))
+	r.Header.Set("Content-Type", "application/json")
+	handleForwardToEndpoint(ow, r)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// openAIHost is the only "region" of the OpenAI API.
+const openAIHost = "api.openai.com"
+
+// isOpenAIModel reports whether model is served by the OpenAI API.
+func isOpenAIModel(model string) bool {
+	return slices.Contains(cfg().OpenAIModels, model)
+}
+
+// openAIProvider serves GPT models through the OpenAI chat completions API,
+// translating Messages requests and responses like azureProvider. The model
+// name is sent unchanged.
+type openAIProvider struct{}
+
+func (openAIProvider) Ready() bool {
+	return cfg().OpenAIAPIKey != ""
+}
+
+func (openAIProvider) BuildRequest(ctx context.Context, region, model string, body io.Reader) (*http.Request, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if data, _, err = translateMessagesRequest(data, model); err != nil {
+		return nil, invalidRequest(err.Error())
+	}
+	return http.NewRequestWithContext(ctx, http.MethodPost, "https://"+region+"/v1/chat/completions", bytes.NewReader(data))
+}
+
+func (openAIProvider) Authenticate(req *http.Request) error {
+	key := cfg().OpenAIAPIKey
+	if key == "" {
+		return errCredentialsUnavailable
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	if org := cfg().OpenAIOrganization; org != "" {
+		req.Header.Set("OpenAI-Organization", org)
+	}
+	return nil
+}
+
+func (openAIProvider) StreamResponse(resp *http.Response) *http.Response {
+	if id := resp.Header.Get("X-Request-Id"); id != "" {
+		resp.Header.Set("request-id", id)
+	}
+	return adaptChatCompletionsResponse(resp)
+}
+
+// servedRegion is the region reported to clients for a request served in
+// region. The regions of OpenAI-compatible servers are their base URLs,
+// internal addresses that are not reported.
+func servedRegion(region string) string {
+	if strings.Contains(region, "://") {
+		return ""
+	}
+	return region
+}
+
+// openAICompatibleProvider serves self-hosted models behind servers speaking
+// the chat completions API, such as vLLM, Ollama or LM Studio. The region is
+// the server's base URL, e.g. http://localhost:11434/v1, and the model name is
+// sent unchanged.
+type openAICompatibleProvider struct{}
+
+// Ready is always true since local servers usually take no key.
+func (openAICompatibleProvider) Ready() bool {
+	return true
+}
+
+func (openAICompatibleProvider) BuildRequest(ctx context.Context, region, model string, body io.Reader) (*http.Request, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if data, _, err = translateMessagesRequest(data, model); err != nil {
+		return nil, invalidRequest(err.Error())
+	}
+	return http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(region, "/")+"/chat/completions", bytes.NewReader(data))
+}
+
+func (openAICompatibleProvider) Authenticate(req *http.Request) error {
+	if key := cfg().OpenAICompatibleAPIKey; key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	return nil
+}
+
+func (openAICompatibleProvider) StreamResponse(resp *http.Response) *http.Response {
+	return adaptChatCompletionsResponse(resp)
+}
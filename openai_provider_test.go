@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// chatCompletionsUpstream answers chat completions requests with "Hello
+// world", streamed when the request asks for it, and passes each request to
+// check first.
+func chatCompletionsUpstream(t *testing.T, check func(r *http.Request, body map[string]json.RawMessage)) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("body %s: %v", data, err)
+		}
+		check(r, body)
+		w.Header().Set("X-Request-Id", "req-openai")
+		if string(body["stream"]) != "true" {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"message":{"content":"Hello world"},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: "+`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"delta":{"content":"Hello"}}]}`+"\n\n"+
+			"data: "+`{"choices":[{"delta":{"content":" world"},"finish_reason":"stop"}]}`+"\n\n"+
+			"data: "+`{"choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`+"\n\n"+
+			"data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// messagesText collects the text of a Messages response or stream.
+func messagesText(t *testing.T, body string) string {
+	t.Helper()
+	var text strings.Builder
+	if !strings.HasPrefix(body, "event: ") {
+		var msg struct {
+			Content []struct{ Text string }
+		}
+		if err := json.Unmarshal([]byte(body), &msg); err != nil {
+			t.Fatalf("response %s: %v", body, err)
+		}
+		for _, block := range msg.Content {
+			text.WriteString(block.Text)
+		}
+		return text.String()
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var event struct {
+				Delta struct{ Text string }
+			}
+			json.Unmarshal([]byte(data), &event)
+			text.WriteString(event.Delta.Text)
+		}
+	}
+	return text.String()
+}
+
+func TestOpenAIProvider(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-default"
+		c.AllowedModels = []string{"gpt-4o"}
+		c.OpenAIModels = []string{"gpt-4o"}
+		c.OpenAIAPIKey = "sk-test"
+		c.OpenAIOrganization = "org-1"
+		c.ModelRegions = nil
+		c.ModelAliases = nil
+		c.ModelFailover = nil
+	})
+	swap(t, &storedModels, &modelAllowlist{})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+	srv := chatCompletionsUpstream(t, func(r *http.Request, body map[string]json.RawMessage) {
+		if r.Host != openAIHost || r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("request to %s%s", r.Host, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer sk-test" || r.Header.Get("OpenAI-Organization") != "org-1" {
+			t.Errorf("Authorization %q, organization %q", r.Header.Get("Authorization"), r.Header.Get("OpenAI-Organization"))
+		}
+		if string(body["model"]) != `"gpt-4o"` {
+			t.Errorf("model %s, want gpt-4o", body["model"])
+		}
+	})
+	target, _ := url.Parse(srv.URL)
+	swap(t, &upstreamClient, &http.Client{Transport: redirectTransport{target}})
+
+	for _, stream := range []bool{true, false} {
+		body := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":false}`
+		if stream {
+			body = strings.Replace(body, `"stream":false`, `"stream":true`, 1)
+		}
+		w := httptest.NewRecorder()
+		handleForwardToEndpoint(w, newMessagesRequest("k", body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("stream %v: status %d: %s", stream, w.Code, w.Body)
+		}
+		if got := messagesText(t, w.Body.String()); got != "Hello world" {
+			t.Errorf("stream %v: text %q in\n%s", stream, got, w.Body)
+		}
+		if w.Header().Get("X-Served-Model") != "gpt-4o" || w.Header().Get("X-Served-Region") != openAIHost || w.Header().Get("X-Upstream-Request-Id") != "req-openai" {
+			t.Errorf("stream %v: headers %v", stream, w.Header())
+		}
+	}
+
+	setConfig(t, func(c *Config) { c.OpenAIAPIKey = "" })
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without an API key: status %d, want 503: %s", w.Code, w.Body)
+	}
+}
+
+func TestOpenAICompatibleProvider(t *testing.T) {
+	var wantAuth string
+	srv := chatCompletionsUpstream(t, func(r *http.Request, body map[string]json.RawMessage) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("request to %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != wantAuth {
+			t.Errorf("Authorization = %q, want %q", got, wantAuth)
+		}
+		if string(body["model"]) != `"llama3"` {
+			t.Errorf("model %s, want llama3", body["model"])
+		}
+	})
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-default"
+		c.AllowedModels = []string{"llama3"}
+		c.OpenAICompatibleModels = map[string]string{"llama3": srv.URL + "/v1/"}
+		c.OpenAICompatibleAPIKey = ""
+		c.ModelRegions = nil
+		c.ModelAliases = nil
+		c.ModelFailover = nil
+	})
+	swap(t, &storedModels, &modelAllowlist{})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+
+	tests := []struct {
+		name   string
+		apiKey string
+		stream bool
+	}{
+		{name: "no key", stream: true},
+		{name: "no key, not streamed"},
+		{name: "with key", apiKey: "local-key", stream: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.OpenAICompatibleAPIKey = tt.apiKey })
+			wantAuth = ""
+			if tt.apiKey != "" {
+				wantAuth = "Bearer " + tt.apiKey
+			}
+			body, _ := json.Marshal(map[string]any{"model": "llama3", "messages": []any{map[string]string{"role": "user", "content": "hi"}}, "stream": tt.stream})
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest("k", string(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := messagesText(t, w.Body.String()); got != "Hello world" {
+				t.Errorf("text %q in\n%s", got, w.Body)
+			}
+			// 自建服务的 base URL 属于内网地址，不在响应头里暴露
+			if w.Header().Get("X-Served-Model") != "llama3" || w.Header().Get("X-Served-Region") != "" {
+				t.Errorf("headers %v", w.Header())
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTranslateOpenAIRequest(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.AllowedModels = []string{"claude-a"}
+		c.ModelAliases = nil
+	})
+	swap(t, &storedModels, &modelAllowlist{})
+	tests := []struct {
+		name      string
+		body      string
+		want      string
+		wantUsage bool
+	}{
+		{
+			name: "system prompt and merged user messages",
+			body: `{"model":"gpt-4o","messages":[{"role":"system","content":"Be brief."},{"role":"developer","content":[{"type":"text","text":"No emoji."}]},{"role":"user","content":"hi"},{"role":"user","content":"there"}],"max_tokens":100,"temperature":1.5,"stop":"END","user":"u-1"}`,
+			want: `{"anthropic_version":"vertex-2023-10-16","max_tokens":100,"messages":[{"content":[{"text":"hi","type":"text"},{"text":"there","type":"text"}],"role":"user"}],"metadata":{"user_id":"u-1"},"stop_sequences":["END"],"system":"Be brief.\n\nNo emoji.","temperature":1}`,
+		},
+		{
+			name: "allowed model kept",
+			body: `{"model":"claude-a","messages":[{"role":"user","content":"hi"}]}`,
+			want: `{"anthropic_version":"vertex-2023-10-16","max_tokens":4096,"messages":[{"content":[{"text":"hi","type":"text"}],"role":"user"}],"model":"claude-a"}`,
+		},
+		{
+			name: "tool call round trip",
+			body: `{"messages":[{"role":"user","content":"weather?"},{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\": \"Paris\"}"}}]},{"role":"tool","tool_call_id":"call_1","content":"sunny"},{"role":"user","content":"thanks"}],` +
+				`"tools":[{"type":"function","function":{"name":"get_weather","description":"Look up weather","parameters":{"type":"object"}}}],"tool_choice":"required","max_completion_tokens":50,"max_tokens":10}`,
+			want: `{"anthropic_version":"vertex-2023-10-16","max_tokens":50,"messages":[{"content":[{"text":"weather?","type":"text"}],"role":"user"},{"content":[{"id":"call_1","input":{"city":"Paris"},"name":"get_weather","type":"tool_use"}],"role":"assistant"},` +
+				`{"content":[{"content":[{"text":"sunny","type":"text"}],"tool_use_id":"call_1","type":"tool_result"},{"text":"thanks","type":"text"}],"role":"user"}],"tool_choice":{"type":"any"},"tools":[{"description":"Look up weather","input_schema":{"type":"object"},"name":"get_weather"}]}`,
+		},
+		{
+			name: "images and tools turned off",
+			body: `{"messages":[{"role":"user","content":[{"type":"text","text":"what is this"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}},{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]}],` +
+				`"tools":[{"type":"function","function":{"name":"f"}}],"tool_choice":"none","stream":true,"stream_options":{"include_usage":true}}`,
+			want:      `{"anthropic_version":"vertex-2023-10-16","max_tokens":4096,"messages":[{"content":[{"text":"what is this","type":"text"},{"source":{"data":"AAAA","media_type":"image/png","type":"base64"},"type":"image"},{"source":{"type":"url","url":"https://example.com/a.png"},"type":"image"}],"role":"user"}],"stream":true}`,
+			wantUsage: true,
+		},
+		{
+			name: "named tool and stop list",
+			body: `{"messages":[{"role":"user","content":"go"}],"tools":[{"type":"function","function":{"name":"f"}}],"tool_choice":{"type":"function","function":{"name":"f"}},"stop":["a","b"],"top_p":0.5,"stream":true}`,
+			want: `{"anthropic_version":"vertex-2023-10-16","max_tokens":4096,"messages":[{"content":[{"text":"go","type":"text"}],"role":"user"}],"stop_sequences":["a","b"],"stream":true,"tool_choice":{"name":"f","type":"tool"},"tools":[{"input_schema":{"type":"object","properties":{}},"name":"f"}],"top_p":0.5}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, includeUsage, err := translateOpenAIRequest([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			if includeUsage != tt.wantUsage {
+				t.Errorf("include usage %v, want %v", includeUsage, tt.wantUsage)
+			}
+		})
+	}
+}
+
+func TestTranslateOpenAIRequestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"invalid JSON", `{"messages":`, "invalid request body"},
+		{"no messages", `{"messages":[]}`, "messages: at least one message is required"},
+		{"several choices", `{"messages":[{"role":"user","content":"hi"}],"n":2}`, "n: only 1 is supported"},
+		{"unknown role", `{"messages":[{"role":"function","content":"hi"}]}`, `messages[0].role: unsupported role "function"`},
+		{"image in system prompt", `{"messages":[{"role":"system","content":[{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]}]}`, "system messages can only contain text"},
+		{"unknown content part", `{"messages":[{"role":"user","content":[{"type":"input_audio"}]}]}`, `unsupported content part type "input_audio"`},
+		{"image data not base64", `{"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png,AAAA"}}]}]}`, "must be base64 encoded"},
+		{"tool arguments not JSON", `{"messages":[{"role":"assistant","tool_calls":[{"id":"c","function":{"name":"f","arguments":"{city"}}]}]}`, "messages[0].tool_calls[0].function.arguments: must be JSON"},
+		{"numeric stop", `{"messages":[{"role":"user","content":"hi"}],"stop":1}`, "stop: must be a string or an array of strings"},
+		{"non-function tool", `{"messages":[{"role":"user","content":"hi"}],"tools":[{"type":"retrieval"}]}`, "tools[0].type: only function tools are supported"},
+		{"unknown tool choice", `{"messages":[{"role":"user","content":"hi"}],"tool_choice":"sometimes"}`, `tool_choice: unsupported value "sometimes"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := translateOpenAIRequest([]byte(tt.body))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTranslateAnthropicMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "text and tool call",
+			body: `{"id":"msg_1","content":[{"type":"text","text":"Let me check."},{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}],"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5}}`,
+			want: `{"id":"msg_1","object":"chat.completion","created":1700000000,"model":"claude-a","choices":[{"index":0,"message":{"role":"assistant","content":"Let me check.","tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`,
+		},
+		{
+			name: "tool call only",
+			body: `{"id":"msg_2","content":[{"type":"tool_use","id":"toolu_1","name":"f","input":{}}],"stop_reason":"tool_use","usage":{"input_tokens":1,"output_tokens":2}}`,
+			want: `{"id":"msg_2","object":"chat.completion","created":1700000000,"model":"claude-a","choices":[{"index":0,"message":{"role":"assistant","tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"f","arguments":"{}"}}]},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3}}`,
+		},
+		{
+			name: "cut off at max tokens",
+			body: `{"id":"msg_3","content":[{"type":"thinking","thinking":"hmm"},{"type":"text","text":"Once upon"}],"stop_reason":"max_tokens","usage":{"input_tokens":3,"output_tokens":4}}`,
+			want: `{"id":"msg_3","object":"chat.completion","created":1700000000,"model":"claude-a","choices":[{"index":0,"message":{"role":"assistant","content":"Once upon"},"finish_reason":"length"}],"usage":{"prompt_tokens":3,"completion_tokens":4,"total_tokens":7}}`,
+		},
+		{
+			name: "empty answer",
+			body: `{"id":"msg_4","content":[],"stop_reason":"end_turn","usage":{"input_tokens":3,"output_tokens":0}}`,
+			want: `{"id":"msg_4","object":"chat.completion","created":1700000000,"model":"claude-a","choices":[{"index":0,"message":{"role":"assistant","content":""},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":0,"total_tokens":3}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := translateAnthropicMessage([]byte(tt.body), "claude-a", 1700000000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenAIStream(t *testing.T) {
+	toolStream := "event: message_start\n" +
+		`data: {"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":10}}}` + "\n\n" +
+		"event: content_block_start\n" +
+		`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}` + "\n\n" +
+		"event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Checking."}}` + "\n\n" +
+		"event: content_block_start\n" +
+		`data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather"}}` + "\n\n" +
+		"event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}` + "\n\n" +
+		"event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}` + "\n\n" +
+		"event: message_delta\n" +
+		`data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":7}}` + "\n\n" +
+		"event: message_stop\n" +
+		`data: {"type":"message_stop"}` + "\n\n"
+	chunk := func(delta string, finish string) string {
+		return `data: {"id":"msg_1","object":"chat.completion.chunk","created":1700000000,"model":"claude-a","choices":[{"index":0,"delta":` + delta + `,"finish_reason":` + finish + `}]}` + "\n\n"
+	}
+
+	tests := []struct {
+		name         string
+		stream       string
+		includeUsage bool
+		want         string
+	}{
+		{
+			name:   "text",
+			stream: sseTranscript,
+			want: chunk(`{"role":"assistant","content":""}`, "null") +
+				chunk(`{"content":"Hello"}`, "null") +
+				chunk(`{"content":" world"}`, "null") +
+				chunk(`{}`, `"stop"`) +
+				"data: [DONE]\n\n",
+		},
+		{
+			name:         "tool call with usage",
+			stream:       toolStream,
+			includeUsage: true,
+			want: chunk(`{"role":"assistant","content":""}`, "null") +
+				chunk(`{"content":"Checking."}`, "null") +
+				chunk(`{"tool_calls":[{"index":0,"id":"toolu_1","type":"function","function":{"name":"get_weather","arguments":""}}]}`, "null") +
+				chunk(`{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}`, "null") +
+				chunk(`{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]}`, "null") +
+				chunk(`{}`, `"tool_calls"`) +
+				`data: {"id":"msg_1","object":"chat.completion.chunk","created":1700000000,"model":"claude-a","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":7,"total_tokens":17}}` + "\n\n" +
+				"data: [DONE]\n\n",
+		},
+		{
+			name:   "error event",
+			stream: `data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}` + "\n\n",
+			want:   `data: {"error":{"code":null,"message":"Overloaded","type":"overloaded_error"}}` + "\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &openAIStream{model: "claude-a", created: 1700000000, includeUsage: tt.includeUsage, toolCalls: make(map[int]int)}
+			var got bytes.Buffer
+			for _, event := range strings.SplitAfter(tt.stream, "\n\n") {
+				got.Write(s.translate([]byte(event)))
+			}
+			if got.String() != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleChatCompletions(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-default"
+		c.AllowedModels = nil
+		c.ModelAliases = nil
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	keys := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"stream":true`) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"Hello world"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":5}}`)
+			return
+		}
+		streamSSE(w, sseTranscript)
+	})
+
+	tests := []struct {
+		name        string
+		auth        string
+		body        string
+		wantStatus  int
+		wantContent string
+		wantError   string // error.type
+	}{
+		{"completion", "Bearer k", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`, http.StatusOK, "Hello world", ""},
+		{"stream", "Bearer k", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":true,"stream_options":{"include_usage":true}}`, http.StatusOK, "Hello world", ""},
+		{"invalid key", "Bearer unknown", `{"messages":[{"role":"user","content":"hi"}]}`, http.StatusUnauthorized, "", codeAuthentication},
+		{"untranslatable request", "Bearer k", `{"messages":[]}`, http.StatusBadRequest, "", codeInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Authorization", tt.auth)
+			w := httptest.NewRecorder()
+			handleChatCompletions(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			if tt.wantError != "" {
+				var resp struct {
+					Error struct {
+						Type    string          `json:"type"`
+						Message string          `json:"message"`
+						Code    json.RawMessage `json:"code"`
+					} `json:"error"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Error.Type != tt.wantError || resp.Error.Message == "" || string(resp.Error.Code) != "null" {
+					t.Errorf("error %+v, want type %s", resp.Error, tt.wantError)
+				}
+				return
+			}
+
+			var (
+				content strings.Builder
+				usage   *openAIUsage
+				chunks  []string
+			)
+			if !isEventStream(w.Header()) {
+				chunks = []string{w.Body.String()}
+			} else {
+				body, done := strings.CutSuffix(w.Body.String(), "data: [DONE]\n\n")
+				if !done {
+					t.Fatalf("stream not ended with [DONE]:\n%s", w.Body)
+				}
+				for _, event := range strings.Split(strings.TrimSpace(body), "\n\n") {
+					chunks = append(chunks, strings.TrimPrefix(event, "data: "))
+				}
+			}
+			for _, c := range chunks {
+				var resp openAIResponse
+				if err := json.Unmarshal([]byte(c), &resp); err != nil {
+					t.Fatalf("chunk %q: %v", c, err)
+				}
+				if resp.Model != "claude-default" || resp.ID != "msg_1" {
+					t.Errorf("chunk %s, want it for msg_1 served by claude-default", c)
+				}
+				for _, choice := range resp.Choices {
+					for _, m := range []*openAIResponseMessage{choice.Message, choice.Delta} {
+						if m != nil && m.Content != nil {
+							content.WriteString(*m.Content)
+						}
+					}
+				}
+				if resp.Usage != nil {
+					usage = resp.Usage
+				}
+			}
+			if content.String() != tt.wantContent {
+				t.Errorf("content %q, want %q", content.String(), tt.wantContent)
+			}
+			if usage == nil || *usage != (openAIUsage{10, 5, 15}) {
+				t.Errorf("usage %+v, want 10 prompt and 5 completion tokens", usage)
+			}
+		})
+	}
+	if got := keys.remaining("k"); got != 8 {
+		t.Errorf("%d calls left, want 8", got)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+// operatorLimiter is the per-minute limit of the operator key, separate from
+// RATE_LIMIT_RPM so it applies even when client rate limiting is off.
+var operatorLimiter *rateLimiter
+
+// operatorAuthenticator accepts OPERATOR_KEY ahead of the configured backend
+// so operators can exercise the upstream path during a database outage. The
+// operator key is never looked up or charged; every use is logged for audit.
+type operatorAuthenticator struct {
+	next Authenticator
+}
+
+// isOperatorRequest reports whether the request carries OPERATOR_KEY.
+func isOperatorRequest(r *http.Request) bool {
+	return cfg().OperatorKey != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("x-api-key")), []byte(cfg().OperatorKey)) == 1
+}
+
+func (a operatorAuthenticator) Authenticate(ctx context.Context, r *http.Request) (*APIKey, error) {
+	if !isOperatorRequest(r) {
+		return a.next.Authenticate(ctx, r)
+	}
+	logf(ctx, "AUDIT operator key used from %s: %s %s", clientIP(r), r.Method, r.URL.Path)
+	return &APIKey{Key: cfg().OperatorKey, Operator: true, RemainingCalls: cfg().OperatorKeyRPM}, nil
+}
+
+func (a operatorAuthenticator) Charge(ctx context.Context, key *APIKey, cost int) (int, error) {
+	if key.Operator {
+		return key.RemainingCalls, nil
+	}
+	return a.next.Charge(ctx, key, cost)
+}
+
+func (a operatorAuthenticator) Refund(ctx context.Context, key *APIKey, cost int) error {
+	if key.Operator {
+		return nil
+	}
+	return a.next.Refund(ctx, key, cost)
+}
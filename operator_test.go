@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOperatorKeyDuringDBOutage(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.OperatorKey = "operator-secret"
+		c.OperatorKeyRPM = 2
+	})
+	fake := useFakeDB(t, func(q fakeQuery) fakeResult {
+		return fakeResult{Err: errors.New("connection refused")}
+	})
+	swap[Authenticator](t, &authenticator, operatorAuthenticator{next: dbAuthenticator{}})
+	swap(t, &operatorLimiter, newRateLimiter(2, time.Minute))
+	var forwarded int
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		streamSSE(w, sseTranscript)
+	})
+	var logs syncBuffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(&redactingHandler{next: slog.NewTextHandler(&logs, nil)}))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	tests := []struct {
+		name          string
+		key           string
+		wantStatus    int
+		wantForwarded bool
+	}{
+		{"operator key", "operator-secret", http.StatusOK, true},
+		{"normal key", "k", http.StatusServiceUnavailable, false},
+		{"operator key again", "operator-secret", http.StatusOK, true},
+		{"operator key rate limited", "operator-secret", http.StatusTooManyRequests, false},
+	}
+	for _, tt := range tests {
+		forwarded = 0
+		w := httptest.NewRecorder()
+		handleForwardToEndpoint(w, newMessagesRequest(tt.key, `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.wantStatus, w.Body)
+		}
+		if (forwarded > 0) != tt.wantForwarded {
+			t.Errorf("%s: forwarded %d times", tt.name, forwarded)
+		}
+	}
+	// 运维密钥不查询也不扣减数据库额度
+	for _, q := range fake.ran() {
+		for _, arg := range q.Args {
+			if arg == "operator-secret" {
+				t.Errorf("operator key sent to the database: %s", q.SQL)
+			}
+		}
+	}
+	if got := strings.Count(logs.String(), "AUDIT operator key used"); got != 3 {
+		t.Errorf("%d audit lines, want one per operator request:\n%s", got, logs.String())
+	}
+	if strings.Contains(logs.String(), "operator-secret") {
+		t.Error("operator key written to the logs")
+	}
+}
+
+func TestOperatorKeyDisabledByDefault(t *testing.T) {
+	setConfig(t, func(c *Config) { c.OperatorKey = "" })
+	next := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	auth := operatorAuthenticator{next: next}
+	for _, key := range []string{"", "operator-secret"} {
+		if _, err := auth.Authenticate(context.Background(), newMessagesRequest(key, `{}`)); !errors.Is(err, errKeyNotFound) {
+			t.Errorf("key %q: err = %v, want it looked up as a normal key", key, err)
+		}
+	}
+	if isOperatorRequest(newMessagesRequest("", `{}`)) {
+		t.Error("empty key treated as the operator key while OPERATOR_KEY is unset")
+	}
+}
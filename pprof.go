@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// newPprofHandler serves the runtime profiles under /debug/pprof/, behind
+// ADMIN_TOKEN. It is only mounted on the PPROF_ADDR listener, never on the
+// gateway's router. Importing net/http/pprof also registers the profiles on
+// http.DefaultServeMux, which the gateway never serves.
+func newPprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(route string, handler http.HandlerFunc) {
+		mux.HandleFunc(route, withRequestID(requireAdmin(handler)))
+	}
+	handle("/debug/pprof/", pprof.Index)
+	handle("/debug/pprof/cmdline", pprof.Cmdline)
+	handle("/debug/pprof/profile", pprof.Profile)
+	handle("/debug/pprof/symbol", pprof.Symbol)
+	handle("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// servePprof serves the profiles on addr until ctx is done. There is no write
+// timeout, so CPU profiles and traces can run as long as they are asked to.
+func servePprof(ctx context.Context, addr string) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           newPprofHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("Profiles are served on %s", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Failed to serve profiles: %v", err)
+	}
+}
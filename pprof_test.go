@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		adminToken string
+		auth       string
+		path       string
+		wantStatus int
+	}{
+		{"admin token", "admin-secret", "Bearer admin-secret", "/debug/pprof/", http.StatusOK},
+		{"named profile", "admin-secret", "Bearer admin-secret", "/debug/pprof/goroutine?debug=1", http.StatusOK},
+		{"cmdline", "admin-secret", "Bearer admin-secret", "/debug/pprof/cmdline", http.StatusOK},
+		{"no token", "admin-secret", "", "/debug/pprof/", http.StatusUnauthorized},
+		{"wrong token", "admin-secret", "Bearer guess", "/debug/pprof/heap", http.StatusUnauthorized},
+		{"API key", "admin-secret", "Bearer k", "/debug/pprof/", http.StatusUnauthorized},
+		{"admin disabled", "", "Bearer admin-secret", "/debug/pprof/", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.AdminToken = tt.adminToken })
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			newPprofHandler().ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestPprofNotOnRouter(t *testing.T) {
+	useFakeDB(t, nil)
+	setConfig(t, func(c *Config) { c.AdminToken = "admin-secret" })
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("gateway router answered %s with %d, want 404", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultTier is the tier of keys that haven't been assigned one.
+const defaultTier = "default"
+
+// pricingTable maps tier -> model -> quota cost per request. The "*" tier
+// applies to every tier without its own entry for a model.
+type pricingTable map[string]map[string]int
+
+// parsePricing parses entries of the form tier/model=cost.
+func parsePricing(entries []string) pricingTable {
+	table := make(pricingTable)
+	for _, entry := range entries {
+		target, value, ok := strings.Cut(entry, "=")
+		tier, model, ok2 := strings.Cut(target, "/")
+		cost, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || !ok2 || err != nil || cost < 0 {
+			log.Printf("Ignoring invalid pricing entry %q", entry)
+			continue
+		}
+		tier, model = strings.TrimSpace(tier), strings.TrimSpace(model)
+		if table[tier] == nil {
+			table[tier] = make(map[string]int)
+		}
+		table[tier][model] = cost
+	}
+	return table
+}
+
+// tokenPrice is the USD price per million input and output tokens.
+type tokenPrice struct {
+	Input, Output float64
+}
+
+// parseTokenPrices parses entries of the form model=input:output, in USD per
+// million tokens.
+func parseTokenPrices(entries []string) map[string]tokenPrice {
+	prices := make(map[string]tokenPrice)
+	for _, entry := range entries {
+		model, value, ok := strings.Cut(entry, "=")
+		in, out, ok2 := strings.Cut(value, ":")
+		input, err := strconv.ParseFloat(strings.TrimSpace(in), 64)
+		output, err2 := strconv.ParseFloat(strings.TrimSpace(out), 64)
+		if !ok || !ok2 || err != nil || err2 != nil || input < 0 || output < 0 {
+			log.Printf("Ignoring invalid token price %q", entry)
+			continue
+		}
+		prices[strings.TrimSpace(model)] = tokenPrice{Input: input, Output: output}
+	}
+	return prices
+}
+
+// tokenCostUSD prices the tokens of a finished request. It reports false when
+// the model has no token price.
+func tokenCostUSD(model string, usage usageTracker) (float64, bool) {
+	price, ok := cfg().TokenPrices[model]
+	if !ok {
+		return 0, false
+	}
+	return (float64(usage.InputTokens)*price.Input + float64(usage.OutputTokens)*price.Output) / 1e6, true
+}
+
+// setCostHeaders reports what a finished request cost: X-Request-Cost is the
+// quota calls charged and X-Request-Cost-USD the token cost, when priced.
+func setCostHeaders(h http.Header, model string, calls int, usage usageTracker) {
+	h.Set("X-Request-Cost", strconv.Itoa(calls))
+	if usd, ok := tokenCostUSD(model, usage); ok {
+		h.Set("X-Request-Cost-USD", strconv.FormatFloat(usd, 'f', 6, 64))
+	}
+}
+
+// modelCost returns the number of calls deducted for one request to model by
+// a key in tier. Unpriced aliases cost as much as their target, other
+// unpriced models one call.
+func modelCost(tier, model string) int {
+	if cost, ok := modelPrice(tier, model); ok {
+		return cost
+	}
+	if route, ok := modelAliases.Lookup(model); ok {
+		if cost, ok := modelPrice(tier, route.Model); ok {
+			return cost
+		}
+	}
+	return 1
+}
+
+// modelPrice returns the price of model for tier, falling back to the "*"
+// tier, if one is configured.
+func modelPrice(tier, model string) (int, bool) {
+	if cost, ok := cfg().Pricing[tier][model]; ok {
+		return cost, true
+	}
+	cost, ok := cfg().Pricing["*"][model]
+	return cost, ok
+}
+
+// tierPricing lists the effective cost of every known model for tier: the
+// default and allowed models, and any model with a price.
+func tierPricing(tier string) map[string]int {
+	prices := map[string]int{cfg().DefaultModel: modelCost(tier, cfg().DefaultModel)}
+	for _, m := range allowedModels() {
+		prices[m] = modelCost(tier, m)
+	}
+	for _, t := range []string{"*", tier} {
+		for m := range cfg().Pricing[t] {
+			prices[m] = modelCost(tier, m)
+		}
+	}
+	return prices
+}
+
+// handlePricing returns the per-model costs that apply to the caller's key.
+func handlePricing(w http.ResponseWriter, r *http.Request) {
+	if !checkAuthLockout(w, r) {
+		return
+	}
+	apiKey := r.Header.Get("x-api-key")
+	if apiKey == "" {
+		respondError(w, r, errAPIKeyRequired)
+		return
+	}
+	key, err := authenticator.Authenticate(r.Context(), r)
+	// 额度耗尽的密钥仍可查询价格
+	if err != nil && !errors.Is(err, errNoRemainingCalls) {
+		respondError(w, r, authFailure(r, apiKey, err))
+		return
+	}
+
+	prices := tierPricing(key.Tier)
+	type modelPrice struct {
+		Model string `json:"model"`
+		Cost  int    `json:"cost"`
+	}
+	resp := struct {
+		Tier   string       `json:"tier"`
+		Models []modelPrice `json:"models"`
+	}{Tier: key.Tier}
+	for m, cost := range prices {
+		resp.Models = append(resp.Models, modelPrice{Model: m, Cost: cost})
+	}
+	sort.Slice(resp.Models, func(i, j int) bool { return resp.Models[i].Model < resp.Models[j].Model })
+
+	writeJSON(w, http.StatusOK, resp)
+}
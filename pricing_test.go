@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePricing(t *testing.T) {
+	got := parsePricing([]string{"pro/claude-a=2", " * / claude-b = 5 ", "free/claude-a=x", "claude-a=3", "pro/claude-c=-1"})
+	want := pricingTable{"pro": {"claude-a": 2}, "*": {"claude-b": 5}}
+	if len(got) != len(want) || !maps.Equal(got["pro"], want["pro"]) || !maps.Equal(got["*"], want["*"]) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// usePricing sets up two tiers priced differently: pro pays less for
+// claude-big, and both fall back to the "*" tier for claude-mid.
+func usePricing(t *testing.T) {
+	t.Helper()
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-small"
+		c.AllowedModels = []string{"claude-big"}
+		c.ModelAliases = nil
+		c.Pricing = pricingTable{
+			"*":         {"claude-mid": 3},
+			defaultTier: {"claude-big": 10},
+			"pro":       {"claude-big": 4, "claude-small": 0},
+		}
+	})
+	swap(t, &modelAliases, &modelAliasTable{})
+	swap(t, &storedModels, &modelAllowlist{})
+}
+
+func TestModelCost(t *testing.T) {
+	usePricing(t)
+	tests := []struct {
+		tier, model string
+		want        int
+	}{
+		{defaultTier, "claude-big", 10},
+		{"pro", "claude-big", 4},
+		{defaultTier, "claude-mid", 3},
+		{"pro", "claude-mid", 3},
+		{defaultTier, "claude-small", 1},
+		{"pro", "claude-small", 0},
+		{"other", "claude-big", 1},
+	}
+	for _, tt := range tests {
+		if got := modelCost(tt.tier, tt.model); got != tt.want {
+			t.Errorf("modelCost(%s, %s) = %d, want %d", tt.tier, tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestHandlePricing(t *testing.T) {
+	usePricing(t)
+	useKeys(t,
+		&APIKey{Key: "basic", RemainingCalls: 5, Tier: defaultTier},
+		&APIKey{Key: "pro", RemainingCalls: 0, Tier: "pro"},
+	)
+	tests := []struct {
+		name     string
+		key      string
+		wantTier string
+		want     map[string]int
+	}{
+		{"default tier", "basic", defaultTier, map[string]int{"claude-small": 1, "claude-big": 10, "claude-mid": 3}},
+		{"pro tier without calls left", "pro", "pro", map[string]int{"claude-small": 0, "claude-big": 4, "claude-mid": 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/pricing", nil)
+			r.Header.Set("x-api-key", tt.key)
+			w := httptest.NewRecorder()
+			handlePricing(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var resp struct {
+				Tier   string
+				Models []struct {
+					Model string
+					Cost  int
+				}
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]int)
+			for _, m := range resp.Models {
+				got[m.Model] = m.Cost
+			}
+			if resp.Tier != tt.wantTier || !maps.Equal(got, tt.want) {
+				t.Errorf("got tier %s %v, want %s %v", resp.Tier, got, tt.wantTier, tt.want)
+			}
+		})
+	}
+}
+
+func TestPricedRequestCharged(t *testing.T) {
+	usePricing(t)
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	auth := useKeys(t,
+		&APIKey{Key: "basic", RemainingCalls: 20, Tier: defaultTier},
+		&APIKey{Key: "pro", RemainingCalls: 20, Tier: "pro"},
+	)
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+
+	for key, want := range map[string]int{"basic": 10, "pro": 16} {
+		w := httptest.NewRecorder()
+		handleForwardToEndpoint(w, newMessagesRequest(key, `{"model":"claude-big","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", key, w.Code, w.Body)
+		}
+		if got := auth.remaining(key); got != want {
+			t.Errorf("%s has %d calls left, want %d", key, got, want)
+		}
+	}
+}
+
+func TestParseTokenPrices(t *testing.T) {
+	got := parseTokenPrices([]string{"claude-a=3:15", " claude-b = 0.8 : 4 ", "claude-c=3", "claude-d=x:1", "claude-e=-1:2"})
+	want := map[string]tokenPrice{"claude-a": {3, 15}, "claude-b": {0.8, 4}}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRequestCostTrailer(t *testing.T) {
+	tests := []struct {
+		name     string
+		pricing  pricingTable
+		prices   map[string]tokenPrice
+		wantCost string
+		wantUSD  string // 空表示不应有该 trailer
+	}{
+		{"unpriced", nil, nil, "1", ""},
+		{"calls only", pricingTable{defaultTier: {"claude-a": 3}}, nil, "3", ""},
+		// sseTranscript: 10 个输入 token，5 个输出 token
+		{"tokens priced", pricingTable{defaultTier: {"claude-a": 3}}, map[string]tokenPrice{"claude-a": {3, 15}}, "3", "0.000105"},
+		{"other model priced", nil, map[string]tokenPrice{"claude-b": {3, 15}}, "1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.DefaultModel = "claude-a"
+				c.Pricing = tt.pricing
+				c.TokenPrices = tt.prices
+			})
+			swap(t, &modelAliases, &modelAliasTable{})
+			resp, _ := relay(t, func(w http.ResponseWriter, r *http.Request) {
+				streamSSE(w, sseTranscript)
+			})
+			if got := resp.Trailer.Get("X-Request-Cost"); got != tt.wantCost {
+				t.Errorf("X-Request-Cost = %q, want %q", got, tt.wantCost)
+			}
+			if got := resp.Trailer.Get("X-Request-Cost-USD"); got != tt.wantUSD {
+				t.Errorf("X-Request-Cost-USD = %q, want %q", got, tt.wantUSD)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// projectWeight is one GC_PROJECTS entry.
+type projectWeight struct {
+	ID     string
+	Weight int
+}
+
+// parseProjectWeights parses id=weight entries; a bare id has weight 1.
+// Without entries the single fallback project is used.
+func parseProjectWeights(entries []string, fallback string) []projectWeight {
+	var projects []projectWeight
+	for _, entry := range entries {
+		id, weight, ok := strings.Cut(entry, "=")
+		project := projectWeight{ID: strings.TrimSpace(id), Weight: 1}
+		if ok {
+			n, err := strconv.Atoi(strings.TrimSpace(weight))
+			if err != nil || n < 1 {
+				log.Printf("Ignoring invalid project weight %q", entry)
+				continue
+			}
+			project.Weight = n
+		}
+		if project.ID == "" {
+			log.Printf("Ignoring invalid project weight %q", entry)
+			continue
+		}
+		projects = append(projects, project)
+	}
+	if len(projects) == 0 {
+		projects = []projectWeight{{ID: fallback, Weight: 1}}
+	}
+	return projects
+}
+
+// parseProjectCredentials parses id=path entries naming the credentials file
+// of a project.
+func parseProjectCredentials(entries []string) map[string]string {
+	creds := make(map[string]string)
+	for _, entry := range entries {
+		id, path, ok := strings.Cut(entry, "=")
+		id, path = strings.TrimSpace(id), strings.TrimSpace(path)
+		if !ok || id == "" || path == "" {
+			log.Printf("Ignoring invalid project credentials %q", entry)
+			continue
+		}
+		creds[id] = path
+	}
+	return creds
+}
+
+// gcpProject is a Google Cloud project whose Vertex AI quota serves
+// requests. A project with its own credentials keeps its own access token;
+// the others use the gateway's.
+type gcpProject struct {
+	ID      string
+	weight  int
+	current int
+
+	provider TokenProvider
+	tokenMu  sync.RWMutex
+	token    string
+	expiry   time.Time
+}
+
+// AccessToken returns the token for calls billed to the project, empty until
+// one was obtained.
+func (p *gcpProject) AccessToken() string {
+	if p.provider == nil {
+		return currentAccessToken()
+	}
+	p.tokenMu.RLock()
+	defer p.tokenMu.RUnlock()
+	return p.token
+}
+
+// tokenExpiry returns when the project's own token expires, zero when
+// unknown.
+func (p *gcpProject) tokenExpiry() time.Time {
+	p.tokenMu.RLock()
+	defer p.tokenMu.RUnlock()
+	return p.expiry
+}
+
+func (p *gcpProject) refreshToken() error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().TokenExchangeTimeout)
+	defer cancel()
+
+	token, expiry, err := p.provider.AccessToken(ctx)
+	if err != nil {
+		return fmt.Errorf("project %s: %w", p.ID, err)
+	}
+	p.tokenMu.Lock()
+	p.token = token
+	p.expiry = expiry
+	p.tokenMu.Unlock()
+	return nil
+}
+
+// projectPool spreads requests over projects by smooth weighted
+// round-robin, so a project with weight 3 next to one with weight 1 serves
+// three of every four requests, interleaved rather than in bursts.
+type projectPool struct {
+	mu       sync.Mutex
+	projects []*gcpProject
+	total    int
+}
+
+// newProjectPool builds the pool from cfg.Projects, loading the credentials
+// file configured for a project in cfg.ProjectCredentials.
+func newProjectPool() (*projectPool, error) {
+	pool := &projectPool{}
+	for _, pw := range cfg().Projects {
+		project := &gcpProject{ID: pw.ID, weight: pw.Weight}
+		if path, ok := cfg().ProjectCredentials[pw.ID]; ok {
+			provider, err := credentialsFromFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("project %s: %w", pw.ID, err)
+			}
+			project.provider = provider
+		}
+		pool.projects = append(pool.projects, project)
+		pool.total += pw.Weight
+	}
+	for id := range cfg().ProjectCredentials {
+		if !slices.ContainsFunc(cfg().Projects, func(p projectWeight) bool { return p.ID == id }) {
+			log.Printf("Ignoring credentials for unknown project %s", id)
+		}
+	}
+	return pool, nil
+}
+
+// Next picks the project for a request.
+func (p *projectPool) Next() *gcpProject {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *gcpProject
+	for _, project := range p.projects {
+		project.current += project.weight
+		if best == nil || project.current > best.current {
+			best = project
+		}
+	}
+	best.current -= p.total
+	return best
+}
+
+// Get returns the project with id, or nil when it isn't in the pool.
+func (p *projectPool) Get(id string) *gcpProject {
+	for _, project := range p.projects {
+		if project.ID == id {
+			return project
+		}
+	}
+	return nil
+}
+
+// Ready reports whether every project has an access token.
+func (p *projectPool) Ready() bool {
+	for _, project := range p.projects {
+		if project.AccessToken() == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// keepTokensFresh renews the tokens of projects with their own credentials
+// in the background; see keepTokenFresh.
+func (p *projectPool) keepTokensFresh(ctx context.Context) {
+	for _, project := range p.projects {
+		if project.provider != nil {
+			go keepTokenFresh(ctx, project.refreshToken, project.tokenExpiry)
+		}
+	}
+}
+
+// refreshTokens obtains the tokens of projects with their own credentials,
+// retrying failures in the background like the gateway's own token.
+func (p *projectPool) refreshTokens() {
+	for _, project := range p.projects {
+		if project.provider == nil {
+			continue
+		}
+		if err := project.refreshToken(); err != nil {
+			log.Printf("Error getting access token: %v, retrying in background", err)
+			go retryAccessToken(context.Background(), project.refreshToken)
+		}
+	}
+}
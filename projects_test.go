@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseProjectWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []projectWeight
+	}{
+		{"fallback", nil, []projectWeight{{"default-project", 1}}},
+		{"weights", []string{"p-a=3", " p-b "}, []projectWeight{{"p-a", 3}, {"p-b", 1}}},
+		{"invalid entries skipped", []string{"p-a=0", "p-b=x", "=2", "p-c=2"}, []projectWeight{{"p-c", 2}}},
+		{"all invalid", []string{"p-a=-1"}, []projectWeight{{"default-project", 1}}},
+	}
+	for _, tt := range tests {
+		if got := parseProjectWeights(tt.entries, "default-project"); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProjectPoolNext(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []projectWeight
+	}{
+		{"equal", []projectWeight{{"p-a", 1}, {"p-b", 1}}},
+		{"three to one", []projectWeight{{"p-a", 3}, {"p-b", 1}}},
+		{"three projects", []projectWeight{{"p-a", 1}, {"p-b", 5}, {"p-c", 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := &projectPool{}
+			for _, w := range tt.weights {
+				pool.projects = append(pool.projects, &gcpProject{ID: w.ID, weight: w.Weight})
+				pool.total += w.Weight
+			}
+			const rounds = 100
+			counts := make(map[string]int)
+			longest, run, last := 0, 0, ""
+			for range rounds * pool.total {
+				id := pool.Next().ID
+				counts[id]++
+				if id == last {
+					run++
+				} else {
+					run, last = 1, id
+				}
+				longest = max(longest, run)
+			}
+			maxWeight := 0
+			for _, w := range tt.weights {
+				if counts[w.ID] != rounds*w.Weight {
+					t.Errorf("%s served %d of %d requests, want %d", w.ID, counts[w.ID], rounds*pool.total, rounds*w.Weight)
+				}
+				maxWeight = max(maxWeight, w.Weight)
+			}
+			// 平滑加权轮询：同一项目连续服务的请求数不超过其权重
+			if longest > maxWeight {
+				t.Errorf("one project served %d requests in a row", longest)
+			}
+		})
+	}
+}
+
+func TestProjectsOnForwardedRequests(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-a"
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.VertexAPIVersion = "v1"
+		c.VertexPublisher = "anthropic"
+	})
+	swap(t, &accessToken, "shared-token")
+	own := &gcpProject{ID: "p-a", weight: 3, provider: staticTokenProvider("token-a")}
+	if err := own.refreshToken(); err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &projects, &projectPool{projects: []*gcpProject{own, {ID: "p-b", weight: 1}}, total: 4})
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 1000, Tier: defaultTier})
+
+	wantToken := map[string]string{"p-a": "Bearer token-a", "p-b": "Bearer shared-token"}
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, rest, _ := strings.Cut(r.URL.Path, "/projects/")
+		project, _, _ := strings.Cut(rest, "/")
+		if got := r.Header.Get("Authorization"); got != wantToken[project] {
+			t.Errorf("request to %s authorized with %q, want %q", project, got, wantToken[project])
+		}
+		mu.Lock()
+		counts[project]++
+		mu.Unlock()
+		streamSSE(w, sseTranscript)
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	swap(t, &vertexClient, &http.Client{Transport: redirectTransport{target}})
+
+	const requests = 400
+	for range requests {
+		w := httptest.NewRecorder()
+		handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+	// 允许 ±5% 的偏差
+	for project, share := range map[string]float64{"p-a": 0.75, "p-b": 0.25} {
+		if got := float64(counts[project]) / requests; got < share-0.05 || got > share+0.05 {
+			t.Errorf("%s served %.0f%% of requests, want about %.0f%%", project, got*100, share*100)
+		}
+	}
+	if got := auth.remaining("k"); got != 1000-requests {
+		t.Errorf("%d calls left, want %d", got, 1000-requests)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Provider is an upstream backend serving Messages requests. The handlers
+// take care of keys, quota, limits and regional failover; a provider turns a
+// prepared Messages body into a call to its backend and the backend's answer
+// back into Anthropic's format.
+type Provider interface {
+	// Ready reports whether the provider has credentials, so requests can
+	// be turned away before they are charged.
+	Ready() bool
+	// BuildRequest creates the call sending a Messages body to model in
+	// region. Headers common to all providers are added by the caller.
+	BuildRequest(ctx context.Context, region, model string, body io.Reader) (*http.Request, error)
+	// Authenticate adds the provider's credentials to req.
+	Authenticate(req *http.Request) error
+	// StreamResponse adapts the backend's response to what the gateway
+	// forwards: Anthropic SSE events for streams and Anthropic JSON
+	// otherwise. Backends that already speak it return resp unchanged.
+	StreamResponse(resp *http.Response) *http.Response
+}
+
+// Provider names, as used by model aliases.
+const (
+	providerVertex           = "vertex"
+	providerGemini           = "gemini"
+	providerBedrock          = "bedrock"
+	providerAzure            = "azure"
+	providerOpenAI           = "openai"
+	providerOpenAICompatible = "openai-compatible"
+	providerAnthropic        = "anthropic"
+)
+
+// providerOf names the provider serving model: Bedrock for the models in
+// BEDROCK_MODELS, Azure OpenAI for those in AZURE_OPENAI_DEPLOYMENTS, OpenAI
+// for OPENAI_MODELS, self-hosted servers for OPENAI_COMPATIBLE_MODELS, Gemini
+// on Vertex AI for GEMINI_MODELS, the Anthropic API for ANTHROPIC_MODELS
+// unless it is only a fallback, and Claude on Vertex AI otherwise.
+func providerOf(model string) string {
+	c := cfg()
+	if _, ok := c.BedrockModels[model]; ok {
+		return providerBedrock
+	}
+	if _, ok := c.AzureDeployments[model]; ok {
+		return providerAzure
+	}
+	if isOpenAIModel(model) {
+		return providerOpenAI
+	}
+	if _, ok := c.OpenAICompatibleModels[model]; ok {
+		return providerOpenAICompatible
+	}
+	if isGeminiModel(model) {
+		return providerGemini
+	}
+	if _, ok := c.AnthropicModels[model]; ok && !c.AnthropicFallback {
+		return providerAnthropic
+	}
+	return providerVertex
+}
+
+// providerNamed returns the named provider for the next request for model.
+// Vertex AI falls back to the Anthropic API for the models configured so.
+func providerNamed(name, model string) Provider {
+	switch name {
+	case providerBedrock:
+		return bedrockProvider{}
+	case providerAzure:
+		return azureProvider{}
+	case providerOpenAI:
+		return openAIProvider{}
+	case providerOpenAICompatible:
+		return openAICompatibleProvider{}
+	case providerGemini:
+		return geminiProvider{vertexProvider{project: projects.Next()}}
+	case providerAnthropic:
+		return anthropicProvider{}
+	}
+	if _, ok := cfg().AnthropicModels[model]; ok && cfg().AnthropicFallback {
+		return anthropicFallbackProvider{vertexProvider{project: projects.Next()}}
+	}
+	return vertexProvider{project: projects.Next()}
+}
+
+// newProvider returns the provider serving the next request for model, an
+// alias or a model named by providerOf. It can be replaced to run the
+// handlers against another backend.
+var newProvider = func(model string) Provider {
+	if route, ok := modelAliases.Lookup(model); ok {
+		return aliasProvider{Provider: providerNamed(route.provider(), route.Model), model: route.Model}
+	}
+	return providerNamed(providerOf(model), model)
+}
+
+// servedByVertex reports whether model, or the target of the alias model,
+// goes to Claude on Vertex AI rather than another provider.
+func servedByVertex(model string) bool {
+	if route, ok := modelAliases.Lookup(model); ok {
+		return route.provider() == providerVertex
+	}
+	return providerOf(model) == providerVertex
+}
+
+// aliasProvider sends the requests for an alias to its target model, also
+// naming it in the body's "model" field when there is one.
+type aliasProvider struct {
+	Provider
+	model string
+}
+
+func (a aliasProvider) BuildRequest(ctx context.Context, region, _ string, body io.Reader) (*http.Request, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return a.Provider.BuildRequest(ctx, region, a.model, bytes.NewReader(replaceBodyModel(data, a.model)))
+}
+
+// vertexProvider serves Claude on Vertex AI, billed to project.
+type vertexProvider struct {
+	project *gcpProject
+}
+
+// projectID names the project billed, reported by the diagnostic
+// endpoints.
+func (v vertexProvider) projectID() string {
+	return v.project.ID
+}
+
+func (v vertexProvider) Ready() bool {
+	return v.project.AccessToken() != ""
+}
+
+// locate returns the project and location a request to region goes to:
+// those of a VERTEX_TARGETS entry project/location, or a location of v's
+// project.
+func (v vertexProvider) locate(region string) (project, location string) {
+	if project, location, ok := strings.Cut(region, "/"); ok {
+		return project, location
+	}
+	return v.project.ID, region
+}
+
+// BuildRequest drops the body's "model" field, as Vertex AI takes the model
+// in the URL and rejects it in the body. A buffered body is rewritten whole,
+// keeping its length; a body streamed from the client is filtered as it is
+// sent, so it is never held in memory.
+func (v vertexProvider) BuildRequest(ctx context.Context, region, model string, body io.Reader) (*http.Request, error) {
+	project, location := v.locate(region)
+	if _, buffered := body.(*bytes.Reader); !buffered {
+		return http.NewRequestWithContext(ctx, http.MethodPost, vertexURL(project, location, model), newModelStripper(body))
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequestWithContext(ctx, http.MethodPost, vertexURL(project, location, model), bytes.NewReader(stripBodyModel(data)))
+}
+
+// stripBodyModel removes the "model" field from a JSON body, returning body
+// unchanged when it has none or isn't an object.
+func stripBodyModel(body []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	if _, ok := fields["model"]; !ok {
+		return body
+	}
+	delete(fields, "model")
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// modelStripper removes the top-level "model" member from a JSON object read
+// from src while it is copied, holding back no more than a member name. The
+// commas between the members left are written anew, so the result stays
+// valid wherever "model" was. Input that isn't an object passes unchanged.
+type modelStripper struct {
+	src io.Reader
+	buf []byte
+	out []byte
+	err error
+
+	started  bool // 已见到首个非空白字符
+	object   bool // 顶层是对象，需要过滤
+	depth    int
+	inString bool
+	escaped  bool
+	inKey    bool // 正在读取顶层成员名
+	key      []byte
+	wantKey  bool // 下一个顶层字符串是成员名
+	skipping bool // 正在丢弃 "model" 成员
+	members  int  // 已写出的顶层成员数
+}
+
+func newModelStripper(src io.Reader) *modelStripper {
+	return &modelStripper{src: src, buf: make([]byte, 32*1024)}
+}
+
+func (m *modelStripper) Read(p []byte) (int, error) {
+	for len(m.out) == 0 && m.err == nil {
+		n, err := m.src.Read(m.buf)
+		for _, c := range m.buf[:n] {
+			m.feed(c)
+		}
+		m.err = err
+	}
+	n := copy(p, m.out)
+	m.out = m.out[n:]
+	if len(m.out) == 0 && m.err != nil {
+		return n, m.err
+	}
+	return n, nil
+}
+
+func (m *modelStripper) emit(c ...byte) {
+	if !m.skipping {
+		m.out = append(m.out, c...)
+	}
+}
+
+func (m *modelStripper) feed(c byte) {
+	if !m.started {
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			m.out = append(m.out, c)
+			return
+		}
+		m.started, m.object = true, c == '{'
+	}
+	if !m.object {
+		m.out = append(m.out, c)
+		return
+	}
+	if m.inString {
+		switch {
+		case m.escaped:
+			m.escaped = false
+		case c == '\\':
+			m.escaped = true
+		case c == '"':
+			m.inString = false
+		}
+		if !m.inKey {
+			m.emit(c)
+			return
+		}
+		m.key = append(m.key, c)
+		if m.inString {
+			return
+		}
+		// 成员名读完后才能决定保留还是丢弃整个成员
+		m.inKey = false
+		if string(m.key) == `"model"` {
+			m.skipping = true
+			return
+		}
+		if m.members > 0 {
+			m.emit(',')
+		}
+		m.members++
+		m.emit(m.key...)
+		return
+	}
+	switch c {
+	case '"':
+		m.inString = true
+		if m.depth == 1 && m.wantKey {
+			m.wantKey, m.inKey, m.key = false, true, append(m.key[:0], c)
+			return
+		}
+	case '{', '[':
+		m.depth++
+		if m.depth == 1 {
+			m.wantKey = true
+		}
+	case '}', ']':
+		m.depth--
+		if m.depth == 0 {
+			m.skipping = false
+		}
+	case ',':
+		if m.depth == 1 {
+			m.skipping, m.wantKey = false, true
+			return
+		}
+	}
+	m.emit(c)
+}
+
+// Authenticate uses the token of the project named in the URL, which is
+// another than v's for VERTEX_TARGETS entries.
+func (v vertexProvider) Authenticate(req *http.Request) error {
+	project := v.project
+	_, rest, _ := strings.Cut(req.URL.Path, "/projects/")
+	if id, _, _ := strings.Cut(rest, "/"); id != project.ID {
+		if p := projects.Get(id); p != nil {
+			project = p
+		}
+	}
+	token := project.AccessToken()
+	if token == "" {
+		return errCredentialsUnavailable
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (v vertexProvider) StreamResponse(resp *http.Response) *http.Response {
+	return resp
+}
+
+// countTokensProvider sends requests to the Anthropic count-tokens endpoint
+// on Vertex, which takes the model in the body instead of the path.
+type countTokensProvider struct {
+	vertexProvider
+}
+
+func (c countTokensProvider) BuildRequest(ctx context.Context, region, _ string, body io.Reader) (*http.Request, error) {
+	project, location := c.locate(region)
+	return http.NewRequestWithContext(ctx, http.MethodPost, vertexModelURL(project, location, "count-tokens", "rawPredict"), body)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// redirectTransport sends every request to a test server, keeping its path,
+// so providers can be exercised with their real upstream URLs.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestVertexRequestWithFakeTokenProvider(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-test@20250101"
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.VertexAPIVersion = "v1"
+		c.VertexPublisher = "anthropic"
+	})
+	swap[TokenProvider](t, &tokenProvider, staticTokenProvider("fake-token"))
+	swap(t, &accessToken, "")
+	if err := refreshAccessToken(); err != nil {
+		t.Fatal(err)
+	}
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer fake-token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if want := "/v1/projects/test-project/locations/us-east5/publishers/anthropic/models/claude-test@20250101:streamRawPredict"; r.URL.Path != want {
+			t.Errorf("path %s, want %s", r.URL.Path, want)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"model"`) {
+			t.Errorf("body %s sent with a model field", body)
+		}
+		streamSSE(w, sseTranscript)
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	swap(t, &vertexClient, &http.Client{Transport: redirectTransport{target}})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"model":"claude-test@20250101","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusOK || w.Body.String() != sseTranscript {
+		t.Errorf("got %d:\n%s", w.Code, w.Body)
+	}
+}
+
+func TestVertexProviderWithoutToken(t *testing.T) {
+	swap(t, &accessToken, "")
+	p := vertexProvider{project: &gcpProject{ID: "test-project"}}
+	if p.Ready() {
+		t.Error("provider ready without a token")
+	}
+	req := httptest.NewRequest(http.MethodPost, vertexURL("test-project", "us-east5", "claude"), nil)
+	if err := p.Authenticate(req); err != errCredentialsUnavailable {
+		t.Errorf("Authenticate = %v, want errCredentialsUnavailable", err)
+	}
+}
+
+func TestProviderOf(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.BedrockModels = map[string]string{"claude-bedrock": "anthropic.claude-v2"}
+		c.AzureDeployments = map[string]string{"gpt-azure": "prod-gpt"}
+		c.OpenAIModels = []string{"gpt-4o"}
+		c.OpenAICompatibleModels = map[string]string{"llama": "http://vllm:8000/v1"}
+		c.GeminiModels = []string{"gemini-2.0-flash"}
+		c.AnthropicModels = map[string]string{"claude-direct": "claude-3-5-sonnet-latest"}
+		c.AnthropicFallback = false
+	})
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"claude-bedrock", providerBedrock},
+		{"gpt-azure", providerAzure},
+		{"gpt-4o", providerOpenAI},
+		{"llama", providerOpenAICompatible},
+		{"gemini-2.0-flash", providerGemini},
+		{"claude-direct", providerAnthropic},
+		{"claude-3-5-sonnet@20240620", providerVertex},
+	}
+	for _, tt := range tests {
+		if got := providerOf(tt.model); got != tt.want {
+			t.Errorf("providerOf(%q) = %s, want %s", tt.model, got, tt.want)
+		}
+	}
+
+	// 作为回退时，Anthropic 模型由 Vertex 提供
+	setConfig(t, func(c *Config) { c.AnthropicFallback = true })
+	if got := providerOf("claude-direct"); got != providerVertex {
+		t.Errorf("fallback model served by %s, want vertex", got)
+	}
+	if _, ok := newProvider("claude-direct").(anthropicFallbackProvider); !ok {
+		t.Errorf("fallback model got provider %T", newProvider("claude-direct"))
+	}
+}
+
+func TestVertexProviderTargets(t *testing.T) {
+	a := &gcpProject{ID: "p-a", provider: staticTokenProvider("a"), token: "token-a"}
+	b := &gcpProject{ID: "p-b", provider: staticTokenProvider("b"), token: "token-b"}
+	swap(t, &projects, &projectPool{projects: []*gcpProject{a, b}, total: 2})
+	p := vertexProvider{project: a}
+	tests := []struct {
+		name      string
+		region    string
+		wantURL   string
+		wantToken string
+	}{
+		{"location of the provider's project", "us-east5", vertexURL("p-a", "us-east5", "claude"), "token-a"},
+		{"target in another project", "p-b/europe-west1", vertexURL("p-b", "europe-west1", "claude"), "token-b"},
+		{"target in an unknown project", "p-x/europe-west1", vertexURL("p-x", "europe-west1", "claude"), "token-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := p.BuildRequest(context.Background(), tt.region, "claude", strings.NewReader(`{}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.URL.String() != tt.wantURL {
+				t.Errorf("URL %s, want %s", req.URL, tt.wantURL)
+			}
+			if err := p.Authenticate(req); err != nil {
+				t.Fatal(err)
+			}
+			if got := req.Header.Get("Authorization"); got != "Bearer "+tt.wantToken {
+				t.Errorf("Authorization = %q, want the token %s", got, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestModelStripper(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"first member", `{"model":"claude","max_tokens":5}`, `{"max_tokens":5}`},
+		{"middle member", `{"a":1, "model" : "claude" ,"b":[1,2]}`, `{"a":1 ,"b":[1,2]}`},
+		{"last member", `{"a":{"b":1},"model":"claude"}`, `{"a":{"b":1}}`},
+		{"only member", ` {"model":"claude"}`, ` {}`},
+		{"object value", `{"model":{"id":"x","n":[1]},"a":1}`, `{"a":1}`},
+		{"nested model kept", `{"metadata":{"model":"x"},"model":"y"}`, `{"metadata":{"model":"x"}}`},
+		{"escaped quotes", `{"a":"say \"model\", }","model":"c\"d","b":"\\"}`, `{"a":"say \"model\", }","b":"\\"}`},
+		{"model in a string", `{"text":"{\"model\":1}"}`, `{"text":"{\"model\":1}"}`},
+		{"without model", `{"a":1,"b":2}`, `{"a":1,"b":2}`},
+		{"not an object", `["model",1]`, `["model",1]`},
+		{"empty", ``, ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, r := range []io.Reader{strings.NewReader(tt.in), iotest.OneByteReader(strings.NewReader(tt.in))} {
+				got, err := io.ReadAll(newModelStripper(r))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != tt.want {
+					t.Errorf("got %s, want %s", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a per-key fixed window requests-per-minute limiter. Windows
+// expire from the cache once they end, so idle keys are reaped.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	windows *expiringCache[string, *rateWindow]
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: newExpiringCache[string, *rateWindow](window),
+	}
+}
+
+// Allow records a request for key and reports whether it fits in the current
+// window, along with the requests left in the window and when it resets.
+func (l *rateLimiter) Allow(key string) (remaining int, reset time.Time, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	win, exists := l.windows.Get(key)
+	if !exists || now.Sub(win.start) >= l.window {
+		win = &rateWindow{start: now}
+		l.windows.SetUntil(key, win, now.Add(l.window))
+	}
+	reset = win.start.Add(l.window)
+	if win.count >= l.limit {
+		return 0, reset, false
+	}
+	win.count++
+	return l.limit - win.count, reset, true
+}
+
+// Reap drops windows that have ended.
+func (l *rateLimiter) Reap() int {
+	return l.windows.Reap()
+}
+
+// rateLimitInfo describes the state reported through the X-RateLimit-*
+// response headers.
+type rateLimitInfo struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// setRateLimitHeaders writes the standard rate-limit headers. Limit and Reset
+// are only meaningful when the RPM limiter is enabled.
+func setRateLimitHeaders(w http.ResponseWriter, info rateLimitInfo) {
+	if info.Limit > 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(info.Limit))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(info.Reset.Unix(), 10))
+	}
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(max(info.Remaining, 0)))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(3, time.Minute)
+	for i, want := range []struct {
+		remaining int
+		ok        bool
+	}{{2, true}, {1, true}, {0, true}, {0, false}, {0, false}} {
+		remaining, reset, ok := l.Allow("k")
+		if remaining != want.remaining || ok != want.ok {
+			t.Errorf("request %d: got (%d, %v), want (%d, %v)", i+1, remaining, ok, want.remaining, want.ok)
+		}
+		if until := time.Until(reset); until <= 0 || until > time.Minute {
+			t.Errorf("request %d: reset in %v", i+1, until)
+		}
+	}
+	if remaining, _, ok := l.Allow("other"); !ok || remaining != 2 {
+		t.Errorf("other key: got (%d, %v), want its own window", remaining, ok)
+	}
+}
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	reset := time.Unix(1700000000, 0)
+	tests := []struct {
+		name          string
+		info          rateLimitInfo
+		wantLimit     string
+		wantRemaining string
+		wantReset     string
+	}{
+		{"limiter enabled", rateLimitInfo{Limit: 60, Remaining: 59, Reset: reset}, "60", "59", "1700000000"},
+		{"negative remaining is clamped", rateLimitInfo{Limit: 60, Remaining: -3, Reset: reset}, "60", "0", "1700000000"},
+		{"without limiter only remaining", rateLimitInfo{Remaining: 42}, "", "42", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			setRateLimitHeaders(w, tt.info)
+			h := w.Header()
+			if h.Get("X-RateLimit-Limit") != tt.wantLimit || h.Get("X-RateLimit-Remaining") != tt.wantRemaining || h.Get("X-RateLimit-Reset") != tt.wantReset {
+				t.Errorf("headers limit=%q remaining=%q reset=%q, want %q %q %q",
+					h.Get("X-RateLimit-Limit"), h.Get("X-RateLimit-Remaining"), h.Get("X-RateLimit-Reset"),
+					tt.wantLimit, tt.wantRemaining, tt.wantReset)
+			}
+		})
+	}
+}
+
+func TestRateLimitHeadersOnResponses(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	swap(t, &limiter, newRateLimiter(2, time.Minute))
+	useKeys(t,
+		&APIKey{Key: "rich", RemainingCalls: 100, Tier: defaultTier},
+		&APIKey{Key: "poor", RemainingCalls: 1, Tier: defaultTier},
+	)
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+
+	tests := []struct {
+		name          string
+		key           string
+		wantStatus    int
+		wantRemaining string
+	}{
+		{"first request", "rich", http.StatusOK, "1"},
+		{"last request in the window", "rich", http.StatusOK, "0"},
+		{"throttled", "rich", http.StatusTooManyRequests, "0"},
+		{"balance below the window", "poor", http.StatusOK, "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest(tt.key, `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			h := w.Header()
+			if got := h.Get("X-RateLimit-Limit"); got != "2" {
+				t.Errorf("X-RateLimit-Limit = %q, want 2", got)
+			}
+			if got := h.Get("X-RateLimit-Remaining"); got != tt.wantRemaining {
+				t.Errorf("X-RateLimit-Remaining = %q, want %s", got, tt.wantRemaining)
+			}
+			reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+			if until := time.Until(time.Unix(reset, 0)); err != nil || until < -time.Second || until > time.Minute {
+				t.Errorf("X-RateLimit-Reset = %q, want the end of the window", h.Get("X-RateLimit-Reset"))
+			}
+			if tt.wantStatus == http.StatusTooManyRequests && h.Get("Retry-After") == "" {
+				t.Error("throttled response without Retry-After")
+			}
+		})
+	}
+}
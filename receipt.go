@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// usageReceipt is the signed record of what a request was charged.
+type usageReceipt struct {
+	KeyID        string `json:"key_id"`
+	Model        string `json:"model"`
+	Calls        int    `json:"calls"`
+	InputTokens  int    `json:"input_tokens"`
+	OutputTokens int    `json:"output_tokens"`
+	Timestamp    int64  `json:"ts"`
+}
+
+// signReceipt encodes the receipt as base64url(JSON) "." base64url(HMAC-SHA256)
+// where the MAC covers the encoded payload.
+func signReceipt(receipt usageReceipt, secret []byte) (string, error) {
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyReceipt checks a receipt produced by signReceipt and decodes it.
+func verifyReceipt(token string, secret []byte) (usageReceipt, error) {
+	var receipt usageReceipt
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return receipt, errors.New("malformed receipt")
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return receipt, errors.New("malformed receipt signature")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return receipt, errors.New("invalid receipt signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return receipt, errors.New("malformed receipt payload")
+	}
+	err = json.Unmarshal(data, &receipt)
+	return receipt, err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceiptSignature(t *testing.T) {
+	secret := []byte("receipt-secret")
+	want := usageReceipt{KeyID: "0123456789abcdef", Model: "claude", Calls: 1, InputTokens: 10, OutputTokens: 5, Timestamp: 1700000000}
+	token, err := signReceipt(want, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, _ := strings.Cut(token, ".")
+	forged, _ := signReceipt(usageReceipt{KeyID: want.KeyID, Model: "claude", Calls: 1, OutputTokens: 1}, []byte("other"))
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := []struct {
+		name    string
+		token   string
+		secret  []byte
+		wantErr string
+	}{
+		{"valid", token, secret, ""},
+		{"wrong secret", token, []byte("other"), "invalid receipt signature"},
+		{"payload swapped", forgedPayload + "." + sig, secret, "invalid receipt signature"},
+		{"signature truncated", payload + "." + sig[:10], secret, "invalid receipt signature"},
+		{"no signature", payload, secret, "malformed receipt"},
+		{"signature not base64", payload + ".!!", secret, "malformed receipt signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyReceipt(tt.token, tt.secret)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("receipt %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	data, _ := base64.RawURLEncoding.DecodeString(payload)
+	if string(data) != `{"key_id":"0123456789abcdef","model":"claude","calls":1,"input_tokens":10,"output_tokens":5,"ts":1700000000}` {
+		t.Errorf("payload %s", data)
+	}
+}
+
+func TestUsageReceiptOnResponses(t *testing.T) {
+	const secret = "receipt-secret"
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.DefaultModel = "claude"
+		c.ReceiptSecret = secret
+	})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"stream":true`) {
+			streamSSE(w, sseTranscript)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"Hello world"}],"usage":{"input_tokens":10,"output_tokens":5}}`)
+	})
+	srv := httptest.NewServer(http.HandlerFunc(handleForwardToEndpoint))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		stream  bool
+		trailer bool
+	}{
+		{"streaming response carries a trailer", true, true},
+		{"buffered response carries a header", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"messages":[{"role":"user","content":"hi"}],"stream":false}`
+			if tt.stream {
+				body = strings.Replace(body, "false", "true", 1)
+			}
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/messages", strings.NewReader(body))
+			req.Header.Set("x-api-key", "k")
+			req.Header.Set("Content-Type", "application/json")
+			start := time.Now().Unix()
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			if _, err := io.ReadAll(resp.Body); err != nil {
+				t.Fatal(err)
+			}
+
+			token := resp.Header.Get("X-Usage-Receipt")
+			if tt.trailer {
+				if token != "" {
+					t.Error("streaming receipt sent as a header")
+				}
+				token = resp.Trailer.Get("X-Usage-Receipt")
+			}
+			receipt, err := verifyReceipt(token, []byte(secret))
+			if err != nil {
+				t.Fatalf("receipt %q: %v", token, err)
+			}
+			if receipt.KeyID != keyID("k") || receipt.Model != "claude" || receipt.Calls != 1 || receipt.InputTokens != 10 || receipt.OutputTokens != 5 {
+				t.Errorf("receipt %+v", receipt)
+			}
+			if receipt.Timestamp < start || receipt.Timestamp > time.Now().Unix() {
+				t.Errorf("receipt timestamp %d", receipt.Timestamp)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// restartOnlySettings are the settings consumed while the gateway starts:
+// listeners, routes, clients and limiters are built from them once. A reload
+// keeps their running values and reports the ones that changed.
+var restartOnlySettings = []struct{ field, env string }{
+	{"TLSCertFile", "TLS_CERT_FILE"},
+	{"TLSKeyFile", "TLS_KEY_FILE"},
+	{"TLSMinVersion", "TLS_MIN_VERSION"},
+	{"TLSReload", "TLS_RELOAD"},
+	{"PprofAddr", "PPROF_ADDR"},
+	{"UpstreamCAFile", "UPSTREAM_CA_FILE"},
+	{"UpstreamClientCertFile", "UPSTREAM_CLIENT_CERT_FILE"},
+	{"UpstreamClientKeyFile", "UPSTREAM_CLIENT_KEY_FILE"},
+	{"UpstreamServerName", "UPSTREAM_TLS_SERVER_NAME"},
+	{"UpstreamDNSServer", "UPSTREAM_DNS_SERVER"},
+	{"UpstreamDNSCacheTTL", "UPSTREAM_DNS_CACHE_TTL"},
+	{"DBReplicaHosts", "DB_REPLICA_HOST"},
+	{"AuthBackend", "AUTH_BACKEND"},
+	{"AuthIntrospectionURL", "AUTH_INTROSPECTION_URL"},
+	{"AuthIntrospectionToken", "AUTH_INTROSPECTION_TOKEN"},
+	{"AuthIntrospectionTimeout", "AUTH_INTROSPECTION_TIMEOUT"},
+	{"OperatorKey", "OPERATOR_KEY"},
+	{"OperatorKeyRPM", "OPERATOR_KEY_RPM"},
+	{"StartupMode", "STARTUP_MODE"},
+	{"BasePath", "BASE_PATH"},
+	{"BasePathIncludesOps", "BASE_PATH_INCLUDE_OPS"},
+	{"Projects", "GC_PROJECTS"},
+	{"ProjectCredentials", "GC_PROJECT_CREDENTIALS"},
+	{"Warmup", "WARMUP"},
+	{"WarmupTimeout", "WARMUP_TIMEOUT"},
+	{"RateLimitRPM", "RATE_LIMIT_RPM"},
+	{"MaxInflightPerKey", "MAX_INFLIGHT_PER_KEY"},
+	{"MaxUpstreamConcurrency", "MAX_UPSTREAM_CONCURRENCY"},
+	{"AuthLockoutThreshold", "AUTH_LOCKOUT_THRESHOLD"},
+	{"AuthLockoutWindow", "AUTH_LOCKOUT_WINDOW"},
+	{"AuthLockoutDuration", "AUTH_LOCKOUT_DURATION"},
+	{"UsageNATSURL", "USAGE_NATS_URL"},
+	{"UsageNATSSubject", "USAGE_NATS_SUBJECT"},
+	{"StrictValidation", "STRICT_VALIDATION"},
+	{"ValidateParams", "VALIDATE_PARAMS"},
+	{"ValidateTools", "VALIDATE_TOOLS"},
+	{"InjectUserID", "INJECT_USER_ID"},
+	{"CaptureS3Endpoint", "CAPTURE_S3_ENDPOINT"},
+	{"CaptureS3Bucket", "CAPTURE_S3_BUCKET"},
+	{"CaptureS3Region", "CAPTURE_S3_REGION"},
+	{"CaptureS3AccessKey", "CAPTURE_S3_ACCESS_KEY"},
+	{"CaptureS3SecretKey", "CAPTURE_S3_SECRET_KEY"},
+	{"BreakerThreshold", "BREAKER_FAILURE_THRESHOLD"},
+	{"BreakerCooldown", "BREAKER_COOLDOWN"},
+	{"ShedLatencySLO", "SHED_LATENCY_SLO"},
+	{"ShedWindow", "SHED_WINDOW"},
+	{"ShedStep", "SHED_STEP"},
+	{"ShedMaxRate", "SHED_MAX_RATE"},
+	{"ShedEvalInterval", "SHED_EVAL_INTERVAL"},
+	{"RetryBudget", "RETRY_BUDGET"},
+	{"RetryBudgetRate", "RETRY_BUDGET_RATE"},
+	{"UpstreamPacingThreshold", "UPSTREAM_PACING_THRESHOLD"},
+	{"UpstreamPacingMaxWait", "UPSTREAM_PACING_MAX_WAIT"},
+	{"FeatureFlags", "FEATURE_FLAGS"},
+	{"FeatureFlagRefresh", "FEATURE_FLAG_REFRESH"},
+	{"RequestTransformers", "REQUEST_TRANSFORMERS"},
+	{"SystemPromptPrefix", "SYSTEM_PROMPT_PREFIX"},
+	{"DefaultParams", "DEFAULT_PARAMS"},
+	{"ModelDefaultParams", "MODEL_DEFAULT_PARAMS"},
+	{"JanitorInterval", "JANITOR_INTERVAL"},
+	{"LogRedactPatterns", "LOG_REDACT_PATTERNS"},
+	{"AccessLog", "ACCESS_LOG"},
+	{"OutputRedactPatterns", "OUTPUT_REDACT_PATTERNS"},
+	{"OutputRedactHoldback", "OUTPUT_REDACT_HOLDBACK"},
+}
+
+// reloadMu serializes reloads, which rewrite the process environment.
+var reloadMu sync.Mutex
+
+// reloadConfig re-reads .env, CONFIG_FILE and the environment and publishes
+// the result, which requests read from then on. Restart-only settings keep
+// their running values; the variables of those that changed are returned. On
+// an error the running configuration stays in place.
+func reloadConfig() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := loadEnv(); err != nil {
+		return nil, err
+	}
+	next := loadConfig()
+	if err := validateConfig(*next); err != nil {
+		return nil, err
+	}
+
+	prev := cfg()
+	var pending []string
+	nv, pv := reflect.ValueOf(next).Elem(), reflect.ValueOf(prev).Elem()
+	for _, s := range restartOnlySettings {
+		nf, pf := nv.FieldByName(s.field), pv.FieldByName(s.field)
+		if !reflect.DeepEqual(nf.Interface(), pf.Interface()) {
+			pending = append(pending, s.env)
+		}
+		nf.Set(pf)
+	}
+	liveConfig.Store(next)
+	return pending, nil
+}
+
+// logReload reports the outcome of a reload.
+func logReload(pending []string, err error) {
+	switch {
+	case err != nil:
+		log.Printf("Configuration reload failed, keeping the running configuration: %v", err)
+	case len(pending) > 0:
+		log.Printf("Configuration reloaded; restart to apply %s", strings.Join(pending, ", "))
+	default:
+		log.Printf("Configuration reloaded")
+	}
+}
+
+// reloadOnSIGHUP reloads the configuration whenever the process receives
+// SIGHUP.
+func reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logReload(reloadConfig())
+		}
+	}()
+}
+
+type reloadResult struct {
+	Reloaded        bool     `json:"reloaded"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// handleConfigReload is the admin counterpart of SIGHUP. Invalid settings are
+// answered with a 400 listing the problems.
+func handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	pending, err := reloadConfig()
+	logReload(pending, err)
+	if err != nil {
+		respondError(w, r, invalidRequest(fmt.Sprintf("Configuration not reloaded: %v", err)))
+		return
+	}
+	writeJSON(w, http.StatusOK, reloadResult{Reloaded: true, RestartRequired: append([]string{}, pending...)})
+}
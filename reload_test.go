@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// reloadEnv prepares a process environment for reloadConfig whose optional
+// settings come from a config file, and restores the running configuration
+// when the test ends. It returns a function that rewrites the file.
+func reloadEnv(t *testing.T) func(settings string) {
+	t.Helper()
+	prev := cfg()
+	t.Cleanup(func() { liveConfig.Store(prev) })
+	swap(t, &processEnv, nil)
+	for name, value := range map[string]string{
+		"APP_PORT":      "8080",
+		"DB_USER":       "gateway",
+		"DB_PASSWORD":   "secret",
+		"DB_NAME":       "gateway",
+		"DB_PORT":       "5432",
+		"GC_PROJECT_ID": "test-project",
+	} {
+		t.Setenv(name, value)
+	}
+	// 配置文件写入的变量在测试结束时清除
+	for _, name := range []string{"ALLOWED_MODELS", "MODEL_TOKEN_PRICES", "PPROF_ADDR", "TOKEN_REFRESH_INTERVAL"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("CONFIG_FILE", path)
+	// 以该环境启动时的配置运行，重载前后只相差配置文件中的设置
+	liveConfig.Store(loadConfig())
+	return func(settings string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(`{"defaults": `+settings+`}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func reloadRequest(t *testing.T) (int, reloadResult, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleConfigReload(w, httptest.NewRequest(http.MethodPost, "/v1/config/reload", nil))
+	var result reloadResult
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, result, w.Body.String()
+}
+
+func TestHandleConfigReload(t *testing.T) {
+	writeSettings := reloadEnv(t)
+	writeSettings(`{"ALLOWED_MODELS": ["claude-a"], "MODEL_TOKEN_PRICES": ["claude-a=3:15"]}`)
+	if code, result, body := reloadRequest(t); code != http.StatusOK || !result.Reloaded || len(result.RestartRequired) != 0 {
+		t.Fatalf("first reload: %d %s", code, body)
+	}
+	inflight := cfg()
+
+	tests := []struct {
+		name         string
+		settings     string
+		wantStatus   int
+		wantRestart  []string
+		wantModels   []string
+		wantPrice    tokenPrice
+		wantPprofOff bool
+	}{
+		{
+			name:       "hot-reloadable settings",
+			settings:   `{"ALLOWED_MODELS": ["claude-a", "claude-b"], "MODEL_TOKEN_PRICES": ["claude-a=1:5"]}`,
+			wantStatus: http.StatusOK, wantRestart: []string{},
+			wantModels: []string{"claude-a", "claude-b"}, wantPrice: tokenPrice{1, 5}, wantPprofOff: true,
+		},
+		{
+			name:       "restart-only setting kept",
+			settings:   `{"ALLOWED_MODELS": ["claude-b"], "MODEL_TOKEN_PRICES": ["claude-a=1:5"], "PPROF_ADDR": "127.0.0.1:6060"}`,
+			wantStatus: http.StatusOK, wantRestart: []string{"PPROF_ADDR"},
+			wantModels: []string{"claude-b"}, wantPrice: tokenPrice{1, 5}, wantPprofOff: true,
+		},
+		{
+			name:       "invalid settings rejected",
+			settings:   `{"ALLOWED_MODELS": ["claude-c"], "TOKEN_REFRESH_INTERVAL": "2h"}`,
+			wantStatus: http.StatusBadRequest,
+			wantModels: []string{"claude-b"}, wantPrice: tokenPrice{1, 5}, wantPprofOff: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeSettings(tt.settings)
+			code, result, body := reloadRequest(t)
+			if code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", code, tt.wantStatus, body)
+			}
+			if code == http.StatusOK && !slices.Equal(result.RestartRequired, tt.wantRestart) {
+				t.Errorf("restart required for %v, want %v", result.RestartRequired, tt.wantRestart)
+			}
+			if code != http.StatusOK && !strings.Contains(body, "TOKEN_REFRESH_INTERVAL") {
+				t.Errorf("body %s, want the invalid setting named", body)
+			}
+			c := cfg()
+			if !slices.Equal(c.AllowedModels, tt.wantModels) || c.TokenPrices["claude-a"] != tt.wantPrice {
+				t.Errorf("running with models %v and price %v, want %v and %v", c.AllowedModels, c.TokenPrices["claude-a"], tt.wantModels, tt.wantPrice)
+			}
+			if (c.PprofAddr == "") != tt.wantPprofOff {
+				t.Errorf("PPROF_ADDR %q applied without a restart", c.PprofAddr)
+			}
+		})
+	}
+
+	// 已开始的请求仍使用其读取到的配置
+	if !slices.Equal(inflight.AllowedModels, []string{"claude-a"}) || inflight.TokenPrices["claude-a"] != (tokenPrice{3, 15}) {
+		t.Errorf("in-flight snapshot changed to %v %v", inflight.AllowedModels, inflight.TokenPrices)
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	writeSettings := reloadEnv(t)
+	writeSettings(`{"ALLOWED_MODELS": ["claude-a"]}`)
+	reloadOnSIGHUP()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the reload", func() bool { return slices.Equal(cfg().AllowedModels, []string{"claude-a"}) })
+
+	// 后续请求按新的允许列表处理
+	if !modelAllowed("claude-a") || modelAllowed("claude-b") {
+		t.Error("reloaded allowlist not applied")
+	}
+}
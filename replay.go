@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxReplayResponse caps the upstream response returned by a replay.
+const maxReplayResponse = 1 << 20
+
+type replayRequest struct {
+	// Request is the captured request body, as stored in a capture's
+	// "request" field.
+	Request json.RawMessage `json:"request"`
+	// Model overrides the target model, the gateway default when empty.
+	Model  string `json:"model"`
+	DryRun bool   `json:"dry_run"`
+}
+
+type replayResult struct {
+	Model       string          `json:"model"`
+	Project     string          `json:"project,omitempty"`
+	Region      string          `json:"region,omitempty"`
+	URL         string          `json:"url,omitempty"`
+	Status      int             `json:"status,omitempty"`
+	LatencyMS   int64           `json:"latency_ms"`
+	Request     json.RawMessage `json:"request"`
+	Response    string          `json:"response,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	Truncated   bool            `json:"truncated,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// handleReplay sends a captured request body through the forwarding path
+// (request transformers, model selection and regional failover) with the
+// gateway's own credentials, and returns the upstream status and response
+// for diagnosis. No key is charged. With dry_run the body and URL that would
+// be sent are returned without calling the upstream.
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	var req replayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Request) == 0 {
+		respondError(w, r, invalidRequest(`body must be {"request": {...}, "model": "...", "dry_run": false}`))
+		return
+	}
+	result := replayResult{Model: req.Model}
+	if result.Model == "" {
+		result.Model = cfg().DefaultModel
+	}
+	regions, err := regionsForModel(result.Model)
+	if err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+
+	// 与正式请求一样经过改写插件，但不关联任何密钥；模型级默认值按目标模型取
+	body, err := transformRequest(req.Request, &APIKey{ForcedModel: result.Model})
+	if err != nil {
+		respondError(w, r, invalidRequest(err.Error()))
+		return
+	}
+	body = replaceBodyModel(body, result.Model)
+	result.Request = body
+
+	provider := newProvider(result.Model)
+	if v, ok := provider.(interface{ projectID() string }); ok {
+		result.Project = v.projectID()
+	}
+	upstreamURL := func(region string) string {
+		req, err := provider.BuildRequest(r.Context(), region, result.Model, bytes.NewReader(body))
+		if err != nil {
+			return ""
+		}
+		return req.URL.String()
+	}
+	if req.DryRun {
+		result.Region = regions[0]
+		result.URL = upstreamURL(regions[0])
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	if !provider.Ready() {
+		result.Error = "no upstream credentials"
+		writeJSON(w, http.StatusServiceUnavailable, result)
+		return
+	}
+	headers := map[string]string{
+		"Content-Type": "application/json; charset=utf-8",
+		"X-Request-Id": requestIDFor(r),
+	}
+	start := time.Now()
+	resp, served, err := forwardWithFailover(r.Context(), provider, regions, result.Model, headers, body)
+	result.Region = served.region
+	if err != nil {
+		result.LatencyMS = time.Since(start).Milliseconds()
+		result.Error = err.Error()
+		writeJSON(w, http.StatusBadGateway, result)
+		return
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxReplayResponse+1))
+	result.LatencyMS = time.Since(start).Milliseconds()
+	result.URL = upstreamURL(served.region)
+	result.Status = resp.StatusCode
+	result.ContentType = resp.Header.Get("Content-Type")
+	if len(respBody) > maxReplayResponse {
+		respBody, result.Truncated = respBody[:maxReplayResponse], true
+	}
+	result.Response = string(respBody)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHandleReplay(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.DefaultModel = "claude-default"
+	})
+	swap(t, &requestPipeline, nil)
+	const captured = `{"model":"claude-old","messages":[{"role":"user","content":"hi"}],"stream":true}`
+	tests := []struct {
+		name         string
+		body         string
+		upstream     int
+		wantStatus   int
+		wantModel    string
+		wantUpstream int // 上游收到的请求数
+		wantResponse string
+	}{
+		{"stream", `{"request":` + captured + `}`, http.StatusOK, http.StatusOK, "claude-default", 1, sseTranscript},
+		{"other model", `{"request":` + captured + `,"model":"claude-new"}`, http.StatusOK, http.StatusOK, "claude-new", 1, sseTranscript},
+		{"upstream error", `{"request":` + captured + `}`, http.StatusBadRequest, http.StatusOK, "claude-default", 1, `{"type":"error","error":{"type":"invalid_request_error","message":"bad"}}`},
+		{"dry run", `{"request":` + captured + `,"dry_run":true}`, http.StatusOK, http.StatusOK, "claude-default", 0, ""},
+		{"no request", `{"model":"claude-new"}`, http.StatusOK, http.StatusBadRequest, "", 0, ""},
+		{"not JSON", `replay this`, http.StatusOK, http.StatusBadRequest, "", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, nil)
+			useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+			var calls atomic.Int32
+			srv := fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				body, _ := io.ReadAll(r.Body)
+				var sent struct{ Model string }
+				json.Unmarshal(body, &sent)
+				if sent.Model != tt.wantModel {
+					t.Errorf("upstream got model %q, want %q", sent.Model, tt.wantModel)
+				}
+				if tt.upstream != http.StatusOK {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(tt.upstream)
+					io.WriteString(w, tt.wantResponse)
+					return
+				}
+				streamSSE(w, sseTranscript)
+			})
+
+			w := httptest.NewRecorder()
+			handleReplay(w, httptest.NewRequest(http.MethodPost, "/v1/replay", strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := int(calls.Load()); got != tt.wantUpstream {
+				t.Errorf("%d upstream requests, want %d", got, tt.wantUpstream)
+			}
+			if len(fake.ran()) != 0 {
+				t.Errorf("replay ran %d statements, want no key charged", len(fake.ran()))
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var result replayResult
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Model != tt.wantModel || result.Region != "us-east5" || result.Response != tt.wantResponse {
+				t.Errorf("result %+v", result)
+			}
+			if tt.wantUpstream > 0 && result.Status != tt.upstream {
+				t.Errorf("reported status %d, want %d", result.Status, tt.upstream)
+			}
+			if want := srv.URL + "/us-east5/" + tt.wantModel; result.URL != want {
+				t.Errorf("URL %s, want %s", result.URL, want)
+			}
+			if !strings.Contains(string(result.Request), `"model":"`+tt.wantModel+`"`) {
+				t.Errorf("replayed body %s", result.Request)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// replicas are read-only connection pools for queries that tolerate
+// replication lag, such as the admin key and usage endpoints. Quota checks
+// and all writes stay on the primary.
+var (
+	replicas    []*sql.DB
+	replicaNext atomic.Uint64
+)
+
+// initReplicas opens a pool per DB_REPLICA_HOST entry. Connections are made
+// lazily, so an unreachable replica doesn't block startup.
+func initReplicas() {
+	for _, host := range cfg().DBReplicaHosts {
+		replica, err := sql.Open("postgres", postgresURL(host))
+		if err != nil {
+			log.Fatalf("Failed to configure database replica %s: %v", host, err)
+		}
+		replica.SetMaxOpenConns(25)
+		replica.SetMaxIdleConns(25)
+		replica.SetConnMaxLifetime(5 * time.Minute)
+		replicas = append(replicas, replica)
+	}
+}
+
+// readDB returns the pool for a lag-tolerant read: the replicas in turn, or
+// the primary when none are configured.
+func readDB() *sql.DB {
+	if len(replicas) == 0 {
+		return db
+	}
+	return replicas[replicaNext.Add(1)%uint64(len(replicas))]
+}
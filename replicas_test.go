@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadDB(t *testing.T) {
+	primary, _ := openFakeDB(t, nil)
+	replicaA, _ := openFakeDB(t, nil)
+	replicaB, _ := openFakeDB(t, nil)
+	swap(t, &db, primary)
+
+	tests := []struct {
+		name     string
+		replicas []*sql.DB
+		want     []*sql.DB
+	}{
+		{"no replicas", nil, []*sql.DB{primary, primary}},
+		{"one replica", []*sql.DB{replicaA}, []*sql.DB{replicaA, replicaA}},
+		{"replicas in turn", []*sql.DB{replicaA, replicaB}, []*sql.DB{replicaB, replicaA, replicaB, replicaA}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			swap(t, &replicas, tt.replicas)
+			replicaNext.Store(0)
+			for i, want := range tt.want {
+				if readDB() != want {
+					t.Errorf("read %d went to the wrong pool", i)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicaRouting(t *testing.T) {
+	primary := useFakeDB(t, nil)
+	conn, replica := openFakeDB(t, keyTable(3))
+	swap(t, &replicas, []*sql.DB{conn})
+
+	// 读：管理端列出密钥走副本
+	w := httptest.NewRecorder()
+	handleListKeys(w, httptest.NewRequest(http.MethodGet, "/v1/keys", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing keys: status %d: %s", w.Code, w.Body)
+	}
+	if len(replica.ran()) != 1 || len(primary.ran()) != 0 {
+		t.Errorf("listing ran %d statements on the replica and %d on the primary, want 1 and 0", len(replica.ran()), len(primary.ran()))
+	}
+
+	// 写：额度与用量变更只走主库
+	writes := []struct {
+		name string
+		run  func() error
+	}{
+		{"refund", func() error { return refundAPIKey("k", 1) }},
+		{"output tokens", func() error { return chargeOutputTokens("k", 5) }},
+		{"daily usage", func() error { return returnDailyUsage("k", "2026-03-01") }},
+	}
+	for _, write := range writes {
+		before := len(primary.ran())
+		if err := write.run(); err != nil {
+			t.Fatalf("%s: %v", write.name, err)
+		}
+		if ran := primary.ran(); len(ran) != before+1 || !strings.HasPrefix(strings.TrimSpace(ran[before].SQL), "UPDATE") {
+			t.Errorf("%s didn't run its update on the primary", write.name)
+		}
+	}
+	if len(replica.ran()) != 1 {
+		t.Errorf("%d statements ran on the replica, want only the listing", len(replica.ran()))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// requestIDFor returns the request's ID: the one assigned by withRequestID,
+// else the client's X-Request-Id, or a new random ID.
+func requestIDFor(r *http.Request) string {
+	if id := requestIDFromContext(r.Context()); id != "" {
+		return id
+	}
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 {
+		return id
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID assigns every request an ID, taken from X-Request-Id when
+// the client sent one, and echoes it in the X-Request-Id response header. The
+// ID travels in the request context, so logf tags log lines with it and it is
+// forwarded to the upstream.
+func withRequestID(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := requestIDFor(r)
+		w.Header().Set("X-Request-Id", id)
+		handler(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// logf logs like log.Printf, tagged with the request ID in ctx.
+func logf(ctx context.Context, format string, args ...any) {
+	slog.InfoContext(ctx, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent log writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	var upstreamID string
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get("X-Request-Id")
+		w.Header().Set("request-id", "req_vertex_1")
+		streamSSE(w, sseTranscript)
+	})
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	tests := []struct {
+		name   string
+		client string // 客户端发送的 X-Request-Id
+		want   string // 空表示应生成新的 ID
+	}{
+		{"client ID", "client-abc-123", "client-abc-123"},
+		{"no ID", "", ""},
+		{"overlong ID replaced", strings.Repeat("x", 129), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs syncBuffer
+			prev := slog.Default()
+			slog.SetDefault(slog.New(&redactingHandler{next: slog.NewTextHandler(&logs, nil)}))
+			t.Cleanup(func() { slog.SetDefault(prev) })
+
+			r := newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`)
+			if tt.client != "" {
+				r.Header.Set("X-Request-Id", tt.client)
+			}
+			w := httptest.NewRecorder()
+			withRequestID(handleForwardToEndpoint)(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			id := w.Header().Get("X-Request-Id")
+			if tt.want != "" && id != tt.want || tt.want == "" && !generated.MatchString(id) {
+				t.Errorf("echoed ID %q, want %q", id, tt.want)
+			}
+			if upstreamID != id {
+				t.Errorf("upstream got ID %q, want %q", upstreamID, id)
+			}
+			if got := w.Header().Get("X-Upstream-Request-Id"); got != "req_vertex_1" {
+				t.Errorf("X-Upstream-Request-Id = %q", got)
+			}
+			line := ""
+			for _, l := range strings.Split(logs.String(), "\n") {
+				if strings.Contains(l, "req_vertex_1") {
+					line = l
+				}
+			}
+			if !strings.Contains(line, "request_id="+id) {
+				t.Errorf("upstream ID logged as %q, want it tagged with request_id=%s", line, id)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// writeBody writes a fully buffered response with an accurate
+// Content-Length. Streamed responses are written without one and use chunked
+// transfer instead.
+func writeBody(w http.ResponseWriter, status int, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeJSON encodes v and writes it with writeBody.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+		status = http.StatusInternalServerError
+		body = []byte(`{"error":{"type":"api_error","message":"Failed to encode response"}}`)
+	}
+	writeBody(w, status, "application/json", append(body, '\n'))
+}
+
+// isEventStream reports whether an upstream response is a server-sent event
+// stream rather than a single JSON document.
+func isEventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// streamsTruncated counts streams ended for exceeding MAX_STREAM_BYTES.
+var streamsTruncated atomic.Int64
+
+// streamResponse relays an upstream event stream event by event and returns
+// the usage it reported, plus the output sent to the client when capture is
+// set. Events not matched by filter are dropped after usage was read from
+// them. The stream status and usage receipt are sent as trailers because they
+// are only known at the end. A non-nil error means the client went away and
+// the stream was abandoned; an upstream timeout ends the stream with a
+// timeout_error event instead. Streams longer than MAX_STREAM_BYTES are cut
+// off with an api_error event and charged for the output sent.
+func streamResponse(w http.ResponseWriter, resp *http.Response, apiKey, model string, calls int, capture bool, filter eventFilter) (usageTracker, []byte, error) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// 流是否完整结束、请求费用都在最后才可知，以 trailer 告知客户端
+	w.Header().Add("Trailer", "X-Stream-Status")
+	w.Header().Add("Trailer", "X-Request-Cost")
+	if _, priced := cfg().TokenPrices[model]; priced {
+		w.Header().Add("Trailer", "X-Request-Cost-USD")
+	}
+	if cfg().ReceiptSecret != "" {
+		// token 用量在流结束后才可知，因此以 trailer 形式返回
+		w.Header().Add("Trailer", "X-Usage-Receipt")
+	}
+
+	// 创建一个缓冲读取器
+	reader := bufio.NewReader(resp.Body)
+	transformer := newStreamTransformer()
+	var usage usageTracker
+	var captured *bytes.Buffer
+	if capture {
+		captured = new(bytes.Buffer)
+	}
+
+	// 合并短时间内的多个事件再写出，减少系统调用；每次写入都是完整事件
+	out := newCoalescingWriter(w, cfg().SSECoalesceInterval, cfg().SSECoalesceBytes)
+
+	// 逐个事件读取响应并写入 ResponseWriter，只转发完整的 SSE 事件
+	// 上限在流开始时读取，配置重载不影响进行中的流
+	maxBytes := cfg().MaxStreamBytes
+	var sent int
+	for {
+		event, err := readSSEEvent(reader)
+		if err == io.ErrUnexpectedEOF && len(event) > 0 {
+			// 上游在事件中途断开，不完整的事件不转发，按流被截断处理；
+			// 没有读到半个事件的 ErrUnexpectedEOF 来自传输层（如分块编码中断），按读取错误处理
+			logf(resp.Request.Context(), "Dropping incomplete event at end of stream")
+			err = io.EOF
+		}
+		if err == nil || err == io.EOF {
+			var data []byte
+			if err == nil {
+				usage.observeEvent(event)
+				data = transformer.Transform(event)
+			} else {
+				data = transformer.Flush()
+			}
+			data = filter.apply(data)
+			if captured != nil {
+				captured.Write(data)
+			}
+
+			if _, werr := out.Write(data); werr != nil {
+				logf(resp.Request.Context(), "Error writing to ResponseWriter: %v", werr)
+				out.Stop()
+				return usage, nil, werr
+			}
+			sent += len(data)
+			// 超过单次响应的字节上限：结束流并关闭上游连接，按已发送内容计费
+			if maxBytes > 0 && sent > maxBytes && !usage.Completed {
+				logf(resp.Request.Context(), "Stream exceeded %d bytes, closing upstream", maxBytes)
+				streamsTruncated.Add(1)
+				resp.Body.Close()
+				usage.truncate()
+				writeSSEError(out, "api_error", "Response exceeded the gateway's size limit")
+				break
+			}
+		}
+		if err == io.EOF {
+			// 上游在 message_stop 之前关闭连接，流被截断；上游已发送错误事件时不再追加
+			if resp.StatusCode == http.StatusOK && !usage.Completed && !usage.Failed {
+				logf(resp.Request.Context(), "Upstream stream ended before message_stop")
+				writeSSEError(out, "api_error", "Upstream stream ended unexpectedly")
+			}
+			break
+		}
+		if err != nil {
+			// 丢弃不完整的事件；区分客户端断开与超时，再以错误事件结束流
+			ctxErr := resp.Request.Context().Err()
+			if errors.Is(ctxErr, context.Canceled) {
+				logf(resp.Request.Context(), "Client disconnected during stream")
+				out.Stop()
+				return usage, nil, ctxErr
+			}
+			if errors.Is(ctxErr, context.DeadlineExceeded) {
+				logf(resp.Request.Context(), "Stream timed out: %v", err)
+				writeSSEError(out, "timeout_error", "Request timed out")
+				break
+			}
+			logf(resp.Request.Context(), "Error reading from response: %v", err)
+			writeSSEError(out, "api_error", "Upstream stream was interrupted")
+			break
+		}
+	}
+	if err := out.Stop(); err != nil {
+		logf(resp.Request.Context(), "Error writing to ResponseWriter: %v", err)
+		return usage, nil, err
+	}
+	if usage.Completed {
+		w.Header().Set("X-Stream-Status", "complete")
+	} else {
+		w.Header().Set("X-Stream-Status", "error")
+	}
+	setCostHeaders(w.Header(), model, calls, usage)
+	if receipt := usageReceiptFor(apiKey, model, calls, usage); receipt != "" {
+		w.Header().Set("X-Usage-Receipt", receipt)
+	}
+
+	if captured == nil {
+		return usage, nil, nil
+	}
+	return usage, captured.Bytes(), nil
+}
+
+// respondSizeExceeded fails a buffered response whose upstream body passed
+// MAX_STREAM_BYTES and closes the upstream connection.
+func respondSizeExceeded(w http.ResponseWriter, resp *http.Response, maxBytes int) {
+	logf(resp.Request.Context(), "Response exceeded %d bytes, closing upstream", maxBytes)
+	streamsTruncated.Add(1)
+	resp.Body.Close()
+	respondError(w, resp.Request, upstreamFailure("Response exceeded the gateway's size limit", nil))
+}
+
+// bufferResponse relays a non-streaming upstream response (stream=false or
+// an upstream error) in one piece with its status and Content-Length. The
+// usage receipt is a regular header since usage is known before writing. A
+// 400 is re-emitted as an invalid_request_error with the upstream message.
+// Successful messages go through transformMessage like streams go through
+// the stream transformer.
+func bufferResponse(w http.ResponseWriter, resp *http.Response, apiKey, model string, calls int, capture bool) (usageTracker, []byte) {
+	var usage usageTracker
+	// 非流式响应整体缓冲，同样受字节上限约束，异常的大响应不会占满内存
+	maxBytes := cfg().MaxStreamBytes
+	var reader io.Reader = resp.Body
+	if maxBytes > 0 {
+		reader = io.LimitReader(resp.Body, int64(maxBytes)+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		respondError(w, resp.Request, upstreamFailure("Failed to read upstream response", err))
+		return usage, nil
+	}
+	if maxBytes > 0 && len(body) > maxBytes {
+		respondSizeExceeded(w, resp, maxBytes)
+		return usage, nil
+	}
+	usage.observeMessage(body)
+	if resp.StatusCode == http.StatusOK {
+		body = transformMessage(body)
+	}
+
+	setCostHeaders(w.Header(), model, calls, usage)
+	if receipt := usageReceiptFor(apiKey, model, calls, usage); receipt != "" {
+		w.Header().Set("X-Usage-Receipt", receipt)
+	}
+	// 上游拒绝请求体时统一转换为网关的错误格式，保留上游的错误信息
+	if resp.StatusCode == http.StatusBadRequest {
+		respondError(w, resp.Request, invalidRequest(upstreamErrorMessage(body)))
+	} else {
+		contentType := resp.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		writeBody(w, resp.StatusCode, contentType, body)
+	}
+
+	if !capture {
+		return usage, nil
+	}
+	return usage, body
+}
+
+// usageReceiptFor signs the receipt of a finished request, or returns "" when
+// receipts are disabled.
+func usageReceiptFor(apiKey, model string, calls int, usage usageTracker) string {
+	if cfg().ReceiptSecret == "" {
+		return ""
+	}
+	receipt, err := signReceipt(usageReceipt{
+		KeyID:        keyID(apiKey),
+		Model:        model,
+		Calls:        calls,
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+		Timestamp:    time.Now().Unix(),
+	}, []byte(cfg().ReceiptSecret))
+	if err != nil {
+		log.Printf("Error signing usage receipt: %v", err)
+		return ""
+	}
+	return receipt
+}
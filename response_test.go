@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamChunks answers with body as an event stream written n bytes at a
+// time, each chunk flushed on its own, so events reach the gateway split
+// wherever the boundaries fall.
+func streamChunks(w http.ResponseWriter, body string, n int) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for len(body) > 0 {
+		chunk := body[:min(n, len(body))]
+		body = body[len(chunk):]
+		io.WriteString(w, chunk)
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// relay sends a streaming Messages request through the gateway to an
+// upstream answering with handler, and returns the response with its body
+// read, so trailers are available.
+func relay(t *testing.T, handler http.HandlerFunc) (*http.Response, string) {
+	t.Helper()
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	fakeUpstream(t, handler)
+	srv := httptest.NewServer(http.HandlerFunc(handleForwardToEndpoint))
+	t.Cleanup(srv.Close)
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/messages", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	req.Header.Set("x-api-key", "k")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestStreamSplitAcrossReads(t *testing.T) {
+	for _, size := range []int{3, 7, 64} {
+		t.Run(fmt.Sprintf("%d-byte chunks", size), func(t *testing.T) {
+			resp, body := relay(t, func(w http.ResponseWriter, r *http.Request) {
+				streamChunks(w, sseTranscript, size)
+			})
+			if body != sseTranscript {
+				t.Errorf("client got\n%s\nwant the upstream events unchanged", body)
+			}
+			if got := resp.Trailer.Get("X-Stream-Status"); got != "complete" {
+				t.Errorf("X-Stream-Status = %q, want complete", got)
+			}
+		})
+	}
+}
+
+func TestStreamTruncatedMidEvent(t *testing.T) {
+	// 截断在第三个事件（首个文本增量）的数据行中间
+	events := strings.SplitAfter(sseTranscript, "\n\n")
+	complete := events[0] + events[1]
+	partial := events[2][:len(events[2])/2]
+
+	resp, body := relay(t, func(w http.ResponseWriter, r *http.Request) {
+		streamChunks(w, complete+partial, 11)
+	})
+	rest, ok := strings.CutPrefix(body, complete)
+	if !ok {
+		t.Fatalf("client got\n%s\nwant the complete events first", body)
+	}
+	if strings.Contains(rest, "Hello") || strings.Contains(rest, partial) {
+		t.Errorf("partial event forwarded:\n%s", rest)
+	}
+	if !strings.HasPrefix(rest, "event: error\n") || !strings.Contains(rest, "Upstream stream ended unexpectedly") || !strings.HasSuffix(rest, "\n\n") {
+		t.Errorf("stream ends with\n%s\nwant an api_error event", rest)
+	}
+	if got := resp.Trailer.Get("X-Stream-Status"); got != "error" {
+		t.Errorf("X-Stream-Status = %q, want error", got)
+	}
+}
+
+func TestStreamFailureAfterStart(t *testing.T) {
+	events := strings.SplitAfter(sseTranscript, "\n\n")
+	started := strings.Join(events[:3], "")
+	upstreamError := "event: error\n" + `data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}` + "\n\n"
+
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		wantError string // 网关追加的错误事件类型与消息，空表示不追加
+		wantType  string
+	}{
+		{
+			name: "connection dropped",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				streamChunks(w, started, 64)
+				// 不发送分块编码的结束块直接断开连接
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.Close()
+			},
+			wantType:  "api_error",
+			wantError: "Upstream stream was interrupted",
+		},
+		{
+			name: "closed before message_stop",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				streamChunks(w, started, 64)
+			},
+			wantType:  "api_error",
+			wantError: "Upstream stream ended unexpectedly",
+		},
+		{
+			name: "upstream error event",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				streamChunks(w, started+upstreamError, 64)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := relay(t, tt.handler)
+			rest, ok := strings.CutPrefix(body, started)
+			if !ok {
+				t.Fatalf("client got\n%s\nwant the events sent before the failure", body)
+			}
+			if tt.wantError == "" {
+				if rest != upstreamError {
+					t.Errorf("stream ends with\n%s\nwant only the upstream's error event", rest)
+				}
+			} else {
+				event, err := readSSEEvent(bufio.NewReader(strings.NewReader(rest)))
+				if err != nil || string(event) != rest {
+					t.Fatalf("stream ends with\n%s\nwant a single error event", rest)
+				}
+				var msg struct {
+					Type  string
+					Error struct{ Type, Message string }
+				}
+				data, _ := strings.CutPrefix(strings.Split(string(event), "\n")[1], "data: ")
+				if err := json.Unmarshal([]byte(data), &msg); err != nil {
+					t.Fatal(err)
+				}
+				if msg.Type != "error" || msg.Error.Type != tt.wantType || msg.Error.Message != tt.wantError {
+					t.Errorf("error event %+v, want %s %q", msg, tt.wantType, tt.wantError)
+				}
+			}
+			if got := resp.Trailer.Get("X-Stream-Status"); got != "error" {
+				t.Errorf("X-Stream-Status = %q, want error", got)
+			}
+		})
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	const message = `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"Hello world"}],"usage":{"input_tokens":10,"output_tokens":5}}`
+	tests := []struct {
+		name        string
+		apiKey      string
+		upstream    http.HandlerFunc
+		wantStatus  int
+		wantChunked bool
+	}{
+		{"JSON response", "k", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(message))
+		}, http.StatusOK, false},
+		{"upstream error", "k", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"error":{"code":400,"message":"bad"}}`, http.StatusBadRequest)
+		}, http.StatusBadRequest, false},
+		{"gateway error", "unknown", func(w http.ResponseWriter, r *http.Request) {}, http.StatusUnauthorized, false},
+		{"event stream", "k", func(w http.ResponseWriter, r *http.Request) {
+			streamSSE(w, sseTranscript)
+		}, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.Regions = []string{"us-east5"}
+				c.ModelRegions = nil
+				c.VertexTargets = nil
+			})
+			useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+			fakeUpstream(t, tt.upstream)
+			srv := httptest.NewServer(http.HandlerFunc(handleForwardToEndpoint))
+			defer srv.Close()
+
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/messages", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			req.Header.Set("x-api-key", tt.apiKey)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			chunked := len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+			if chunked != tt.wantChunked {
+				t.Errorf("transfer encoding %v, want chunked=%v", resp.TransferEncoding, tt.wantChunked)
+			}
+			if tt.wantChunked {
+				if resp.Header.Get("Content-Length") != "" || resp.ContentLength != -1 {
+					t.Errorf("event stream with Content-Length %d", resp.ContentLength)
+				}
+			} else if resp.ContentLength != int64(len(body)) {
+				t.Errorf("Content-Length %d for a %d-byte body", resp.ContentLength, len(body))
+			}
+		})
+	}
+}
+
+func TestClientDisconnectCancelsUpstream(t *testing.T) {
+	events := strings.SplitAfter(sseTranscript, "\n\n")
+	silentStart := strings.Replace(events[0], `"output_tokens":1`, `"output_tokens":0`, 1)
+	tests := []struct {
+		name          string
+		sent          string // 客户端断开前上游已发送的事件
+		refund        bool
+		wantRemaining int
+	}{
+		{"no output, refund on", silentStart, true, 10},
+		{"no output, refund off", silentStart, false, 9},
+		{"partial output, refund on", events[0] + events[1] + events[2], true, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.Regions = []string{"us-east5"}
+				c.ModelRegions = nil
+				c.VertexTargets = nil
+				c.DisconnectRefund = tt.refund
+			})
+			auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+			cancelled := make(chan struct{})
+			fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				streamChunks(w, tt.sent, len(tt.sent))
+				select {
+				case <-r.Context().Done():
+					close(cancelled)
+				case <-time.After(5 * time.Second):
+				}
+			})
+			srv := httptest.NewServer(http.HandlerFunc(handleForwardToEndpoint))
+			defer srv.Close()
+
+			ctx, disconnect := context.WithCancel(context.Background())
+			defer disconnect()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/v1/messages", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			req.Header.Set("x-api-key", "k")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if _, err := readSSEEvent(bufio.NewReader(resp.Body)); err != nil {
+				t.Fatalf("reading the first event: %v", err)
+			}
+			disconnect()
+
+			select {
+			case <-cancelled:
+			case <-time.After(2 * time.Second):
+				t.Fatal("upstream request still running after the client disconnected")
+			}
+			waitFor(t, "the quota to settle", func() bool { return auth.remaining("k") == tt.wantRemaining })
+		})
+	}
+}
+
+func TestUpstreamBadRequestTranslated(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantMessage string
+	}{
+		{"Anthropic error", "application/json", `{"type":"error","error":{"type":"invalid_request_error","message":"messages: at least one message is required"}}`, "messages: at least one message is required"},
+		{"Vertex error", "application/json", `[{"error":{"code":400,"message":"Request contains an invalid argument.","status":"INVALID_ARGUMENT"}}]`, "Request contains an invalid argument."},
+		{"plain text", "text/plain", "malformed body", "malformed body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := relay(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, tt.body)
+			})
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("status %d: %s", resp.StatusCode, body)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type %s", ct)
+			}
+			var got ErrorResponse
+			if err := json.Unmarshal([]byte(body), &got); err != nil {
+				t.Fatalf("%v: %s", err, body)
+			}
+			if got.Error.Type != "invalid_request_error" || got.Error.Message != tt.wantMessage {
+				t.Errorf("error %+v, want invalid_request_error %q", got.Error, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	message := func(text string) string {
+		return `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"` + text + `"}],"usage":{"input_tokens":5,"output_tokens":2}}`
+	}
+	tests := []struct {
+		name     string
+		limit    int
+		upstream string
+		wantCode int
+	}{
+		{"under the limit", 1000, message("Hello"), http.StatusOK},
+		{"no limit", 0, message(strings.Repeat("x", 10000)), http.StatusOK},
+		{"large JSON body", 1000, message(strings.Repeat("x", 10000)), http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.MaxStreamBytes = tt.limit })
+			truncated := streamsTruncated.Load()
+			resp, body := relay(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, tt.upstream)
+			})
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status %d, want %d: %.200s", resp.StatusCode, tt.wantCode, body)
+			}
+			if tt.wantCode == http.StatusOK {
+				if !strings.Contains(body, `"type":"message"`) || streamsTruncated.Load() != truncated {
+					t.Errorf("response within the limit changed: %.200s", body)
+				}
+				return
+			}
+			if want := `{"error":{"type":"api_error","message":"Response exceeded the gateway's size limit"}}`; strings.TrimSpace(body) != want {
+				t.Errorf("body %s, want %s", body, want)
+			}
+			if got := streamsTruncated.Load() - truncated; got != 1 {
+				t.Errorf("%d responses counted as truncated, want 1", got)
+			}
+		})
+	}
+}
+
+func TestMaxStreamBytes(t *testing.T) {
+	events := strings.SplitAfter(sseTranscript, "\n\n")
+	delta := "event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"` + strings.Repeat("x", 100) + `"}}` + "\n\n"
+	tests := []struct {
+		name       string
+		limit      int
+		runaway    bool // 上游不停地发送文本增量
+		wantStatus string
+	}{
+		{"under the limit", len(sseTranscript), false, "complete"},
+		{"no limit", 0, false, "complete"},
+		{"runaway stream", 1000, true, "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.MaxStreamBytes = tt.limit })
+			rec := recordUsage(t)
+			truncated := streamsTruncated.Load()
+			cancelled := make(chan struct{})
+			resp, body := relay(t, func(w http.ResponseWriter, r *http.Request) {
+				if !tt.runaway {
+					streamSSE(w, sseTranscript)
+					return
+				}
+				// 读完请求体，服务器才能察觉网关断开连接
+				io.Copy(io.Discard, r.Body)
+				w.Header().Set("Content-Type", "text/event-stream")
+				io.WriteString(w, events[0]+events[1])
+				// 一直发送，直到网关断开；不能先发完，否则无从判断是否被取消
+				for {
+					if _, err := io.WriteString(w, delta); err != nil || r.Context().Err() != nil {
+						close(cancelled)
+						return
+					}
+					w.(http.Flusher).Flush()
+				}
+			})
+			if got := resp.Trailer.Get("X-Stream-Status"); got != tt.wantStatus {
+				t.Errorf("X-Stream-Status = %q, want %s", got, tt.wantStatus)
+			}
+			if !tt.runaway {
+				if body != sseTranscript || streamsTruncated.Load() != truncated {
+					t.Errorf("stream within the limit changed:\n%s", body)
+				}
+				return
+			}
+
+			select {
+			case <-cancelled:
+			case <-time.After(2 * time.Second):
+				t.Fatal("upstream still streaming after the limit was hit")
+			}
+			rest, ok := strings.CutSuffix(body, "event: error\n"+`data: {"type":"error","error":{"type":"api_error","message":"Response exceeded the gateway's size limit"}}`+"\n\n")
+			if !ok {
+				t.Fatalf("stream does not end with a size limit error:\n%s", body)
+			}
+			sent := strings.Count(rest, delta)
+			if len(rest) > tt.limit+len(delta) || !strings.HasSuffix(rest, delta) {
+				t.Errorf("sent %d bytes (%d deltas) for a %d byte limit", len(rest), sent, tt.limit)
+			}
+			if got := streamsTruncated.Load() - truncated; got != 1 {
+				t.Errorf("%d streams counted as truncated, want 1", got)
+			}
+			// 用量按已发送的文本估算
+			waitFor(t, "the usage event", func() bool { return len(rec.published()) == 1 })
+			if got, want := rec.published()[0].OutputTokens, sent*100/bytesPerToken; got != want {
+				t.Errorf("charged %d output tokens, want %d for the text sent", got, want)
+			}
+		})
+	}
+}
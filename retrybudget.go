@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// retryBudget is a token bucket shared by every retry site, capping the
+// total retry rate so an outage can't turn into a retry storm. Each retry
+// takes one token; tokens refill at rate per second up to capacity. When the
+// bucket is empty failures are returned without retrying.
+type retryBudget struct {
+	mu       sync.Mutex
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+	denied   map[string]uint64
+}
+
+func newRetryBudget(capacity, rate float64) *retryBudget {
+	return &retryBudget{
+		capacity: capacity,
+		rate:     rate,
+		tokens:   capacity,
+		last:     time.Now(),
+		denied:   make(map[string]uint64),
+	}
+}
+
+func (b *retryBudget) refill(now time.Time) {
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Allow takes a token for a retry at site and reports whether the retry may
+// go ahead.
+func (b *retryBudget) Allow(site string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		b.denied[site]++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Level returns the tokens currently available.
+func (b *retryBudget) Level() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.tokens
+}
+
+// Denied returns how many retries each site was refused.
+func (b *retryBudget) Denied() map[string]uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	denied := make(map[string]uint64, len(b.denied))
+	for site, n := range b.denied {
+		denied[site] = n
+	}
+	return denied
+}
+
+// Retry sites sharing the budget.
+const (
+	retrySiteFailover = "region_failover"
+	retrySiteToken    = "token_exchange"
+)
+
+// allowRetry consults the global retry budget; without one every retry is
+// allowed.
+func allowRetry(site string) bool {
+	if retries == nil || retries.Allow(site) {
+		return true
+	}
+	log.Printf("Retry budget exhausted, not retrying %s", site)
+	return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(3, 0)
+	var allowed []bool
+	for _, site := range []string{retrySiteFailover, retrySiteToken, retrySiteFailover, retrySiteFailover, retrySiteToken} {
+		allowed = append(allowed, b.Allow(site))
+	}
+	if want := []bool{true, true, true, false, false}; !slices.Equal(allowed, want) {
+		t.Errorf("allowed %v, want %v", allowed, want)
+	}
+	if denied := b.Denied(); denied[retrySiteFailover] != 1 || denied[retrySiteToken] != 1 {
+		t.Errorf("denied %v, want one per site", denied)
+	}
+
+	// 按速率回填，但不超过容量
+	b = newRetryBudget(3, 2)
+	for b.Allow(retrySiteFailover) {
+	}
+	b.mu.Lock()
+	b.last = b.last.Add(-time.Second)
+	b.mu.Unlock()
+	if level := b.Level(); level < 2 || level > 2.1 {
+		t.Errorf("level %g a second after running dry at 2/s, want 2", level)
+	}
+	b.mu.Lock()
+	b.last = b.last.Add(-time.Hour)
+	b.mu.Unlock()
+	if level := b.Level(); level != 3 {
+		t.Errorf("level %g after an hour, want the capacity 3", level)
+	}
+}
+
+func TestFailoverStopsWhenBudgetDepleted(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.FailoverCooldown = 0
+		c.ModelFailover = nil
+	})
+	swap(t, &retries, newRetryBudget(3, 0))
+	var (
+		mu    sync.Mutex
+		tried int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tried++
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	regions := []string{"us-east5", "europe-west1", "asia-southeast1"}
+	tests := []struct {
+		name      string
+		wantTried int
+	}{
+		{"budget for two retries", 3},
+		{"one retry left", 2},
+		{"budget depleted", 1},
+		{"still depleted", 1},
+	}
+	for _, tt := range tests {
+		tried = 0
+		resp, _, err := forwardWithFailover(context.Background(), fakeProvider{url: srv.URL}, regions, "claude", nil, []byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: status %d, want the failure surfaced", tt.name, resp.StatusCode)
+		}
+		if tried != tt.wantTried {
+			t.Errorf("%s: tried %d regions, want %d", tt.name, tried, tt.wantTried)
+		}
+	}
+	if denied := retries.Denied()[retrySiteFailover]; denied != 3 {
+		t.Errorf("%d failovers denied, want 3", denied)
+	}
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{"llm_gateway_retry_budget_tokens 0\n", `llm_gateway_retry_budget_denied_total{site="region_failover"} 3`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, w.Body)
+		}
+	}
+}
+
+func TestTokenRetryBudget(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.TokenRetryInitialBackoff = time.Millisecond
+		c.TokenRetryMaxBackoff = time.Millisecond
+	})
+	swap(t, &retries, newRetryBudget(2, 0))
+	var attempts atomic.Int32
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	retryAccessToken(ctx, func() error {
+		attempts.Add(1)
+		return errors.New("token endpoint down")
+	})
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("%d token attempts, want 2 before the budget ran out", got)
+	}
+	if retries.Denied()[retrySiteToken] == 0 {
+		t.Error("no token retries denied")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// newRouter registers all gateway routes. API routes are mounted under
+// cfg.BasePath; the operational endpoints (/health, /metrics) stay at the
+// root so probes and scrapers keep working, unless BasePathIncludesOps is set.
+// Every route gets a request ID, its own deadline from cfg.RouteTimeouts and
+// deprecation headers when listed in cfg.DeprecatedRoutes. API routes
+// reject duplicate credential headers, answer 503 while the gateway runs
+// degraded and can wrap JSON responses in an envelope. Paths without a
+// route get a structured 404.
+func newRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+	api := func(route string, handler http.HandlerFunc) {
+		pattern := cfg().BasePath + route
+		// "/" 只匹配根路径本身，其余未注册路径交给 handleUnknownRoute
+		if route == "/" {
+			pattern += "{$}"
+		}
+		mux.HandleFunc(pattern, withRequestID(withDeprecation(route, rejectDuplicateAuth(withRouteTimeout(route, withEnvelope(requireReady(handler)))))))
+	}
+	ops := func(route string, handler http.HandlerFunc) {
+		prefix := ""
+		if cfg().BasePathIncludesOps {
+			prefix = cfg().BasePath
+		}
+		mux.HandleFunc(prefix+route, withRequestID(withDeprecation(route, withRouteTimeout(route, handler))))
+	}
+
+	api("/v1/messages", allowMethods(handleForwardToEndpoint, http.MethodPost))
+	// 旧客户端直接向根路径发送 Messages 请求
+	api("/", allowMethods(handleForwardToEndpoint, http.MethodPost))
+	// WebSocket 连接不经过路由超时与响应信封，超时在处理函数内部施加
+	mux.HandleFunc(cfg().BasePath+"/v1/messages/ws", withRequestID(withDeprecation("/v1/messages/ws", rejectDuplicateAuth(allowMethods(requireReady(handleWebSocket), http.MethodGet)))))
+	api("/v1/messages/count_tokens", allowMethods(handleCountTokens, http.MethodPost))
+	api("/v1/chat/completions", allowMethods(handleChatCompletions, http.MethodPost))
+	api("/v1/multi", allowMethods(handleMulti, http.MethodPost))
+	api("/v1/pricing", allowMethods(handlePricing, http.MethodGet))
+	api("/v1/selftest", allowMethods(requireAdmin(handleSelftest), http.MethodPost))
+	api("/v1/replay", allowMethods(requireAdmin(handleReplay), http.MethodPost))
+	api("/v1/config/reload", allowMethods(requireAdmin(handleConfigReload), http.MethodPost))
+	api("/v1/allowed-models", allowMethods(requireAdmin(handleListAllowedModels), http.MethodGet))
+	api("/v1/allowed-models/{model}", allowMethods(requireAdmin(handleAllowedModel), http.MethodPut, http.MethodDelete))
+	api("/v1/model-aliases", allowMethods(requireAdmin(handleListModelAliases), http.MethodGet))
+	api("/v1/model-aliases/{alias}", allowMethods(requireAdmin(handleModelAlias), http.MethodPut, http.MethodDelete))
+	api("/v1/flags", allowMethods(requireAdmin(handleListFlags), http.MethodGet))
+	api("/v1/flags/{name}", allowMethods(requireAdmin(handleSetFlag), http.MethodPut))
+	api("/v1/export/usage.csv", allowMethods(requireAdmin(handleExportUsage), http.MethodGet))
+	api("/v1/keys", allowMethods(requireAdmin(handleListKeys), http.MethodGet))
+	api("/v1/keys/{id}", allowMethods(requireAdmin(handleGetKey), http.MethodGet))
+	api("/v1/keys/{id}/reset", allowMethods(requireAdmin(handleResetKeyUsage), http.MethodPost))
+	api("/v1/keys/{id}/usage/stream", allowMethods(requireAdmin(handleUsageStream), http.MethodGet))
+
+	ops("/health", allowMethods(handleHealthCheck, http.MethodGet, http.MethodHead))
+	ops("/metrics", allowMethods(handleMetrics, http.MethodGet))
+	mux.HandleFunc("/", withRequestID(handleUnknownRoute))
+	return mux
+}
+
+// handleUnknownRoute answers paths that no route matches with a not_found_error
+// instead of forwarding them upstream.
+func handleUnknownRoute(w http.ResponseWriter, r *http.Request) {
+	respondError(w, r, notFound(fmt.Sprintf("Unknown endpoint: %s %s", r.Method, r.URL.Path)))
+}
+
+// normalizeBasePath turns "api/llm/" into "/api/llm"; the root becomes "".
+func normalizeBasePath(p string) string {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeBasePath(t *testing.T) {
+	for in, want := range map[string]string{
+		"":           "",
+		"/":          "",
+		"api/llm":    "/api/llm",
+		"/api/llm/":  "/api/llm",
+		" /api/llm ": "/api/llm",
+	} {
+		if got := normalizeBasePath(in); got != want {
+			t.Errorf("normalizeBasePath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestBasePathRoutes(t *testing.T) {
+	useFakeDB(t, nil)
+	tests := []struct {
+		name       string
+		includeOps bool
+		method     string
+		path       string
+		wantFound  bool
+	}{
+		{"messages under the prefix", false, http.MethodGet, "/api/llm/v1/messages", true},
+		{"messages without the prefix", false, http.MethodGet, "/v1/messages", false},
+		{"legacy root under the prefix", false, http.MethodGet, "/api/llm/", true},
+		{"admin routes under the prefix", false, http.MethodPost, "/api/llm/v1/keys", true},
+		{"health at the root", false, http.MethodGet, "/health", true},
+		{"metrics at the root", false, http.MethodGet, "/metrics", true},
+		{"health not under the prefix", false, http.MethodGet, "/api/llm/health", false},
+		{"health under the prefix with ops", true, http.MethodGet, "/api/llm/health", true},
+		{"metrics under the prefix with ops", true, http.MethodGet, "/api/llm/metrics", true},
+		{"health not at the root with ops", true, http.MethodGet, "/health", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.BasePath = "/api/llm"
+				c.BasePathIncludesOps = tt.includeOps
+			})
+			w := httptest.NewRecorder()
+			newRouter().ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if found := w.Code != http.StatusNotFound; found != tt.wantFound {
+				t.Errorf("%s %s answered %d, want found=%v", tt.method, tt.path, w.Code, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestMessagesRoutes(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.BasePath = ""
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	useFakeDB(t, nil)
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantError  string // error message, "" when forwarded
+	}{
+		{"messages", http.MethodPost, "/v1/messages", http.StatusOK, ""},
+		{"legacy root", http.MethodPost, "/", http.StatusOK, ""},
+		{"wrong method", http.MethodGet, "/v1/messages", http.StatusMethodNotAllowed, "Method not allowed"},
+		{"unknown endpoint", http.MethodPost, "/v1/complete", http.StatusNotFound, "Unknown endpoint: POST /v1/complete"},
+		{"below messages", http.MethodPost, "/v1/messages/batches", http.StatusNotFound, "Unknown endpoint: POST /v1/messages/batches"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`)
+			r.Method, r.URL.Path = tt.method, tt.path
+			w := httptest.NewRecorder()
+			newRouter().ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantError == "" {
+				return
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("body %q: %v", w.Body, err)
+			}
+			if resp.Error.Message != tt.wantError {
+				t.Errorf("error %+v, want %q", resp.Error, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// selftestBody is the smallest useful Messages request: one word in, at most
+// one token out.
+const selftestBody = `{"anthropic_version":"vertex-2023-10-16","messages":[{"role":"user","content":"ping"}],"max_tokens":1}`
+
+type selftestResult struct {
+	OK        bool   `json:"ok"`
+	Model     string `json:"model"`
+	Project   string `json:"project,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleSelftest sends a canned prompt to the model's provider with the gateway's own
+// credentials and reports whether the round trip worked. It checks the token
+// and upstream path end to end without touching any key's quota. ?model=
+// tests a model other than the default.
+func handleSelftest(w http.ResponseWriter, r *http.Request) {
+	result := selftestResult{Model: r.URL.Query().Get("model")}
+	if result.Model == "" {
+		result.Model = cfg().DefaultModel
+	}
+	fail := func(status int, msg string) {
+		result.Error = msg
+		writeJSON(w, status, result)
+	}
+
+	provider := newProvider(result.Model)
+	if v, ok := provider.(interface{ projectID() string }); ok {
+		result.Project = v.projectID()
+	}
+	if !provider.Ready() {
+		fail(http.StatusServiceUnavailable, "no upstream credentials")
+		return
+	}
+	regions, err := regionsForModel(result.Model)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json; charset=utf-8",
+		"X-Request-Id": requestIDFor(r),
+	}
+	start := time.Now()
+	resp, served, err := forwardWithFailover(r.Context(), provider, regions, result.Model, headers, []byte(selftestBody))
+	result.Region = served.region
+	if err != nil {
+		result.LatencyMS = time.Since(start).Milliseconds()
+		fail(http.StatusBadGateway, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	result.LatencyMS = time.Since(start).Milliseconds()
+	result.Status = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		fail(http.StatusBadGateway, strings.TrimSpace(string(body)))
+		return
+	}
+	result.OK = true
+	writeJSON(w, http.StatusOK, result)
+}
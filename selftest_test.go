@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelftest(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.DefaultModel = "claude-default"
+	})
+	tests := []struct {
+		name       string
+		query      string
+		status     int
+		body       string
+		wantStatus int
+		wantModel  string
+		wantError  string
+	}{
+		{"success", "", http.StatusOK, `{"type":"message","content":[{"type":"text","text":"pong"}]}`, http.StatusOK, "claude-default", ""},
+		{"other model", "?model=claude-other", http.StatusOK, `{"type":"message"}`, http.StatusOK, "claude-other", ""},
+		{"upstream rejects", "", http.StatusForbidden, `{"error":{"message":"Permission denied on project"}}`, http.StatusBadGateway, "claude-default", "Permission denied on project"},
+		{"upstream down", "", http.StatusServiceUnavailable, "unavailable", http.StatusBadGateway, "claude-default", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, nil)
+			useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+			fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != selftestBody {
+					t.Errorf("upstream got %s, want the canned prompt", body)
+				}
+				if model := strings.TrimPrefix(r.URL.Path, "/"+upstreamRegion(r)+"/"); model != tt.wantModel {
+					t.Errorf("request for %s, want %s", model, tt.wantModel)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			w := httptest.NewRecorder()
+			handleSelftest(w, httptest.NewRequest(http.MethodPost, "/v1/selftest"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var result selftestResult
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.OK != (tt.wantStatus == http.StatusOK) || result.Model != tt.wantModel || result.Region != "us-east5" {
+				t.Errorf("result %+v", result)
+			}
+			if !result.OK && result.Error == "" {
+				t.Error("failure reported without an error")
+			}
+			if !strings.Contains(result.Error, tt.wantError) {
+				t.Errorf("error %q, want it to contain %q", result.Error, tt.wantError)
+			}
+			if len(fake.ran()) != 0 {
+				t.Errorf("self-test ran %d statements, want no quota touched", len(fake.ran()))
+			}
+		})
+	}
+}
+
+func TestSelftestRequiresAdmin(t *testing.T) {
+	setConfig(t, func(c *Config) { c.AdminToken = "admin-secret" })
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("upstream called without admin credentials")
+	})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/v1/selftest", nil)
+	r.Header.Set("Authorization", "Bearer not-the-admin")
+	requireAdmin(handleSelftest)(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// shouldShadow samples requests that are mirrored to the shadow model.
+func shouldShadow() bool {
+	if cfg().ShadowModel == "" || cfg().ShadowSampleRate <= 0 || !flags.Enabled(flagShadowTraffic) {
+		return false
+	}
+	return rand.Float64() < cfg().ShadowSampleRate
+}
+
+// shadowRequest sends a copy of the request to the shadow model in the
+// background and logs its token usage and latency for comparison. Its output
+// never reaches the client and it doesn't touch the caller's quota.
+func shadowRequest(headers map[string]string, body []byte, primaryModel string) {
+	go func() {
+		regions, err := regionsForModel(cfg().ShadowModel)
+		if err != nil {
+			log.Printf("Shadow request skipped: %v", err)
+			return
+		}
+		start := time.Now()
+		resp, served, err := forwardWithFailover(context.Background(), newProvider(cfg().ShadowModel), targetBalance.Order(regions, cfg().ShadowModel, ""), cfg().ShadowModel, headers, replaceBodyModel(body, cfg().ShadowModel))
+		if err != nil {
+			log.Printf("Shadow request to %s failed: %v", cfg().ShadowModel, err)
+			return
+		}
+		defer resp.Body.Close()
+
+		var usage usageTracker
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			usage.observe(scanner.Bytes())
+		}
+		log.Printf("Shadow comparison: primary=%s shadow=%s region=%s status=%d input_tokens=%d output_tokens=%d latency=%s",
+			primaryModel, served.model, served.region, resp.StatusCode, usage.InputTokens, usage.OutputTokens, time.Since(start))
+	}()
+}
+
+// replaceBodyModel rewrites the "model" field of a request body if present.
+func replaceBodyModel(body []byte, model string) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	if _, ok := fields["model"]; !ok {
+		return body
+	}
+	fields["model"], _ = json.Marshal(model)
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return out
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShadowTraffic(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate float64
+		enabled    bool
+		wantShadow bool
+	}{
+		{"sampled request is mirrored", 1, true, true},
+		{"unsampled request is not", 0, true, false},
+		{"flag off", 1, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.Regions = []string{"us-east5"}
+				c.ModelRegions = nil
+				c.VertexTargets = nil
+				c.ShadowModel = "claude-shadow"
+				c.ShadowSampleRate = tt.sampleRate
+			})
+			setFlag(t, flagShadowTraffic, tt.enabled)
+			auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+			shadowed := make(chan string, 1)
+			fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/claude-shadow") {
+					shadowed <- r.URL.Path
+				}
+				streamSSE(w, sseTranscript)
+			})
+
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest("k", `{"model":"`+cfg().DefaultModel+`","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Hello") {
+				t.Fatalf("primary response %d: %s", w.Code, w.Body)
+			}
+			if strings.Contains(w.Header().Get("X-Served-Model"), "shadow") {
+				t.Error("client served by the shadow model")
+			}
+
+			wait := 50 * time.Millisecond
+			if tt.wantShadow {
+				wait = 2 * time.Second
+			}
+			select {
+			case <-shadowed:
+				if !tt.wantShadow {
+					t.Error("unexpected shadow request")
+				}
+			case <-time.After(wait):
+				if tt.wantShadow {
+					t.Error("no shadow request")
+				}
+			}
+			if got := auth.remaining("k"); got != 9 {
+				t.Errorf("key has %d calls left, want one charged", got)
+			}
+		})
+	}
+}
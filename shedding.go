@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadShedder rejects a growing fraction of requests while upstream latency
+// exceeds the SLO. Every evaluation interval the p99 of the recent latency
+// samples is compared with the SLO and the shed rate is stepped up or down.
+// Samples older than maxAge no longer count, so the rate comes down once
+// shedding leaves too few requests to sample.
+type loadShedder struct {
+	mu       sync.Mutex
+	slo      time.Duration
+	step     float64
+	maxRate  float64
+	interval time.Duration
+	maxAge   time.Duration
+
+	samples  []latencySample
+	next     int
+	filled   bool
+	rate     float64
+	lastEval time.Time
+}
+
+// latencySample is an upstream latency and when it was recorded.
+type latencySample struct {
+	latency time.Duration
+	at      time.Time
+}
+
+func newLoadShedder(slo time.Duration, window int, step, maxRate float64, interval, maxAge time.Duration) *loadShedder {
+	return &loadShedder{
+		slo:      slo,
+		step:     step,
+		maxRate:  maxRate,
+		interval: interval,
+		maxAge:   maxAge,
+		samples:  make([]latencySample, window),
+		lastEval: time.Now(),
+	}
+}
+
+// Record adds an upstream latency sample.
+func (s *loadShedder) Record(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples[s.next] = latencySample{latency: latency, at: time.Now()}
+	s.next = (s.next + 1) % len(s.samples)
+	if s.next == 0 {
+		s.filled = true
+	}
+}
+
+// ShouldShed reports whether the current request of a key in tier should be
+// rejected. Tiers are shed at the rate scaled by their SHED_TIER_WEIGHTS
+// weight, so higher tiers with a lower weight keep more of their traffic.
+func (s *loadShedder) ShouldShed(tier string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.lastEval) >= s.interval {
+		s.evaluateLocked()
+	}
+	return s.rate > 0 && rand.Float64() < s.rate*shedWeight(tier)
+}
+
+func (s *loadShedder) evaluateLocked() {
+	s.lastEval = time.Now()
+	n := s.next
+	if s.filled {
+		n = len(s.samples)
+	}
+	var recent []time.Duration
+	for _, sample := range s.samples[:n] {
+		if time.Since(sample.at) < s.maxAge {
+			recent = append(recent, sample.latency)
+		}
+	}
+	if len(recent) == 0 {
+		s.rate = max(s.rate-s.step, 0)
+		return
+	}
+	slices.Sort(recent)
+	p99 := recent[(len(recent)*99-1)/100]
+	if p99 > s.slo {
+		s.rate = min(s.rate+s.step, s.maxRate)
+	} else {
+		s.rate = max(s.rate-s.step, 0)
+	}
+}
+
+// Rate returns the current fraction of requests being shed.
+func (s *loadShedder) Rate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rate
+}
+
+// shedWeight is the factor the shed rate is scaled by for keys in tier: its
+// SHED_TIER_WEIGHTS entry, 1 for tiers without one.
+func shedWeight(tier string) float64 {
+	if w, ok := cfg().ShedTierWeights[tier]; ok {
+		return w
+	}
+	return 1
+}
+
+// parseShedTierWeights parses entries of the form tier=weight, with weights
+// between 0 (never shed) and 1 (shed at the full rate).
+func parseShedTierWeights(entries []string) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, entry := range entries {
+		tier, value, ok := strings.Cut(entry, "=")
+		w, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || strings.TrimSpace(tier) == "" || err != nil || w < 0 || w > 1 {
+			log.Printf("Ignoring invalid SHED_TIER_WEIGHTS entry %q", entry)
+			continue
+		}
+		weights[strings.TrimSpace(tier)] = w
+	}
+	return weights
+}
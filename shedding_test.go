@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadShedder(t *testing.T) {
+	s := newLoadShedder(100*time.Millisecond, 10, 0.25, 0.9, 0, time.Hour)
+	record := func(latency time.Duration) {
+		for range 10 {
+			s.Record(latency)
+		}
+	}
+
+	record(50 * time.Millisecond)
+	s.ShouldShed(defaultTier)
+	if got := s.Rate(); got != 0 {
+		t.Fatalf("rate %v under the SLO, want 0", got)
+	}
+
+	record(300 * time.Millisecond)
+	for _, want := range []float64{0.25, 0.5, 0.75, 0.9, 0.9} {
+		s.ShouldShed(defaultTier)
+		if got := s.Rate(); got != want {
+			t.Errorf("rate %v while over the SLO, want %v", got, want)
+		}
+	}
+
+	record(50 * time.Millisecond)
+	for _, want := range []float64{0.65, 0.4, 0.15, 0} {
+		s.ShouldShed(defaultTier)
+		if got := s.Rate(); got < want-1e-9 || got > want+1e-9 {
+			t.Errorf("rate %v while recovering, want %v", got, want)
+		}
+	}
+}
+
+func TestLoadShedderP99(t *testing.T) {
+	s := newLoadShedder(100*time.Millisecond, 100, 0.5, 1, 0, time.Hour)
+	// 一个慢请求不足以让 p99 超出 SLO
+	for i := range 100 {
+		latency := 10 * time.Millisecond
+		if i == 0 {
+			latency = time.Second
+		}
+		s.Record(latency)
+	}
+	s.ShouldShed(defaultTier)
+	if got := s.Rate(); got != 0 {
+		t.Errorf("rate %v with a single outlier, want 0", got)
+	}
+	// 窗口已满，新样本覆盖最旧的（即那个慢请求）
+	s.Record(time.Second)
+	s.Record(time.Second)
+	s.ShouldShed(defaultTier)
+	if got := s.Rate(); got != 0.5 {
+		t.Errorf("rate %v with two slow requests in 100, want 0.5", got)
+	}
+}
+
+func TestShedRequestsAreFree(t *testing.T) {
+	s := newLoadShedder(time.Millisecond, 1, 1, 1, 0, time.Hour)
+	s.Record(time.Second)
+	swap(t, &shedder, s)
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("shed request reached the upstream")
+	})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}]}`))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503: %s", w.Code, w.Body)
+	}
+	if got := auth.remaining("k"); got != 5 {
+		t.Errorf("key has %d calls left, want 5", got)
+	}
+
+	w = httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "llm_gateway_shed_rate 1\n") {
+		t.Error("/metrics doesn't report the shed rate")
+	}
+}
+
+func TestLoadShedderSamplesExpire(t *testing.T) {
+	s := newLoadShedder(100*time.Millisecond, 10, 0.5, 0.9, 0, 20*time.Millisecond)
+	s.Record(time.Second)
+	s.ShouldShed(defaultTier)
+	if got := s.Rate(); got != 0.5 {
+		t.Fatalf("rate %v over the SLO, want 0.5", got)
+	}
+	// 丢弃期间没有新样本，旧的慢样本过期后比例回落
+	time.Sleep(30 * time.Millisecond)
+	s.ShouldShed(defaultTier)
+	if got := s.Rate(); got != 0 {
+		t.Errorf("rate %v once the samples expired, want 0", got)
+	}
+}
+
+func TestParseShedTierWeights(t *testing.T) {
+	got := parseShedTierWeights([]string{"enterprise=0", " pro = 0.5 ", "free=2", "=0.1", "basic"})
+	if want := map[string]float64{"enterprise": 0, "pro": 0.5}; !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestShedByTier(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.ShedTierWeights = map[string]float64{"enterprise": 0}
+	})
+	s := newLoadShedder(time.Millisecond, 1, 1, 1, 0, time.Hour)
+	s.Record(time.Second)
+	swap(t, &shedder, s)
+	useKeys(t,
+		&APIKey{Key: "free", RemainingCalls: 5, Tier: defaultTier},
+		&APIKey{Key: "enterprise", RemainingCalls: 5, Tier: "enterprise"},
+	)
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+
+	for key, want := range map[string]int{"free": http.StatusServiceUnavailable, "enterprise": http.StatusOK} {
+		w := httptest.NewRecorder()
+		handleForwardToEndpoint(w, newMessagesRequest(key, `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+		if w.Code != want {
+			t.Errorf("%s key: status %d, want %d: %s", key, w.Code, want, w.Body)
+		}
+	}
+}
+
+func TestShedderRecordsTimeouts(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	s := newLoadShedder(time.Hour, 10, 0.1, 0.9, time.Hour, time.Hour)
+	swap(t, &shedder, s)
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`).WithContext(ctx))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status %d, want 504: %s", w.Code, w.Body)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next != 1 || s.samples[0].latency < 30*time.Millisecond {
+		t.Errorf("samples %v, want the timed-out request at 30ms or more", s.samples[:s.next])
+	}
+}
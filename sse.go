@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// readSSEEvent reads the next complete server-sent event, including the
+// blank line that terminates it. Lines split across network reads are
+// reassembled by the bufio.Reader, so a partial line is never returned with a
+// nil error. A stream ending between events returns io.EOF and no data; one
+// ending within an event returns the incomplete event with
+// io.ErrUnexpectedEOF. Any other error is likewise returned together with the
+// incomplete event. Callers must not forward incomplete events.
+func readSSEEvent(reader *bufio.Reader) ([]byte, error) {
+	var event []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		event = append(event, line...)
+		if err == io.EOF && len(event) > 0 {
+			return event, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return event, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return event, nil
+		}
+	}
+}
+
+// writeSSE writes a single server-sent event and flushes it to the client.
+func writeSSE(w http.ResponseWriter, event string, data []byte) error {
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// writeSSEError terminates a stream with an Anthropic-style error event.
+func writeSSEError(w io.Writer, errType, message string) {
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", anthropicError(errType, message))
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// sseEventTypes are the event types of the Messages streaming API.
+var sseEventTypes = map[string]bool{
+	"message_start":       true,
+	"content_block_start": true,
+	"content_block_delta": true,
+	"content_block_stop":  true,
+	"message_delta":       true,
+	"message_stop":        true,
+	"ping":                true,
+	"error":               true,
+}
+
+// terminalEvents are forwarded by every filter: they carry the stop reason,
+// the final usage and errors, and mark the end of the stream.
+var terminalEvents = []string{"message_delta", "message_stop", "error"}
+
+// eventFilter is the set of stream event types forwarded to the client. A
+// nil filter forwards everything.
+type eventFilter map[string]bool
+
+// parseEventFilter reads the event types a client wants from the
+// X-Stream-Events header or the stream_events query parameter, as a comma
+// separated list such as "content_block_delta".
+func parseEventFilter(r *http.Request) (eventFilter, error) {
+	value := r.Header.Get("X-Stream-Events")
+	if value == "" {
+		value = r.URL.Query().Get("stream_events")
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	filter := make(eventFilter)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if !sseEventTypes[name] {
+			return nil, fmt.Errorf("unknown stream event type %q", name)
+		}
+		filter[name] = true
+	}
+	for _, name := range terminalEvents {
+		filter[name] = true
+	}
+	return filter, nil
+}
+
+// apply drops the events of data whose type the client didn't ask for. data
+// holds zero or more complete events; anything without a recognisable type,
+// such as a non-SSE error body, is kept.
+func (f eventFilter) apply(data []byte) []byte {
+	if f == nil || len(data) == 0 {
+		return data
+	}
+	var out []byte
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		event, err := readSSEEvent(reader)
+		if t := sseEventType(event); len(event) > 0 && (t == "" || f[t]) {
+			out = append(out, event...)
+		}
+		if err != nil {
+			return out
+		}
+	}
+}
+
+// sseEventType returns the event's type from its event: line, or from the
+// type field of its data when there is none.
+func sseEventType(event []byte) string {
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		if name, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r"), []byte("event:")); ok {
+			return string(bytes.TrimSpace(name))
+		}
+	}
+	data, ok := sseEventData(event)
+	if !ok {
+		return ""
+	}
+	var payload struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(data, &payload)
+	return payload.Type
+}
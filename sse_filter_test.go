@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseEventFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		query   string
+		want    []string // nil 表示不过滤
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "header", header: "content_block_delta", want: []string{"content_block_delta", "error", "message_delta", "message_stop"}},
+		{name: "query", query: "content_block_delta, ping", want: []string{"content_block_delta", "error", "message_delta", "message_stop", "ping"}},
+		{name: "header wins", header: "message_start", query: "ping", want: []string{"error", "message_delta", "message_start", "message_stop"}},
+		{name: "unknown type", header: "content_block_delta,thinking", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/messages?stream_events="+strings.ReplaceAll(tt.query, " ", "%20"), nil)
+			if tt.header != "" {
+				r.Header.Set("X-Stream-Events", tt.header)
+			}
+			filter, err := parseEventFilter(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			var got []string
+			for name := range filter {
+				got = append(got, name)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("filter %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventFilterApply(t *testing.T) {
+	ping := "event: ping\ndata: {\"type\": \"ping\"}\n\n"
+	delta := "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi\"}}\n\n"
+	untyped := "data: {\"type\":\"content_block_start\",\"index\":0}\n\n"
+	stop := "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+	filter := eventFilter{"content_block_delta": true, "message_stop": true}
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"kept", delta, delta},
+		{"dropped", ping, ""},
+		{"mixed", ping + delta + ping + stop, delta + stop},
+		{"type from the data", untyped + delta, delta},
+		{"not an event stream", `{"error":"bad gateway"}`, `{"error":"bad gateway"}`},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := string(filter.apply([]byte(tt.in))); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := string(eventFilter(nil).apply([]byte(ping + delta))); got != ping+delta {
+		t.Errorf("nil filter changed the stream: %q", got)
+	}
+}
+
+func TestFilteredStream(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	ping := "event: ping\ndata: {\"type\": \"ping\"}\n\n"
+	events := strings.SplitAfter(sseTranscript, "\n\n")
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, events[0]+ping+strings.Join(events[1:], ""))
+	})
+
+	tests := []struct {
+		name   string
+		filter string
+		want   []string
+	}{
+		{"unfiltered", "", []string{"message_start", "ping", "content_block_start", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}},
+		{"deltas only", "content_block_delta", []string{"content_block_delta", "content_block_delta", "message_delta", "message_stop"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := auth.remaining("k")
+			r := newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`)
+			if tt.filter != "" {
+				r.Header.Set("X-Stream-Events", tt.filter)
+			}
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var got []string
+			for _, event := range strings.SplitAfter(w.Body.String(), "\n\n") {
+				if event != "" {
+					got = append(got, sseEventType([]byte(event)))
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("client got %v, want %v", got, tt.want)
+			}
+			if !strings.Contains(w.Body.String(), `"text":"Hello"`) || !strings.Contains(w.Body.String(), `"output_tokens":5`) {
+				t.Errorf("essential content missing: %s", w.Body)
+			}
+			if auth.remaining("k") != before-1 {
+				t.Error("filtered request not charged like any other")
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	r := newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`)
+	r.Header.Set("X-Stream-Events", "everything")
+	handleForwardToEndpoint(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown event type: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader returns at most n bytes per read, splitting events and lines
+// wherever the boundaries fall.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c chunkReader) Read(p []byte) (int, error) {
+	return c.r.Read(p[:min(len(p), c.n)])
+}
+
+func TestReadSSEEvent(t *testing.T) {
+	const events = "event: a\ndata: {\"x\":1}\n\n" + "event: b\r\ndata: {\"y\":2}\r\n\r\n" + ": comment\n\n"
+	want := []string{"event: a\ndata: {\"x\":1}\n\n", "event: b\r\ndata: {\"y\":2}\r\n\r\n", ": comment\n\n"}
+	readers := map[string]func() io.Reader{
+		"whole":        func() io.Reader { return strings.NewReader(events) },
+		"one byte":     func() io.Reader { return iotest.OneByteReader(strings.NewReader(events)) },
+		"7-byte reads": func() io.Reader { return chunkReader{strings.NewReader(events), 7} },
+		"half reads":   func() io.Reader { return iotest.HalfReader(strings.NewReader(events)) },
+	}
+	for name, newReader := range readers {
+		t.Run(name, func(t *testing.T) {
+			// 最小缓冲区，使行也会跨越多次读取
+			reader := bufio.NewReaderSize(newReader(), 16)
+			for i, w := range want {
+				event, err := readSSEEvent(reader)
+				if err != nil || string(event) != w {
+					t.Fatalf("event %d = %q, %v; want %q", i, event, err, w)
+				}
+			}
+			if event, err := readSSEEvent(reader); err != io.EOF || len(event) != 0 {
+				t.Errorf("after the last event got %q, %v; want io.EOF", event, err)
+			}
+		})
+	}
+}
+
+func TestReadSSEEventTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string
+	}{
+		{"mid-line", "event: b\ndata: {\"y\""},
+		{"after the data line", "event: b\ndata: {\"y\":2}\n"},
+		{"after the event line", "event: b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(chunkReader{strings.NewReader("event: a\ndata: {}\n\n" + tt.tail), 5})
+			if event, err := readSSEEvent(reader); err != nil || string(event) != "event: a\ndata: {}\n\n" {
+				t.Fatalf("first event %q, %v", event, err)
+			}
+			event, err := readSSEEvent(reader)
+			if err != io.ErrUnexpectedEOF || string(event) != tt.tail {
+				t.Errorf("got %q, %v; want the partial event with io.ErrUnexpectedEOF", event, err)
+			}
+		})
+	}
+}
+
+func TestReadSSEEventReadError(t *testing.T) {
+	reader := bufio.NewReader(io.MultiReader(strings.NewReader("event: a\nda"), iotest.ErrReader(io.ErrClosedPipe)))
+	event, err := readSSEEvent(reader)
+	if err != io.ErrClosedPipe || string(event) != "event: a\nda" {
+		t.Errorf("got %q, %v; want the partial event with the read error", event, err)
+	}
+}
+
+func TestWriteSSEError(t *testing.T) {
+	tests := []struct {
+		errType, message string
+		want             string
+	}{
+		{"api_error", "Upstream stream ended unexpectedly",
+			"event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"api_error\",\"message\":\"Upstream stream ended unexpectedly\"}}\n\n"},
+		{"overloaded_error", `quota "exhausted"`,
+			"event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"quota \\\"exhausted\\\"\"}}\n\n"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeSSEError(w, tt.errType, tt.message)
+		if w.Body.String() != tt.want || !w.Flushed {
+			t.Errorf("got %q (flushed %v), want %q", w.Body, w.Flushed, tt.want)
+		}
+	}
+}
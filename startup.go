@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Startup modes. In strict mode a missing setting or an unreachable database
+// stops the process; in lenient mode the gateway starts degraded, answers
+// 503 and keeps retrying its dependencies in the background.
+const (
+	startupStrict  = "strict"
+	startupLenient = "lenient"
+)
+
+// dbReady is set once the database is reachable and migrated.
+var dbReady atomic.Bool
+
+// parseStartupMode validates STARTUP_MODE, falling back to strict.
+func parseStartupMode(mode string) string {
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case startupStrict, startupLenient:
+		return mode
+	default:
+		log.Printf("Invalid STARTUP_MODE %q, using %s", mode, startupStrict)
+		return startupStrict
+	}
+}
+
+// startupFailure stops the process in strict mode and only logs the error in
+// lenient mode. It reports whether startup continues.
+func startupFailure(format string, args ...any) bool {
+	if cfg().StartupMode == startupStrict {
+		log.Fatalf(format, args...)
+	}
+	log.Printf("Starting degraded: "+format, args...)
+	return false
+}
+
+// prepareDB checks the connection, applies pending migrations and loads the
+// stored feature flags and allowed models.
+func prepareDB(db *sql.DB) error {
+	if err := db.Ping(); err != nil {
+		return err
+	}
+	if err := runMigrations(db); err != nil {
+		return err
+	}
+	if err := flags.Load(db); err != nil {
+		log.Printf("Error loading feature flags: %v", err)
+	}
+	if err := storedModels.Load(db); err != nil {
+		log.Printf("Error loading allowed models: %v", err)
+	}
+	if err := modelAliases.Load(db); err != nil {
+		log.Printf("Error loading model aliases: %v", err)
+	}
+	dbReady.Store(true)
+	return nil
+}
+
+// dbRetryBackoff is the first delay before the database is retried.
+var dbRetryBackoff = time.Second
+
+// retryDB keeps preparing the database with exponential backoff until it
+// succeeds.
+func retryDB(db *sql.DB) {
+	backoff := dbRetryBackoff
+	for {
+		time.Sleep(backoff)
+		err := prepareDB(db)
+		if err == nil {
+			log.Printf("Database is ready")
+			return
+		}
+		log.Printf("Error preparing database: %v, retrying in %s", err, backoff)
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// requireReady answers 503 while the gateway runs degraded.
+func requireReady(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 运维密钥在数据库不可用时仍可验证上游链路
+		if !dbReady.Load() && !isOperatorRequest(r) {
+			respondError(w, r, unavailable("Gateway dependencies are unavailable, please retry later", nil))
+			return
+		}
+		handler(w, r)
+	}
+}
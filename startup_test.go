@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseStartupMode(t *testing.T) {
+	for in, want := range map[string]string{
+		"":          startupStrict,
+		"strict":    startupStrict,
+		" Lenient ": startupLenient,
+		"degrade":   startupStrict,
+	} {
+		if got := parseStartupMode(in); got != want {
+			t.Errorf("parseStartupMode(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestStartupFailureStrict(t *testing.T) {
+	// 严格模式下进程直接退出，只能在子进程中验证
+	if os.Getenv("STARTUP_FAILURE_CHILD") == "1" {
+		setConfig(t, func(c *Config) { c.StartupMode = startupStrict })
+		startupFailure("Failed to prepare database: %v", errors.New("connection refused"))
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestStartupFailureStrict$")
+	cmd.Env = append(os.Environ(), "STARTUP_FAILURE_CHILD=1")
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.Success() {
+		t.Fatalf("process ended with %v, want it to exit with an error:\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Failed to prepare database: connection refused") {
+		t.Errorf("output\n%s\nwant the failure logged", out)
+	}
+}
+
+func TestStartupLenient(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.StartupMode = startupLenient
+		c.OperatorKey = "operator-secret"
+	})
+	swap(t, &dbRetryBackoff, 10*time.Millisecond)
+	swap(t, &flags, &featureFlags{values: make(map[string]bool)})
+	swap(t, &storedModels, &modelAllowlist{})
+	swap(t, &modelAliases, &modelAliasTable{})
+	swap(t, &accessToken, "fake-token")
+	t.Cleanup(func() { dbReady.Store(true) })
+	dbReady.Store(false)
+
+	// 数据库先不可用，恢复后由后台重试完成迁移
+	var down atomic.Bool
+	down.Store(true)
+	versions := &schemaVersions{}
+	conn, _ := openFakeDB(t, func(q fakeQuery) fakeResult {
+		if down.Load() {
+			return fakeResult{Err: errors.New("connection refused")}
+		}
+		return versions.handle(q)
+	})
+	swap(t, &db, conn)
+
+	if err := prepareDB(conn); err == nil {
+		t.Fatal("database prepared while it is down")
+	}
+	if startupFailure("Failed to prepare database: %v", errors.New("connection refused")) {
+		t.Error("startupFailure reported startup as healthy")
+	}
+
+	handler := requireReady(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	tests := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"client request", "k", http.StatusServiceUnavailable},
+		{"operator request", "operator-secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, newMessagesRequest(tt.key, `{}`))
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+	w := httptest.NewRecorder()
+	handleHealthCheck(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("health %d while degraded, want 503", w.Code)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		retryDB(conn)
+		close(done)
+	}()
+	time.Sleep(30 * time.Millisecond)
+	down.Store(false)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("database not prepared after it came back")
+	}
+	if !dbReady.Load() || len(versions.applied) != len(migrations) {
+		t.Fatalf("ready %v with %d migrations applied, want all %d", dbReady.Load(), len(versions.applied), len(migrations))
+	}
+	w = httptest.NewRecorder()
+	handler(w, newMessagesRequest("k", `{}`))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d after recovery, want the request served", w.Code)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+// StreamTransformer rewrites the streamed model output on its way to the
+// client. Transform receives one complete SSE event and returns the bytes to
+// send in its place, which may be empty or several events. Flush returns
+// anything still buffered when the stream ends. Transformers are stateful, so
+// a new one is created for every request.
+type StreamTransformer interface {
+	Transform(event []byte) []byte
+	Flush() []byte
+}
+
+// newStreamTransformer creates the transformer applied to each response.
+var newStreamTransformer = func() StreamTransformer { return nopTransformer{} }
+
+// transformMessage rewrites the model output of a complete, non-streaming
+// message the way newStreamTransformer's transformers rewrite streams.
+var transformMessage = func(body []byte) []byte { return body }
+
+type nopTransformer struct{}
+
+func (nopTransformer) Transform(event []byte) []byte { return event }
+func (nopTransformer) Flush() []byte                 { return nil }
+
+// TextFilter rewrites the text of a content block. Pending text that a
+// filter can't decide on yet is kept back by the textDeltaTransformer.
+type TextFilter func(text string) string
+
+// textDeltaTransformer applies a TextFilter to the text deltas of every
+// content block. Since a sensitive value may be split over several deltas, the
+// last holdback runes of each block are buffered unfiltered and only emitted
+// once more text arrives or the block ends; they are then filtered together
+// with the new text. Working on decoded runes means multi-byte characters are
+// never split. Non-text events pass through untouched, preserving SSE framing.
+type textDeltaTransformer struct {
+	filter TextFilter
+	// safeCut moves the point up to which text is emitted back so that it
+	// doesn't split text the filter would rewrite as a whole; nil keeps it.
+	safeCut  func(text string, cut int) int
+	holdback int
+	pending  map[int]string
+}
+
+func newTextDeltaTransformer(filter TextFilter, holdback int) *textDeltaTransformer {
+	return &textDeltaTransformer{filter: filter, holdback: holdback, pending: make(map[int]string)}
+}
+
+type sseData struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+}
+
+func (t *textDeltaTransformer) Transform(event []byte) []byte {
+	data, ok := sseEventData(event)
+	if !ok {
+		return event
+	}
+	var msg sseData
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return event
+	}
+
+	switch {
+	case msg.Type == "content_block_delta" && msg.Delta.Type == "text_delta":
+		text := t.pending[msg.Index] + msg.Delta.Text
+		cut := len(text)
+		for n := 0; n < t.holdback && cut > 0; n++ {
+			_, size := utf8.DecodeLastRuneInString(text[:cut])
+			cut -= size
+		}
+		if t.safeCut != nil {
+			cut = t.safeCut(text, cut)
+		}
+		// 保留的文本不经过滤，否则被截断的匹配会先被替换，与后续文本拼接后无法再匹配
+		t.pending[msg.Index] = text[cut:]
+		if cut == 0 {
+			return nil
+		}
+		return textDeltaEvent(msg.Index, t.filter(text[:cut]))
+	case msg.Type == "content_block_stop":
+		return append(t.flushBlock(msg.Index), event...)
+	}
+	return event
+}
+
+func (t *textDeltaTransformer) Flush() []byte {
+	var out []byte
+	for index := range t.pending {
+		out = append(out, t.flushBlock(index)...)
+	}
+	return out
+}
+
+func (t *textDeltaTransformer) flushBlock(index int) []byte {
+	text, ok := t.pending[index]
+	delete(t.pending, index)
+	if !ok || text == "" {
+		return nil
+	}
+	return textDeltaEvent(index, t.filter(text))
+}
+
+func textDeltaEvent(index int, text string) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]string{"type": "text_delta", "text": text},
+	})
+	return []byte(fmt.Sprintf("event: content_block_delta\ndata: %s\n\n", data))
+}
+
+// sseEventData returns the payload of the event's data line.
+func sseEventData(event []byte) ([]byte, bool) {
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		if data, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r"), []byte("data:")); ok {
+			return bytes.TrimSpace(data), true
+		}
+	}
+	return nil, false
+}
+
+// messageTextFilter returns a transformMessage applying filter to the text
+// blocks of a Messages response. Bodies that aren't messages, such as errors,
+// are returned unchanged.
+func messageTextFilter(filter TextFilter) func([]byte) []byte {
+	return func(body []byte) []byte {
+		var msg map[string]json.RawMessage
+		var content []map[string]json.RawMessage
+		if json.Unmarshal(body, &msg) != nil || json.Unmarshal(msg["content"], &content) != nil {
+			return body
+		}
+		for _, block := range content {
+			var text string
+			if string(block["type"]) != `"text"` || json.Unmarshal(block["text"], &text) != nil {
+				continue
+			}
+			block["text"], _ = json.Marshal(filter(text))
+		}
+		msg["content"], _ = json.Marshal(content)
+		out, err := json.Marshal(msg)
+		if err != nil {
+			return body
+		}
+		return out
+	}
+}
+
+// redactionFilter masks every match of patterns.
+func redactionFilter(patterns []*regexp.Regexp) TextFilter {
+	return func(text string) string {
+		for _, re := range patterns {
+			text = re.ReplaceAllString(text, redacted)
+		}
+		return text
+	}
+}
+
+// redactionCut moves cut to the start of any match of patterns spanning it,
+// so a match is always masked as a whole.
+func redactionCut(patterns []*regexp.Regexp) func(text string, cut int) int {
+	return func(text string, cut int) int {
+		for moved := true; moved; {
+			moved = false
+			for _, re := range patterns {
+				for _, loc := range re.FindAllStringIndex(text, -1) {
+					if loc[0] < cut && loc[1] > cut {
+						cut, moved = loc[0], true
+					}
+				}
+			}
+		}
+		return cut
+	}
+}
+
+// newRedactionTransformer masks every match of patterns in the model output.
+// holdback must be at least the longest text a pattern can match.
+func newRedactionTransformer(patterns []*regexp.Regexp, holdback int) StreamTransformer {
+	t := newTextDeltaTransformer(redactionFilter(patterns), holdback)
+	t.safeCut = redactionCut(patterns)
+	return t
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var emailPattern = regexp.MustCompile(`[a-z0-9.]+@[a-z0-9.]+\.[a-z]+`)
+
+// deltaTranscript is a stream whose text arrives in the given deltas.
+func deltaTranscript(deltas ...string) []string {
+	events := []string{
+		"event: message_start\n" + `data: {"type":"message_start","message":{"usage":{"input_tokens":10,"output_tokens":1}}}` + "\n\n",
+		"event: content_block_start\n" + `data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}` + "\n\n",
+	}
+	for _, d := range deltas {
+		text, _ := json.Marshal(d)
+		events = append(events, fmt.Sprintf("event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":%s}}\n\n", text))
+	}
+	return append(events,
+		"event: content_block_stop\n"+`data: {"type":"content_block_stop","index":0}`+"\n\n",
+		"event: message_stop\n"+`data: {"type":"message_stop"}`+"\n\n",
+	)
+}
+
+// streamedText checks that out is a sequence of complete events and returns
+// the text of its deltas together with the event types in order.
+func streamedText(t *testing.T, out string) (string, []string) {
+	t.Helper()
+	if !strings.HasSuffix(out, "\n\n") {
+		t.Fatalf("output doesn't end with a complete event: %q", out)
+	}
+	var text strings.Builder
+	var types []string
+	for _, event := range strings.Split(strings.TrimSuffix(out, "\n\n"), "\n\n") {
+		data, ok := sseEventData([]byte(event))
+		if !ok || !strings.HasPrefix(event, "event: ") {
+			t.Fatalf("malformed event %q", event)
+		}
+		var msg sseData
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("event %q: %v", event, err)
+		}
+		if !utf8.ValidString(msg.Delta.Text) {
+			t.Errorf("delta %q splits a character", msg.Delta.Text)
+		}
+		text.WriteString(msg.Delta.Text)
+		types = append(types, msg.Type)
+	}
+	return text.String(), types
+}
+
+func TestRedactionTransformer(t *testing.T) {
+	tests := []struct {
+		name   string
+		deltas []string
+		want   string
+	}{
+		{"match within a delta", []string{"Mail bob@example.com now"}, "Mail " + redacted + " now"},
+		{"match split across deltas", []string{"Mail bob@exa", "mple.c", "om now"}, "Mail " + redacted + " now"},
+		{"match at the end of the block", []string{"Write to ", "alice@example.org"}, "Write to " + redacted},
+		{"multi-byte text split by the holdback", []string{"こんにちは、", "世界！ ✓ é"}, "こんにちは、世界！ ✓ é"},
+		{"nothing to redact", []string{"Hello", " world"}, "Hello world"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newRedactionTransformer([]*regexp.Regexp{emailPattern}, 8)
+			var out strings.Builder
+			for _, event := range deltaTranscript(tt.deltas...) {
+				out.Write(tr.Transform([]byte(event)))
+			}
+			out.Write(tr.Flush())
+
+			text, types := streamedText(t, out.String())
+			if text != tt.want {
+				t.Errorf("text %q, want %q", text, tt.want)
+			}
+			if types[len(types)-2] != "content_block_stop" || types[len(types)-1] != "message_stop" {
+				t.Errorf("events %v, want the block stopped after its text", types)
+			}
+		})
+	}
+}
+
+func TestRedactionTransformerFlushesUnfinishedBlock(t *testing.T) {
+	tr := newRedactionTransformer([]*regexp.Regexp{emailPattern}, 8)
+	events := deltaTranscript("cut off at bob@example.com")
+	var out strings.Builder
+	for _, event := range events[:len(events)-2] {
+		out.Write(tr.Transform([]byte(event)))
+	}
+	out.Write(tr.Flush())
+	if text, _ := streamedText(t, out.String()); text != "cut off at "+redacted {
+		t.Errorf("text %q after the stream ended early", text)
+	}
+}
+
+func TestMessageTextFilter(t *testing.T) {
+	filter := messageTextFilter(redactionFilter([]*regexp.Regexp{emailPattern}))
+	got := filter([]byte(`{"id":"msg_1","content":[{"type":"text","text":"Mail bob@example.com"},{"type":"tool_use","name":"x","input":{"to":"bob@example.com"}}]}`))
+	var msg struct {
+		ID      string            `json:"id"`
+		Content []json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(got, &msg); err != nil || msg.ID != "msg_1" || len(msg.Content) != 2 {
+		t.Fatalf("filtered message %s", got)
+	}
+	if !strings.Contains(string(msg.Content[0]), `"Mail `+redacted+`"`) || !strings.Contains(string(msg.Content[1]), "bob@example.com") {
+		t.Errorf("content %s, want only the text block redacted", got)
+	}
+	if body := `{"type":"error","error":{"message":"bob@example.com"}}`; string(filter([]byte(body))) != body {
+		t.Error("error body changed")
+	}
+}
+
+func TestRedactedStreamResponse(t *testing.T) {
+	patterns := []*regexp.Regexp{emailPattern}
+	swap(t, &newStreamTransformer, func() StreamTransformer { return newRedactionTransformer(patterns, 8) })
+	_, body := relay(t, func(w http.ResponseWriter, r *http.Request) {
+		streamChunks(w, strings.Join(deltaTranscript("Contact bob@exa", "mple.com today"), ""), 9)
+	})
+	text, _ := streamedText(t, body)
+	if text != "Contact "+redacted+" today" {
+		t.Errorf("client got text %q", text)
+	}
+	if strings.Contains(body, "example") {
+		t.Errorf("stream leaks the address:\n%s", body)
+	}
+}
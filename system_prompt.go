@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// systemPromptFor returns the system prompt used when a request has none:
+// the key's own, else DEFAULT_SYSTEM_PROMPT. Empty means none is injected.
+func systemPromptFor(key *APIKey) string {
+	if key.SystemPrompt != "" {
+		return key.SystemPrompt
+	}
+	return cfg().DefaultSystemPrompt
+}
+
+// applyDefaultSystemPrompt fills in the system prompt when the client didn't
+// send one. A client system prompt always wins, then the key's, then the
+// global default; an empty string or array counts as not sent.
+func applyDefaultSystemPrompt(body []byte, key *APIKey) ([]byte, error) {
+	prompt := systemPromptFor(key)
+	if prompt == "" {
+		return body, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("invalid request body: %v", err)
+	}
+	switch string(fields["system"]) {
+	case "", "null", `""`, "[]":
+	default:
+		return body, nil
+	}
+	fields["system"], _ = json.Marshal(prompt)
+	return json.Marshal(fields)
+}
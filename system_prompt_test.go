@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApplyDefaultSystemPrompt(t *testing.T) {
+	tests := []struct {
+		name       string
+		client     string // 请求体中的 system 字段，空表示未提供
+		key        string
+		global     string
+		wantSystem string
+	}{
+		{"nothing set", "", "", "", ""},
+		{"global only", "", "", "Global.", `"Global."`},
+		{"key only", "", "Key.", "", `"Key."`},
+		{"key over global", "", "Key.", "Global.", `"Key."`},
+		{"client over global", `"Client."`, "", "Global.", `"Client."`},
+		{"client over key", `"Client."`, "Key.", "", `"Client."`},
+		{"all three present", `"Client."`, "Key.", "Global.", `"Client."`},
+		{"client blocks kept", `[{"type":"text","text":"Client."}]`, "Key.", "Global.", `[{"type":"text","text":"Client."}]`},
+		{"empty client string", `""`, "Key.", "Global.", `"Key."`},
+		{"empty client array", `[]`, "", "Global.", `"Global."`},
+		{"null client", `null`, "Key.", "Global.", `"Key."`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.DefaultSystemPrompt = tt.global })
+			body := `{"messages":[{"role":"user","content":"hi"}]}`
+			if tt.client != "" {
+				body = `{"system":` + tt.client + `,"messages":[{"role":"user","content":"hi"}]}`
+			}
+			got, err := applyDefaultSystemPrompt([]byte(body), &APIKey{SystemPrompt: tt.key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(got, &fields); err != nil {
+				t.Fatal(err)
+			}
+			if string(fields["system"]) != tt.wantSystem {
+				t.Errorf("system %s, want %s", fields["system"], tt.wantSystem)
+			}
+			if tt.wantSystem == tt.client && string(got) != body {
+				t.Errorf("body rewritten to %s though the client's prompt won", got)
+			}
+		})
+	}
+}
+
+func TestSystemPromptOnForwardedRequest(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.DefaultSystemPrompt = "Global."
+	})
+	swap(t, &requestPipeline, nil)
+	useKeys(t,
+		&APIKey{Key: "plain", RemainingCalls: 10, Tier: defaultTier},
+		&APIKey{Key: "branded", RemainingCalls: 10, Tier: defaultTier, SystemPrompt: "Key."},
+	)
+	var got string
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ System string }
+		raw, _ := io.ReadAll(r.Body)
+		json.Unmarshal(raw, &body)
+		got = body.System
+		streamSSE(w, sseTranscript)
+	})
+
+	tests := []struct {
+		key, body, want string
+	}{
+		{"plain", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`, "Global."},
+		{"branded", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`, "Key."},
+		{"branded", `{"system":"Client.","messages":[{"role":"user","content":"hi"}],"stream":true}`, "Client."},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handleForwardToEndpoint(w, newMessagesRequest(tt.key, tt.body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		if got != tt.want {
+			t.Errorf("%s: upstream got system %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// vertexTarget is one VERTEX_TARGETS entry: a Vertex AI location of a
+// project, receiving requests by weight.
+type vertexTarget struct {
+	Project  string
+	Location string
+	Weight   int
+}
+
+// Region is how the target appears in a list of regions: project/location.
+func (t vertexTarget) Region() string {
+	return t.Project + "/" + t.Location
+}
+
+// parseVertexTargets parses project/location=weight entries; an entry
+// without a weight has weight 1.
+func parseVertexTargets(entries []string) []vertexTarget {
+	var targets []vertexTarget
+	for _, entry := range entries {
+		region, weight, ok := strings.Cut(entry, "=")
+		project, location, _ := strings.Cut(strings.TrimSpace(region), "/")
+		target := vertexTarget{Project: strings.TrimSpace(project), Location: strings.TrimSpace(location), Weight: 1}
+		if ok {
+			n, err := strconv.Atoi(strings.TrimSpace(weight))
+			if err != nil || n < 1 {
+				log.Printf("Ignoring invalid Vertex target %q", entry)
+				continue
+			}
+			target.Weight = n
+		}
+		if target.Project == "" || target.Location == "" {
+			log.Printf("Ignoring invalid Vertex target %q", entry)
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// vertexTargetRegions lists the targets in locations, or all of them when
+// locations is empty, in their configured order.
+func vertexTargetRegions(locations []string) []string {
+	var regions []string
+	for _, t := range cfg().VertexTargets {
+		if len(locations) == 0 || slices.Contains(locations, t.Location) {
+			regions = append(regions, t.Region())
+		}
+	}
+	return regions
+}
+
+// targetBalancer picks the Vertex target serving each request. Requests are
+// spread by smooth weighted round-robin like projects are, so the quota of
+// every target is used in proportion to its weight.
+type targetBalancer struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+var targetBalance = &targetBalancer{current: make(map[string]int)}
+
+// Order moves the target serving the next request for model to the front of
+// regions; the others keep their order for failover, as do regions that
+// aren't targets. Targets cooling down are only picked when all of them are.
+// With a sticky key the target is the one the key maps to by weighted
+// rendezvous hashing instead, so the requests of a key keep reaching the same
+// project and location while that target is available.
+func (b *targetBalancer) Order(regions []string, model, sticky string) []string {
+	weights := make(map[string]int)
+	for _, t := range cfg().VertexTargets {
+		weights[t.Region()] = t.Weight
+	}
+	var candidates, available []string
+	for _, region := range regions {
+		if _, ok := weights[region]; ok {
+			candidates = append(candidates, region)
+			if !cooldowns.Cooling(model, region) {
+				available = append(available, region)
+			}
+		}
+	}
+	if len(candidates) < 2 {
+		return regions
+	}
+	if len(available) > 0 {
+		candidates = available
+	}
+
+	var picked string
+	if sticky != "" {
+		picked = rendezvous(candidates, weights, sticky)
+	} else {
+		picked = b.next(candidates, weights)
+	}
+	ordered := []string{picked}
+	for _, region := range regions {
+		if region != picked {
+			ordered = append(ordered, region)
+		}
+	}
+	return ordered
+}
+
+// next picks one of candidates by smooth weighted round-robin.
+func (b *targetBalancer) next(candidates []string, weights map[string]int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var best string
+	total := 0
+	for _, region := range candidates {
+		b.current[region] += weights[region]
+		total += weights[region]
+		if best == "" || b.current[region] > b.current[best] {
+			best = region
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// rendezvous picks the candidate with the highest weighted score for key. A
+// key keeps its target when other targets come and go, and each target gets
+// keys in proportion to its weight.
+func rendezvous(candidates []string, weights map[string]int, key string) string {
+	var best string
+	bestScore := math.Inf(-1)
+	for _, region := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(region))
+		// 哈希映射到 (0,1) 区间，权重越大得分越高
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := float64(weights[region]) / -math.Log(u)
+		if score > bestScore {
+			best, bestScore = region, score
+		}
+	}
+	return best
+}
+
+// stickyKey returns the key a request is routed by when STICKY_ROUTING is on
+// and its body uses prompt caching, whose cache lives in one project and
+// location. Stateless requests return "" and are balanced by weight.
+func stickyKey(key *APIKey, body []byte) string {
+	if !cfg().StickyRouting || !bytes.Contains(body, []byte(`"cache_control"`)) {
+		return ""
+	}
+	return key.Key
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseVertexTargets(t *testing.T) {
+	got := parseVertexTargets([]string{
+		"p1/us-east5=3",
+		" p2 / europe-west1 ",
+		"p3/asia-southeast1=0",
+		"p4/us-central1=x",
+		"p5",
+		"/us-east5=2",
+	})
+	want := []vertexTarget{{"p1", "us-east5", 3}, {"p2", "europe-west1", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestTargetBalancerOrder(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.VertexTargets = []vertexTarget{{"p1", "us-east5", 3}, {"p2", "europe-west1", 1}, {"p3", "asia-southeast1", 1}}
+	})
+	regions := []string{"p1/us-east5", "p2/europe-west1", anthropicHost}
+
+	tests := []struct {
+		name    string
+		regions []string
+		cooling []string
+		want    map[string]int
+	}{
+		{"by weight", regions, nil, map[string]int{"p1/us-east5": 6, "p2/europe-west1": 2}},
+		{"target cooling down", regions, []string{"p1/us-east5"}, map[string]int{"p2/europe-west1": 8}},
+		{"all targets cooling down", regions, []string{"p1/us-east5", "p2/europe-west1"}, map[string]int{"p1/us-east5": 6, "p2/europe-west1": 2}},
+		{"single target", []string{"p3/asia-southeast1", anthropicHost}, nil, map[string]int{"p3/asia-southeast1": 8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &targetBalancer{current: make(map[string]int)}
+			swap(t, &cooldowns, &cooldownTracker{until: make(map[string]time.Time)})
+			for _, region := range tt.cooling {
+				cooldowns.Start("claude-a", region, time.Minute)
+			}
+			got := make(map[string]int)
+			for range 8 {
+				ordered := b.Order(tt.regions, "claude-a", "")
+				// 其余区域保持原有顺序，供故障转移使用
+				rest := slices.DeleteFunc(slices.Clone(tt.regions), func(r string) bool { return r == ordered[0] })
+				if !slices.Equal(ordered[1:], rest) {
+					t.Fatalf("order %v of %v", ordered, tt.regions)
+				}
+				got[ordered[0]]++
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("picked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetBalancerSticky(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.VertexTargets = []vertexTarget{{"p1", "us-east5", 3}, {"p2", "europe-west1", 1}}
+	})
+	swap(t, &cooldowns, &cooldownTracker{until: make(map[string]time.Time)})
+	regions := []string{"p1/us-east5", "p2/europe-west1"}
+	b := &targetBalancer{current: make(map[string]int)}
+
+	picked := make(map[string]int)
+	for i := range 1000 {
+		key := fmt.Sprintf("sk-%d", i)
+		first := b.Order(regions, "claude-a", key)[0]
+		if again := b.Order(regions, "claude-a", key)[0]; again != first {
+			t.Fatalf("key %s moved from %s to %s", key, first, again)
+		}
+		picked[first]++
+	}
+	// 权重 3:1，允许一定的哈希偏差
+	if n := picked["p1/us-east5"]; n < 700 || n > 800 {
+		t.Errorf("picked %v, want about 750 for p1/us-east5", picked)
+	}
+
+	key := "sk-cooling"
+	home := b.Order(regions, "claude-a", key)[0]
+	cooldowns.Start("claude-a", home, time.Minute)
+	if moved := b.Order(regions, "claude-a", key)[0]; moved == home {
+		t.Errorf("key kept %s while it cools down", home)
+	}
+}
+
+func TestStickyKey(t *testing.T) {
+	key := &APIKey{Key: "sk-1"}
+	cached := []byte(`{"system":[{"type":"text","text":"long","cache_control":{"type":"ephemeral"}}]}`)
+	tests := []struct {
+		name   string
+		sticky bool
+		body   []byte
+		want   string
+	}{
+		{"prompt caching", true, cached, "sk-1"},
+		{"no prompt caching", true, []byte(`{"messages":[]}`), ""},
+		{"sticky routing off", false, cached, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.StickyRouting = tt.sticky })
+			if got := stickyKey(key, tt.body); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseRouteTimeouts parses a list of route=duration entries. A zero duration
+// means the route is not bounded.
+func parseRouteTimeouts(entries []string) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for _, entry := range entries {
+		route, value, ok := strings.Cut(entry, "=")
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if !ok || err != nil {
+			log.Printf("Ignoring invalid route timeout %q", entry)
+			continue
+		}
+		timeouts[strings.TrimSpace(route)] = d
+	}
+	return timeouts
+}
+
+// withRouteTimeout applies the configured deadline of route to the request
+// context. If the handler hasn't started responding by the deadline the
+// client gets a 504; a response that is already streaming is ended by the
+// context cancellation instead. The server write deadline is moved to match,
+// so long-running routes aren't cut off by the server-wide WriteTimeout. A
+// handler can swap the deadline for its own with overrideRouteTimeout.
+func withRouteTimeout(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d := cfg().RouteTimeouts[route]
+		rc := http.NewResponseController(w)
+		if d <= 0 {
+			rc.SetWriteDeadline(time.Time{})
+			handler(w, r)
+			return
+		}
+		rc.SetWriteDeadline(time.Now().Add(d + 5*time.Second))
+
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, header: make(http.Header)}
+		ctx = context.WithValue(ctx, routeTimeoutKey{}, tw)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handler(tw, r.WithContext(ctx))
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			tw.mu.Lock()
+			if ctx.Err() == context.DeadlineExceeded && !tw.wroteHeader && !tw.overridden {
+				tw.timedOut = true
+				respondError(w, r, timedOut("Request timed out"))
+			}
+			timedOut := tw.timedOut
+			tw.mu.Unlock()
+			if !timedOut {
+				// 已开始写响应，等待处理函数因上下文取消而退出
+				<-done
+			}
+		}
+	}
+}
+
+// timeoutWriter guards the underlying ResponseWriter so that a handler still
+// running after its route timed out can't write over the 504.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+	// overridden is set once the handler replaced the route deadline with
+	// its own, so the route no longer answers 504 on its behalf.
+	overridden bool
+}
+
+type routeTimeoutKey struct{}
+
+// overrideRouteTimeout replaces the route deadline of r with d, which may be
+// shorter or longer. The returned context keeps the request's values and is
+// still cancelled when the client goes away. The handler has to use it for
+// the rest of the request and end the response itself when it expires.
+func overrideRouteTimeout(r *http.Request, d time.Duration) (context.Context, context.CancelFunc) {
+	parent := r.Context()
+	if tw, ok := parent.Value(routeTimeoutKey{}).(*timeoutWriter); ok {
+		tw.mu.Lock()
+		tw.overridden = true
+		tw.mu.Unlock()
+		http.NewResponseController(tw.w).SetWriteDeadline(time.Now().Add(d + 5*time.Second))
+	}
+
+	// 脱离路由的截止时间，但客户端断开时仍需取消
+	detached, cancel := context.WithCancel(context.WithoutCancel(parent))
+	stop := context.AfterFunc(parent, func() {
+		if !errors.Is(parent.Err(), context.DeadlineExceeded) {
+			cancel()
+		}
+	})
+	ctx, cancelTimeout := context.WithTimeout(detached, d)
+	return ctx, func() {
+		stop()
+		cancelTimeout()
+		cancel()
+	}
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	// 响应头发送后写入的是 trailer，需直接落到底层 ResponseWriter
+	if tw.wroteHeader {
+		return tw.w.Header()
+	}
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeaderLocked(status)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(status int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	for k, v := range tw.header {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	return tw.w.Write(p)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRouteTimeouts(t *testing.T) {
+	got := parseRouteTimeouts([]string{"/v1/messages=10m", " /v1/pricing = 5s ", "/v1/flags=0", "/bad", "/v1/keys=soon"})
+	want := map[string]time.Duration{"/v1/messages": 10 * time.Minute, "/v1/pricing": 5 * time.Second, "/v1/flags": 0}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for route, d := range want {
+		if got[route] != d {
+			t.Errorf("%s: %v, want %v", route, got[route], d)
+		}
+	}
+}
+
+func TestWithRouteTimeout(t *testing.T) {
+	// work sleeps for d unless the request context ends first, then answers.
+	work := func(d time.Duration) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(d):
+				io.WriteString(w, "done")
+			case <-r.Context().Done():
+			}
+		}
+	}
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		handler    http.HandlerFunc
+		wantStatus int
+		wantBody   string
+	}{
+		{"slow handler on a short route", 20 * time.Millisecond, work(time.Second), http.StatusGatewayTimeout, "timeout_error"},
+		{"same handler on a long route", time.Second, work(20 * time.Millisecond), http.StatusOK, "done"},
+		{"unbounded route", 0, work(20 * time.Millisecond), http.StatusOK, "done"},
+		{"response already streaming", 20 * time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "partial")
+			<-r.Context().Done()
+			io.WriteString(w, " late")
+		}, http.StatusOK, "partial late"},
+		{"handler overriding the deadline", 20 * time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := overrideRouteTimeout(r, time.Second)
+			defer cancel()
+			work(50*time.Millisecond)(w, r.WithContext(ctx))
+		}, http.StatusOK, "done"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.RouteTimeouts = map[string]time.Duration{"/route": tt.timeout} })
+			w := httptest.NewRecorder()
+			withRouteTimeout("/route", tt.handler)(w, httptest.NewRequest(http.MethodGet, "/route", nil))
+			if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %q, want %d with %q", w.Code, w.Body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestTimedOutHandlerCantWrite(t *testing.T) {
+	setConfig(t, func(c *Config) { c.RouteTimeouts = map[string]time.Duration{"/route": 10 * time.Millisecond} })
+	wrote := make(chan error, 1)
+	w := httptest.NewRecorder()
+	withRouteTimeout("/route", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		time.Sleep(10 * time.Millisecond)
+		_, err := io.WriteString(w, "too late")
+		wrote <- err
+	})(w, httptest.NewRequest(http.MethodGet, "/route", nil))
+
+	if err := <-wrote; err != http.ErrHandlerTimeout {
+		t.Errorf("late write returned %v, want ErrHandlerTimeout", err)
+	}
+	if w.Code != http.StatusGatewayTimeout || strings.Contains(w.Body.String(), "too late") {
+		t.Errorf("got %d %q, want only the 504", w.Code, w.Body)
+	}
+}
+
+func TestUpstreamTimeoutVersusCancel(t *testing.T) {
+	first := strings.SplitAfter(sseTranscript, "\n\n")[0]
+	tests := []struct {
+		name          string
+		sent          string // 上游挂起前已发送的内容，空表示连响应头都未发送
+		cancel        bool   // 客户端主动断开，否则等请求超时
+		refund        bool
+		wantStatus    int
+		wantBody      string
+		wantRemaining int
+	}{
+		{name: "timeout before the response", wantStatus: http.StatusGatewayTimeout, wantBody: "Upstream request timed out", wantRemaining: 10},
+		{name: "timeout mid-stream", sent: first, wantStatus: http.StatusOK, wantBody: "timeout_error", wantRemaining: 9},
+		{name: "cancel before the response, refund on", cancel: true, refund: true, wantRemaining: 10},
+		{name: "cancel before the response, refund off", cancel: true, wantRemaining: 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.Regions = []string{"us-east5"}
+				c.ModelRegions = nil
+				c.VertexTargets = nil
+				c.DisconnectRefund = tt.refund
+			})
+			auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+			var ctx context.Context
+			var cancel context.CancelFunc
+			if tt.cancel {
+				ctx, cancel = context.WithCancel(context.Background())
+			} else {
+				ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+			}
+			defer cancel()
+			fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				// 读完请求体后服务端才能察觉连接断开
+				io.Copy(io.Discard, r.Body)
+				if tt.sent != "" {
+					streamChunks(w, tt.sent, len(tt.sent))
+				}
+				if tt.cancel {
+					cancel()
+				}
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+			})
+
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`).WithContext(ctx))
+			if tt.cancel {
+				if w.Body.Len() != 0 {
+					t.Errorf("wrote %q to a client that went away", w.Body)
+				}
+			} else {
+				if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), tt.wantBody) {
+					t.Errorf("got %d %s, want %d with %q", w.Code, w.Body, tt.wantStatus, tt.wantBody)
+				}
+			}
+			if got := auth.remaining("k"); got != tt.wantRemaining {
+				t.Errorf("%d calls left, want %d", got, tt.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestKeyMaxRequestDuration(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.RouteTimeouts = map[string]time.Duration{"/v1/messages": 100 * time.Millisecond}
+	})
+	useKeys(t,
+		&APIKey{Key: "default", RemainingCalls: 10, Tier: defaultTier},
+		&APIKey{Key: "short", RemainingCalls: 10, Tier: defaultTier, MaxRequestDuration: 30 * time.Millisecond},
+		&APIKey{Key: "long", RemainingCalls: 10, Tier: defaultTier, MaxRequestDuration: 5 * time.Second},
+	)
+	events := strings.SplitAfter(sseTranscript, "\n\n")
+	head := strings.Join(events[:3], "")
+	// 上游先发送前几个事件，停顿 300ms 后再发送剩余部分
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		streamChunks(w, head, len(head))
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(300 * time.Millisecond):
+		}
+		io.WriteString(w, strings.TrimPrefix(sseTranscript, head))
+	})
+
+	tests := []struct {
+		key          string
+		wantComplete bool
+	}{
+		{"short", false},
+		{"default", false},
+		{"long", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			withRouteTimeout("/v1/messages", handleForwardToEndpoint)(w, newMessagesRequest(tt.key, `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			body := w.Body.String()
+			if !strings.HasPrefix(body, head) {
+				t.Errorf("stream starts with\n%s\nwant the events sent before the pause", body)
+			}
+			if tt.wantComplete {
+				if body != sseTranscript || w.Header().Get("X-Stream-Status") != "complete" {
+					t.Errorf("got\n%s\nwant the whole stream past the route timeout", body)
+				}
+				return
+			}
+			if !strings.HasSuffix(body, "\n\n") || !strings.Contains(body, `"type":"timeout_error"`) || strings.Contains(body, "message_stop") {
+				t.Errorf("got\n%s\nwant the stream ended with a timeout_error event", body)
+			}
+		})
+	}
+}
+
+func TestUpstreamFailureRefunded(t *testing.T) {
+	tests := []struct {
+		name          string
+		upstream      http.HandlerFunc
+		wantStatus    int
+		wantRemaining int
+	}{
+		{
+			name: "connection failure in every region",
+			upstream: func(http.ResponseWriter, *http.Request) {
+				panic(http.ErrAbortHandler)
+			},
+			wantStatus:    http.StatusBadGateway,
+			wantRemaining: 10,
+		},
+		{
+			name: "upstream rate limit",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "3")
+				http.Error(w, `{"type":"error","error":{"type":"rate_limit_error","message":"quota"}}`, http.StatusTooManyRequests)
+			},
+			wantStatus:    http.StatusTooManyRequests,
+			wantRemaining: 10,
+		},
+		{
+			name: "server error in every region",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"type":"error","error":{"type":"api_error","message":"internal"}}`, http.StatusInternalServerError)
+			},
+			wantStatus:    http.StatusInternalServerError,
+			wantRemaining: 10,
+		},
+		{
+			// 客户端自身的错误照常计费
+			name: "bad request",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens"}}`, http.StatusBadRequest)
+			},
+			wantStatus:    http.StatusBadRequest,
+			wantRemaining: 9,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.Regions = []string{"us-east5", "europe-west1"}
+				c.ModelRegions = nil
+				c.VertexTargets = nil
+				c.ModelFailover = nil
+				c.FailoverOnRateLimit = false
+				c.FailoverCooldown = 0
+			})
+			swap(t, &limiter, newRateLimiter(100, time.Minute))
+			auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+			fakeUpstream(t, tt.upstream)
+
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := auth.remaining("k"); got != tt.wantRemaining {
+				t.Errorf("%d calls left, want %d", got, tt.wantRemaining)
+			}
+			if got := w.Header().Get("X-RateLimit-Remaining"); tt.wantStatus != http.StatusBadGateway && got != strconv.Itoa(tt.wantRemaining) {
+				t.Errorf("X-RateLimit-Remaining = %q, want %d", got, tt.wantRemaining)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// parseTLSVersion maps "1.2" / "1.3" to the crypto/tls constants, falling back
+// to TLS 1.2.
+func parseTLSVersion(v string) uint16 {
+	switch v {
+	case "1.2":
+		return tls.VersionTLS12
+	case "1.3":
+		return tls.VersionTLS13
+	default:
+		log.Printf("Invalid TLS_MIN_VERSION %q, using 1.2", v)
+		return tls.VersionTLS12
+	}
+}
+
+// certReloader serves the certificate from disk and, when reload is enabled,
+// picks up a rotated certificate on the next handshake after the files'
+// modification times change.
+type certReloader struct {
+	certFile, keyFile string
+	reload            bool
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string, reload bool) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, reload: reload}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// latestModTime is the newer of the certificate and key modification times.
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A failed reload keeps
+// serving the previous certificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate for mTLS
+// to the upstream.
+func (c *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.current(), nil
+}
+
+func (c *certReloader) current() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reload {
+		if modTime, err := c.latestModTime(); err == nil && modTime.After(c.modTime) {
+			if err := c.load(); err != nil {
+				log.Printf("Error reloading TLS certificate: %v", err)
+			} else {
+				log.Printf("Reloaded TLS certificate from %s", c.certFile)
+			}
+		}
+	}
+	return c.cert
+}
+
+// newTLSConfig builds the server TLS configuration from cfg.
+func newTLSConfig() (*tls.Config, error) {
+	reloader, err := newCertReloader(cfg().TLSCertFile, cfg().TLSKeyFile, cfg().TLSReload)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     cfg().TLSMinVersion,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+// newUpstreamTLSConfig builds the client TLS configuration for calls to
+// Vertex AI: extra root CAs on top of the system pool, a client certificate for
+// mTLS and a server name override. It returns nil when none is configured,
+// keeping Go's defaults.
+func newUpstreamTLSConfig() (*tls.Config, error) {
+	if cfg().UpstreamCAFile == "" && cfg().UpstreamClientCertFile == "" && cfg().UpstreamServerName == "" {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: cfg().UpstreamServerName}
+
+	if cfg().UpstreamCAFile != "" {
+		pem, err := os.ReadFile(cfg().UpstreamCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading upstream CA file: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg().UpstreamCAFile)
+		}
+		config.RootCAs = roots
+	}
+
+	if cfg().UpstreamClientCertFile != "" || cfg().UpstreamClientKeyFile != "" {
+		if cfg().UpstreamClientCertFile == "" || cfg().UpstreamClientKeyFile == "" {
+			return nil, fmt.Errorf("UPSTREAM_CLIENT_CERT_FILE and UPSTREAM_CLIENT_KEY_FILE must be set together")
+		}
+		reloader, err := newCertReloader(cfg().UpstreamClientCertFile, cfg().UpstreamClientKeyFile, cfg().TLSReload)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return config, nil
+}
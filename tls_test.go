@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and vertex.internal
+// with serial to certFile and its key to keyFile, and returns the
+// certificate. It is valid for both servers and clients.
+func writeSelfSignedCert(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "llm-gateway test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     []string{"vertex.internal"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// serveTLS starts a server with newTLSConfig like main does and returns its
+// address.
+func serveTLS(t *testing.T) string {
+	t.Helper()
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "OK") }),
+		TLSConfig: tlsConfig,
+	}
+	go server.ServeTLS(ln, "", "")
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().String()
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for in, want := range map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13, "1.1": tls.VersionTLS12, "": tls.VersionTLS12} {
+		if got := parseTLSVersion(in); got != want {
+			t.Errorf("parseTLSVersion(%q) = %x, want %x", in, got, want)
+		}
+	}
+}
+
+func TestServeHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeSelfSignedCert(t, certFile, keyFile, 1)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	tests := []struct {
+		name          string
+		minVersion    uint16
+		clientVersion uint16
+		wantErr       bool
+	}{
+		{"TLS 1.2", tls.VersionTLS12, tls.VersionTLS12, false},
+		{"TLS 1.3", tls.VersionTLS12, tls.VersionTLS13, false},
+		{"client below the minimum", tls.VersionTLS13, tls.VersionTLS12, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.TLSCertFile, c.TLSKeyFile = certFile, keyFile
+				c.TLSMinVersion = tt.minVersion
+				c.TLSReload = false
+			})
+			addr := serveTLS(t)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MaxVersion: tt.clientVersion}}}
+			resp, err := client.Get("https://" + addr + "/health")
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("handshake succeeded below the minimum version")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(body) != "OK" || resp.TLS.Version != tt.clientVersion {
+				t.Errorf("got %d %q over %x", resp.StatusCode, body, resp.TLS.Version)
+			}
+		})
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeSelfSignedCert(t, certFile, keyFile, 1)
+
+	for _, reload := range []bool{false, true} {
+		reloader, err := newCertReloader(certFile, keyFile, reload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeSelfSignedCert(t, certFile, keyFile, 2)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(certFile, later, later)
+		os.Chtimes(keyFile, later, later)
+
+		served, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(served.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := int64(1)
+		if reload {
+			want = 2
+		}
+		if leaf.SerialNumber.Int64() != want {
+			t.Errorf("reload=%v: serving certificate %d, want %d", reload, leaf.SerialNumber, want)
+		}
+		writeSelfSignedCert(t, certFile, keyFile, 1)
+	}
+
+	t.Run("broken rotation keeps the certificate", func(t *testing.T) {
+		writeSelfSignedCert(t, certFile, keyFile, 3)
+		reloader, err := newCertReloader(certFile, keyFile, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(certFile, []byte("not a certificate"), 0o600)
+		later := time.Now().Add(2 * time.Minute)
+		os.Chtimes(certFile, later, later)
+		served, _ := reloader.GetCertificate(nil)
+		if leaf, err := x509.ParseCertificate(served.Certificate[0]); err != nil || leaf.SerialNumber.Int64() != 3 {
+			t.Errorf("serving %v, want the previous certificate", leaf.SerialNumber)
+		}
+	})
+}
+
+func TestUpstreamMTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	clientCert, clientKey := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writeSelfSignedCert(t, serverCert, serverKey, 1)
+	client := writeSelfSignedCert(t, clientCert, clientKey, 2)
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("no certificates here"), 0o600)
+
+	// 要求客户端证书的上游
+	pair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(client)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].SerialNumber.String())
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{pair}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name               string
+		ca, cert, key, sni string
+		wantConfigErr      bool
+		wantOK             bool
+	}{
+		{name: "defaults", wantOK: false},
+		{name: "CA without a client certificate", ca: serverCert, wantOK: false},
+		{name: "CA and client certificate", ca: serverCert, cert: clientCert, key: clientKey, wantOK: true},
+		{name: "server name override", ca: serverCert, cert: clientCert, key: clientKey, sni: "vertex.internal", wantOK: true},
+		{name: "server name not in the certificate", ca: serverCert, cert: clientCert, key: clientKey, sni: "other.internal", wantOK: false},
+		{name: "certificate without a key", ca: serverCert, cert: clientCert, wantConfigErr: true},
+		{name: "CA file without certificates", ca: empty, wantConfigErr: true},
+		{name: "missing CA file", ca: filepath.Join(dir, "missing.pem"), wantConfigErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.UpstreamCAFile = tt.ca
+				c.UpstreamClientCertFile = tt.cert
+				c.UpstreamClientKeyFile = tt.key
+				c.UpstreamServerName = tt.sni
+			})
+			config, err := newUpstreamTLSConfig()
+			if (err != nil) != tt.wantConfigErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantConfigErr)
+			}
+			if tt.wantConfigErr {
+				return
+			}
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+			resp, err := c.Get(srv.URL)
+			if !tt.wantOK {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("request succeeded, want a TLS failure")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if body, _ := io.ReadAll(resp.Body); string(body) != "2" {
+				t.Errorf("upstream saw client certificate %s, want serial 2", body)
+			}
+		})
+	}
+}
+
+func TestClientFor(t *testing.T) {
+	tests := []struct {
+		url  string
+		want *http.Client
+	}{
+		{"https://us-east5-aiplatform.googleapis.com/v1/projects/p", vertexClient},
+		{"https://oauth2.googleapis.com/token", upstreamClient},
+		{"http://metadata.google.internal/computeMetadata/v1/", upstreamClient},
+		{"https://api.anthropic.com/v1/messages", upstreamClient},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.url, nil)
+		if clientFor(req) != tt.want {
+			t.Errorf("%s used the wrong client", tt.url)
+		}
+	}
+}
@@ -1,45 +1,201 @@
 package main
 
 import (
+	"context"
 	"crypto/rsa"
-	"encoding/json"
 	"fmt"
-	"io"
+	"log"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
-func GetAccessToken(clientEmail, privateKeyPEM, privateKeyID string) (string, error) {
+// TokenProvider obtains OAuth access tokens for the upstream, with their
+// expiry when the token endpoint tells it; zero otherwise.
+type TokenProvider interface {
+	AccessToken(ctx context.Context) (string, time.Time, error)
+}
+
+// googleTokenProvider exchanges a self-signed service account JWT for an
+// access token.
+type googleTokenProvider struct {
+	clientEmail   string
+	privateKeyPEM string
+	privateKeyID  string
+}
+
+func (p *googleTokenProvider) AccessToken(ctx context.Context) (string, time.Time, error) {
+	return GetAccessToken(ctx, p.clientEmail, p.privateKeyPEM, p.privateKeyID)
+}
+
+// staticTokenProvider always returns the same token. It is used for local
+// development against a proxy and for tests.
+type staticTokenProvider string
+
+func (p staticTokenProvider) AccessToken(context.Context) (string, time.Time, error) {
+	return string(p), time.Time{}, nil
+}
+
+// newTokenProvider selects the provider from the environment: a static
+// token, the service account key in GC_*, or Application Default
+// Credentials.
+func newTokenProvider() (TokenProvider, error) {
+	if token := os.Getenv("STATIC_ACCESS_TOKEN"); token != "" {
+		return staticTokenProvider(token), nil
+	}
+	if os.Getenv("GC_CLIENT_EMAIL") != "" && os.Getenv("GC_PRIVATE_KEY") != "" {
+		return &googleTokenProvider{
+			clientEmail:   os.Getenv("GC_CLIENT_EMAIL"),
+			privateKeyPEM: os.Getenv("GC_PRIVATE_KEY"),
+			privateKeyID:  os.Getenv("GC_PRIVATE_KEY_ID"),
+		}, nil
+	}
+	return defaultTokenProvider()
+}
+
+var (
+	tokenProvider TokenProvider
+
+	tokenMu     sync.RWMutex
+	accessToken string
+	tokenExpiry time.Time
+)
+
+func currentAccessToken() string {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	return accessToken
+}
+
+// currentTokenExpiry returns when the gateway's token expires, zero when
+// unknown.
+func currentTokenExpiry() time.Time {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	return tokenExpiry
+}
+
+// refreshAccessToken fetches a new access token from the token provider and
+// stores it for the handlers.
+func refreshAccessToken() error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().TokenExchangeTimeout)
+	defer cancel()
+
+	token, expiry, err := tokenProvider.AccessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	tokenMu.Lock()
+	accessToken = token
+	tokenExpiry = expiry
+	tokenMu.Unlock()
+	return nil
+}
+
+// retryAccessToken keeps calling refresh with exponential backoff until it
+// obtains a token or ctx ends. Attempts the retry budget refuses are skipped
+// until the next backoff step.
+func retryAccessToken(ctx context.Context, refresh func() error) {
+	backoff := cfg().TokenRetryInitialBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if !allowRetry(retrySiteToken) {
+			backoff = min(backoff*2, cfg().TokenRetryMaxBackoff)
+			continue
+		}
+		err := refresh()
+		if err == nil {
+			log.Printf("Access token acquired")
+			return
+		}
+		log.Printf("Error getting access token: %v, retrying in %s", err, backoff)
+		backoff = min(backoff*2, cfg().TokenRetryMaxBackoff)
+	}
+}
+
+const (
+	// maxTokenExpiryMargin is how long before its expiry a token is renewed
+	// at the latest; tokens living less than four times as long are renewed
+	// after three quarters of their remaining lifetime.
+	maxTokenExpiryMargin = 5 * time.Minute
+	// minTokenRefreshDelay keeps a token reported as (nearly) expired from
+	// being renewed in a busy loop.
+	minTokenRefreshDelay = 10 * time.Second
+)
+
+// tokenRefreshDelay is how long to wait before renewing a token expiring at
+// expiry: ahead of the expiry by maxTokenExpiryMargin, or a quarter of the
+// remaining lifetime for short-lived tokens, and at most
+// TOKEN_REFRESH_INTERVAL. Tokens without a known expiry use the interval. The
+// wait is cut by up to a tenth at random so instances started together don't
+// refresh in lockstep.
+func tokenRefreshDelay(expiry time.Time) time.Duration {
+	wait := cfg().TokenRefreshInterval
+	if !expiry.IsZero() {
+		remaining := time.Until(expiry)
+		wait = min(wait, remaining-min(maxTokenExpiryMargin, remaining/4))
+	}
+	wait = max(wait, minTokenRefreshDelay)
+	return wait - rand.N(wait/10+1)
+}
+
+// keepTokenFresh renews a token with refresh until ctx ends, scheduling each
+// renewal from the current token's expiry as reported by expiry; see
+// tokenRefreshDelay. A failed refresh is retried with backoff while the
+// current token stays in use.
+func keepTokenFresh(ctx context.Context, refresh func() error, expiry func() time.Time) {
+	for {
+		wait := tokenRefreshDelay(expiry())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if err := refresh(); err != nil {
+			log.Printf("Error refreshing access token: %v, retrying", err)
+			retryAccessToken(ctx, refresh)
+		}
+	}
+}
+
+func GetAccessToken(ctx context.Context, clientEmail, privateKeyPEM, privateKeyID string) (string, time.Time, error) {
 	// 解析私钥
 	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(privateKeyPEM))
 	if err != nil {
-		return "", fmt.Errorf("parsing private key: %w", err)
+		return "", time.Time{}, fmt.Errorf("parsing private key: %w", err)
 	}
 
 	// 生成 JWT
 	jwtToken, err := generateJWT(clientEmail, privateKey, privateKeyID)
 	if err != nil {
-		return "", fmt.Errorf("generating JWT: %w", err)
+		return "", time.Time{}, fmt.Errorf("generating JWT: %w", err)
 	}
 
 	// 交换 JWT 获取访问令牌
-	accessToken, err := exchangeJWTForAccessToken(jwtToken)
+	accessToken, expiry, err := exchangeJWTForAccessToken(ctx, jwtToken)
 	if err != nil {
-		return "", fmt.Errorf("exchanging JWT for access token: %w", err)
+		return "", time.Time{}, fmt.Errorf("exchanging JWT for access token: %w", err)
 	}
 
-	return accessToken, nil
+	return accessToken, expiry, nil
 }
 
 func generateJWT(clientEmail string, privateKey *rsa.PrivateKey, privateKeyID string) (string, error) {
 	now := time.Now()
 	claims := jwt.MapClaims{
 		"iss":   clientEmail,
-		"aud":   "https://www.googleapis.com/oauth2/v4/token",
+		"aud":   tokenURL,
 		"iat":   now.Unix(),
 		"exp":   now.Add(time.Hour).Unix(),
 		"scope": "https://www.googleapis.com/auth/cloud-platform",
@@ -51,34 +207,19 @@ func generateJWT(clientEmail string, privateKey *rsa.PrivateKey, privateKeyID st
 	return token.SignedString(privateKey)
 }
 
-func exchangeJWTForAccessToken(jwtToken string) (string, error) {
+// tokenURL is the Google OAuth token endpoint. It is a variable so the
+// exchange can be pointed at a stub server.
+var tokenURL = "https://www.googleapis.com/oauth2/v4/token"
+
+func exchangeJWTForAccessToken(ctx context.Context, jwtToken string) (string, time.Time, error) {
 	data := url.Values{}
 	data.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
 	data.Set("assertion", jwtToken)
 
-	resp, err := http.Post("https://www.googleapis.com/oauth2/v4/token",
-		"application/x-www-form-urlencoded",
-		strings.NewReader(data.Encode()))
-	if err != nil {
-		return "", fmt.Errorf("sending request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
-		return "", fmt.Errorf("reading response: %w", err)
+		return "", time.Time{}, fmt.Errorf("creating request: %w", err)
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("token exchange failed: status=%d, body=%s", resp.StatusCode, body)
-	}
-
-	var tokenResp struct {
-		AccessToken string `json:"access_token"`
-	}
-	if err := json.Unmarshal(body, &tokenResp); err != nil {
-		return "", fmt.Errorf("parsing response: %w", err)
-	}
-
-	return tokenResp.AccessToken, nil
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doTokenRequest(req)
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServiceAccount is a googleTokenProvider with a freshly generated key.
+func testServiceAccount(t *testing.T) *googleTokenProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return &googleTokenProvider{clientEmail: "gateway@test.iam.gserviceaccount.com", privateKeyPEM: string(keyPEM), privateKeyID: "kid"}
+}
+
+// stubTokenEndpoint points the token exchange at handler for the rest of the
+// test.
+func stubTokenEndpoint(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	swap(t, &tokenURL, srv.URL)
+}
+
+func TestTokenExchange(t *testing.T) {
+	stubTokenEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || r.PostForm.Get("assertion") == "" {
+			t.Errorf("unexpected token request %v", r.PostForm)
+		}
+		w.Write([]byte(`{"access_token":"ya29.token","expires_in":3600}`))
+	})
+
+	before := time.Now()
+	token, expiry, err := testServiceAccount(t).AccessToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "ya29.token" {
+		t.Errorf("token = %q", token)
+	}
+	if expiry.Before(before.Add(time.Hour)) || expiry.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expiry %v, want an hour from the request", expiry)
+	}
+}
+
+func TestTokenExchangeTimeout(t *testing.T) {
+	setConfig(t, func(c *Config) { c.TokenExchangeTimeout = 50 * time.Millisecond })
+	stubTokenEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body) // 读完请求体后服务端才能察觉客户端断开
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	swap[TokenProvider](t, &tokenProvider, testServiceAccount(t))
+
+	start := time.Now()
+	err := refreshAccessToken()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("exchange took %v, want it cut at the timeout", elapsed)
+	}
+}
+
+func TestRetryAccessToken(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.TokenRetryInitialBackoff = time.Millisecond
+		c.TokenRetryMaxBackoff = 4 * time.Millisecond
+	})
+	swap(t, &retries, nil)
+
+	t.Run("retries until a token is obtained", func(t *testing.T) {
+		var calls atomic.Int32
+		retryAccessToken(context.Background(), func() error {
+			if calls.Add(1) < 4 {
+				return errors.New("token endpoint unavailable")
+			}
+			return nil
+		})
+		if got := calls.Load(); got != 4 {
+			t.Errorf("refresh called %d times, want 4", got)
+		}
+	})
+
+	t.Run("stops when the context ends", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+		defer cancel()
+		done := make(chan struct{})
+		go func() {
+			retryAccessToken(ctx, func() error { return errors.New("token endpoint unavailable") })
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("retryAccessToken kept going after its context ended")
+		}
+	})
+}
+
+func TestTokenRefreshDelay(t *testing.T) {
+	setConfig(t, func(c *Config) { c.TokenRefreshInterval = 50 * time.Minute })
+	tests := []struct {
+		name     string
+		expiry   time.Time
+		min, max time.Duration
+	}{
+		{"unknown expiry uses the interval", time.Time{}, 45 * time.Minute, 50 * time.Minute},
+		{"hour-long token renewed at the interval", time.Now().Add(time.Hour), 45 * time.Minute, 50 * time.Minute},
+		{"token renewed five minutes ahead", time.Now().Add(30 * time.Minute), 22 * time.Minute, 25 * time.Minute},
+		{"short-lived token renewed after three quarters", time.Now().Add(8 * time.Minute), 5*time.Minute + 20*time.Second, 6 * time.Minute},
+		{"expired token waits the minimum", time.Now().Add(-time.Minute), 9 * time.Second, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenRefreshDelay(tt.expiry); got < tt.min || got > tt.max {
+				t.Errorf("delay %v, want between %v and %v", got, tt.min, tt.max)
+			}
+		})
+	}
+}
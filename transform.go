@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// RequestTransformer rewrites the parsed request body before it is
+// forwarded. Transformers run in the order listed in REQUEST_TRANSFORMERS,
+// each seeing the previous one's changes, and before the key's guardrails so
+// those are always enforced last.
+type RequestTransformer interface {
+	Name() string
+	Transform(body map[string]json.RawMessage, key *APIKey) error
+}
+
+// transformerRegistry maps the names accepted in REQUEST_TRANSFORMERS to
+// constructors. A new transformer only needs an entry here; constructors read
+// their settings from cfg and fail on invalid ones.
+var transformerRegistry = map[string]func() (RequestTransformer, error){
+	"system_prompt":  newSystemPromptTransformer,
+	"default_params": newDefaultParamsTransformer,
+}
+
+// requestPipeline is the configured transformer chain, empty by default.
+var requestPipeline []RequestTransformer
+
+func newRequestPipeline(names []string) ([]RequestTransformer, error) {
+	var pipeline []RequestTransformer
+	for _, name := range names {
+		factory, ok := transformerRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown request transformer %q", name)
+		}
+		t, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		pipeline = append(pipeline, t)
+	}
+	return pipeline, nil
+}
+
+// transformRequest runs body through the pipeline. Bodies are returned
+// unchanged when no transformer is configured.
+func transformRequest(body []byte, key *APIKey) ([]byte, error) {
+	if len(requestPipeline) == 0 {
+		return body, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("invalid request body: %v", err)
+	}
+	for _, t := range requestPipeline {
+		if err := t.Transform(fields, key); err != nil {
+			return nil, fmt.Errorf("%s: %v", t.Name(), err)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// systemPromptTransformer puts SYSTEM_PROMPT_PREFIX ahead of the client's
+// system prompt, or uses it as the system prompt when there is none.
+type systemPromptTransformer struct {
+	prefix string
+}
+
+func newSystemPromptTransformer() (RequestTransformer, error) {
+	if cfg().SystemPromptPrefix == "" {
+		return nil, fmt.Errorf("SYSTEM_PROMPT_PREFIX is not set")
+	}
+	return systemPromptTransformer{prefix: cfg().SystemPromptPrefix}, nil
+}
+
+func (systemPromptTransformer) Name() string { return "system_prompt" }
+
+func (t systemPromptTransformer) Transform(body map[string]json.RawMessage, key *APIKey) error {
+	raw, ok := body["system"]
+	if !ok || string(raw) == "null" {
+		body["system"], _ = json.Marshal(t.prefix)
+		return nil
+	}
+
+	// system 可以是字符串或内容块数组，两种形式都要支持
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		body["system"], _ = json.Marshal(t.prefix + "\n\n" + text)
+		return nil
+	}
+	var blocks []json.RawMessage
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return fmt.Errorf("system: must be a string or an array of content blocks")
+	}
+	block, _ := json.Marshal(map[string]string{"type": "text", "text": t.prefix})
+	body["system"], _ = json.Marshal(append([]json.RawMessage{block}, blocks...))
+	return nil
+}
+
+// defaultParamsTransformer sets fields the client omitted, taking them from
+// MODEL_DEFAULT_PARAMS for the model the request is served by and from
+// DEFAULT_PARAMS otherwise. Fields sent by the client, even with other
+// values, are left alone.
+type defaultParamsTransformer struct {
+	params      map[string]json.RawMessage
+	modelParams map[string]map[string]json.RawMessage
+}
+
+func newDefaultParamsTransformer() (RequestTransformer, error) {
+	if len(cfg().DefaultParams) == 0 && len(cfg().ModelDefaultParams) == 0 {
+		return nil, fmt.Errorf("neither DEFAULT_PARAMS nor MODEL_DEFAULT_PARAMS is set")
+	}
+	return defaultParamsTransformer{params: cfg().DefaultParams, modelParams: cfg().ModelDefaultParams}, nil
+}
+
+func (defaultParamsTransformer) Name() string { return "default_params" }
+
+func (t defaultParamsTransformer) Transform(body map[string]json.RawMessage, key *APIKey) error {
+	// 模型级默认值优先于全局默认值
+	for _, params := range []map[string]json.RawMessage{t.modelParams[effectiveModel(key)], t.params} {
+		for name, value := range params {
+			if raw, ok := body[name]; !ok || string(raw) == "null" {
+				body[name] = value
+			}
+		}
+	}
+	return nil
+}
+
+// parseDefaultParams parses name=value entries where value is a JSON value,
+// e.g. max_tokens=1024 or top_k=40.
+func parseDefaultParams(entries []string) map[string]json.RawMessage {
+	params := make(map[string]json.RawMessage)
+	for _, entry := range entries {
+		name, value, ok := parseDefaultParam(entry)
+		if !ok {
+			log.Printf("Ignoring invalid default param %q", entry)
+			continue
+		}
+		params[name] = value
+	}
+	return params
+}
+
+// parseModelDefaultParams parses model/name=value entries, e.g.
+// claude-3-haiku@20240307/max_tokens=1024.
+func parseModelDefaultParams(entries []string) map[string]map[string]json.RawMessage {
+	params := make(map[string]map[string]json.RawMessage)
+	for _, entry := range entries {
+		i := strings.LastIndex(entry, "/")
+		name, value, ok := parseDefaultParam(entry[i+1:])
+		model := strings.TrimSpace(entry[:max(i, 0)])
+		if i < 0 || model == "" || !ok {
+			log.Printf("Ignoring invalid model default param %q", entry)
+			continue
+		}
+		if params[model] == nil {
+			params[model] = make(map[string]json.RawMessage)
+		}
+		params[model][name] = value
+	}
+	return params
+}
+
+func parseDefaultParam(entry string) (string, json.RawMessage, bool) {
+	name, value, ok := strings.Cut(entry, "=")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || name == "" || !json.Valid([]byte(value)) {
+		return "", nil, false
+	}
+	return name, json.RawMessage(value), true
+}
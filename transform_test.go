@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// traceTransformer appends its name to the body's "trace" array, so tests can
+// see the order transformers ran in.
+type traceTransformer struct {
+	name string
+	err  error
+}
+
+func (t traceTransformer) Name() string { return t.name }
+
+func (t traceTransformer) Transform(body map[string]json.RawMessage, key *APIKey) error {
+	if t.err != nil {
+		return t.err
+	}
+	var trace []string
+	json.Unmarshal(body["trace"], &trace)
+	body["trace"], _ = json.Marshal(append(trace, t.name))
+	return nil
+}
+
+func TestNewRequestPipeline(t *testing.T) {
+	tests := []struct {
+		name      string
+		names     []string
+		prefix    string
+		params    map[string]json.RawMessage
+		wantNames []string
+		wantErr   string
+	}{
+		{name: "empty", wantNames: nil},
+		{name: "both in order", names: []string{"default_params", "system_prompt"}, prefix: "Be brief.", params: map[string]json.RawMessage{"max_tokens": json.RawMessage("512")}, wantNames: []string{"default_params", "system_prompt"}},
+		{name: "unknown", names: []string{"rot13"}, wantErr: `unknown request transformer "rot13"`},
+		{name: "missing setting", names: []string{"system_prompt"}, wantErr: "SYSTEM_PROMPT_PREFIX is not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.SystemPromptPrefix = tt.prefix
+				c.DefaultParams = tt.params
+				c.ModelDefaultParams = nil
+			})
+			pipeline, err := newRequestPipeline(tt.names)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, p := range pipeline {
+				names = append(names, p.Name())
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantNames, ",") {
+				t.Errorf("pipeline %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestTransformRequest(t *testing.T) {
+	setConfig(t, func(c *Config) { c.DefaultModel = "claude-a" })
+	prompt := systemPromptTransformer{prefix: "Be brief."}
+	defaults := defaultParamsTransformer{
+		params:      map[string]json.RawMessage{"max_tokens": json.RawMessage("512"), "system": json.RawMessage(`"Default."`)},
+		modelParams: map[string]map[string]json.RawMessage{"claude-a": {"max_tokens": json.RawMessage("1024")}},
+	}
+	tests := []struct {
+		name     string
+		pipeline []RequestTransformer
+		body     string
+		want     string
+		wantErr  string
+	}{
+		{"no pipeline", nil, `{"b":1, "a":2}`, `{"b":1, "a":2}`, ""},
+		{"applied in order", []RequestTransformer{traceTransformer{name: "first"}, traceTransformer{name: "second"}}, `{}`, `{"trace":["first","second"]}`, ""},
+		{"prompt then defaults", []RequestTransformer{prompt, defaults}, `{"messages":[]}`, `{"max_tokens":1024,"messages":[],"system":"Be brief."}`, ""},
+		{"defaults then prompt", []RequestTransformer{defaults, prompt}, `{"messages":[]}`, `{"max_tokens":1024,"messages":[],"system":"Be brief.\n\nDefault."}`, ""},
+		{"client values kept", []RequestTransformer{defaults, prompt}, `{"max_tokens":10,"system":[{"type":"text","text":"Mine."}]}`, `{"max_tokens":10,"system":[{"text":"Be brief.","type":"text"},{"type":"text","text":"Mine."}]}`, ""},
+		{"failing transformer", []RequestTransformer{traceTransformer{name: "first"}, traceTransformer{name: "broken", err: errors.New("no")}}, `{}`, "", "broken: no"},
+		{"invalid system", []RequestTransformer{prompt}, `{"system":42}`, "", "system_prompt: system"},
+		{"not JSON", []RequestTransformer{prompt}, `{`, "", "invalid request body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			swap(t, &requestPipeline, tt.pipeline)
+			got, err := transformRequest([]byte(tt.body), &APIKey{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || string(got) != tt.want {
+				t.Errorf("got %s, %v; want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDefaultParams(t *testing.T) {
+	got := parseDefaultParams([]string{"max_tokens=1024", " top_k = 40 ", `stop_sequences=["END"]`, "temperature=warm", "=1"})
+	want := map[string]string{"max_tokens": "1024", "top_k": "40", "stop_sequences": `["END"]`}
+	if len(got) != len(want) {
+		t.Errorf("got %d params, want %d", len(got), len(want))
+	}
+	for name, value := range want {
+		if string(got[name]) != value {
+			t.Errorf("%s = %s, want %s", name, got[name], value)
+		}
+	}
+
+	model := parseModelDefaultParams([]string{"claude-3-haiku@20240307/max_tokens=1024", "max_tokens=1", "/top_k=1"})
+	if len(model) != 1 || string(model["claude-3-haiku@20240307"]["max_tokens"]) != "1024" {
+		t.Errorf("model params %v", model)
+	}
+}
+
+func TestPipelineOnForwardedRequest(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	swap(t, &requestPipeline, []RequestTransformer{traceTransformer{name: "first"}, traceTransformer{name: "second"}})
+	useFakeDB(t, nil)
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Trace []string }
+		raw, _ := io.ReadAll(r.Body)
+		json.Unmarshal(raw, &body)
+		if strings.Join(body.Trace, ",") != "first,second" {
+			t.Errorf("upstream got %s, want both transformers applied in order", raw)
+		}
+		streamSSE(w, sseTranscript)
+	})
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestModelDefaultParams(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.DefaultModel = "claude-haiku"
+		c.AllowedModels = []string{"claude-opus", "claude-other"}
+		c.DefaultParams = parseDefaultParams([]string{"max_tokens=2048", "top_k=40"})
+		c.ModelDefaultParams = parseModelDefaultParams([]string{"claude-haiku/max_tokens=512", "claude-opus/max_tokens=8192", "claude-opus/temperature=0.2"})
+	})
+	defaults, err := newDefaultParamsTransformer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &requestPipeline, []RequestTransformer{defaults})
+	swap(t, &storedModels, &modelAllowlist{})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	var got map[string]json.RawMessage
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		got = nil
+		json.Unmarshal(raw, &got)
+		streamSSE(w, sseTranscript)
+	})
+
+	tests := []struct {
+		name  string
+		model string // 请求体中的模型，空表示默认模型
+		extra string
+		want  map[string]string // 缺失的字段为空字符串
+	}{
+		{"default model", "", "", map[string]string{"max_tokens": "512", "top_k": "40", "temperature": ""}},
+		{"model A", "claude-haiku", "", map[string]string{"max_tokens": "512", "top_k": "40", "temperature": ""}},
+		{"model B", "claude-opus", "", map[string]string{"max_tokens": "8192", "top_k": "40", "temperature": "0.2"}},
+		{"model without its own defaults", "claude-other", "", map[string]string{"max_tokens": "2048", "top_k": "40", "temperature": ""}},
+		{"client values win", "claude-opus", `"max_tokens":100,"temperature":1,`, map[string]string{"max_tokens": "100", "top_k": "40", "temperature": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{` + tt.extra + `"messages":[{"role":"user","content":"hi"}],"stream":true}`
+			if tt.model != "" {
+				body = `{"model":"` + tt.model + `",` + body[1:]
+			}
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest("k", body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			for name, want := range tt.want {
+				if string(got[name]) != want {
+					t.Errorf("%s = %s, want %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
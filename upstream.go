@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamDialer opens upstream connections. UPSTREAM_DNS_SERVER and
+// UPSTREAM_DNS_CACHE_TTL replace its lookups with a cachingDialer.
+var upstreamDialer = &net.Dialer{
+	Timeout:   10 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// upstreamClient is shared by all outgoing calls so connections to Google
+// are pooled and reused.
+var upstreamClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           upstreamDialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   25,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+}
+
+// vertexClient calls Vertex AI. It has a transport of its own so the
+// upstream TLS settings, which describe the Vertex AI endpoint, don't apply
+// to the token endpoint, the metadata server or other providers.
+var vertexClient = &http.Client{Transport: upstreamClient.Transport.(*http.Transport).Clone()}
+
+// clientFor returns the client for req: vertexClient for Vertex AI hosts and
+// upstreamClient for everything else.
+func clientFor(req *http.Request) *http.Client {
+	if strings.HasSuffix(req.URL.Hostname(), "-aiplatform.googleapis.com") {
+		return vertexClient
+	}
+	return upstreamClient
+}
+
+func vertexURL(project, region, model string) string {
+	return vertexModelURL(project, region, model, "streamRawPredict")
+}
+
+// vertexBaseURL is the regional Vertex AI endpoint.
+func vertexBaseURL(region string) string {
+	return fmt.Sprintf("https://%s-aiplatform.googleapis.com", region)
+}
+
+func vertexModelURL(gcProjectID, region, model, method string) string {
+	return fmt.Sprintf("%s/%s/projects/%s/locations/%s/publishers/%s/models/%s:%s",
+		vertexBaseURL(region), cfg().VertexAPIVersion, gcProjectID, region, cfg().VertexPublisher, model, method)
+}
+
+var (
+	vertexAPIVersionPattern = regexp.MustCompile(`^v[0-9]+((alpha|beta)[0-9]*)?$`)
+	vertexModelPattern      = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*(@[a-z0-9.-]+)?$`)
+	vertexPublisherPattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+)
+
+// parseURLSegment validates a configurable path segment of the Vertex URL,
+// falling back to the default when it doesn't match pattern.
+func parseURLSegment(name, value, fallback string, pattern *regexp.Regexp) string {
+	if !pattern.MatchString(value) {
+		log.Printf("Invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return value
+}
+
+// regionsForModel returns the failover order of regions able to serve model.
+// Aliases use the regions of their route, or those of their target.
+func regionsForModel(model string) ([]string, error) {
+	if route, ok := modelAliases.Lookup(model); ok {
+		if len(route.Regions) > 0 {
+			return route.Regions, nil
+		}
+		return providerRegions(route.provider(), route.Model)
+	}
+	return providerRegions(providerOf(model), model)
+}
+
+// providerRegions returns the regions of the named provider serving model.
+// A MODEL_REGIONS mapping takes precedence; otherwise Vertex AI uses
+// cfg.Regions, Bedrock cfg.BedrockRegions, Azure OpenAI cfg.AzureEndpoints,
+// OpenAI and the Anthropic API their host and OpenAI-compatible servers
+// their base URL. VERTEX_TARGETS replace the regions of Vertex AI, keeping
+// those in the model's MODEL_REGIONS locations. The Anthropic API is added as
+// the last Vertex region for the models it is a fallback for.
+func providerRegions(provider, model string) ([]string, error) {
+	c := cfg()
+	regions := c.ModelRegions[model]
+	if len(regions) == 0 {
+		switch provider {
+		case providerBedrock:
+			return c.BedrockRegions, nil
+		case providerAzure:
+			return c.AzureEndpoints, nil
+		case providerOpenAI:
+			return []string{openAIHost}, nil
+		case providerOpenAICompatible:
+			return []string{c.OpenAICompatibleModels[model]}, nil
+		case providerAnthropic:
+			return []string{anthropicHost}, nil
+		}
+		if len(c.ModelRegions) > 0 {
+			return nil, fmt.Errorf("model %s is not available in any configured region", model)
+		}
+		regions = c.Regions
+	}
+	if len(c.VertexTargets) > 0 && (provider == providerVertex || provider == providerGemini) {
+		if regions = vertexTargetRegions(c.ModelRegions[model]); len(regions) == 0 {
+			return nil, fmt.Errorf("model %s is not available in any configured region", model)
+		}
+	}
+	if _, ok := c.AnthropicModels[model]; ok && c.AnthropicFallback && provider == providerVertex {
+		regions = append(slices.Clip(regions), anthropicHost)
+	}
+	return regions, nil
+}
+
+// parseModelTargets parses entries of the form model=target, naming what
+// serves a model at another provider, e.g. a Bedrock model ID.
+func parseModelTargets(name string, entries []string) map[string]string {
+	targets := make(map[string]string)
+	for _, entry := range entries {
+		model, target, ok := strings.Cut(entry, "=")
+		model, target = strings.TrimSpace(model), strings.TrimSpace(target)
+		if !ok || model == "" || target == "" {
+			log.Printf("Ignoring invalid %s entry %q", name, entry)
+			continue
+		}
+		targets[model] = target
+	}
+	return targets
+}
+
+// parseModelLists parses entries of the form model=value1|value2, such as
+// the regions of a model.
+func parseModelLists(name string, entries []string) map[string][]string {
+	mapping := make(map[string][]string)
+	for _, entry := range entries {
+		model, list, ok := strings.Cut(entry, "=")
+		if !ok {
+			log.Printf("Ignoring invalid %s entry %q", name, entry)
+			continue
+		}
+		for _, value := range strings.Split(list, "|") {
+			if value = strings.TrimSpace(value); value != "" {
+				mapping[strings.TrimSpace(model)] = append(mapping[strings.TrimSpace(model)], value)
+			}
+		}
+	}
+	return mapping
+}
+
+// isRegionFailure reports whether an upstream result indicates the region
+// itself is unavailable, so the request may be retried elsewhere.
+func isRegionFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// failsOver reports whether a request answered with resp or err moves on to
+// the remaining targets. Besides region-level failures, a 429 moves on with
+// FAILOVER_ON_RATE_LIMIT, or when the Anthropic API fallback is still ahead
+// since its capacity is separate from Vertex AI's.
+func failsOver(resp *http.Response, err error, remaining []failoverTarget) bool {
+	if isRegionFailure(resp, err) {
+		return true
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+	return cfg().FailoverOnRateLimit || slices.ContainsFunc(remaining, func(t failoverTarget) bool { return t.region == anthropicHost })
+}
+
+// forwardWithFailover sends the request for model to each region of p in
+// order, then to the secondary models of MODEL_FAILOVER, until a target
+// answers without a failure worth failing over for, as long as the retry
+// budget allows. Failed targets cool down for FAILOVER_COOLDOWN and are
+// skipped meanwhile. It returns the response together with the target that
+// served it, whose model differs from model after failing over to a
+// secondary one.
+func forwardWithFailover(ctx context.Context, p Provider, regions []string, model string, headers map[string]string, body []byte) (*http.Response, failoverTarget, error) {
+	var (
+		resp   *http.Response
+		err    error
+		served failoverTarget
+	)
+	targets := failoverTargets(p, regions, model)
+	for i, t := range targets {
+		served = t
+		resp, err = sendToRegion(ctx, t.provider, t.region, t.model, headers, bytes.NewReader(body))
+		if errors.Is(err, errUpstreamBusy) || errors.As(err, new(*GatewayError)) {
+			return nil, served, err
+		}
+		if !failsOver(resp, err, targets[i+1:]) {
+			break
+		}
+		if cfg().FailoverCooldown > 0 && ctx.Err() == nil {
+			cooldowns.Start(t.model, t.region, cooldownFor(resp))
+		}
+		if i == len(targets)-1 || ctx.Err() != nil || !allowRetry(retrySiteFailover) {
+			break
+		}
+		next := targets[i+1]
+		if next.model != t.model {
+			logf(ctx, "Failing over from %s to %s", t.model, next.model)
+		}
+		if err != nil {
+			logf(ctx, "Region %s failed: %v, trying %s", t.region, err, next.region)
+		} else {
+			logf(ctx, "Region %s returned status %d, trying %s", t.region, resp.StatusCode, next.region)
+			resp.Body.Close()
+		}
+	}
+	return resp, served, err
+}
+
+// forwardStream sends a request body that is streamed from the client. Such
+// a body can only be read once, so there is no failover: only the first
+// region not cooling down is tried.
+func forwardStream(ctx context.Context, p Provider, regions []string, model string, headers map[string]string, body io.Reader) (*http.Response, string, error) {
+	region := regions[0]
+	for _, r := range regions {
+		if !cooldowns.Cooling(model, r) {
+			region = r
+			break
+		}
+	}
+	resp, err := sendToRegion(ctx, p, region, model, headers, body)
+	if cfg().FailoverCooldown > 0 && ctx.Err() == nil && failsOver(resp, err, nil) {
+		cooldowns.Start(model, region, cooldownFor(resp))
+	}
+	return resp, region, err
+}
+
+// sendToRegion builds and authenticates the call with p, paces it with the
+// rate governor and records the upstream's rate limit headers from the
+// response, which is returned in Anthropic's format.
+func sendToRegion(ctx context.Context, p Provider, region, model string, headers map[string]string, body io.Reader) (*http.Response, error) {
+	if governor != nil {
+		if err := governor.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	req, err := p.BuildRequest(ctx, region, model, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	if err := p.Authenticate(req); err != nil {
+		return nil, err
+	}
+
+	// 响应体不做缓冲，由调用方边读边转发
+	resp, err := clientFor(req).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if governor != nil {
+		governor.Observe(resp.Header)
+	}
+	return p.StreamResponse(resp), nil
+}
+
+// upstreamRetryAfter determines how long a client should back off after an
+// upstream 429. It honours the Retry-After header (seconds or HTTP date), then
+// the RetryInfo detail of a Google RESOURCE_EXHAUSTED error body, and finally
+// falls back to the configured default.
+func upstreamRetryAfter(header http.Header, body []byte) time.Duration {
+	if v := header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return max(time.Until(t), 0)
+		}
+	}
+
+	// Google errors may be a single object or wrapped in an array.
+	var errResp struct {
+		Error struct {
+			Details []struct {
+				Type       string `json:"@type"`
+				RetryDelay string `json:"retryDelay"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errResp); err != nil {
+		var list []json.RawMessage
+		if json.Unmarshal(body, &list) == nil && len(list) > 0 {
+			json.Unmarshal(list[0], &errResp)
+		}
+	}
+	for _, d := range errResp.Error.Details {
+		if d.Type != "type.googleapis.com/google.rpc.RetryInfo" {
+			continue
+		}
+		if delay, err := time.ParseDuration(d.RetryDelay); err == nil {
+			return delay
+		}
+	}
+
+	return cfg().UpstreamRetryAfter
+}
+
+// upstreamErrorMessage extracts the message of an upstream error body, which
+// is either Anthropic's {"type": "error", "error": {"message"}} or a Google
+// API error {"error": {"code", "message", "status"}}, possibly wrapped in an
+// array. Anything else is returned as is, or replaced by a generic message
+// when empty.
+func upstreamErrorMessage(body []byte) string {
+	var errResp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errResp); err != nil {
+		var list []json.RawMessage
+		if json.Unmarshal(body, &list) == nil && len(list) > 0 {
+			json.Unmarshal(list[0], &errResp)
+		}
+	}
+	if errResp.Error.Message != "" {
+		return errResp.Error.Message
+	}
+	if msg := strings.TrimSpace(string(body)); msg != "" {
+		return msg
+	}
+	return "Upstream rejected the request"
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForwardWithFailover(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     map[string]int // per region, 200 when missing
+		wantRegion string
+		wantStatus int
+		wantTried  []string
+	}{
+		{
+			name:       "first region succeeds",
+			wantRegion: "us-east5",
+			wantStatus: http.StatusOK,
+			wantTried:  []string{"us-east5"},
+		},
+		{
+			name:       "first region fails, second succeeds",
+			status:     map[string]int{"us-east5": http.StatusInternalServerError},
+			wantRegion: "europe-west1",
+			wantStatus: http.StatusOK,
+			wantTried:  []string{"us-east5", "europe-west1"},
+		},
+		{
+			name:       "overloaded regions are skipped",
+			status:     map[string]int{"us-east5": http.StatusServiceUnavailable, "europe-west1": 529},
+			wantRegion: "asia-southeast1",
+			wantStatus: http.StatusOK,
+			wantTried:  []string{"us-east5", "europe-west1", "asia-southeast1"},
+		},
+		{
+			name:       "client errors don't fail over",
+			status:     map[string]int{"us-east5": http.StatusBadRequest},
+			wantRegion: "us-east5",
+			wantStatus: http.StatusBadRequest,
+			wantTried:  []string{"us-east5"},
+		},
+		{
+			name:       "last failure is returned",
+			status:     map[string]int{"us-east5": 500, "europe-west1": 502, "asia-southeast1": 503},
+			wantRegion: "asia-southeast1",
+			wantStatus: http.StatusServiceUnavailable,
+			wantTried:  []string{"us-east5", "europe-west1", "asia-southeast1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.FailoverCooldown = 0
+				c.ModelFailover = nil
+			})
+			var (
+				mu    sync.Mutex
+				tried []string
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				region := upstreamRegion(r)
+				mu.Lock()
+				tried = append(tried, region)
+				mu.Unlock()
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != `{"x":1}` {
+					t.Errorf("region %s got body %q", region, body)
+				}
+				if status, ok := tt.status[region]; ok {
+					w.WriteHeader(status)
+				}
+			}))
+			defer srv.Close()
+
+			regions := []string{"us-east5", "europe-west1", "asia-southeast1"}
+			resp, served, err := forwardWithFailover(context.Background(), fakeProvider{url: srv.URL}, regions, "claude", nil, []byte(`{"x":1}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if served.region != tt.wantRegion || resp.StatusCode != tt.wantStatus {
+				t.Errorf("served by %s with %d, want %s with %d", served.region, resp.StatusCode, tt.wantRegion, tt.wantStatus)
+			}
+			if !slices.Equal(tried, tt.wantTried) {
+				t.Errorf("tried %v, want %v", tried, tt.wantTried)
+			}
+		})
+	}
+}
+
+func TestFailoverServedRegionHeader(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5", "europe-west1"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.FailoverCooldown = 0
+	})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if upstreamRegion(r) == "us-east5" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		streamSSE(w, sseTranscript)
+	})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Served-Region"); got != "europe-west1" {
+		t.Errorf("X-Served-Region = %q, want europe-west1", got)
+	}
+}
+
+func TestUpstreamRetryAfter(t *testing.T) {
+	setConfig(t, func(c *Config) { c.UpstreamRetryAfter = 7 * time.Second })
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		want   time.Duration
+	}{
+		{"seconds", "12", "", 12 * time.Second},
+		{"HTTP date in the past", "Mon, 02 Jan 2006 15:04:05 GMT", "", 0},
+		{"RetryInfo detail", "", `{"error":{"code":429,"status":"RESOURCE_EXHAUSTED","details":[{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"30s"}]}}`, 30 * time.Second},
+		{"RetryInfo in an array", "", `[{"error":{"details":[{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"2.5s"}]}}]`, 2500 * time.Millisecond},
+		{"header wins over the body", "3", `{"error":{"details":[{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"30s"}]}}`, 3 * time.Second},
+		{"invalid header falls back", "soon", "", 7 * time.Second},
+		{"nothing falls back", "", `{"error":{"message":"quota"}}`, 7 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.header != "" {
+				header.Set("Retry-After", tt.header)
+			}
+			if got := upstreamRetryAfter(header, []byte(tt.body)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstream429RetryAfterPropagated(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.FailoverCooldown = 0
+	})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "42")
+		http.Error(w, `{"error":{"code":429,"status":"RESOURCE_EXHAUSTED"}}`, http.StatusTooManyRequests)
+	})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}]}`))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Retry-After"); got != "42" {
+		t.Errorf("Retry-After = %q, want 42", got)
+	}
+}
+
+func TestRegionsForModel(t *testing.T) {
+	tests := []struct {
+		name         string
+		modelRegions map[string][]string
+		targets      []vertexTarget
+		model        string
+		want         []string
+		wantErr      bool
+	}{
+		{"no mapping uses every region", nil, nil, "claude-a", []string{"us-east5", "europe-west1"}, false},
+		{"model with specific regions", map[string][]string{"claude-a": {"europe-west1"}}, nil, "claude-a", []string{"europe-west1"}, false},
+		{"model missing from the mapping", map[string][]string{"claude-a": {"europe-west1"}}, nil, "claude-b", nil, true},
+		{"targets in the model's locations", map[string][]string{"claude-a": {"europe-west1"}},
+			[]vertexTarget{{"p1", "us-east5", 1}, {"p1", "europe-west1", 1}, {"p2", "europe-west1", 1}}, "claude-a", []string{"p1/europe-west1", "p2/europe-west1"}, false},
+		{"no target in the model's locations", map[string][]string{"claude-a": {"asia-southeast1"}},
+			[]vertexTarget{{"p1", "us-east5", 1}}, "claude-a", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.Regions = []string{"us-east5", "europe-west1"}
+				c.ModelRegions = tt.modelRegions
+				c.VertexTargets = tt.targets
+				c.AnthropicModels = nil
+			})
+			swap(t, &modelAliases, &modelAliasTable{})
+			got, err := regionsForModel(tt.model)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("regions %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelWithoutRegionRejected(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.DefaultModel = "claude-a"
+		c.AllowedModels = []string{"claude-b"}
+		c.Regions = []string{"us-east5", "europe-west1"}
+		c.ModelRegions = map[string][]string{"claude-a": {"europe-west1"}}
+		c.VertexTargets = nil
+	})
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if region := upstreamRegion(r); region != "europe-west1" {
+			t.Errorf("request sent to %s", region)
+		}
+		streamSSE(w, sseTranscript)
+	})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusOK {
+		t.Errorf("model with a region: status %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"model":"claude-b","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "not available in any configured region") {
+		t.Errorf("model without a region: got %d %s, want a 400", w.Code, w.Body)
+	}
+	if got := auth.remaining("k"); got != 4 {
+		t.Errorf("key has %d calls left, want only the served request charged", got)
+	}
+}
+
+func TestVertexModelURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   string
+		publisher string
+		want      string
+	}{
+		{"defaults", "", "", "https://us-east5-aiplatform.googleapis.com/v1/projects/proj/locations/us-east5/publishers/anthropic/models/claude-a:streamRawPredict"},
+		{"beta version", "v1beta1", "", "https://us-east5-aiplatform.googleapis.com/v1beta1/projects/proj/locations/us-east5/publishers/anthropic/models/claude-a:streamRawPredict"},
+		{"other publisher", "v2", "anthropic-next", "https://us-east5-aiplatform.googleapis.com/v2/projects/proj/locations/us-east5/publishers/anthropic-next/models/claude-a:streamRawPredict"},
+		{"invalid version", "v1/../v2", "", "https://us-east5-aiplatform.googleapis.com/v1/projects/proj/locations/us-east5/publishers/anthropic/models/claude-a:streamRawPredict"},
+		{"invalid publisher", "", "Anthropic/x", "https://us-east5-aiplatform.googleapis.com/v1/projects/proj/locations/us-east5/publishers/anthropic/models/claude-a:streamRawPredict"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("VERTEX_API_VERSION", tt.version)
+			t.Setenv("VERTEX_PUBLISHER", tt.publisher)
+			loaded := loadConfig()
+			setConfig(t, func(c *Config) {
+				c.VertexAPIVersion = loaded.VertexAPIVersion
+				c.VertexPublisher = loaded.VertexPublisher
+			})
+			if got := vertexURL("proj", "us-east5", "claude-a"); got != tt.want {
+				t.Errorf("URL %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamErrorMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"Anthropic error", `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: Field required"}}`, "max_tokens: Field required"},
+		{"Google API error", `{"error":{"code":400,"message":"Invalid JSON payload received.","status":"INVALID_ARGUMENT"}}`, "Invalid JSON payload received."},
+		{"wrapped in an array", `[{"error":{"code":400,"message":"Request contains an invalid argument.","status":"INVALID_ARGUMENT"}}]`, "Request contains an invalid argument."},
+		{"plain text", "  Bad Request\n", "Bad Request"},
+		{"JSON without a message", `{"error":{}}`, `{"error":{}}`},
+		{"empty", "", "Upstream rejected the request"},
+	}
+	for _, tt := range tests {
+		if got := upstreamErrorMessage([]byte(tt.body)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// UsageEvent describes a completed request for the accounting pipeline.
+type UsageEvent struct {
+	KeyID        string    `json:"key_id"`
+	Model        string    `json:"model"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	Status       int       `json:"status"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// UsagePublisher ships usage events to an external sink.
+type UsagePublisher interface {
+	PublishUsage(event UsageEvent) error
+}
+
+// usageSinks receive every completed request. The live feed is always
+// present; the database log and external broker are added at startup.
+var usageSinks = []UsagePublisher{liveUsage}
+
+// publishUsage hands a completed request to every usage sink.
+func publishUsage(event UsageEvent) {
+	for _, sink := range usageSinks {
+		sink.PublishUsage(event)
+	}
+}
+
+// dbUsageLog records usage events in the usage_log table.
+type dbUsageLog struct{}
+
+func (dbUsageLog) PublishUsage(event UsageEvent) error {
+	_, err := db.Exec(`
+		INSERT INTO usage_log (key_id, model, input_tokens, output_tokens, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		event.KeyID, event.Model, event.InputTokens, event.OutputTokens, event.Status, event.Timestamp)
+	return err
+}
+
+// asyncPublisher decouples request handling from a slow or unavailable sink.
+// Events are dropped when the queue is full so the gateway fails open.
+type asyncPublisher struct {
+	next   UsagePublisher
+	events chan UsageEvent
+}
+
+func newAsyncPublisher(next UsagePublisher, size int) *asyncPublisher {
+	p := &asyncPublisher{next: next, events: make(chan UsageEvent, size)}
+	go p.run()
+	return p
+}
+
+func (p *asyncPublisher) PublishUsage(event UsageEvent) error {
+	select {
+	case p.events <- event:
+	default:
+		log.Printf("Usage queue full, dropping event for key %s", event.KeyID)
+	}
+	return nil
+}
+
+func (p *asyncPublisher) run() {
+	for event := range p.events {
+		if err := p.next.PublishUsage(event); err != nil {
+			log.Printf("Error publishing usage event: %v", err)
+		}
+	}
+}
+
+// keyID returns a stable, non-reversible identifier for an API key so that
+// plaintext keys never leave the gateway.
+func keyID(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// isKeyID reports whether s has the form of a key ID.
+func isKeyID(s string) bool {
+	return len(s) == 16 && isLowerHex(s)
+}
+
+// isKeyHash reports whether s has the form of a key's full SHA-256 hash, of
+// which the key ID is the first 16 characters.
+func isKeyHash(s string) bool {
+	return len(s) == 2*sha256.Size && isLowerHex(s)
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// usageTracker extracts token usage from the Anthropic SSE stream.
+type usageTracker struct {
+	InputTokens  int
+	OutputTokens int
+	// Completed is set once the stream's message_stop event, or a complete
+	// non-streaming message, was seen.
+	Completed bool
+	// Failed is set when the upstream ended the stream with an error event.
+	Failed bool
+	// deltaBytes counts the text and tool input streamed so far, used to
+	// estimate output tokens when the stream is cut short.
+	deltaBytes int
+}
+
+// bytesPerToken is the rough size of an output token used to estimate usage
+// of streams that never reached their final message_delta.
+const bytesPerToken = 4
+
+// truncate accounts for a stream ended by the gateway: the last reported
+// output_tokens lags behind what was sent, so the streamed deltas are used
+// when they indicate more.
+func (u *usageTracker) truncate() {
+	if estimate := (u.deltaBytes + bytesPerToken - 1) / bytesPerToken; estimate > u.OutputTokens {
+		u.OutputTokens = estimate
+	}
+}
+
+// observeMessage reads usage from a non-streaming Messages API response.
+func (u *usageTracker) observeMessage(body []byte) {
+	var message struct {
+		Type  string `json:"type"`
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &message); err != nil || message.Type != "message" {
+		return
+	}
+	u.InputTokens = message.Usage.InputTokens
+	u.OutputTokens = message.Usage.OutputTokens
+	u.Completed = true
+}
+
+// observeEvent feeds every line of an SSE event to observe.
+func (u *usageTracker) observeEvent(event []byte) {
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		u.observe(line)
+	}
+}
+
+func (u *usageTracker) observe(line []byte) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return
+	}
+	var event struct {
+		Type    string `json:"type"`
+		Message struct {
+			Usage struct {
+				InputTokens  int `json:"input_tokens"`
+				OutputTokens int `json:"output_tokens"`
+			} `json:"usage"`
+		} `json:"message"`
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+		Delta struct {
+			Text        string `json:"text"`
+			Thinking    string `json:"thinking"`
+			PartialJSON string `json:"partial_json"`
+		} `json:"delta"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(data), &event); err != nil {
+		return
+	}
+	switch event.Type {
+	case "message_start":
+		u.InputTokens = event.Message.Usage.InputTokens
+		u.OutputTokens = event.Message.Usage.OutputTokens
+	case "content_block_delta":
+		u.deltaBytes += len(event.Delta.Text) + len(event.Delta.Thinking) + len(event.Delta.PartialJSON)
+	case "message_delta":
+		// message_delta 中的 output_tokens 为累计值；input_tokens 仅在部分提供方的流中出现
+		u.OutputTokens = event.Usage.OutputTokens
+		if event.Usage.InputTokens > 0 {
+			u.InputTokens = event.Usage.InputTokens
+		}
+	case "message_stop":
+		u.Completed = true
+	case "error":
+		u.Failed = true
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// usageHub fans usage events out to live subscribers, keyed by key ID.
+// Slow subscribers miss events rather than blocking request handling.
+type usageHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan UsageEvent]struct{}
+}
+
+var liveUsage = &usageHub{subs: make(map[string]map[chan UsageEvent]struct{})}
+
+func (h *usageHub) PublishUsage(event UsageEvent) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[event.KeyID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	return nil
+}
+
+func (h *usageHub) subscribe(id string) chan UsageEvent {
+	ch := make(chan UsageEvent, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[id] == nil {
+		h.subs[id] = make(map[chan UsageEvent]struct{})
+	}
+	h.subs[id][ch] = struct{}{}
+	return ch
+}
+
+func (h *usageHub) unsubscribe(id string, ch chan UsageEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[id], ch)
+	if len(h.subs[id]) == 0 {
+		delete(h.subs, id)
+	}
+}
+
+// handleUsageStream streams usage events for one key, addressed like the
+// other admin key routes, as they happen.
+func handleUsageStream(w http.ResponseWriter, r *http.Request) {
+	id, _, ok := parseKeyRef(r.PathValue("id"))
+	if !ok {
+		respondError(w, r, invalidRequest(errInvalidKeyRef))
+		return
+	}
+
+	// 长连接不受服务器写超时限制
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	events := liveUsage.subscribe(id)
+	defer liveUsage.unsubscribe(id, events)
+
+	heartbeat := time.NewTicker(cfg().SSEHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if err := writeSSE(w, "usage", data); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribers returns how many live feeds follow the key ID.
+func (h *usageHub) subscribers(id string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs[id])
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestUsageStream(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.SSEHeartbeat = 10 * time.Millisecond
+	})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/keys/{id}/usage/stream", handleUsageStream)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	id := keyID("k")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/v1/keys/"+id+"/usage/stream", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("stream ended")
+			}
+			return line
+		case <-time.After(2 * time.Second):
+			t.Fatal("no event within 2s")
+			return ""
+		}
+	}
+
+	waitFor(t, "the feed to subscribe", func() bool { return liveUsage.subscribers(id) == 1 })
+	if line := next(); line != ": heartbeat" {
+		t.Errorf("first line %q, want a heartbeat", line)
+	}
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	for line := next(); line != "event: usage"; line = next() {
+	}
+	data, ok := strings.CutPrefix(next(), "data: ")
+	if !ok {
+		t.Fatal("usage event without data")
+	}
+	var event UsageEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.KeyID != id || event.InputTokens != 10 || event.OutputTokens != 5 || event.Status != http.StatusOK {
+		t.Errorf("event %+v, want the request's usage", event)
+	}
+
+	cancel()
+	waitFor(t, "the feed to unsubscribe", func() bool { return liveUsage.subscribers(id) == 0 })
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingPublisher keeps the usage events published to it.
+type recordingPublisher struct {
+	mu     sync.Mutex
+	events []UsageEvent
+}
+
+func (p *recordingPublisher) PublishUsage(event UsageEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+func (p *recordingPublisher) published() []UsageEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]UsageEvent(nil), p.events...)
+}
+
+// recordUsage sends the usage events to a recordingPublisher for the rest of
+// the test.
+func recordUsage(t *testing.T) *recordingPublisher {
+	t.Helper()
+	rec := &recordingPublisher{}
+	swap(t, &usageSinks, []UsagePublisher{rec})
+	return rec
+}
+
+func TestUsageEventPerRequest(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 100, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+	rec := recordUsage(t)
+
+	const requests = 3
+	for range requests {
+		w := httptest.NewRecorder()
+		handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+	// 被拒绝的请求不产生用量事件
+	handleForwardToEndpoint(httptest.NewRecorder(), newMessagesRequest("unknown", `{}`))
+
+	events := rec.published()
+	if len(events) != requests {
+		t.Fatalf("got %d events, want %d", len(events), requests)
+	}
+	for _, e := range events {
+		if e.KeyID != keyID("k") || e.Model != cfg().DefaultModel || e.InputTokens != 10 || e.OutputTokens != 5 || e.Status != http.StatusOK || e.Timestamp.IsZero() {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+}
+
+func TestUsageTracker(t *testing.T) {
+	var u usageTracker
+	reader := bufio.NewReader(strings.NewReader(sseTranscript))
+	for {
+		event, err := readSSEEvent(reader)
+		if err != nil {
+			break
+		}
+		u.observeEvent(event)
+	}
+	if u.InputTokens != 10 || u.OutputTokens != 5 {
+		t.Errorf("tracked %d input and %d output tokens, want 10 and 5", u.InputTokens, u.OutputTokens)
+	}
+}
+
+func TestKeyIDForms(t *testing.T) {
+	tests := []struct {
+		in     string
+		isID   bool
+		isHash bool
+	}{
+		{keyID("secret"), true, false},
+		{"0123456789abcdef", true, false},
+		{"0123456789ABCDEF", false, false},
+		{"sk-live-123", false, false},
+		{strings.Repeat("0123456789abcdef", 4), false, true},
+	}
+	for _, tt := range tests {
+		if got := isKeyID(tt.in); got != tt.isID {
+			t.Errorf("isKeyID(%q) = %v, want %v", tt.in, got, tt.isID)
+		}
+		if got := isKeyHash(tt.in); got != tt.isHash {
+			t.Errorf("isKeyHash(%q) = %v, want %v", tt.in, got, tt.isHash)
+		}
+	}
+	if keyID("secret") == keyID("other") {
+		t.Error("distinct keys share a key ID")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// messagesRequest mirrors the top-level fields of the Anthropic Messages API
+// request body as accepted by Vertex AI.
+type messagesRequest struct {
+	AnthropicVersion string            `json:"anthropic_version"`
+	Model            string            `json:"model,omitempty"`
+	Messages         []json.RawMessage `json:"messages"`
+	System           json.RawMessage   `json:"system,omitempty"`
+	MaxTokens        int               `json:"max_tokens"`
+	Metadata         json.RawMessage   `json:"metadata,omitempty"`
+	StopSequences    []string          `json:"stop_sequences,omitempty"`
+	Stream           bool              `json:"stream,omitempty"`
+	Temperature      *float64          `json:"temperature,omitempty"`
+	TopP             *float64          `json:"top_p,omitempty"`
+	TopK             *int              `json:"top_k,omitempty"`
+	Tools            json.RawMessage   `json:"tools,omitempty"`
+	ToolChoice       json.RawMessage   `json:"tool_choice,omitempty"`
+}
+
+// validateRequest checks the request body before it is forwarded. It returns
+// an error whose message is safe to show to the client.
+func validateRequest(body []byte) error {
+	if flags.Enabled(flagStrictValidation) {
+		var req messagesRequest
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			// encoding/json reports unknown fields as: json: unknown field "name"
+			if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+				return fmt.Errorf("unknown field %s", field)
+			}
+			return fmt.Errorf("invalid request body: %v", err)
+		}
+	}
+
+	if flags.Enabled(flagValidateParams) {
+		if err := validateParams(body); err != nil {
+			return err
+		}
+	}
+
+	if flags.Enabled(flagValidateTools) {
+		if err := validateTools(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestLimits caps the size of a request, 0 meaning unlimited.
+type requestLimits struct {
+	MaxMessages    int
+	MaxInputTokens int
+}
+
+// requestLimitsFor returns the caps for key's requests: the key's own where
+// set, else MAX_MESSAGES and MAX_INPUT_TOKENS.
+func requestLimitsFor(key *APIKey) requestLimits {
+	limits := requestLimits{MaxMessages: cfg().MaxMessages, MaxInputTokens: cfg().MaxInputTokens}
+	if key.MaxMessages != nil {
+		limits.MaxMessages = *key.MaxMessages
+	}
+	if key.MaxInputTokens != nil {
+		limits.MaxInputTokens = *key.MaxInputTokens
+	}
+	return limits
+}
+
+func (l requestLimits) active() bool {
+	return l.MaxMessages > 0 || l.MaxInputTokens > 0
+}
+
+// validateRequestSize checks the number of messages and the estimated input
+// tokens of body against limits. The estimate counts the text of the system
+// prompt, messages and tools at bytesPerToken, leaving out base64 image and
+// document data, so it is only a rough guard against runaway conversations.
+func validateRequestSize(body []byte, limits requestLimits) error {
+	if !limits.active() {
+		return nil
+	}
+	var req struct {
+		Messages []json.RawMessage `json:"messages"`
+		System   json.RawMessage   `json:"system"`
+		Tools    json.RawMessage   `json:"tools"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	if limits.MaxMessages > 0 && len(req.Messages) > limits.MaxMessages {
+		return fmt.Errorf("messages: %d messages exceed the limit of %d", len(req.Messages), limits.MaxMessages)
+	}
+	if limits.MaxInputTokens > 0 {
+		var n int
+		for _, raw := range append(req.Messages, req.System, req.Tools) {
+			n += textBytes(raw)
+		}
+		if tokens := (n + bytesPerToken - 1) / bytesPerToken; tokens > limits.MaxInputTokens {
+			return fmt.Errorf("request has about %d input tokens, more than the limit of %d", tokens, limits.MaxInputTokens)
+		}
+	}
+	return nil
+}
+
+// textBytes sums the length of the strings in a JSON value, skipping the
+// base64 "data" of image and document sources.
+func textBytes(raw json.RawMessage) int {
+	if len(raw) == 0 {
+		return 0
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return 0
+	}
+	var count func(v any) int
+	count = func(v any) int {
+		switch v := v.(type) {
+		case string:
+			return len(v)
+		case []any:
+			n := 0
+			for _, item := range v {
+				n += count(item)
+			}
+			return n
+		case map[string]any:
+			n := 0
+			for k, item := range v {
+				if k != "data" {
+					n += count(item)
+				}
+			}
+			return n
+		}
+		return 0
+	}
+	return count(v)
+}
+
+// paramBound is the inclusive range accepted for a numeric parameter.
+type paramBound struct {
+	Min, Max float64
+}
+
+// parseParamBounds parses a list of name=min:max entries. Either side of the
+// range may be left empty to leave it unbounded.
+func parseParamBounds(entries []string) map[string]paramBound {
+	bounds := make(map[string]paramBound)
+	for _, entry := range entries {
+		name, rng, ok := strings.Cut(entry, "=")
+		lo, hi, ok2 := strings.Cut(rng, ":")
+		if !ok || !ok2 {
+			log.Printf("Ignoring invalid parameter bound %q", entry)
+			continue
+		}
+		b := paramBound{Min: math.Inf(-1), Max: math.Inf(1)}
+		var err error
+		if lo != "" {
+			if b.Min, err = strconv.ParseFloat(lo, 64); err != nil {
+				log.Printf("Ignoring invalid parameter bound %q", entry)
+				continue
+			}
+		}
+		if hi != "" {
+			if b.Max, err = strconv.ParseFloat(hi, 64); err != nil {
+				log.Printf("Ignoring invalid parameter bound %q", entry)
+				continue
+			}
+		}
+		bounds[strings.TrimSpace(name)] = b
+	}
+	return bounds
+}
+
+// validateParams checks the sampling parameters against cfg.ParamBounds.
+func validateParams(body []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+
+	for name, bound := range cfg().ParamBounds {
+		raw, ok := fields[name]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		var v float64
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("%s: must be a number", name)
+		}
+		if v < bound.Min || v > bound.Max {
+			return fmt.Errorf("%s: %g is out of range [%g, %g]", name, v, bound.Min, bound.Max)
+		}
+	}
+
+	if raw, ok := fields["stop_sequences"]; ok && string(raw) != "null" {
+		var seqs []string
+		if err := json.Unmarshal(raw, &seqs); err != nil {
+			return fmt.Errorf("stop_sequences: must be an array of strings")
+		}
+	}
+	return nil
+}
+
+// validateTools checks the structure of the tool definitions: every custom
+// tool needs a name and an input_schema that is a JSON Schema object.
+// Anthropic-defined tools (those with a type other than "custom") only need a
+// name.
+func validateTools(body []byte) error {
+	var req struct {
+		Tools json.RawMessage `json:"tools"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	if len(req.Tools) == 0 || string(req.Tools) == "null" {
+		return nil
+	}
+
+	var tools []map[string]json.RawMessage
+	if err := json.Unmarshal(req.Tools, &tools); err != nil {
+		return fmt.Errorf("tools: must be an array of objects")
+	}
+	for i, tool := range tools {
+		var name string
+		if err := json.Unmarshal(tool["name"], &name); err != nil || name == "" {
+			return fmt.Errorf("tools[%d]: name must be a non-empty string", i)
+		}
+
+		var toolType string
+		json.Unmarshal(tool["type"], &toolType)
+		if toolType != "" && toolType != "custom" {
+			continue
+		}
+
+		if err := validateInputSchema(tool["input_schema"]); err != nil {
+			return fmt.Errorf("tools[%d] (%s): %v", i, name, err)
+		}
+	}
+	return nil
+}
+
+func validateInputSchema(raw json.RawMessage) error {
+	if raw == nil {
+		return fmt.Errorf("input_schema is required")
+	}
+	var schema map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &schema); err != nil || schema == nil {
+		return fmt.Errorf("input_schema must be an object")
+	}
+
+	var schemaType string
+	if err := json.Unmarshal(schema["type"], &schemaType); err != nil || schemaType != "object" {
+		return fmt.Errorf(`input_schema.type must be "object"`)
+	}
+	if raw, ok := schema["properties"]; ok {
+		var props map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &props); err != nil || props == nil {
+			return fmt.Errorf("input_schema.properties must be an object")
+		}
+	}
+	if raw, ok := schema["required"]; ok {
+		var required []string
+		if err := json.Unmarshal(raw, &required); err != nil {
+			return fmt.Errorf("input_schema.required must be an array of strings")
+		}
+	}
+	return nil
+}
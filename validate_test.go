@@ -0,0 +1,242 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStrictValidation(t *testing.T) {
+	const typo = `{"messages":[{"role":"user","content":"hi"}],"max_token":100}`
+	const valid = `{"messages":[{"role":"user","content":"hi"}],"max_tokens":100}`
+	tests := []struct {
+		name    string
+		strict  bool
+		body    string
+		wantErr string
+	}{
+		{"typo in strict mode", true, typo, `unknown field "max_token"`},
+		{"typo in lenient mode", false, typo, ""},
+		{"valid body in strict mode", true, valid, ""},
+		{"malformed body in strict mode", true, `{"messages":`, "invalid request body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, flagStrictValidation, tt.strict)
+			err := validateRequest([]byte(tt.body))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStrictValidationRejectsBeforeCharging(t *testing.T) {
+	setFlag(t, flagStrictValidation, true)
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("invalid request reached the upstream")
+	})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[],"max_token":1}`))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_request_error") {
+		t.Errorf("got %d %s, want a 400 invalid_request_error", w.Code, w.Body)
+	}
+	if got := auth.remaining("k"); got != 5 {
+		t.Errorf("key has %d calls left, want 5", got)
+	}
+}
+
+func TestValidateParams(t *testing.T) {
+	setFlag(t, flagStrictValidation, false)
+	setFlag(t, flagValidateParams, true)
+	setConfig(t, func(c *Config) {
+		c.ParamBounds = parseParamBounds([]string{"temperature=0:1", "top_p=0:1", "top_k=0:", "max_tokens=1:"})
+	})
+	tests := []struct {
+		name    string
+		params  string
+		wantErr string
+	}{
+		{"valid values", `"top_p":0.9,"top_k":40,"temperature":0.7`, ""},
+		{"bounds are inclusive", `"top_p":1,"top_k":0,"temperature":0`, ""},
+		{"null is left to the upstream", `"top_p":null`, ""},
+		{"top_p above 1", `"top_p":1.5`, "top_p: 1.5 is out of range [0, 1]"},
+		{"negative top_p", `"top_p":-0.1`, "top_p: -0.1 is out of range [0, 1]"},
+		{"negative top_k", `"top_k":-1`, "top_k: -1 is out of range [0, +Inf]"},
+		{"top_k not a number", `"top_k":"40"`, "top_k: must be a number"},
+		{"stop_sequences not strings", `"stop_sequences":[1]`, "stop_sequences: must be an array of strings"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"messages":[{"role":"user","content":"hi"}],"max_tokens":100,` + tt.params + `}`
+			err := validateRequest([]byte(body))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseParamBounds(t *testing.T) {
+	bounds := parseParamBounds([]string{"top_p=0:1", "top_k=0:", "max_tokens=:4096", "bad", "temperature=x:1"})
+	want := map[string]paramBound{
+		"top_p":      {Min: 0, Max: 1},
+		"top_k":      {Min: 0, Max: math.Inf(1)},
+		"max_tokens": {Min: math.Inf(-1), Max: 4096},
+	}
+	if !maps.Equal(bounds, want) {
+		t.Errorf("bounds %v, want %v", bounds, want)
+	}
+}
+
+func TestOutOfRangeParamRejectedBeforeForwarding(t *testing.T) {
+	setFlag(t, flagValidateParams, true)
+	auth := useKeys(t, &APIKey{Key: "k", RemainingCalls: 5, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("invalid request reached the upstream")
+	})
+
+	w := httptest.NewRecorder()
+	handleForwardToEndpoint(w, newMessagesRequest("k", `{"messages":[{"role":"user","content":"hi"}],"top_p":2}`))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "top_p") {
+		t.Errorf("got %d %s, want a 400 naming top_p", w.Code, w.Body)
+	}
+	if got := auth.remaining("k"); got != 5 {
+		t.Errorf("key has %d calls left, want 5", got)
+	}
+}
+
+func TestValidateTools(t *testing.T) {
+	setFlag(t, flagStrictValidation, false)
+	setFlag(t, flagValidateParams, false)
+	setFlag(t, flagValidateTools, true)
+	tests := []struct {
+		name    string
+		tools   string
+		wantErr string
+	}{
+		{"valid tool", `[{"name":"get_weather","description":"Weather","input_schema":{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}}]`, ""},
+		{"Anthropic-defined tool", `[{"type":"bash_20250124","name":"bash"}]`, ""},
+		{"no tools", `null`, ""},
+		{"tools not an array", `{"name":"x"}`, "tools: must be an array of objects"},
+		{"missing name", `[{"input_schema":{"type":"object"}}]`, "tools[0]: name must be a non-empty string"},
+		{"missing input_schema", `[{"name":"ok","input_schema":{"type":"object"}},{"name":"bad"}]`, "tools[1] (bad): input_schema is required"},
+		{"input_schema not an object", `[{"name":"bad","input_schema":"object"}]`, "tools[0] (bad): input_schema must be an object"},
+		{"input_schema of another type", `[{"name":"bad","input_schema":{"type":"string"}}]`, `tools[0] (bad): input_schema.type must be "object"`},
+		{"properties not an object", `[{"name":"bad","input_schema":{"type":"object","properties":[]}}]`, "tools[0] (bad): input_schema.properties must be an object"},
+		{"required not strings", `[{"name":"bad","input_schema":{"type":"object","required":[1]}}]`, "tools[0] (bad): input_schema.required must be an array of strings"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"messages":[{"role":"user","content":"hi"}],"max_tokens":100,"tools":` + tt.tools + `}`
+			err := validateRequest([]byte(body))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("opt-in", func(t *testing.T) {
+		setFlag(t, flagValidateTools, false)
+		if err := validateRequest([]byte(`{"messages":[],"tools":[{"name":"bad"}]}`)); err != nil {
+			t.Errorf("unexpected error with validation off: %v", err)
+		}
+	})
+}
+
+func TestValidateRequestSize(t *testing.T) {
+	msg := func(text string) string { return `{"role":"user","content":"` + text + `"}` }
+	body := func(msgs ...string) string { return `{"messages":[` + strings.Join(msgs, ",") + `]}` }
+	image := `{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + strings.Repeat("A", 4000) + `"}}]}`
+	tests := []struct {
+		name    string
+		body    string
+		limits  requestLimits
+		wantErr string
+	}{
+		{"no caps", body(msg("a"), msg("b"), msg("c")), requestLimits{}, ""},
+		{"within the message cap", body(msg("a"), msg("b")), requestLimits{MaxMessages: 2}, ""},
+		{"over the message cap", body(msg("a"), msg("b"), msg("c")), requestLimits{MaxMessages: 2}, "3 messages exceed the limit of 2"},
+		{"within the token cap", body(msg(strings.Repeat("x", 400))), requestLimits{MaxInputTokens: 110}, ""},
+		{"over the token cap", body(msg(strings.Repeat("x", 800))), requestLimits{MaxInputTokens: 110}, "more than the limit of 110"},
+		{"system prompt counted", `{"system":"` + strings.Repeat("x", 800) + `","messages":[` + msg("hi") + `]}`, requestLimits{MaxInputTokens: 110}, "more than the limit of 110"},
+		{"image data not counted", body(image), requestLimits{MaxInputTokens: 110}, ""},
+		{"malformed body", `{"messages":`, requestLimits{MaxMessages: 2}, "invalid request body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRequestSize([]byte(tt.body), tt.limits)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMessageCapOnForwardedRequest(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+		c.MaxMessages = 2
+		c.MaxInputTokens = 0
+	})
+	five, unlimited := 5, 0
+	auth := useKeys(t,
+		&APIKey{Key: "default", RemainingCalls: 5, Tier: defaultTier},
+		&APIKey{Key: "raised", RemainingCalls: 5, Tier: defaultTier, MaxMessages: &five},
+		&APIKey{Key: "uncapped", RemainingCalls: 5, Tier: defaultTier, MaxMessages: &unlimited},
+	)
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+	turn := `{"role":"user","content":"hi"},{"role":"assistant","content":"hello"}`
+	tests := []struct {
+		name       string
+		key        string
+		messages   int
+		wantStatus int
+	}{
+		{"within the global cap", "default", 2, http.StatusOK},
+		{"over the global cap", "default", 4, http.StatusBadRequest},
+		{"within the key's cap", "raised", 4, http.StatusOK},
+		{"over the key's cap", "raised", 6, http.StatusBadRequest},
+		{"key without a cap", "uncapped", 20, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs := strings.TrimSuffix(strings.Repeat(turn+",", tt.messages/2), ",")
+			before := auth.remaining(tt.key)
+			w := httptest.NewRecorder()
+			handleForwardToEndpoint(w, newMessagesRequest(tt.key, `{"messages":[`+msgs+`],"stream":true}`))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusBadRequest {
+				if !strings.Contains(w.Body.String(), "exceed the limit") {
+					t.Errorf("body %s, want the cap named", w.Body)
+				}
+				if auth.remaining(tt.key) != before {
+					t.Error("rejected request was charged")
+				}
+			}
+		})
+	}
+}
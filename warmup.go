@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// upstreamRegions lists every region a request may be sent to.
+func upstreamRegions() []string {
+	regions := slices.Clone(cfg().Regions)
+	for _, rs := range cfg().ModelRegions {
+		regions = append(regions, rs...)
+	}
+	for _, t := range cfg().VertexTargets {
+		regions = append(regions, t.Location)
+	}
+	slices.Sort(regions)
+	return slices.Compact(regions)
+}
+
+// warmupUpstream opens a connection to the Vertex AI host of every region so
+// the DNS lookup and TLS handshake are done before the first request. It
+// sends an unauthenticated HEAD request, which uses no quota, and returns the
+// connection to the pool. Failures are only logged.
+func warmupUpstream(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, region := range upstreamRegions() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			url := vertexBaseURL(region) + "/"
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+			if err != nil {
+				log.Printf("Warmup of %s failed: %v", url, err)
+				return
+			}
+			resp, err := vertexClient.Do(req)
+			if err != nil {
+				log.Printf("Warmup of %s failed: %v", url, err)
+				return
+			}
+			// 读完响应体才能让连接回到连接池
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			log.Printf("Warmed up connection to %s in %s", url, time.Since(start))
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpstreamRegions(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5", "europe-west1"}
+		c.ModelRegions = map[string][]string{"claude-a": {"europe-west1", "asia-southeast1"}}
+		c.VertexTargets = []vertexTarget{{"p1", "us-central1", 1}, {"p2", "us-east5", 1}}
+	})
+	want := []string{"asia-southeast1", "europe-west1", "us-central1", "us-east5"}
+	if got := upstreamRegions(); !slices.Equal(got, want) {
+		t.Errorf("regions %v, want %v", got, want)
+	}
+}
+
+func TestWarmupUpstream(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5", "europe-west1"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	var (
+		mu    sync.Mutex
+		hosts []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.Header.Get("Authorization") != "" {
+			t.Errorf("warmup sent %s with Authorization %q, want an unauthenticated HEAD", r.Method, r.Header.Get("Authorization"))
+		}
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	swap(t, &vertexClient, &http.Client{Transport: redirectTransport{target}})
+
+	warmupUpstream(time.Second)
+	slices.Sort(hosts)
+	if want := []string{"europe-west1-aiplatform.googleapis.com", "us-east5-aiplatform.googleapis.com"}; !slices.Equal(hosts, want) {
+		t.Errorf("connected to %v, want %v", hosts, want)
+	}
+}
+
+func TestWarmupFailureIgnored(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	blocked := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocked
+	}))
+	defer srv.Close()
+	defer close(blocked)
+	target, _ := url.Parse(srv.URL)
+	swap(t, &vertexClient, &http.Client{Transport: redirectTransport{target}})
+
+	start := time.Now()
+	warmupUpstream(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("warmup took %s, want it cut off by its timeout", elapsed)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal RFC 6455 server, enough to stream responses to clients that
+// prefer WebSocket over SSE: text frames, fragmentation, ping/pong and the
+// close handshake. Extensions and subprotocols are not supported.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+const (
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseTooBig      = 1009
+	wsCloseServerError = 1011
+)
+
+// maxWSMessage caps the request message a client may send.
+const maxWSMessage = 32 << 20
+
+var (
+	errWSClosed = errors.New("websocket closed")
+	errWSTooBig = errors.New("websocket message too big")
+)
+
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// upgradeWebSocket performs the opening handshake and takes over the
+// connection. On failure an error response has already been written.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		respondError(w, r, invalidRequest("Expected a WebSocket upgrade request"))
+		return nil, errors.New("not a websocket upgrade")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		respondError(w, r, invalidRequest("Unsupported WebSocket version"))
+		return nil, errors.New("unsupported websocket version")
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		respondError(w, r, internalError("WebSocket upgrade failed", err))
+		return nil, err
+	}
+	// 接管连接后服务器的读写超时不再适用
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteFrame sends one unmasked frame with the FIN bit set.
+func (c *wsConn) WriteFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeFrameLocked(op, payload)
+}
+
+func (c *wsConn) writeFrameLocked(op byte, payload []byte) error {
+	if c.closed {
+		return errWSClosed
+	}
+	header := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	if op == wsOpClose {
+		c.closed = true
+	}
+	return nil
+}
+
+// Close starts the closing handshake with code; later writes fail.
+func (c *wsConn) Close(code uint16, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	return c.WriteFrame(wsOpClose, append(payload, reason...))
+}
+
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin, op = head[0]&0x80 != 0, head[0]&0x0F
+	if head[1]&0x80 == 0 {
+		return fin, op, nil, errors.New("unmasked client frame")
+	}
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > maxWSMessage {
+		return fin, op, nil, errWSTooBig
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// ReadMessage returns the next text or binary message, answering pings on
+// the way. It returns errWSClosed once the client closed the connection,
+// after replying to its close frame.
+func (c *wsConn) ReadMessage() (byte, []byte, error) {
+	var (
+		msgOp byte
+		msg   []byte
+	)
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			if errors.Is(err, errWSTooBig) {
+				c.Close(wsCloseTooBig, "message too big")
+			}
+			return 0, nil, err
+		}
+		switch op {
+		case wsOpPing:
+			c.WriteFrame(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// 回应客户端的关闭帧（若己方尚未发起关闭）
+			c.mu.Lock()
+			if !c.closed {
+				reply := payload
+				if len(reply) > 2 {
+					reply = reply[:2]
+				}
+				c.writeFrameLocked(wsOpClose, reply)
+			}
+			c.mu.Unlock()
+			return 0, nil, errWSClosed
+		case wsOpText, wsOpBinary:
+			if msg != nil {
+				c.Close(wsCloseProtocol, "expected continuation frame")
+				return 0, nil, errors.New("unexpected data frame")
+			}
+			msgOp, msg = op, payload
+		case wsOpContinuation:
+			if msg == nil {
+				c.Close(wsCloseProtocol, "unexpected continuation frame")
+				return 0, nil, errors.New("unexpected continuation frame")
+			}
+			msg = append(msg, payload...)
+		default:
+			c.Close(wsCloseProtocol, "unknown opcode")
+			return 0, nil, fmt.Errorf("unknown opcode %d", op)
+		}
+		if len(msg) > maxWSMessage {
+			c.Close(wsCloseTooBig, "message too big")
+			return 0, nil, errWSTooBig
+		}
+		if fin {
+			return msgOp, msg, nil
+		}
+	}
+}
+
+// wsResponseWriter adapts the WebSocket to the http.ResponseWriter the
+// forwarding handler writes to. Each SSE event becomes one text frame
+// holding its data; any other response, such as a JSON error, is sent as a
+// single frame when the handler is done.
+type wsResponseWriter struct {
+	conn   *wsConn
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func (ww *wsResponseWriter) Header() http.Header { return ww.header }
+
+func (ww *wsResponseWriter) WriteHeader(status int) {
+	if ww.status == 0 {
+		ww.status = status
+	}
+}
+
+func (ww *wsResponseWriter) Write(p []byte) (int, error) {
+	ww.WriteHeader(http.StatusOK)
+	ww.buf.Write(p)
+	if !isEventStream(ww.header) {
+		return len(p), nil
+	}
+	// 只发送完整的事件，不完整的部分留待后续写入
+	for {
+		i := bytes.Index(ww.buf.Bytes(), []byte("\n\n"))
+		if i < 0 {
+			return len(p), nil
+		}
+		event := ww.buf.Next(i + 2)
+		if data, ok := sseEventData(event); ok {
+			if err := ww.conn.WriteFrame(wsOpText, data); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+func (ww *wsResponseWriter) Flush() {}
+
+// finish sends what is left of the response and closes the connection,
+// abnormally if the response was a server error.
+func (ww *wsResponseWriter) finish() {
+	if rest := bytes.TrimSpace(ww.buf.Bytes()); len(rest) > 0 {
+		if data, ok := sseEventData(rest); ok && isEventStream(ww.header) {
+			rest = data
+		}
+		ww.conn.WriteFrame(wsOpText, rest)
+	}
+	code := uint16(wsCloseNormal)
+	if ww.status >= http.StatusInternalServerError {
+		code = wsCloseServerError
+	}
+	ww.conn.Close(code, "")
+}
+
+// handleWebSocket serves /v1/messages/ws: after the upgrade the first
+// message is the Messages request body, which goes through the regular
+// forwarding handler with the upgrade request's headers (x-api-key,
+// X-Priority, ...). Stream events are sent back one per text frame and the
+// connection is closed when the response is complete. A client that closes
+// the connection early cancels the upstream request.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		logf(r.Context(), "WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.conn.Close()
+
+	_, body, err := conn.ReadMessage()
+	if err != nil {
+		if !errors.Is(err, errWSClosed) {
+			logf(r.Context(), "Error reading WebSocket request: %v", err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	if d := cfg().RouteTimeouts["/v1/messages/ws"]; d > 0 {
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	// 客户端关闭连接时取消上游请求
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	req := r.Clone(ctx)
+	req.Method = http.MethodPost
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range []string{"Connection", "Upgrade", "Sec-WebSocket-Key", "Sec-WebSocket-Version", "Sec-WebSocket-Extensions", "Sec-WebSocket-Protocol"} {
+		req.Header.Del(h)
+	}
+
+	ww := &wsResponseWriter{conn: conn, header: make(http.Header)}
+	handleForwardToEndpoint(ww, req)
+	ww.finish()
+
+	// 等待客户端确认关闭，超时则直接断开
+	select {
+	case <-readerDone:
+	case <-time.After(time.Second):
+	}
+}
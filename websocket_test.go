@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsClient is the client side of a wsConn, just enough to drive
+// handleWebSocket in tests.
+type wsClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, srv *httptest.Server, apiKey string) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/messages/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("x-api-key", apiKey)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("handshake answered %s with accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return &wsClient{conn: conn, br: br}
+}
+
+// send writes one masked frame, as clients must.
+func (c *wsClient) send(t *testing.T, op byte, payload []byte) {
+	t.Helper()
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op}
+	if n := len(payload); n < 126 {
+		frame = append(frame, 0x80|byte(n))
+	} else {
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(n))
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// read returns the next server frame.
+func (c *wsClient) read(t *testing.T) (byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.br, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+// readUntilClose collects text frames up to the server's close frame and
+// returns them with the close code.
+func (c *wsClient) readUntilClose(t *testing.T) ([]string, uint16) {
+	t.Helper()
+	var texts []string
+	for {
+		op, payload := c.read(t)
+		switch op {
+		case wsOpText:
+			texts = append(texts, string(payload))
+		case wsOpClose:
+			if len(payload) < 2 {
+				return texts, 0
+			}
+			return texts, binary.BigEndian.Uint16(payload)
+		}
+	}
+}
+
+func TestWebSocketStream(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	keys := useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		streamSSE(w, sseTranscript)
+	})
+	srv := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		key        string
+		wantEvents []string
+		wantCode   uint16
+	}{
+		{
+			name:       "streamed response",
+			key:        "k",
+			wantEvents: []string{"message_start", "content_block_start", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"},
+			wantCode:   wsCloseNormal,
+		},
+		{name: "invalid key", key: "unknown", wantEvents: []string{"authentication_error"}, wantCode: wsCloseNormal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialWebSocket(t, srv, tt.key)
+			c.send(t, wsOpText, []byte(`{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			texts, code := c.readUntilClose(t)
+			var events []string
+			for _, text := range texts {
+				var event struct {
+					Type  string
+					Error *struct{ Type string }
+				}
+				if err := json.Unmarshal([]byte(text), &event); err != nil {
+					t.Fatalf("frame %q is not one JSON event: %v", text, err)
+				}
+				if event.Error != nil {
+					event.Type = event.Error.Type
+				}
+				events = append(events, event.Type)
+			}
+			if strings.Join(events, ",") != strings.Join(tt.wantEvents, ",") {
+				t.Errorf("events %v, want %v", events, tt.wantEvents)
+			}
+			if code != tt.wantCode {
+				t.Errorf("close code %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+	if got := keys.remaining("k"); got != 9 {
+		t.Errorf("%d calls left, want 9", got)
+	}
+}
+
+func TestWebSocketClientCloseCancelsUpstream(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.Regions = []string{"us-east5"}
+		c.ModelRegions = nil
+		c.VertexTargets = nil
+	})
+	useKeys(t, &APIKey{Key: "k", RemainingCalls: 10, Tier: defaultTier})
+	cancelled := make(chan struct{})
+	fakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: message_start\n"+`data: {"type":"message_start"}`+"\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	})
+	srv := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+	defer srv.Close()
+
+	c := dialWebSocket(t, srv, "k")
+	c.send(t, wsOpText, []byte(`{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if op, payload := c.read(t); op != wsOpText || !strings.Contains(string(payload), "message_start") {
+		t.Fatalf("first frame %d %q", op, payload)
+	}
+	c.send(t, wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request not cancelled after the client closed")
+	}
+	// 服务器回应关闭帧
+	if _, code := c.readUntilClose(t); code != wsCloseNormal {
+		t.Errorf("close reply code %d, want %d", code, wsCloseNormal)
+	}
+}
+
+func TestWebSocketUpgradeRequired(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+	}{
+		{"plain GET", nil},
+		{"missing key", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13"}},
+		{"old version", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Key": "a2V5", "Sec-WebSocket-Version": "8"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/v1/messages/ws", nil)
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handleWebSocket(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", tt.name, w.Code)
+		}
+	}
+}